@@ -21,16 +21,20 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mlnoga/nightlight/internal/fits"
 	"github.com/mlnoga/nightlight/internal/ops"
 	"github.com/mlnoga/nightlight/internal/ops/hsl"
+	"github.com/mlnoga/nightlight/internal/ops/live"
+	"github.com/mlnoga/nightlight/internal/ops/mask"
 	"github.com/mlnoga/nightlight/internal/ops/post"
 	"github.com/mlnoga/nightlight/internal/ops/pre"
 	"github.com/mlnoga/nightlight/internal/ops/ref"
@@ -38,6 +42,7 @@ import (
 	"github.com/mlnoga/nightlight/internal/ops/stack"
 	"github.com/mlnoga/nightlight/internal/ops/stretch"
 	"github.com/mlnoga/nightlight/internal/rest"
+	"github.com/mlnoga/nightlight/internal/star"
 	"github.com/mlnoga/nightlight/internal/stats"
 	"github.com/pbnjay/memory"
 )
@@ -61,9 +66,15 @@ var tiff = flag.String("tiff", "", "save 16bit preview of output as TIFF to `fil
 var log = flag.String("log", "%auto", "save log output to `file`. `%auto` replaces suffix of output file with .log")
 var pPre = flag.String("pre", "", "save pre-processed frames with given filename pattern, e.g. `pre%04d.fits`")
 var stars = flag.String("stars", "", "save star detections with given filename pattern, e.g. `stars%04d.fits`")
+var starCat = flag.String("starCat", "", "save star catalogs with given filename pattern as .csv, .json or DS9 .reg, e.g. `stars%04d.reg`. Written upon alignment with reference frame coordinates, else upon star detection")
+var stackCat = flag.String("stackCat", "", "save star catalog of the final image to `file` as .csv, .json or DS9 .reg, e.g. `stack.reg`")
 var back = flag.String("back", "", "save extracted background with given filename pattern, e.g. `back%04d.fits`")
 var pPost = flag.String("post", "", "save post-processed frames with given filename pattern, e.g. `post%04d.fits`")
 var batch = flag.String("batch", "", "save stacked batches with given filename pattern, e.g. `batch%04d.fits`")
+var rejLow = flag.String("rejLow", "", "save map of per-pixel low rejection counts from stacking to `file`, e.g. `rejlow.fits`")
+var rejHigh = flag.String("rejHigh", "", "save map of per-pixel high rejection counts from stacking to `file`, e.g. `rejhigh.fits`")
+var coverage = flag.String("coverage", "", "save map of per-pixel number of valid frames from stacking to `file`, e.g. `coverage.fits`")
+var stdErr = flag.String("stdErr", "", "save map of per-pixel standard error from stacking to `file`, e.g. `stderr.fits`")
 
 var dark = flag.String("dark", "", "apply dark frame from `file`")
 var flat = flag.String("flat", "", "apply flat frame from `file`")
@@ -83,10 +94,17 @@ var binning = flag.Int64("binning", 0, "apply NxN binning, 0 or 1=no binning")
 var bpSigLow = flag.Float64("bpSigLow", 3.0, "low sigma for bad pixel removal as multiple of standard deviations")
 var bpSigHigh = flag.Float64("bpSigHigh", 5.0, "high sigma for bad pixel removal as multiple of standard deviations")
 
+var crSig = flag.Float64("crSig", 0, "sigma for cosmic ray detection on the noise-normalized laplacian, e.g. 4.5, 0=off")
+var crFrac = flag.Float64("crFrac", 0.3, "fraction of crSig for growing cosmic ray detections into neighboring pixels")
+var crObjLim = flag.Float64("crObjLim", 5.0, "cosmic ray detection: minimum contrast of laplacian over fine structure, protects star cores")
+var crIter = flag.Int64("crIter", 4, "cosmic ray detection: maximum number of detect and repair iterations")
+var crNaN = flag.Int64("crNaN", 0, "cosmic ray replacement: 0=local median, 1=NaN (for stacking only)")
+
 var starSig = flag.Float64("starSig", 15.0, "sigma for star detection as multiple of standard deviations")
 var starBpSig = flag.Float64("starBpSig", -1.0, "sigma for star detection bad pixel removal as multiple of standard deviations, -1: auto")
 var starInOut = flag.Float64("starInOut", 1.4, "minimal ratio of brightness inside HFR to outside HFR for star detection")
 var starRadius = flag.Int64("starRadius", 16.0, "radius for star detection in pixels")
+var starPSF = flag.Int64("starPSF", 0, "fit point spread function to detected stars. 0=off, 1=elliptical Gaussian, 2=elliptical Moffat")
 
 var backGrid = flag.Int64("backGrid", 0, "automated background extraction: grid size in pixels, 0=off")
 var backHFRFactor = flag.Float64("backHFRFactor", 4.0, "automated background extraction: exclude stars with HFR multiplied by this factor")
@@ -94,25 +112,89 @@ var backSigma = flag.Float64("backSigma", 1.5, "automated background extraction:
 var backClip = flag.Int64("backClip", 0, "automated background extraction: clip the k brightest grid cells and replace with local median")
 
 var minStars = flag.Int64("minStars", 0, "minimum number of stars for an image to be included in stacking, 0=don't filter")
+var bestPct = flag.Float64("bestPct", 0, "lucky imaging: stack only this percentage of the sharpest frames, 0=all")
+var bestN = flag.Int64("bestN", 0, "lucky imaging: stack only this many of the sharpest frames, 0=use bestPct")
+var bestMetric = flag.Int64("bestMetric", 0, "lucky imaging: sharpness metric, 0=variance of the Laplacian, 1=gradient energy")
+var bestRegion = flag.String("bestRegion", "", "lucky imaging: region for measuring sharpness as `x,y,width,height`, empty=whole frame")
 
 var blurSigma = flag.Float64("blurSigma", 0, "gaussian blurring sigma, ~1/3 radius, 0=no op")
 
 var usmSigma = flag.Float64("usmSigma", 1, "unsharp masking sigma, ~1/3 radius, 0=no op")
 var usmGain = flag.Float64("usmGain", 0, "unsharp masking gain, 0=no op")
 var usmThresh = flag.Float64("usmThresh", 1, "unsharp masking threshold, in standard deviations above background")
+var usmMask = flag.String("usmMask", "", "restrict unsharp masking of color images to a mask. stars=detected stars, nostars=all but the stars, else load from FITS `file` with values in [0,1]. Empty=whole image")
 
 var alignK = flag.Int64("alignK", 20, "use triangles formed from K brightest stars for initial alignment")
-var alignT = flag.Float64("alignT", 1.0, "skip frames if alignment to reference frame has residual greater than this")
+var alignModel = flag.Int64("alignModel", 0, "registration model for alignment. 0=affine, 1=homography, 2=2nd order polynomial, 3=3rd order polynomial")
+var alignInterp = flag.Int64("alignInterp", 0, "interpolation for alignment. 0=bilinear, 1=bicubic, 2=Lanczos-3, 3=Lanczos-4")
+var alignT = flag.Float64("alignT", 1.0, "skip frames if alignment to reference frame has residual greater than this. For disc alignment, the change in disc radius in pixels")
+var alignMethod = flag.Int64("alignMethod", 0, "alignment method. 0=stars, 1=planetary disc centroid, 2=phase correlation for lunar and solar surface detail")
+var alignMinPeak = flag.Float64("alignMinPeak", 0.1, "phase correlation alignment: skip frames whose normalized correlation peak height is lower than this")
+var alignRegion = flag.String("alignRegion", "", "region of the reference frame for disc or phase correlation alignment as `x,y,width,height`, empty=whole frame")
+var localGrid = flag.Int64("localGrid", 0, "local alignment after global alignment: spacing of the alignment points in pixels, 0=off")
+var localMethod = flag.Int64("localMethod", 0, "local alignment: 0=star centroids, 1=cross-correlation of local windows")
+var localShift = flag.Float64("localShift", 5, "local alignment: discard local shifts larger than this many pixels")
+
+var comet = flag.String("comet", "", "comet mode: comet positions in star-aligned frame coordinates as `id,x,y` or `id1,x1,y1,id2,x2,y2`, e.g. read from frames saved with -post")
+var cometRate = flag.String("cometRate", "", "comet mode: comet motion in star-aligned pixels per hour as `vx,vy`, with frame times from DATE-OBS. Used unless two comet positions are given")
+var cometRadius = flag.Float64("cometRadius", 0, "comet mode: radius in pixels around the comet to exclude from the star-aligned stack, 0=a tenth of the image size, <0=rely on rejection. Needs a comet position")
+var cometStack = flag.String("cometStack", "%auto", "comet mode: save comet-aligned stack to `file`. `%auto` replaces suffix of output file with _comet.fits")
+var starStack = flag.String("starStack", "%auto", "comet mode: save star-aligned stack with the comet rejected to `file`. `%auto` replaces suffix of output file with _stars.fits")
+
+var autoCrop = flag.Float64("autoCrop", 0, "crop stacks to the largest rectangle where at least this percentage of frames contributes to each pixel, 0=off")
+
+var mosaicMatch = flag.Float64("mosaicMatch", 0.1, "minimum fraction of stars matching between overlapping mosaic panels")
+var mosaicNorm = flag.Int64("mosaicNorm", 1, "1=normalize mosaic panels to each other in their overlaps, 0=do not normalize")
+var mosaicBlend = flag.Int64("mosaicBlend", 1, "mosaic seam blending. 0=feathering, 1=multi-band")
+var mosaicFeather = flag.Float64("mosaicFeather", 0, "width of the mosaic blending ramp at panel edges in pixels, 0=up to the panel center")
+var mosaicLevels = flag.Int64("mosaicLevels", 6, "number of pyramid levels for multi-band mosaic blending")
+
+var hdrScale = flag.Int64("hdrScale", 0, "HDR flux scaling. 0=by star flux ratios, 1=by exposure")
+var hdrExp = flag.String("hdrExp", "", "HDR exposure per frame of each input stack in seconds as `e1,e2,...`, empty=from the image headers")
+var hdrSat = flag.Float64("hdrSat", 0.95, "HDR saturation level as fraction of each stack's maximum")
+var hdrTrans = flag.Float64("hdrTrans", 0.2, "HDR width of the blending ramp below the saturation level, as fraction of the maximum")
+var hdrFeather = flag.Float64("hdrFeather", 4, "HDR sigma of the spatial blur of the blending mask in pixels, 0=none")
+
+var catalog = flag.String("catalog", "", "plate solve against star catalog from `file`, as CSV with ra, dec and magnitude columns or in binary format. Empty=no plate solving")
+var solveRA = flag.Float64("solveRA", -1, "plate solving: right ascension hint in degrees, -1=from FITS header if present")
+var solveDec = flag.Float64("solveDec", 0, "plate solving: declination hint in degrees")
+var solveRadius = flag.Float64("solveRadius", 5, "plate solving: search radius around the hint in degrees, 0=whole catalog")
+var solveScale = flag.Float64("solveScale", 0, "plate solving: pixel scale hint in arc seconds per pixel, 0=from FITS header if present, else blind")
 
 var lsEst = flag.Int64("lsEst", 3, "location and scale estimators 0=mean/stddev, 1=median/MAD, 2=IKSS, 3=iterative sigma-clipped sampled median and sampled Qn (standard), 4=histogram peak")
 var normRange = flag.Int64("normRange", 0, "normalize range: 1=normalize to [0,1], 0=do not normalize")
 var normHist = flag.Int64("normHist", 4, "normalize histogram: 0=do not normalize, 1=location, 2=location and scale, 3=black point shift for RGB align, 4=auto")
+var normLocal = flag.Int64("normLocal", 0, "local normalization of aligned frames to the reference frame: grid spacing in pixels, larger is smoother, 0=off. Masks stars like -backHFRFactor")
+var normLocalScale = flag.String("normLocalScale", "", "save local normalization scale maps to `file`s, use %d for the image ID")
+var normLocalOffset = flag.String("normLocalOffset", "", "save local normalization offset maps to `file`s, use %d for the image ID")
 
-var stMode = flag.Int64("stMode", 6, "stacking mode. 0=median, 1=mean, 2=sigma clip, 3=winsorized sigma clip, 4=MAD sigma clip, 5=linear fit, 6=auto")
+var stMode = flag.Int64("stMode", 6, "stacking mode. 0=median, 1=mean, 2=sigma clip, 3=winsorized sigma clip, 4=MAD sigma clip, 5=linear fit, 6=auto, 7=generalized ESD, 8=percentile clip, 9=min/max")
+var stClipPercLow = flag.Float64("stClipPercLow", 0.5, "set desired low clipping percentage for stacking, used if the low bound is negative")
+var stClipPercHigh = flag.Float64("stClipPercHigh", 0.5, "set desired high clipping percentage for stacking, used if the high bound is negative")
 var stSigLow = flag.Float64("stSigLow", -1, "low sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
 var stSigHigh = flag.Float64("stSigHigh", -1, "high sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
-var stWeight = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise")
+var stPercLow = flag.Float64("stPercLow", 0.2, "percentile clip stacking: reject values below the median by more than this fraction of it, -1: use clipping percentage to find")
+var stPercHigh = flag.Float64("stPercHigh", 0.1, "percentile clip stacking: reject values above the median by more than this fraction of it, -1: use clipping percentage to find")
+var stESDFrac = flag.Float64("stESDFrac", 0.3, "generalized ESD stacking: maximum fraction of outliers per pixel")
+var stESDAlpha = flag.Float64("stESDAlpha", 0.05, "generalized ESD stacking: significance level of the outlier test")
+var stDropLow = flag.Int64("stDropLow", 1, "min/max stacking: number of lowest values to drop per pixel")
+var stDropHigh = flag.Int64("stDropHigh", 1, "min/max stacking: number of highest values to drop per pixel")
+var stWeight = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise, 3=by inverse HFR, 4=by inverse variance, 5=by SNR, 6=by PSF signal")
 var stMemory = flag.Int64("stMemory", int64((totalMiBs*7)/10), "total MiB of memory to use for stacking, default=0.7x physical memory")
+var spillDir = flag.String("spillDir", "", "if frames exceed memory, spill them to temporary files in this `directory` and stack with global rejection, instead of in batches. Empty=batches")
+var spillKeep = flag.Int64("spillKeep", 0, "1=keep the temporary spill files after stacking, 0=remove them")
+var spillMaxMB = flag.Int64("spillMaxMB", 0, "maximum disk space for spill files in MiB, 0=unlimited")
+var checkpoint = flag.String("checkpoint", "", "save the state of batched stacking to this `directory` after each batch, empty=none")
+var resume = flag.Int64("resume", 0, "1=resume batched stacking from the checkpoint, skipping completed batches, 0=start over")
+
+var liveMode = flag.Int64("liveMode", 1, "live stacking: 0=running mean, 1=running mean with approximate sigma clipping against the frames so far")
+var liveSigLow = flag.Float64("liveSigLow", 3, "live stacking: low sigma for approximate sigma clipping")
+var liveSigHigh = flag.Float64("liveSigHigh", 3, "live stacking: high sigma for approximate sigma clipping")
+var livePattern = flag.String("livePattern", "*.fit*", "live stacking: pattern for the file names to pick up from the watched directory")
+var livePoll = flag.Float64("livePoll", 2, "live stacking: interval for polling the watched directory in seconds")
+var liveIdle = flag.Float64("liveIdle", 0, "live stacking: stop after no new frames for this many seconds, 0=run until interrupted")
+var liveRetries = flag.Int64("liveRetries", 5, "live stacking: attempts to load a file before skipping it, e.g. if it is partially written")
+var liveStatus = flag.String("liveStatus", "%auto", "live stacking: write status JSON to `file` after each frame. `%auto` replaces suffix of output file with .json")
 
 var histoRef = flag.String("histoRef", "%starsHFR", "histogram reference, %starsHFR= best #stars/HFR (default), %location=median location, any int=image ID, filename=image filename")
 var alignRef = flag.String("alignRef", "%starsHFR", "alignment reference, %starsHFR= best #stars/HFR (default), %location=median location, any int=image ID, filename=image filename")
@@ -131,6 +213,10 @@ var balHiR = flag.Float64("balHiR", 1, "balance colors by tinting highlights wit
 var balHiG = flag.Float64("balHiG", 1, "balance colors by tinting highlights with this green color, range 0.0-1.0")
 var balHiB = flag.Float64("balHiB", 1, "balance colors by tinting highlights with this blue color, range 0.0-1.0")
 
+var pcc = flag.Int64("pcc", 0, "photometric color calibration of RGB images against the star catalog given by -catalog, which needs B-V or Gaia BP-RP color indices. 1=yes, 0=no")
+var pccAperture = flag.Float64("pccAperture", 0, "photometric color calibration: aperture radius for star photometry in pixels, 0=three times the HFR")
+var pccMinStars = flag.Int64("pccMinStars", 10, "photometric color calibration: minimum number of matched stars")
+
 var chromaGamma = flag.Float64("chromaGamma", 1.0, "scale LCH chroma curve by given gamma for luminances n sigma above background, 1.0=no op")
 var chromaSigma = flag.Float64("chromaSigma", 1.0, "only scale and add to LCH chroma for luminances n sigma above background")
 
@@ -144,6 +230,9 @@ var rotBy = flag.Float64("rotBy", 0, "rotate LCH color angles in [from,to] by gi
 var rotSigma = flag.Float64("rotSigma", 1, "rotate LCH color angles in [from, to] vor luminances >= location + scale*sigma")
 
 var scnr = flag.Float64("scnr", 0, "apply SCNR in [0,1] to green channel, e.g. 0.5 for tricolor with S2HaO3 and 0.1 for bicolor HaO3O3")
+var chromaMask = flag.String("chromaMask", "", "restrict chroma scaling, hue rotation and SCNR to a mask, specified like -usmMask")
+var maskHFR = flag.Float64("maskHFR", 3, "star masks: disk radius in multiples of each star's half-flux radius")
+var maskBlur = flag.Float64("maskBlur", 2, "star masks: sigma of the gaussian blur softening the edges in pixels, 0=none")
 
 var autoLoc = flag.Float64("autoLoc", 10, "histogram peak location in %% to target with automatic curves adjustment, 0=don't")
 var autoScale = flag.Float64("autoScale", 0.4, "histogram peak scale in %% to target with automatic curves adjustment, 0=don't")
@@ -175,11 +264,15 @@ This program comes with ABSOLUTELY NO WARRANTY.
 This is free software, and you are welcome to redistribute it under certain conditions.
 Refer to https://www.gnu.org/licenses/gpl-3.0.en.html for details.
 
-Usage: %s [-flag value] (stats|stack|rgb|argb|lrgb|legal) (img0.fits ... imgn.fits)
+Usage: %s [-flag value] (stats|stack|live|mosaic|hdr|solve|rgb|argb|lrgb|legal) (img0.fits ... imgn.fits | dir)
 
 Commands:
   stats   Show input image statistics
   stack   Stack input images
+  live    Live stack new images appearing in the given directory, rewriting the outputs after each frame
+  mosaic  Assemble a mosaic from overlapping panels, e.g. stacks of each panel
+  hdr     Compose a high dynamic range image from stacks with different exposure times
+  solve   Plate solve input images against the star catalog given by -catalog, writing WCS headers to -out
   stretch Stretch single image
   rgb     Combine color channels. Inputs are treated as r, g, b and optional l channel in that order
   run     Run a JSON job from the file specified by -job 
@@ -206,6 +299,9 @@ Flags:
 	autoFill(jpg, *out, ".jpg")
 	autoFill(tiff, *out, ".tif")
 	autoFill(exportStats, *out, ".html")
+	autoFill(cometStack, *out, "_comet.fits")
+	autoFill(starStack, *out, "_stars.fits")
+	autoFill(liveStatus, *out, ".json")
 
 	// Enable CPU profiling if flagged
 	if *cpuprofile != "" {
@@ -227,7 +323,7 @@ Flags:
 		flag.Usage()
 		return
 	}
-	if args[0] == "stats" || args[0] == "stack" || args[0] == "stretch" || args[0] == "rgb" || args[0] == "lrgb" {
+	if args[0] == "stats" || args[0] == "stack" || args[0] == "live" || args[0] == "hdr" || args[0] == "stretch" || args[0] == "rgb" || args[0] == "lrgb" {
 		fmt.Fprintf(logWriter, "Using location and scale estimator %d\n", *lsEst)
 		stats.LSEstimator = stats.LSEstimatorMode(*lsEst)
 	}
@@ -251,6 +347,18 @@ Flags:
 		if *starBpSig < 0 {
 			*starBpSig = 5
 		} // default to noise elimination when working with individual subexposures
+	case "mosaic":
+		if *starBpSig < 0 {
+			*starBpSig = 0
+		} // inputs are typically stacked and have undergone noise removal
+	case "hdr":
+		if *starBpSig < 0 {
+			*starBpSig = 0
+		} // inputs are typically stacked and have undergone noise removal
+	case "solve":
+		if *starBpSig < 0 {
+			*starBpSig = 0
+		} // inputs are typically stacked and have undergone noise removal
 	case "stretch":
 	case "rgb":
 		if *normHist == post.HNMAuto {
@@ -276,15 +384,40 @@ Flags:
 	c := ops.NewContext(logWriter, int(*stMemory), stats.LSEstimatorMode(*lsEst))
 
 	// glob filename arguments into an opLoadMany operator
-	var err error
 	opLoadMany := ops.NewOpLoadMany(args)
 
 	// parse preprocessing flags into preprocessing sequence operator
 	opDebayer := pre.NewOpDebayer(*debayer, *cfa)
-	opStarDetect := pre.NewOpStarDetect(int32(*starRadius), float32(*starSig), float32(*starBpSig), float32(*starInOut), *stars)
+	// Star catalogs of frames are written by the alignment if it runs, as they then include reference frame
+	// coordinates, else upon detection. The final image has a catalog pattern of its own
+	frameCat := *starCat
+	switch args[0] {
+	case "stack", "live", "hdr", "stretch":
+		frameCat = ""
+	}
+	opStarDetect := pre.NewOpStarDetect(int32(*starRadius), float32(*starSig), float32(*starBpSig), float32(*starInOut), star.PSFModel(*starPSF), *stars, frameCat)
+	opFinalStarDetect := pre.NewOpStarDetect(int32(*starRadius), float32(*starSig), float32(*starBpSig), float32(*starInOut), star.PSFModel(*starPSF), *stars, *stackCat)
+	opSolve := post.NewOpSolve(*catalog, *solveRA, *solveDec, *solveRadius, *solveScale)
+	region, err := parseRect(*alignRegion)
+	if err != nil {
+		fmt.Fprintf(logWriter, "Error: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	bestRect, err := parseRect(*bestRegion)
+	if err != nil {
+		fmt.Fprintf(logWriter, "Error: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	bestBin := int32(1)
+	if *debayer != "" {
+		bestBin = 2 // score raw color frames on 2x2 superpixels, hiding the color filter array
+	}
+	opCalibrate := pre.NewOpCalibrate(*dark, *flat)
+	opBadPixel := pre.NewOpBadPixel(float32(*bpSigLow), float32(*bpSigHigh), opDebayer)
 	opPreProc := ops.NewOpSequence(
-		pre.NewOpCalibrate(*dark, *flat),
-		pre.NewOpBadPixel(float32(*bpSigLow), float32(*bpSigHigh), opDebayer),
+		opCalibrate,
+		opBadPixel,
+		pre.NewOpCosmicRay(float32(*crSig), float32(*crFrac), float32(*crObjLim), int32(*crIter), pre.CosmicRayReplaceMode(*crNaN), opDebayer),
 		opDebayer,
 		pre.NewOpDebandHoriz(float32(*debandH), int32(*debandHWindow), float32(*debandHSigma)),
 		pre.NewOpDebandVert(float32(*debandV), int32(*debandVWindow), float32(*debandVSigma)),
@@ -296,6 +429,9 @@ Flags:
 		ops.NewOpSave(*pPre, ops.EMMinMax, 1),
 	)
 
+	// local alignment runs as part of the global alignment, so frames are interpolated only once
+	opAlignLocal := post.NewOpAlignLocal(fits.LocalAlignMethod(*localMethod), int32(*localGrid), float32(*localShift), fits.Interpolation(*alignInterp))
+
 	// run actions
 	switch args[0] {
 	case "serve":
@@ -307,8 +443,31 @@ Flags:
 		err = runOp(opSeq, c)
 
 	case "stack":
+		var opStack ops.Operator = stack.NewOpStack(
+			stack.StackMode(*stMode),
+			stack.StackWeighting(*stWeight),
+			float32(*stSigLow),
+			float32(*stSigHigh),
+			float32(*stClipPercLow),
+			float32(*stClipPercHigh),
+			float32(*stPercLow),
+			float32(*stPercHigh),
+			float32(*stESDFrac),
+			float32(*stESDAlpha),
+			int(*stDropLow),
+			int(*stDropHigh),
+			*rejLow, *rejHigh, *coverage, *stdErr,
+			*autoCrop > 0 || *comet != "" || *cometRate != "", // coverage for cropping, and for combining comet and star stacks
+		)
+		if *comet != "" || *cometRate != "" {
+			if opStack, err = newOpStackComet(opStack.(*stack.OpStack), opLoadMany, logWriter); err != nil {
+				break
+			}
+		}
 		opSeq := ops.NewOpSequence(
 			opLoadMany,
+			ref.NewOpSelectBest(fits.SharpnessMetric(*bestMetric), bestRect, bestBin, float32(*bestPct), int(*bestN),
+				ops.NewOpSequence(opCalibrate, opBadPixel)), // score calibrated frames
 			stack.NewOpStackBatches(
 				ops.NewOpSequence(
 					opPreProc,
@@ -316,25 +475,117 @@ Flags:
 					ref.NewOpSelectReference(ref.SRAlign, *alignRef, opStarDetect),
 					ref.NewOpFilter(int(*minStars)),
 					post.NewOpMatchHistogram(post.HistoNormMode(*normHist)),
-					post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeNaN),
+					post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeNaN, star.RegistrationModel(*alignModel), fits.Interpolation(*alignInterp), *starCat,
+						post.AlignMethod(*alignMethod), region, float32(*alignMinPeak), opAlignLocal),
+					post.NewOpLocalNorm(int32(*normLocal), float32(*backHFRFactor), *normLocalScale, *normLocalOffset),
 					ops.NewOpSave(*pPost, ops.EMMinMax, 1),
-					stack.NewOpStack(
-						stack.StackMode(*stMode),
-						stack.StackWeighting(*stWeight),
-						float32(*stSigLow),
-						float32(*stSigHigh),
-					),
+					opStack,
 					opStarDetect,
 					ops.NewOpSave(*batch, ops.EMMinMax, 1),
 				),
+				*spillDir, *spillKeep != 0, *spillMaxMB, *checkpoint, *resume != 0,
+			),
+			post.NewOpAutoCrop(float32(*autoCrop/100)),
+			opFinalStarDetect,
+			opSolve,
+			ops.NewOpSave(*out, ops.EMMinMax, 1),
+			ops.NewOpSave(*tiff, ops.EM0_65535, 1),
+			ops.NewOpSave(*jpg, ops.EM0_65535, float32(*jpgGamma)),
+		)
+		err = runOp(opSeq, c)
+
+	case "live":
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		l := live.NewLive(
+			live.NewWatcher(dir, *livePattern, int(*liveRetries)),
+			time.Duration(*livePoll*float64(time.Second)),
+			time.Duration(*liveIdle*float64(time.Second)),
+			ops.NewOpSequence(
+				opPreProc,
+				ref.NewOpFilter(int(*minStars)),
+			),
+			ops.NewOpSequence(
+				ref.NewOpSelectReference(ref.SRHisto, live.ReferenceMode(*histoRef), opStarDetect),
+				ref.NewOpSelectReference(ref.SRAlign, live.ReferenceMode(*alignRef), opStarDetect),
+				post.NewOpMatchHistogram(post.HistoNormMode(*normHist)),
+				post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeNaN, star.RegistrationModel(*alignModel), fits.Interpolation(*alignInterp), *starCat,
+					post.AlignMethod(*alignMethod), region, float32(*alignMinPeak), opAlignLocal),
+				post.NewOpLocalNorm(int32(*normLocal), float32(*backHFRFactor), *normLocalScale, *normLocalOffset),
+				ops.NewOpSave(*pPost, ops.EMMinMax, 1),
 			),
+			stack.NewRunningStack(stack.RunningMode(*liveMode), float32(*liveSigLow), float32(*liveSigHigh)),
+			ops.NewOpSequence(
+				ops.NewOpSave(*out, ops.EMMinMax, 1),
+				ops.NewOpSave(*tiff, ops.EM0_65535, 1),
+				stretch.NewOpNormalizeRange(), // stretch the preview, as the linear stack is mostly dark
+				stretch.NewOpStretchIterative(float32(*autoLoc/100), float32(*autoScale/100)),
+				ops.NewOpSave(*jpg, ops.EM0_1, float32(*jpgGamma)),
+			),
+			*liveStatus,
+		)
+		stop := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() { <-interrupt; close(stop) }()
+		err = l.Run(c, stop)
+
+	case "mosaic":
+		opSeq := ops.NewOpSequence(
+			opLoadMany,
 			opStarDetect,
+			ref.NewOpSelectReference(ref.SRAlign, *alignRef, opStarDetect),
+			post.NewOpMosaic(int32(*alignK), float32(*alignT), float32(*mosaicMatch), star.RegistrationModel(*alignModel),
+				fits.Interpolation(*alignInterp), *mosaicNorm != 0, post.BlendMode(*mosaicBlend), float32(*mosaicFeather), int32(*mosaicLevels)),
+			opFinalStarDetect,
+			opSolve,
 			ops.NewOpSave(*out, ops.EMMinMax, 1),
 			ops.NewOpSave(*tiff, ops.EM0_65535, 1),
 			ops.NewOpSave(*jpg, ops.EM0_65535, float32(*jpgGamma)),
 		)
 		err = runOp(opSeq, c)
 
+	case "hdr":
+		var vals []float64
+		if vals, err = parseFloats(*hdrExp); err != nil {
+			err = fmt.Errorf("invalid HDR exposures '%s': %s", *hdrExp, err.Error())
+			break
+		}
+		var exposures []float32
+		for _, v := range vals {
+			exposures = append(exposures, float32(v))
+		}
+		opSeq := ops.NewOpSequence(
+			opLoadMany,
+			opStarDetect,
+			ref.NewOpSelectReference(ref.SRAlign, *alignRef, opStarDetect),
+			post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeOwnLocation, star.RegistrationModel(*alignModel), fits.Interpolation(*alignInterp), *starCat,
+				post.AlignMethod(*alignMethod), region, float32(*alignMinPeak), nil),
+			opStarDetect, // star fluxes in registered coordinates for the flux ratios
+			post.NewOpHDR(post.HDRScaleMode(*hdrScale), exposures, float32(*hdrSat), float32(*hdrTrans), float32(*hdrFeather)),
+			opFinalStarDetect,
+			opSolve,
+			ops.NewOpSave(*out, ops.EMMinMax, 1),
+			ops.NewOpSave(*tiff, ops.EM0_65535, 1),
+			ops.NewOpSave(*jpg, ops.EM0_65535, float32(*jpgGamma)),
+		)
+		err = runOp(opSeq, c)
+
+	case "solve":
+		if *catalog == "" {
+			err = fmt.Errorf("plate solving needs a star catalog, specify with -catalog")
+			break
+		}
+		opSeq := ops.NewOpSequence(
+			opLoadMany,
+			opStarDetect,
+			opSolve,
+			ops.NewOpSave(*out, ops.EMMinMax, 1),
+		)
+		err = runOp(opSeq, c)
+
 	case "stretch":
 		opSeq := ops.NewOpSequence(
 			opLoadMany,
@@ -346,7 +597,8 @@ Flags:
 			stretch.NewOpScaleBlack(float32(*scaleBlack/100)),
 			opStarDetect,
 			ref.NewOpSelectReference(ref.SRAlign, *alignRef, opStarDetect),
-			post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeOwnLocation),
+			post.NewOpAlign(int32(*alignK), float32(*alignT), post.OOBModeOwnLocation, star.RegistrationModel(*alignModel), fits.Interpolation(*alignInterp), *starCat,
+				post.AlignMethod(*alignMethod), region, float32(*alignMinPeak), nil),
 			stretch.NewOpGaussianBlur(float32(*blurSigma)),
 			stretch.NewOpUnsharpMask(float32(*usmSigma), float32(*usmGain), float32(*usmThresh)),
 			ops.NewOpSave(*out, ops.EMMinMax, 1),
@@ -356,8 +608,17 @@ Flags:
 		err = runOp(opSeq, c)
 
 	case "rgb":
+		opPCCSolve := post.NewOpSolve("", *solveRA, *solveDec, *solveRadius, *solveScale)
+		if *pcc != 0 {
+			if *catalog == "" {
+				err = fmt.Errorf("photometric color calibration needs a star catalog with color indices, specify with -catalog")
+				break
+			}
+			opPCCSolve = opSolve
+		}
 		opSeq := ops.NewOpSequence(
 			opLoadMany,
+			post.NewOpAutoCrop(float32(*autoCrop/100)),
 			opStarDetect,
 			ref.NewOpSelectReference(ref.SRAlign, "%rgb", opStarDetect),
 
@@ -365,17 +626,20 @@ Flags:
 			rgb.NewOpRGBBalance(int32(*balBlock), float32(*balBorder), float32(*balSkipBright), float32(*balSkipDim),
 				fits.RGB{R: float32(*balShR), G: float32(*balShG), B: float32(*balShB)},
 				fits.RGB{R: float32(*balHiR), G: float32(*balHiG), B: float32(*balHiB)}),
+			post.NewOpColorCalibrate(opPCCSolve, float32(*pccAperture), int(*pccMinStars)),
 
 			rgb.NewOpRGBToHSLuv(),
 			hsl.NewOpHSLApplyLum(),
 
-			hsl.NewOpHSLUnsharpMask(float32(*usmSigma), float32(*usmGain), float32(*usmThresh)),
+			withMask(newMaskSeq(*usmMask), 0,
+				hsl.NewOpHSLUnsharpMask(float32(*usmSigma), float32(*usmGain), float32(*usmThresh))),
 
 			hsl.NewOpHSLNeutralizeBackground(float32(*neutSigmaLow), float32(*neutSigmaHigh)),
-			hsl.NewOpHSLSaturationGamma(float32(*chromaGamma), float32(*chromaSigma)),
-			hsl.NewOpHSLSelectiveSaturation(float32(*chromaFrom), float32(*chromaTo), float32(*chromaBy)),
-			hsl.NewOpHSLRotateHue(float32(*rotFrom), float32(*rotTo), float32(*rotBy), float32(*rotSigma)),
-			hsl.NewOpHSLSCNR(float32(*scnr)),
+			withMask(newMaskSeq(*chromaMask), 0,
+				hsl.NewOpHSLSaturationGamma(float32(*chromaGamma), float32(*chromaSigma)),
+				hsl.NewOpHSLSelectiveSaturation(float32(*chromaFrom), float32(*chromaTo), float32(*chromaBy)),
+				hsl.NewOpHSLRotateHue(float32(*rotFrom), float32(*rotTo), float32(*rotBy), float32(*rotSigma)),
+				hsl.NewOpHSLSCNR(float32(*scnr))),
 
 			hsl.NewOpHSLStretchIterative(float32(*autoLoc/100), float32(*autoScale/100)),
 			hsl.NewOpHSLMidtones(float32(*midtone), float32(*midBlack)),
@@ -444,6 +708,84 @@ Flags:
 	}
 }
 
+// Creates the comet mode stacking operator from the comet flags. Resolves the observation times of the
+// frames with comet positions from their headers, as they may be stacked in different batches
+func newOpStackComet(opStack *stack.OpStack, opLoadMany *ops.OpLoadMany, log io.Writer) (*stack.OpStackComet, error) {
+	positions, err := parseFloats(*comet)
+	if err != nil || len(positions)%3 != 0 || len(positions) > 6 {
+		return nil, fmt.Errorf("invalid comet positions '%s', want id,x,y or id1,x1,y1,id2,x2,y2", *comet)
+	}
+	anchors := []stack.CometAnchor{}
+	for i := 0; i < len(positions); i += 3 {
+		anchors = append(anchors, stack.CometAnchor{ID: int(positions[i]), X: float32(positions[i+1]), Y: float32(positions[i+2])})
+	}
+	rate, err := parseFloats(*cometRate)
+	if err != nil || (len(rate) != 0 && len(rate) != 2) {
+		return nil, fmt.Errorf("invalid comet rate '%s', want vx,vy", *cometRate)
+	}
+	if len(rate) == 0 {
+		rate = []float64{0, 0}
+	}
+
+	op := stack.NewOpStackComet(opStack, anchors, [2]float32{float32(rate[0]), float32(rate[1])}, float32(*cometRadius),
+		fits.Interpolation(*alignInterp), *cometStack, *starStack)
+	fileNames, err := opLoadMany.FileNames(log)
+	if err != nil {
+		return nil, err
+	}
+	return op, op.ResolveAnchorTimes(fileNames, log)
+}
+
+// Parses a comma-separated list of floating point numbers. Returns an empty list for an empty string
+func parseFloats(s string) (res []float64, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// Parses a rectangle given as x,y,width,height. Returns an empty rectangle for an empty string
+func parseRect(s string) (fits.Rect, error) {
+	vals, err := parseFloats(s)
+	if err != nil || (len(vals) != 0 && len(vals) != 4) {
+		return fits.Rect{}, fmt.Errorf("invalid region '%s', want x,y,width,height", s)
+	}
+	if len(vals) == 0 {
+		return fits.Rect{}, nil
+	}
+	return fits.Rect{X: int32(vals[0]), Y: int32(vals[1]), Width: int32(vals[2]), Height: int32(vals[3])}, nil
+}
+
+// Creates the operators generating a mask from the given specification: stars, nostars or a file name.
+// Returns nil for an empty specification
+func newMaskSeq(spec string) *ops.OpSequence {
+	switch spec {
+	case "":
+		return nil
+	case "stars":
+		return ops.NewOpSequence(mask.NewOpStarMask(float32(*maskHFR), 2), mask.NewOpMaskBlur(float32(*maskBlur)))
+	case "nostars":
+		return ops.NewOpSequence(mask.NewOpStarMask(float32(*maskHFR), 2), mask.NewOpMaskBlur(float32(*maskBlur)), mask.NewOpMaskInvert())
+	default:
+		return ops.NewOpSequence(mask.NewOpMaskLoad(spec))
+	}
+}
+
+// Applies the given steps through the mask created by the given operators, or to the whole image if nil
+func withMask(maskSeq *ops.OpSequence, hueChannel int, steps ...ops.Operator) ops.Operator {
+	if maskSeq == nil {
+		return ops.NewOpSequence(steps...)
+	}
+	return mask.NewOpMasked(maskSeq, ops.NewOpSequence(steps...), hueChannel)
+}
+
 // if the value is equal to %auto, replace it with the base filename modified with the given extension
 func autoFill(val *string, base, extension string) {
 	if *val == "%auto" {
@@ -468,6 +810,9 @@ func runOp(op ops.Operator, c *ops.Context) (err error) {
 		return err
 	}
 
-	_, err = ops.MaterializeAll(promises, c.MaxThreads, true)
-	return err
+	if _, err = ops.MaterializeAll(promises, c.MaxThreads, true); err != nil {
+		return err
+	}
+	c.FinishStats()
+	return nil
 }
@@ -15,9 +15,11 @@
 
 package fits
 
-// Convert star color index (blue mag minus visual mag, range -0.4 ... +2.0) to RGB (0.0 ... 1.0).
+import "math"
+
+// Convert star color index (blue mag minus visual mag, range -0.4 ... +2.0) to gamma-encoded sRGB (0.0 ... 1.0).
 // Interpolating the table from http://www.vendian.org/mncharity/dir3/starcolor/details.html
-func bv2rgb(bv float32) RGB {
+func BVToRGB(bv float32) RGB {
 	if bv < -0.4 {
 		bv = -0.4
 	}
@@ -44,6 +46,53 @@ func bv2rgb(bv float32) RGB {
 	return RGB{r, g, b}
 }
 
+// Convert star color index to linear RGB (0.0 ... 1.0), e.g. to compare with flux ratios measured on linear data
+func BVToLinearRGB(bv float32) RGB {
+	c := BVToRGB(bv)
+	return RGB{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+}
+
+// Remove the sRGB gamma from a color component
+func srgbToLinear(c float32) float32 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return float32(math.Pow(float64((c+0.055)/1.055), 2.4))
+}
+
+// Convert Gaia color index (blue photometer mag minus red photometer mag) to B-V, approximately.
+// Interpolating the mean dwarf color sequence of Pecaut & Mamajek (2013) from B0V to M5V
+func BPRPToBV(bprp float32) float32 {
+	if bprp <= bprp2bvTable[0][0] {
+		return bprp2bvTable[0][1]
+	}
+	for i := 1; i < len(bprp2bvTable); i++ {
+		if hi := bprp2bvTable[i]; bprp <= hi[0] {
+			lo := bprp2bvTable[i-1]
+			return lo[1] + (bprp-lo[0])*(hi[1]-lo[1])/(hi[0]-lo[0])
+		}
+	}
+	return bprp2bvTable[len(bprp2bvTable)-1][1]
+}
+
+// Pairs of BP-RP and B-V color indices, ascending
+var bprp2bvTable = [][2]float32{
+	{-0.41, -0.30}, // B0V
+	{-0.18, -0.16}, // B5V
+	{0.00, 0.00},   // A0V
+	{0.18, 0.15},   // A5V
+	{0.46, 0.30},   // F0V
+	{0.59, 0.44},   // F5V
+	{0.75, 0.59},   // G0V
+	{0.82, 0.65},   // G2V
+	{0.98, 0.82},   // K0V
+	{1.43, 1.15},   // K5V
+	{1.84, 1.43},   // M0V
+	{2.16, 1.50},   // M2V
+	{2.80, 1.65},   // M4V
+	{3.30, 1.83},   // M5V
+}
+
 var bv2rgbTable = []RGB{
 	{0.60784, 0.69804, 1.00000}, // -0.40
 	{0.61961, 0.70980, 1.00000}, // -0.35
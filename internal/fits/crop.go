@@ -0,0 +1,210 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// An axis-aligned rectangle in pixel coordinates
+type Rect struct {
+	X, Y          int32 // top left corner
+	Width, Height int32
+}
+
+func (r Rect) String() string {
+	return fmt.Sprintf("%dx%d+%d+%d", r.Width, r.Height, r.X, r.Y)
+}
+
+// Returns the area of the rectangle in pixels
+func (r Rect) Area() int64 {
+	return int64(r.Width) * int64(r.Height)
+}
+
+// Crops the image to the given rectangle, which must lie within the image. Applies to all
+// color channels. Stars outside the rectangle are dropped, the others shifted accordingly.
+// The transformation to the reference frame, the coverage map and the FITS WCS reference pixel
+// CRPIXn are updated to the new origin. Returns a new image, leaving the original unchanged
+func (img *Image) Crop(r Rect) (*Image, error) {
+	width, height := img.Naxisn[0], img.Naxisn[1]
+	if r.X < 0 || r.Y < 0 || r.Width <= 0 || r.Height <= 0 || r.X+r.Width > width || r.Y+r.Height > height {
+		return nil, fmt.Errorf("%d: crop rectangle %v outside image of %dx%d pixels", img.ID, r, width, height)
+	}
+
+	naxisn := append([]int32(nil), img.Naxisn...)
+	naxisn[0], naxisn[1] = r.Width, r.Height
+	res := NewImageFromNaxisn(naxisn, cropPlanes(img.Data, width, height, r))
+	res.ID, res.FileName = img.ID, img.FileName
+	res.Header = img.Header.Clone()
+	res.Exposure = img.Exposure
+	res.HFR, res.FWHM, res.Eccentricity = img.HFR, img.FWHM, img.Eccentricity
+	res.Residual = img.Residual
+
+	dx, dy := float32(r.X), float32(r.Y)
+	for _, s := range img.Stars {
+		if s.X < dx || s.Y < dy || s.X >= dx+float32(r.Width) || s.Y >= dy+float32(r.Height) {
+			continue
+		}
+		s.X, s.Y = s.X-dx, s.Y-dy
+		s.Index = int32(math.Floor(float64(s.Y)))*r.Width + int32(math.Floor(float64(s.X)))
+		res.Stars = append(res.Stars, s)
+	}
+
+	// new pixel coordinates are offset by the crop origin, so prepend a shift to the transformation
+	t := img.Trans
+	res.Trans = star.Transform2D{A: t.A, B: t.B, C: t.C + t.A*dx + t.B*dy, D: t.D, E: t.E, F: t.F + t.D*dx + t.E*dy}
+
+	if img.Coverage != nil {
+		res.Coverage = cropPlanes(img.Coverage, width, height, r)
+	}
+
+	res.Header.shiftReferencePixel("CRPIX1", dx)
+	res.Header.shiftReferencePixel("CRPIX2", dy)
+	return res, nil
+}
+
+// Copies the given rectangle out of all planes of width x height pixels in data
+func cropPlanes(data []float32, width, height int32, r Rect) []float32 {
+	planeSize := int(width) * int(height)
+	planes := len(data) / planeSize
+	res := make([]float32, 0, planes*int(r.Width)*int(r.Height))
+	for p := 0; p < planes; p++ {
+		plane := data[p*planeSize : (p+1)*planeSize]
+		for y := r.Y; y < r.Y+r.Height; y++ {
+			res = append(res, plane[y*width+r.X:y*width+r.X+r.Width]...)
+		}
+	}
+	return res
+}
+
+// Subtracts the given offset from a WCS reference pixel header entry, if present
+func (h *Header) shiftReferencePixel(key string, offset float32) {
+	if v, ok := h.Floats[key]; ok {
+		h.Floats[key] = v - float64(offset)
+	} else if v, ok := h.Ints[key]; ok {
+		delete(h.Ints, key)
+		h.Floats[key] = float64(v) - float64(offset)
+	}
+}
+
+// Returns the per-pixel coverage of the first image plane as a fraction of frames in [0,1].
+// If no coverage map was recorded during stacking, e.g. for stacks loaded from disk, estimates it:
+// NaNs, and areas of one constant value connected to the image border as left behind by stacking
+// where no frame had valid data, are uncovered. All other pixels are fully covered
+func (img *Image) CoverageOrEstimate() []float32 {
+	if img.Coverage != nil {
+		return img.Coverage
+	}
+	width, height := img.Naxisn[0], img.Naxisn[1]
+	data := img.Data[:width*height]
+	cov := make([]float32, len(data))
+	for i := range cov {
+		cov[i] = 1
+	}
+
+	minArea := width
+	if height < minArea {
+		minArea = height
+	}
+	visited := make([]bool, len(data))
+	var component, queue []int32
+	seed := func(x, y int32) {
+		start := y*width + x
+		if visited[start] {
+			return
+		}
+		value := data[start]
+		isNaN := math.IsNaN(float64(value))
+		same := func(v float32) bool { return v == value || (isNaN && math.IsNaN(float64(v))) }
+
+		// flood fill the border-connected area of equal values
+		component, queue = component[:0], append(queue[:0], start)
+		visited[start] = true
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			component = append(component, i)
+			x, y := i%width, i/width
+			for _, n := range [4]int32{i - 1, i + 1, i - width, i + width} {
+				if (n == i-1 && x == 0) || (n == i+1 && x == width-1) || (n == i-width && y == 0) || (n == i+width && y == height-1) {
+					continue
+				}
+				if !visited[n] && same(data[n]) {
+					visited[n] = true
+					queue = append(queue, n)
+				}
+			}
+		}
+		if isNaN || int32(len(component)) >= minArea {
+			for _, i := range component {
+				cov[i] = 0
+			}
+		}
+	}
+	for x := int32(0); x < width; x++ {
+		seed(x, 0)
+		seed(x, height-1)
+	}
+	for y := int32(0); y < height; y++ {
+		seed(0, y)
+		seed(width-1, y)
+	}
+	for i, v := range data {
+		if math.IsNaN(float64(v)) {
+			cov[i] = 0
+		}
+	}
+	return cov
+}
+
+// Finds the largest axis-aligned rectangle in which all pixels have at least the given coverage.
+// Uses the maximal rectangle in a histogram algorithm row by row, in linear time. Returns a
+// rectangle of zero area if no pixel qualifies
+func LargestCoveredRect(coverage []float32, width, height int32, minCoverage float32) Rect {
+	best := Rect{}
+	heights := make([]int32, width+1) // heights of qualifying columns ending in the current row, plus a zero sentinel
+	stack := make([]int32, 0, width+1)
+	for y := int32(0); y < height; y++ {
+		row := coverage[y*width : (y+1)*width]
+		for x, c := range row {
+			if c >= minCoverage {
+				heights[x]++
+			} else {
+				heights[x] = 0
+			}
+		}
+
+		stack = stack[:0]
+		for x := int32(0); x <= width; x++ {
+			for len(stack) > 0 && heights[stack[len(stack)-1]] >= heights[x] {
+				h := heights[stack[len(stack)-1]]
+				stack = stack[:len(stack)-1]
+				left := int32(0)
+				if len(stack) > 0 {
+					left = stack[len(stack)-1] + 1
+				}
+				if r := (Rect{X: left, Y: y - h + 1, Width: x - left, Height: h}); r.Area() > best.Area() {
+					best = r
+				}
+			}
+			stack = append(stack, x)
+		}
+	}
+	return best
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Brute force reference for the largest covered rectangle
+func largestCoveredRectNaive(coverage []float32, width, height int32, minCoverage float32) int64 {
+	best := int64(0)
+	for y0 := int32(0); y0 < height; y0++ {
+		for x0 := int32(0); x0 < width; x0++ {
+			for y1 := y0; y1 < height; y1++ {
+				for x1 := x0; x1 < width; x1++ {
+					ok := true
+					for y := y0; y <= y1 && ok; y++ {
+						for x := x0; x <= x1 && ok; x++ {
+							ok = coverage[y*width+x] >= minCoverage
+						}
+					}
+					if ok {
+						if a := int64(x1-x0+1) * int64(y1-y0+1); a > best {
+							best = a
+						}
+					}
+				}
+			}
+		}
+	}
+	return best
+}
+
+func TestLargestCoveredRect(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for trial := 0; trial < 50; trial++ {
+		width, height := int32(3+rng.Intn(10)), int32(3+rng.Intn(10))
+		coverage := make([]float32, width*height)
+		for i := range coverage {
+			coverage[i] = rng.Float32()
+		}
+		r := LargestCoveredRect(coverage, width, height, 0.3)
+		want := largestCoveredRectNaive(coverage, width, height, 0.3)
+		if r.Area() != want {
+			t.Fatalf("trial %d: got area %d for %v, want %d", trial, r.Area(), r, want)
+		}
+		for y := r.Y; y < r.Y+r.Height; y++ {
+			for x := r.X; x < r.X+r.Width; x++ {
+				if coverage[y*width+x] < 0.3 {
+					t.Fatalf("trial %d: rectangle %v includes pixel %d,%d with coverage %f", trial, r, x, y, coverage[y*width+x])
+				}
+			}
+		}
+	}
+}
+
+func TestCropUpdatesStarsTransformAndWCS(t *testing.T) {
+	width, height := int32(20), int32(10)
+	data := make([]float32, 2*width*height) // two channels
+	for i := range data {
+		data[i] = float32(i)
+	}
+	img := NewImageFromNaxisn([]int32{width, height, 2}, data)
+	img.Stars = []star.Star{{X: 5.5, Y: 4.25}, {X: 1, Y: 1}}
+	img.Trans = star.Transform2D{A: 0, B: -1, C: 100, D: 1, E: 0, F: 50}
+	img.Header.Floats["CRPIX1"] = 10.5
+	img.Header.Ints["CRPIX2"] = 5
+
+	r := Rect{X: 3, Y: 2, Width: 8, Height: 6}
+	res, err := img.Crop(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Naxisn[0] != 8 || res.Naxisn[1] != 6 || res.Naxisn[2] != 2 || len(res.Data) != 2*8*6 {
+		t.Fatalf("unexpected dimensions %v with %d pixels", res.Naxisn, len(res.Data))
+	}
+	for c := int32(0); c < 2; c++ {
+		for y := int32(0); y < r.Height; y++ {
+			for x := int32(0); x < r.Width; x++ {
+				got, want := res.Data[c*8*6+y*8+x], data[c*width*height+(y+r.Y)*width+x+r.X]
+				if got != want {
+					t.Fatalf("channel %d pixel %d,%d: got %f want %f", c, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	if len(res.Stars) != 1 || res.Stars[0].X != 2.5 || res.Stars[0].Y != 2.25 {
+		t.Errorf("unexpected stars after crop: %v", res.Stars)
+	}
+	orig := img.Trans.Apply(star.Point2D{X: 5.5, Y: 4.25})
+	if got := res.Trans.Apply(star.Point2D{X: 2.5, Y: 2.25}); math.Abs(float64(got.X-orig.X)) > 1e-4 || math.Abs(float64(got.Y-orig.Y)) > 1e-4 {
+		t.Errorf("transformation not shifted: got %v want %v", got, orig)
+	}
+
+	if got := res.Header.Floats["CRPIX1"]; got != 7.5 {
+		t.Errorf("CRPIX1 got %f want 7.5", got)
+	}
+	if got := res.Header.Floats["CRPIX2"]; got != 3 {
+		t.Errorf("CRPIX2 got %f want 3", got)
+	}
+	if img.Header.Floats["CRPIX1"] != 10.5 || img.Header.Ints["CRPIX2"] != 5 {
+		t.Errorf("original header modified")
+	}
+
+	if _, err := img.Crop(Rect{X: 15, Y: 0, Width: 8, Height: 4}); err == nil {
+		t.Errorf("expected error for rectangle outside the image")
+	}
+}
+
+func TestCoverageEstimateFromConstantBorder(t *testing.T) {
+	width, height := int32(16), int32(12)
+	rng := rand.New(rand.NewSource(1))
+	data := make([]float32, width*height)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			switch {
+			case x < 3:
+				data[y*width+x] = 0.25 // fill value where no frame contributed
+			case y >= 10:
+				data[y*width+x] = float32(math.NaN())
+			default:
+				data[y*width+x] = 1 + rng.Float32()
+			}
+		}
+	}
+	data[5*width+8] = 0.25 // isolated interior pixel with the fill value stays covered
+	img := NewImageFromNaxisn([]int32{width, height}, data)
+
+	r := LargestCoveredRect(img.CoverageOrEstimate(), width, height, 1)
+	if want := (Rect{X: 3, Y: 0, Width: 13, Height: 10}); r != want {
+		t.Errorf("got %v want %v", r, want)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"strings"
+	"time"
+)
+
+// Layouts of DATE-OBS values, in ISO 8601 with optional fractional seconds, or date only
+var dateObsLayouts = []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05", "2006-01-02"}
+
+// Returns the start of the exposure from the DATE-OBS header value in UTC. Combines the legacy
+// date-only form with TIME-OBS if present. Returns false if missing or invalid
+func (h *Header) DateObs() (time.Time, bool) {
+	v, ok := h.Strings["DATE-OBS"]
+	if !ok {
+		if v, ok = h.Dates["DATE-OBS"]; !ok {
+			return time.Time{}, false
+		}
+	}
+	v = strings.TrimSpace(v)
+	if t, ok := h.Strings["TIME-OBS"]; ok && !strings.Contains(v, "T") {
+		v += "T" + strings.TrimSpace(t)
+	}
+	for _, layout := range dateObsLayouts {
+		if t, err := time.ParseInLocation(layout, v, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Returns the midpoint of the exposure, from DATE-OBS and the exposure duration. Returns false if unknown
+func (img *Image) MidExposure() (time.Time, bool) {
+	t, ok := img.Header.DateObs()
+	if !ok {
+		return t, false
+	}
+	return t.Add(time.Duration(float64(img.Exposure) * 0.5 * float64(time.Second))), true
+}
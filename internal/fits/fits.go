@@ -48,9 +48,13 @@ type Image struct {
 	 
 	Stars  []star.Star        // Star detections
 	HFR    float32       // Half-flux radius of the star detections
+	FWHM   float32       // Median full width at half maximum of the star PSF fits, 0 if not fitted
+	Eccentricity float32 // Median eccentricity of the star PSF fits, 0 if not fitted
 
 	Trans    star.Transform2D // Transformation to reference frame
 	Residual float32     // Residual error from the above transformation 
+
+	Coverage []float32   // Optional per-pixel fraction of stacked frames with valid data, nil if unknown
 }
 
 // Creates a FITS image initialized with empty header
@@ -109,6 +113,8 @@ func NewImageFromImage(img *Image) *Image {
 		MedianDiffStats: nil,
 		Stars:    img.Stars,
 		HFR:      img.HFR,
+		FWHM:     img.FWHM,
+		Eccentricity: img.Eccentricity,
 		Trans:    star.IdentityTransform2D(),
 		Residual: 0,
 	}
@@ -119,7 +125,7 @@ func NewImageFromImage(img *Image) *Image {
 type Header struct {
 	Bools    map[string]bool
 	Ints     map[string]int32
-	Floats   map[string]float32
+	Floats   map[string]float64
 	Strings  map[string]string
 	Dates    map[string]string
 	Comments []string
@@ -133,7 +139,7 @@ func NewHeader() Header {
 	return Header{
 		Bools:   make(map[string]bool), 
 		Ints:    make(map[string]int32),
-		Floats:  make(map[string]float32),
+		Floats:  make(map[string]float64),
 		Strings: make(map[string]string),
 		Dates:   make(map[string]string),
 		Comments:make([]string,0),
@@ -142,6 +148,20 @@ func NewHeader() Header {
 	}
 }
 
+// Returns a deep copy of the header, so changes to the copy do not affect the original
+func (h *Header) Clone() Header {
+	c:=NewHeader()
+	for k,v:=range(h.Bools  ) { c.Bools[k]=v }
+	for k,v:=range(h.Ints   ) { c.Ints[k]=v }
+	for k,v:=range(h.Floats ) { c.Floats[k]=v }
+	for k,v:=range(h.Strings) { c.Strings[k]=v }
+	for k,v:=range(h.Dates  ) { c.Dates[k]=v }
+	c.Comments=append(c.Comments, h.Comments...)
+	c.History =append(c.History,  h.History...)
+	c.End, c.Length=h.End, h.Length
+	return c
+}
+
 const fitsBlockSize int      = 2880       // Block size of FITS header and data units
 const HeaderLineSize int =   80       // Line size of a FITS header
 
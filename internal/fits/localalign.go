@@ -0,0 +1,184 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/median"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Method for measuring residual shifts at the alignment points of local alignment
+type LocalAlignMethod int
+
+const (
+	LAStars       LocalAlignMethod = iota // Centroids of the brightest reference stars near each point
+	LACorrelation                         // Phase correlation of the window around each point
+)
+
+// Number of reference stars measured per alignment point
+const localStarsPerPoint = 5
+
+// Minimum normalized peak height for accepting a local correlation
+const localMinPeak = 0.1
+
+// Measures residual shifts of this globally aligned image against the reference frame on a grid of
+// alignment points with the given spacing, and interpolates a smooth displacement field from them, mapping
+// reference frame coordinates to image coordinates. The star method uses the given reference frame stars.
+// Shifts larger than maxShift are discarded as mismatches, and missing points filled in from their
+// neighbors. Returns the field and the number of points with measurements
+func (img *Image) LocalShifts(ref *Image, refStars []star.Star, method LocalAlignMethod, spacing int32,
+	maxShift float32) (field *star.DisplacementField, measured int, err error) {
+	if !EqualInt32Slice(img.Naxisn, ref.Naxisn) {
+		return nil, 0, errors.New("image and reference frame sizes differ")
+	}
+	width, height := img.Naxisn[0], img.Naxisn[1]
+	cols, rows := int((width+spacing/2)/spacing), int((height+spacing/2)/spacing)
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	stepX, stepY := float32(width)/float32(cols), float32(height)/float32(rows)
+	field = star.NewDisplacementField(stepX/2, stepY/2, stepX, stepY, cols, rows)
+
+	// assign reference stars to the cells, brightest first
+	var cellStars [][]star.Star
+	if method == LAStars {
+		cellStars = make([][]star.Star, cols*rows)
+		sorted := append([]star.Star(nil), refStars...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Mass > sorted[j].Mass })
+		for _, s := range sorted {
+			cx, cy := int(s.X/stepX), int(s.Y/stepY)
+			if cx >= 0 && cy >= 0 && cx < cols && cy < rows && len(cellStars[cy*cols+cx]) < localStarsPerPoint {
+				cellStars[cy*cols+cx] = append(cellStars[cy*cols+cx], s)
+			}
+		}
+	}
+
+	valid := make([]bool, cols*rows)
+	for cy := 0; cy < rows; cy++ {
+		for cx := 0; cx < cols; cx++ {
+			i := cy*cols + cx
+			var dx, dy float32
+			var ok bool
+			switch method {
+			case LAStars:
+				dx, dy, ok = img.starShift(ref, cellStars[i], maxShift)
+			case LACorrelation:
+				cell := Rect{int32(float32(cx) * stepX), int32(float32(cy) * stepY), 0, 0}
+				cell.Width, cell.Height = int32(float32(cx+1)*stepX)-cell.X, int32(float32(cy+1)*stepY)-cell.Y
+				dx, dy, ok = img.correlationShift(ref, cell)
+			default:
+				return nil, 0, errors.New("unknown local alignment method")
+			}
+			if ok && dx*dx+dy*dy <= maxShift*maxShift {
+				field.DX[i], field.DY[i], valid[i] = dx, dy, true
+				measured++
+			}
+		}
+	}
+	if !field.FillAndSmooth(valid, maxShift/4) {
+		return nil, 0, errors.New("no local alignment points could be measured")
+	}
+	return field, measured, nil
+}
+
+// Returns the median shift of the given reference stars in this image
+func (img *Image) starShift(ref *Image, stars []star.Star, maxShift float32) (dx, dy float32, ok bool) {
+	dxs, dys := []float32{}, []float32{}
+	for _, s := range stars {
+		r := int32(math.Ceil(float64(2 * s.HFR)))
+		if r < 3 {
+			r = 3
+		}
+		rx, ry, rOk := ref.starCentroid(s.X, s.Y, r, 0)
+		ix, iy, iOk := img.starCentroid(s.X, s.Y, r, int32(math.Ceil(float64(maxShift))))
+		if rOk && iOk {
+			dxs, dys = append(dxs, ix-rx), append(dys, iy-ry)
+		}
+	}
+	if len(dxs) == 0 {
+		return 0, 0, false
+	}
+	return median.MedianFloat32(dxs), median.MedianFloat32(dys), true
+}
+
+// Finds the centroid of the star near the given position. Starts from the brightest pixel within
+// the given search distance, then iterates the background-subtracted center of mass in a box of
+// the given radius. The background is the mean of the box perimeter
+func (img *Image) starCentroid(x, y float32, r, search int32) (cx, cy float32, ok bool) {
+	width, height := img.Naxisn[0], img.Naxisn[1]
+	px, py := int32(math.Round(float64(x))), int32(math.Round(float64(y)))
+	best := float32(math.Inf(-1))
+	for sy := py - search; sy <= py+search; sy++ {
+		for sx := px - search; sx <= px+search; sx++ {
+			if sx >= 0 && sy >= 0 && sx < width && sy < height && img.Data[sy*width+sx] > best {
+				best, cx, cy = img.Data[sy*width+sx], float32(sx), float32(sy)
+			}
+		}
+	}
+	if math.IsInf(float64(best), -1) {
+		return 0, 0, false
+	}
+
+	for iter := 0; iter < 3; iter++ {
+		bx, by := int32(math.Round(float64(cx))), int32(math.Round(float64(cy)))
+		if bx-r < 0 || by-r < 0 || bx+r >= width || by+r >= height {
+			return 0, 0, false
+		}
+		bg, n := float32(0), 0
+		for i := -r; i <= r; i++ {
+			for _, v := range []float32{img.Data[(by-r)*width+bx+i], img.Data[(by+r)*width+bx+i],
+				img.Data[(by+i)*width+bx-r], img.Data[(by+i)*width+bx+r]} {
+				if v == v {
+					bg += v
+					n++
+				}
+			}
+		}
+		if n == 0 {
+			return 0, 0, false
+		}
+		bg /= float32(n)
+		var sw, sx, sy float32
+		for yy := by - r + 1; yy < by+r; yy++ {
+			for xx := bx - r + 1; xx < bx+r; xx++ {
+				if w := img.Data[yy*width+xx] - bg; w > 0 {
+					sw, sx, sy = sw+w, sx+w*float32(xx), sy+w*float32(yy)
+				}
+			}
+		}
+		if sw == 0 {
+			return 0, 0, false
+		}
+		cx, cy = sx/sw, sy/sw
+	}
+	return cx, cy, true
+}
+
+// Returns the shift of this image against the reference frame in the given window by phase correlation
+func (img *Image) correlationShift(ref *Image, window Rect) (dx, dy float32, ok bool) {
+	if window.Width < 8 || window.Height < 8 {
+		return 0, 0, false
+	}
+	dx, dy, peak := newSpectrum(ref, window, 1).correlate(img, 0, 0)
+	return dx, dy, peak >= localMinPeak
+}
@@ -21,56 +21,273 @@ import (
 	"github.com/mlnoga/nightlight/internal/star"
 )
 
-// Projects an image into a new coordinate system with the given transformation.
-// Fills in missing pixels with the given out of bounds value. Uses bilinear interpolation for now.
-func (img *Image) Project(destNaxisn []int32, trans star.Transform2D, outOfBounds float32) (res *Image, err error) {
+// Interpolation method for resampling images
+type Interpolation int
+
+const (
+	IPBilinear Interpolation = iota // Bilinear interpolation. Fast, but smooths noise and fine detail
+	IPBicubic                       // Bicubic convolution with a=-0.5, 4x4 pixel support
+	IPLanczos3                      // Lanczos windowed sinc with a=3, 6x6 pixel support
+	IPLanczos4                      // Lanczos windowed sinc with a=4, 8x8 pixel support
+)
+
+// Returns the kernel radius of the interpolation method, i.e. half the support in pixels
+func (ip Interpolation) Radius() int32 {
+	switch ip {
+	case IPBicubic:
+		return 2
+	case IPLanczos3:
+		return 3
+	case IPLanczos4:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// Number of destination rows per work package for parallel projection
+const projectTileRows = 32
+
+// Number of sub-pixel phases in the precomputed kernel weight tables
+const kernelPhases = 1024
+
+// Projects an image into a new coordinate system with the given invertible transformation, e.g. an affine
+// transformation, homography or polynomial. Fills in missing pixels with the given out of bounds value.
+// Bicubic and Lanczos interpolation clamp results to the range of the nearest 2x2 source pixels to avoid
+// ringing around bright stars, and fall back to bilinear interpolation near the image borders.
+// Processes tiles of rows in parallel on up to maxThreads goroutines
+func (img *Image) Project(destNaxisn []int32, trans star.Transformation, outOfBounds float32, interp Interpolation, maxThreads int) (res *Image, err error) {
 	// Invert transformation so we can sample from the target coordinate system PoV
-	invTrans, err := trans.Invert()
+	invTrans, err := trans.Inverse()
 	if err != nil {
 		return nil, err
 	}
 
 	// Create new FITS image for the result
-	destWidth := destNaxisn[0]
+	destWidth, destHeight := destNaxisn[0], destNaxisn[1]
 	res = NewImageFromNaxisn(destNaxisn, nil)
-	res.ID, res.Exposure = img.ID, img.Exposure
-
-	// Resample image from the target coordinate system PoV
-	d := img.Data
-	origWidth := img.Naxisn[0]
-
-	for row := int32(0); row < destNaxisn[1]; row++ {
-		for col := int32(0); col < destWidth; col++ {
-			pt := star.Point2D{X: float32(col), Y: float32(row)}
-			proj := invTrans.Apply(pt)
-
-			// perform bilinear interpolation
-			xl, yl := int32(math.Floor(float64(proj.X))), int32(math.Floor(float64(proj.Y)))
-			xh, yh := xl+1, yl+1
-			xr, yr := proj.X-float32(xl), proj.Y-float32(yl)
-
-			if xl < 0 || xh >= origWidth || yl < 0 || yh >= img.Naxisn[1] {
-				// Replace out of bounds values with not a number.
-				// Stacking will exclude NaNs. Note, however, that
-				// other operations will fail miserably. Including
-				// all partitioning and sorting-based operations
-				// like median, because IEEE NaN does not compare
-				// equal to itself.
-				res.Data[col+row*destWidth] = outOfBounds
-				continue
+	res.ID, res.FileName, res.Exposure = img.ID, img.FileName, img.Exposure
+	res.Header = img.Header.Clone() // keep metadata like the observation time, but not the invalidated WCS
+	res.Header.DeleteWCS()
+
+	// Resample image from the target coordinate system PoV, in parallel tiles of rows.
+	// Replace out of bounds values with the given value, typically not a number.
+	// Stacking will exclude NaNs. Note, however, that
+	// other operations will fail miserably. Including
+	// all partitioning and sorting-based operations
+	// like median, because IEEE NaN does not compare
+	// equal to itself.
+	weights := newKernelTable(interp)
+	if maxThreads < 1 {
+		maxThreads = 1
+	}
+	sem := make(chan bool, maxThreads)
+	for lower := int32(0); lower < destHeight; lower += projectTileRows {
+		upper := lower + projectTileRows
+		if upper > destHeight {
+			upper = destHeight
+		}
+
+		sem <- true
+		go func(lower, upper int32) {
+			defer func() { <-sem }()
+			s := newSampler(img.Data, img.Naxisn[0], img.Naxisn[1], interp, weights)
+			xs, ys := make([]float32, destWidth), make([]float32, destWidth)
+			for row := lower; row < upper; row++ {
+				sourceCoords(invTrans, row, xs, ys)
+				s.sampleRow(res.Data[row*destWidth:(row+1)*destWidth], xs, ys, outOfBounds)
 			}
+		}(lower, upper)
+	}
+	for i := 0; i < cap(sem); i++ { // wait for goroutines to finish
+		sem <- true
+	}
+	return res, nil
+}
+
+// Calculates the source coordinates for all pixels of the given destination row under the inverse transformation.
+// Affine transformations are evaluated incrementally along the row, all others pixel by pixel
+func sourceCoords(invTrans star.Transformation, row int32, xs, ys []float32) {
+	if t, ok := invTrans.(*star.Transform2D); ok {
+		// accumulate in double precision to avoid drift along wide rows
+		x, y := float64(t.B)*float64(row)+float64(t.C), float64(t.E)*float64(row)+float64(t.F)
+		dx, dy := float64(t.A), float64(t.D)
+		for col := range xs {
+			xs[col], ys[col] = float32(x), float32(y)
+			x, y = x+dx, y+dy
+		}
+		return
+	}
+	for col := range xs {
+		proj := invTrans.Apply(star.Point2D{X: float32(col), Y: float32(row)})
+		xs[col], ys[col] = proj.X, proj.Y
+	}
+}
+
+// Samples source data at fractional coordinates with a given interpolation method. Not safe for concurrent use
+type sampler struct {
+	data          []float32
+	width, height int32
+	interp        Interpolation
+	radius        int32
+	weights       []float32 // precomputed kernel weights for all sub-pixel phases
+}
+
+func newSampler(data []float32, width, height int32, interp Interpolation, weights []float32) *sampler {
+	return &sampler{data, width, height, interp, interp.Radius(), weights}
+}
+
+// Samples the data at all given positions and stores the results in dest
+func (s *sampler) sampleRow(dest, xs, ys []float32, outOfBounds float32) {
+	if s.interp == IPBilinear {
+		bilinearRow(dest, s.data, s.width, s.height, xs, ys, outOfBounds)
+		return
+	}
+	for i := range dest {
+		dest[i] = s.sample(xs[i], ys[i], outOfBounds)
+	}
+}
+
+// Samples the data at the given position, or returns outOfBounds if no interpolation is possible
+func (s *sampler) sample(x, y float32, outOfBounds float32) float32 {
+	xl, yl := int32(math.Floor(float64(x))), int32(math.Floor(float64(y)))
+	if xl < 0 || xl+1 >= s.width || yl < 0 || yl+1 >= s.height {
+		return outOfBounds
+	}
+	xr, yr := x-float32(xl), y-float32(yl)
+
+	r := s.radius
+	if s.interp == IPBilinear || xl-r+1 < 0 || xl+r >= s.width || yl-r+1 < 0 || yl+r >= s.height {
+		return bilinear(s.data, s.width, xl, yl, xr, yr)
+	}
 
-			xlyl := xl + yl*origWidth
-			xhyl := xlyl + 1         // xh+yl*origWidth
-			xlyh := xlyl + origWidth // xl+yh*origWidth
-			xhyh := xhyl + origWidth // xh+yh*origWidth
+	// separable kernel weights along both axes, normalized to preserve flux
+	wx, wy := s.phaseWeights(xr), s.phaseWeights(yr)
 
-			vyl := d[xlyl]*(1-xr) + d[xhyl]*xr
-			vyh := d[xlyh]*(1-xr) + d[xhyh]*xr
-			v := vyl*(1-yr) + vyh*yr
+	sum := float32(0)
+	base := (yl-r+1)*s.width + xl - r + 1
+	for j, wy := range wy {
+		row := s.data[base+int32(j)*s.width : base+int32(j)*s.width+2*r]
+		rowSum := float32(0)
+		for i, wx := range wx {
+			rowSum += row[i] * wx
+		}
+		sum += rowSum * wy
+	}
 
-			res.Data[col+row*destWidth] = v
+	// clamp against ringing to the range of the nearest 2x2 source pixels
+	i := xl + yl*s.width
+	v00, v10, v01, v11 := s.data[i], s.data[i+1], s.data[i+s.width], s.data[i+s.width+1]
+	lo, hi := v00, v00
+	for _, v := range [3]float32{v10, v01, v11} {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
 		}
 	}
-	return res, nil
+	if sum < lo {
+		return lo
+	}
+	if sum > hi {
+		return hi
+	}
+	return sum
+}
+
+// Returns the precomputed kernel weights for the sub-pixel phase nearest to the fractional offset f in [0,1)
+func (s *sampler) phaseWeights(f float32) []float32 {
+	n := 2 * s.radius
+	phase := int32(f*kernelPhases + 0.5)
+	return s.weights[phase*n : (phase+1)*n]
+}
+
+// Precomputes the kernel weights of the given interpolation method for all sub-pixel phases.
+// Returns nil for bilinear interpolation, which needs no table
+func newKernelTable(interp Interpolation) []float32 {
+	if interp == IPBilinear {
+		return nil
+	}
+	n := 2 * interp.Radius()
+	table := make([]float32, (kernelPhases+1)*n)
+	for phase := int32(0); phase <= kernelPhases; phase++ {
+		kernelWeights(table[phase*n:(phase+1)*n], float32(phase)/kernelPhases, interp)
+	}
+	return table
+}
+
+// Bilinear interpolation of a row of samples at the given positions, pure go implementation.
+// Stores outOfBounds where the 2x2 neighborhood is not fully inside the image
+func bilinearRowPureGo(dest, data []float32, width, height int32, xs, ys []float32, outOfBounds float32) {
+	for i := range dest {
+		x, y := xs[i], ys[i]
+		xl, yl := int32(math.Floor(float64(x))), int32(math.Floor(float64(y)))
+		if xl < 0 || xl+1 >= width || yl < 0 || yl+1 >= height {
+			dest[i] = outOfBounds
+			continue
+		}
+		dest[i] = bilinear(data, width, xl, yl, x-float32(xl), y-float32(yl))
+	}
+}
+
+// Bilinear interpolation at integer position xl,yl plus fractional offsets xr,yr
+func bilinear(d []float32, width, xl, yl int32, xr, yr float32) float32 {
+	xlyl := xl + yl*width
+	xhyl := xlyl + 1     // xh+yl*width
+	xlyh := xlyl + width // xl+yh*width
+	xhyh := xhyl + width // xh+yh*width
+	vyl := d[xlyl] + xr*(d[xhyl]-d[xlyl])
+	vyh := d[xlyh] + xr*(d[xhyh]-d[xlyh])
+	return vyl + yr*(vyh-vyl)
+}
+
+// Calculates the kernel weights for taps at offsets -r+1..r from the integer position, given
+// the fractional offset f in [0,1). Normalizes the weights to sum to one
+func kernelWeights(w []float32, f float32, interp Interpolation) {
+	r := int32(len(w) / 2)
+	sum := float32(0)
+	for k := range w {
+		dist := float64(int32(k)-r+1) - float64(f)
+		var v float64
+		switch interp {
+		case IPBicubic:
+			v = cubicKernel(dist)
+		case IPLanczos3:
+			v = lanczosKernel(dist, 3)
+		case IPLanczos4:
+			v = lanczosKernel(dist, 4)
+		}
+		w[k] = float32(v)
+		sum += w[k]
+	}
+	if sum != 0 {
+		for k := range w {
+			w[k] /= sum
+		}
+	}
+}
+
+// Keys cubic convolution kernel with a=-0.5
+func cubicKernel(x float64) float64 {
+	const a = -0.5
+	x = math.Abs(x)
+	if x < 1 {
+		return ((a+2)*x-(a+3))*x*x + 1
+	} else if x < 2 {
+		return ((a*x-5*a)*x+8*a)*x - 4*a
+	}
+	return 0
+}
+
+// Lanczos windowed sinc kernel with given radius a
+func lanczosKernel(x float64, a float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if x <= -a || x >= a {
+		return 0
+	}
+	px := math.Pi * x
+	return a * math.Sin(px) * math.Sin(px/a) / (px * px)
 }
@@ -0,0 +1,117 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build amd64
+// +build amd64
+
+#include "textflag.h"
+
+// func bilinearRowAVX2(dest, data []float32, width, height int64, xs, ys []float32, outOfBounds float32)
+//    0(FP) dest slice
+//   24(FP) data slice
+//   48(FP) width
+//   56(FP) height
+//   64(FP) xs slice
+//   88(FP) ys slice
+//  112(FP) outOfBounds
+TEXT ·bilinearRowAVX2(SB),NOSPLIT,$0-116
+    MOVQ dest_base+0(FP), DI
+    MOVQ dest_len+8(FP), CX
+    MOVQ data_base+24(FP), R8
+    MOVQ width+48(FP), AX
+    MOVQ height+56(FP), BX
+    MOVQ xs_base+64(FP), SI
+    MOVQ ys_base+88(FP), DX
+
+    // R9 points to the second row of the 2x2 neighborhood
+    LEAQ (R8)(AX*4), R9
+
+    // broadcast constants: Y15 width, Y14 width-1, Y13 height-1, Y12 all -1, Y11 outOfBounds
+    MOVQ AX, X15
+    VPBROADCASTD X15, Y15
+    DECQ AX
+    MOVQ AX, X14
+    VPBROADCASTD X14, Y14
+    DECQ BX
+    MOVQ BX, X13
+    VPBROADCASTD X13, Y13
+    VPCMPEQD Y12, Y12, Y12
+    VBROADCASTSS outOfBounds+112(FP), Y11
+
+    SHRQ $3, CX
+    JZ   bilDone
+
+bilLoop:
+    // load coordinates, split into integer and fractional parts
+    VMOVUPS (SI), Y0
+    VMOVUPS (DX), Y1
+    VROUNDPS $1, Y0, Y2          // floor x
+    VROUNDPS $1, Y1, Y3          // floor y
+    VSUBPS Y2, Y0, Y0            // xr
+    VSUBPS Y3, Y1, Y1            // yr
+    VCVTTPS2DQ Y2, Y2            // xl, NaN and overflow become negative
+    VCVTTPS2DQ Y3, Y3            // yl
+
+    // in bounds mask in Y4: xl>-1 && width-1>xl && yl>-1 && height-1>yl
+    VPCMPGTD Y12, Y2, Y4
+    VPCMPGTD Y2, Y14, Y5
+    VPAND Y5, Y4, Y4
+    VPCMPGTD Y12, Y3, Y5
+    VPAND Y5, Y4, Y4
+    VPCMPGTD Y3, Y13, Y5
+    VPAND Y5, Y4, Y4
+
+    // index of top left pixel in Y3
+    VPMULLD Y15, Y3, Y3
+    VPADDD Y2, Y3, Y3
+
+    // gather 2x2 neighborhood for in bounds lanes. Gathers clear their mask
+    VXORPS Y5, Y5, Y5
+    VMOVDQU Y4, Y10
+    VGATHERDPS Y10, (R8)(Y3*4), Y5    // v00
+    VXORPS Y6, Y6, Y6
+    VMOVDQU Y4, Y10
+    VGATHERDPS Y10, 4(R8)(Y3*4), Y6   // v10
+    VXORPS Y7, Y7, Y7
+    VMOVDQU Y4, Y10
+    VGATHERDPS Y10, (R9)(Y3*4), Y7    // v01
+    VXORPS Y8, Y8, Y8
+    VMOVDQU Y4, Y10
+    VGATHERDPS Y10, 4(R9)(Y3*4), Y8   // v11
+
+    // interpolate along x, then along y
+    VSUBPS Y5, Y6, Y6
+    VMULPS Y0, Y6, Y6
+    VADDPS Y6, Y5, Y5            // top=v00+xr*(v10-v00)
+    VSUBPS Y7, Y8, Y8
+    VMULPS Y0, Y8, Y8
+    VADDPS Y8, Y7, Y7            // bottom=v01+xr*(v11-v01)
+    VSUBPS Y5, Y7, Y7
+    VMULPS Y1, Y7, Y7
+    VADDPS Y7, Y5, Y5            // top+yr*(bottom-top)
+
+    // replace out of bounds lanes and store
+    VBLENDVPS Y4, Y5, Y11, Y5
+    VMOVUPS Y5, (DI)
+
+    ADDQ $32, SI
+    ADDQ $32, DX
+    ADDQ $32, DI
+    DECQ CX
+    JNZ  bilLoop
+
+bilDone:
+    VZEROUPPER
+    RET
@@ -0,0 +1,25 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !amd64
+// +build !amd64
+
+package fits
+
+// Bilinear interpolation of a row of samples at the given positions.
+// Stores outOfBounds where the 2x2 neighborhood is not fully inside the image
+func bilinearRow(dest, data []float32, width, height int32, xs, ys []float32, outOfBounds float32) {
+	bilinearRowPureGo(dest, data, width, height, xs, ys, outOfBounds)
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+var allInterpolations = []Interpolation{IPBilinear, IPBicubic, IPLanczos3, IPLanczos4}
+
+// Creates an image with background 100 and a Gaussian star of given sigma at the given position
+func newStarImage(width, height int32, x0, y0, sigma float32) *Image {
+	img := NewImageFromNaxisn([]int32{width, height}, nil)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			dx, dy := float32(x)-x0, float32(y)-y0
+			img.Data[y*width+x] = 100 + 1000*float32(math.Exp(float64(-(dx*dx+dy*dy)/(2*sigma*sigma))))
+		}
+	}
+	return img
+}
+
+// Returns the flux above background of the image
+func fluxAboveBackground(img *Image) (flux float32) {
+	for _, v := range img.Data {
+		flux += v - 100
+	}
+	return flux
+}
+
+// Returns the star position in the image from a Gaussian PSF fit, starting from the given guess
+func fitStarPosition(t *testing.T, img *Image, x, y float32) (float32, float32) {
+	s := star.Star{X: x, Y: y, Value: img.Data[int32(y+0.5)*img.Naxisn[0]+int32(x+0.5)], HFR: 2}
+	if !star.FitPSF(&s, img.Data, img.Naxisn[0], 100, 1, 8, star.PSFGaussian) {
+		t.Fatalf("PSF fit failed")
+	}
+	return s.X, s.Y
+}
+
+func TestProjectFluxAndShift(t *testing.T) {
+	width, height := int32(64), int32(64)
+	img := newStarImage(width, height, 30, 31, 2)
+	flux := fluxAboveBackground(img)
+
+	for _, shift := range []star.Point2D{{X: 0.25, Y: 0.5}, {X: 0.7, Y: -0.3}, {X: -1.5, Y: 2.25}} {
+		trans := star.Transform2D{A: 1, B: 0, C: shift.X, D: 0, E: 1, F: shift.Y}
+		wantX, wantY := 30+shift.X, 31+shift.Y
+		for _, interp := range allInterpolations {
+			res, err := img.Project(img.Naxisn, &trans, 100, interp, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resFlux := fluxAboveBackground(res)
+			if rel := math.Abs(float64(resFlux/flux - 1)); rel > 0.001 {
+				t.Errorf("interp %d shift %v: flux=%g; want %g +/- 0.1%%", interp, shift, resFlux, flux)
+			}
+			resX, resY := fitStarPosition(t, res, wantX, wantY)
+			if dx, dy := resX-wantX, resY-wantY; dx*dx+dy*dy > 0.02*0.02 {
+				t.Errorf("interp %d shift %v: position=(%g,%g); want (%g,%g)", interp, shift, resX, resY, wantX, wantY)
+			}
+		}
+	}
+}
+
+func TestProjectPeakPreservation(t *testing.T) {
+	// higher order kernels should blur a sharp star less than bilinear interpolation
+	width, height := int32(32), int32(32)
+	img := newStarImage(width, height, 15, 15, 1)
+	trans := star.Transform2D{A: 1, B: 0, C: 0.5, D: 0, E: 1, F: 0.5}
+	peaks := make([]float32, len(allInterpolations))
+	for i, interp := range allInterpolations {
+		res, err := img.Project(img.Naxisn, &trans, 100, interp, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peaks[i] = res.Data[15*width+15] + res.Data[16*width+16]
+	}
+	for i := 1; i < len(peaks); i++ {
+		if peaks[i] <= peaks[0] {
+			t.Errorf("interp %d peak=%g; want more than bilinear %g", allInterpolations[i], peaks[i], peaks[0])
+		}
+	}
+}
+
+func TestProjectClampsRinging(t *testing.T) {
+	// a single hot pixel on flat background must not produce values below the background
+	width, height := int32(32), int32(32)
+	img := NewImageFromNaxisn([]int32{width, height}, nil)
+	for i := range img.Data {
+		img.Data[i] = 100
+	}
+	img.Data[16*width+16] = 10000
+	trans := star.Transform2D{A: 1, B: 0, C: 0.4, D: 0, E: 1, F: 0.6}
+	for _, interp := range allInterpolations {
+		res, err := img.Project(img.Naxisn, &trans, 100, interp, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range res.Data {
+			if v < 100 || v > 10000 {
+				t.Errorf("interp %d data[%d]=%g; want in [100,10000]", interp, i, v)
+				break
+			}
+		}
+	}
+}
+
+func TestBilinearRowMatchesPureGo(t *testing.T) {
+	width, height := int32(37), int32(29)
+	data := make([]float32, width*height)
+	rng := rand.New(rand.NewSource(42))
+	for i := range data {
+		data[i] = rng.Float32() * 1000
+	}
+	n := 203 // not a multiple of the vector width
+	xs, ys := make([]float32, n), make([]float32, n)
+	for i := range xs {
+		xs[i], ys[i] = rng.Float32()*float32(width+4)-2, rng.Float32()*float32(height+4)-2
+	}
+	xs[5], ys[7], xs[11] = float32(math.NaN()), float32(math.Inf(1)), -1e10 // invalid coordinates are out of bounds
+	xs[13], ys[13] = float32(width-1), 0                                    // on the right border, out of bounds
+
+	got, want := make([]float32, n), make([]float32, n)
+	bilinearRow(got, data, width, height, xs, ys, -1)
+	bilinearRowPureGo(want, data, width, height, xs, ys, -1)
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("at (%g,%g) got %g want %g", xs[i], ys[i], got[i], want[i])
+		}
+	}
+}
+
+func TestProjectIndependentOfThreads(t *testing.T) {
+	img := newStarImage(100, 90, 40, 50, 3)
+	trans := star.Transform2D{A: 0.99, B: -0.05, C: 3.3, D: 0.05, E: 0.99, F: -2.7}
+	for _, interp := range allInterpolations {
+		single, err := img.Project(img.Naxisn, &trans, -1, interp, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		multi, err := img.Project(img.Naxisn, &trans, -1, interp, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range single.Data {
+			if single.Data[i] != multi.Data[i] {
+				t.Fatalf("interp %d: data[%d] single %g multi %g", interp, i, single.Data[i], multi.Data[i])
+			}
+		}
+	}
+}
+
+func TestSourceCoordsIncrementalAffine(t *testing.T) {
+	trans := star.Transform2D{A: 0.99, B: -0.05, C: 3.3, D: 0.05, E: 0.99, F: -2.7}
+	// the same transformation as homography takes the generic per-pixel path
+	h := &star.Homography{H: [9]float64{float64(trans.A), float64(trans.B), float64(trans.C),
+		float64(trans.D), float64(trans.E), float64(trans.F), 0, 0, 1}}
+	width := 9000
+	xs, ys := make([]float32, width), make([]float32, width)
+	hxs, hys := make([]float32, width), make([]float32, width)
+	for _, row := range []int32{0, 17, 6000} {
+		sourceCoords(&trans, row, xs, ys)
+		sourceCoords(h, row, hxs, hys)
+		for col := range xs {
+			if dx, dy := xs[col]-hxs[col], ys[col]-hys[col]; dx*dx+dy*dy > 1e-3*1e-3 {
+				t.Fatalf("row %d col %d: incremental (%g,%g) direct (%g,%g)", row, col, xs[col], ys[col], hxs[col], hys[col])
+			}
+		}
+	}
+}
+
+// Reference implementation of a single-threaded projection evaluating the transformation per pixel
+func projectNaive(img *Image, trans star.Transformation, outOfBounds float32, interp Interpolation) *Image {
+	invTrans, _ := trans.Inverse()
+	res := NewImageFromNaxisn(img.Naxisn, nil)
+	s := newSampler(img.Data, img.Naxisn[0], img.Naxisn[1], interp, newKernelTable(interp))
+	for row := int32(0); row < img.Naxisn[1]; row++ {
+		for col := int32(0); col < img.Naxisn[0]; col++ {
+			p := invTrans.Apply(star.Point2D{X: float32(col), Y: float32(row)})
+			res.Data[col+row*img.Naxisn[0]] = s.sample(p.X, p.Y, outOfBounds)
+		}
+	}
+	return res
+}
+
+func benchmarkProject(b *testing.B, naive bool, threads int) {
+	img := newStarImage(4000, 3000, 2000, 1500, 3)
+	trans := star.Transform2D{A: 0.99, B: -0.05, C: 3.3, D: 0.05, E: 0.99, F: -2.7}
+	for _, interp := range allInterpolations {
+		b.Run(fmt.Sprintf("interp%d", interp), func(b *testing.B) {
+			b.SetBytes(int64(len(img.Data) * 4))
+			for i := 0; i < b.N; i++ {
+				if naive {
+					projectNaive(img, &trans, 0, interp)
+				} else if _, err := img.Project(img.Naxisn, &trans, 0, interp, threads); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProjectNaive(b *testing.B)        { benchmarkProject(b, true, 1) }
+func BenchmarkProjectSingleThread(b *testing.B) { benchmarkProject(b, false, 1) }
+func BenchmarkProjectParallel(b *testing.B)     { benchmarkProject(b, false, runtime.GOMAXPROCS(0)) }
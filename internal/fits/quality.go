@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import "errors"
+
+// Returns the signal to noise ratio of the image. The signal is estimated by the scale of the image
+// around its location, which grows with nebulosity and stars and shrinks with sky glow and haze.
+// Requires image statistics
+func (img *Image) SNR() (float32, error) {
+	if img.Stats == nil {
+		return 0, errors.New("missing stats information for SNR")
+	}
+	noise := img.Stats.Noise()
+	if noise <= 0 {
+		return 0, errors.New("zero noise estimate for SNR")
+	}
+	return img.Stats.Scale() / noise, nil
+}
+
+// Returns the PSF signal of the image: the mean star flux spread over the squared FWHM, relative to the
+// noise. Combines transparency, seeing and noise into one measure. Uses the PSF fit FWHM if available,
+// else approximates it by twice the half-flux radius. Requires image statistics and star detections
+func (img *Image) PSFSignal() (float32, error) {
+	if img.Stats == nil {
+		return 0, errors.New("missing stats information for PSF signal")
+	}
+	if len(img.Stars) == 0 {
+		return 0, errors.New("missing stars for PSF signal")
+	}
+	fwhm := img.FWHM
+	if fwhm <= 0 {
+		fwhm = 2 * img.HFR
+	}
+	noise := img.Stats.Noise()
+	if fwhm <= 0 || noise <= 0 {
+		return 0, errors.New("zero FWHM or noise estimate for PSF signal")
+	}
+	flux := float32(0)
+	for _, s := range img.Stars {
+		flux += s.Mass
+	}
+	flux /= float32(len(img.Stars))
+	return flux / (fwhm * fwhm * noise), nil
+}
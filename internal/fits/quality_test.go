@@ -0,0 +1,57 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestPSFSignal(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	img := NewImageFromNaxisn([]int32{200, 200}, nil)
+	for i := range img.Data {
+		img.Data[i] = 100 + 2*float32(rng.NormFloat64())
+	}
+	img.Stats = stats.NewStats(img.Data, img.Naxisn[0])
+	if _, err := img.PSFSignal(); err == nil {
+		t.Errorf("expected error without stars")
+	}
+
+	img.Stars, img.HFR = []star.Star{{Mass: 1000}, {Mass: 3000}}, 2
+	sharp, err := img.PSFSignal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise := img.Stats.Noise()
+	if want := 2000 / (16 * noise); math.Abs(float64(sharp-want)) > 1e-3*float64(want) {
+		t.Errorf("got %g; want %g from HFR", sharp, want)
+	}
+
+	img.FWHM = 8 // PSF fit takes precedence, and doubling the FWHM quarters the signal
+	if blurred, _ := img.PSFSignal(); math.Abs(float64(blurred-sharp/4)) > 1e-3*float64(sharp) {
+		t.Errorf("got %g; want %g", blurred, sharp/4)
+	}
+
+	snr, err := img.SNR()
+	if err != nil || math.Abs(float64(snr-img.Stats.Scale()/noise)) > 1e-6 {
+		t.Errorf("got SNR %g, err %v", snr, err)
+	}
+}
@@ -86,7 +86,7 @@ func (fits *Image) PopHeaderInt32OrFloat(key string) (res float32, err error) {
 		return float32(val), nil
 	} else if val, ok := fits.Header.Floats[key]; ok {
 		delete(fits.Header.Floats, key)
-		return val, nil
+		return float32(val), nil
 	}
 	return 0, fmt.Errorf("%d: FITS header does not contain key %s", fits.ID, key)
 }
@@ -493,9 +493,9 @@ func (h *Header) readLine(subNames []string, subValues [][]byte, id, lineNo int,
 					h.Ints[key] = int32(val)
 				}
 			case byte('f'): // float
-				val, err := strconv.ParseFloat(string(subValues[i]), 64)
+				val, err := strconv.ParseFloat(strings.Replace(string(subValues[i]), "D", "E", 1), 64) // Fortran double exponent
 				if err == nil {
-					h.Floats[key] = float32(val)
+					h.Floats[key] = val
 				}
 			case byte('s'): // string
 				h.Strings[key] = string(subValues[i])
@@ -542,7 +542,7 @@ func compileRE() *regexp.Regexp {
 
 	boo := "(?P<b>[TF])"
 	inte := "(?P<i>[+-]?[0-9]+)"
-	floa := "(?P<f>[+-]?[0-9]*\\.[0-9]*(?:[ED][-+]?[0-9]+)?)"
+	floa := "(?P<f>[+-]?(?:[0-9]*\\.[0-9]*(?:[ED][-+]?[0-9]+)?|[0-9]+[ED][-+]?[0-9]+))"
 	stri := "'(?P<s>[^']*)'"
 	date := "(?P<d>[0-9]{1,4}-?[012][0-9]-?[0123][0-9]T[012][0-9]:?[0-5][0-9]:?[0-5][0-9].?[0-9]*)" // FIXME: other variants possible, see ISO8601
 	val := "(?:" + boo + "|" + inte + "|" + floa + "|" + stri + "|" + date + ")"
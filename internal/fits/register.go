@@ -0,0 +1,351 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+
+	"github.com/mlnoga/nightlight/internal/star"
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+// Maximum side length of the correlation windows. Larger regions are binned for a coarse
+// estimate, which is then refined on a window of this size at full resolution
+const phaseCorrMaxSize = 512
+
+// Number of histogram bins for the disc threshold
+const discHistoBins = 256
+
+// Returns the given rectangle clipped to the image, or the whole image if the rectangle is empty
+func (img *Image) clipRect(r Rect) Rect {
+	width, height := img.Naxisn[0], img.Naxisn[1]
+	if r.Width <= 0 || r.Height <= 0 {
+		return Rect{0, 0, width, height}
+	}
+	x0, y0, x1, y1 := r.X, r.Y, r.X+r.Width, r.Y+r.Height
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 > width {
+		x1 = width
+	}
+	if y1 > height {
+		y1 = height
+	}
+	if x1 <= x0 || y1 <= y0 {
+		return Rect{}
+	}
+	return Rect{x0, y0, x1 - x0, y1 - y0}
+}
+
+// Finds the centroid of the bright disc of a planet, the moon or the sun within the given rectangle,
+// or the whole image if the rectangle is empty. Separates disc from background with Otsu's method and
+// a soft threshold, so the limb contributes with subpixel accuracy, while surface detail inside the
+// disc does not pull the centroid. Returns the centroid and the radius of a disc with the same area
+func (img *Image) DiscCentroid(r Rect) (c star.Point2D, radius float32, err error) {
+	r = img.clipRect(r)
+	if r.Area() == 0 {
+		return c, 0, errors.New("empty disc search region")
+	}
+	width := img.Naxisn[0]
+
+	// determine the value range, ignoring NaNs from earlier projections
+	min, max := float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for y := r.Y; y < r.Y+r.Height; y++ {
+		for _, v := range img.Data[y*width+r.X : y*width+r.X+r.Width] {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if !(max > min) {
+		return c, 0, errors.New("no disc found in flat region")
+	}
+
+	// histogram and Otsu threshold maximizing the between-class variance
+	histo := make([]float64, discHistoBins)
+	binScale := float32(discHistoBins-1) / (max - min)
+	for y := r.Y; y < r.Y+r.Height; y++ {
+		for _, v := range img.Data[y*width+r.X : y*width+r.X+r.Width] {
+			if v == v {
+				histo[int((v-min)*binScale)]++
+			}
+		}
+	}
+	total, sumAll := 0.0, 0.0
+	for i, h := range histo {
+		total += h
+		sumAll += float64(i) * h
+	}
+	bestVar, loMean, hiMean := -1.0, 0.0, 0.0
+	count, sum := 0.0, 0.0
+	for i := 0; i < discHistoBins-1; i++ {
+		count += histo[i]
+		sum += float64(i) * histo[i]
+		if count == 0 || count == total {
+			continue
+		}
+		lo, hi := sum/count, (sumAll-sum)/(total-count)
+		if v := count * (total - count) * (hi - lo) * (hi - lo); v > bestVar {
+			bestVar, loMean, hiMean = v, lo, hi
+		}
+	}
+	if bestVar <= 0 {
+		return c, 0, errors.New("no disc found")
+	}
+	toValue := func(bin float64) float32 { return min + float32(bin+0.5)/binScale }
+	lo, hi := toValue(loMean), toValue(hiMean)
+	threshold := lo + (hi-lo)/4 // close to the limb, where limb darkening and surface detail matter least
+
+	// weighted centroid with a soft threshold, ramping up linearly from halfway between the background
+	// and the threshold. Pixels on the limb contribute by the fraction of their area within the contour
+	var sw, sx, sy float64
+	for y := r.Y; y < r.Y+r.Height; y++ {
+		for x := r.X; x < r.X+r.Width; x++ {
+			v := img.Data[y*width+x]
+			w := 0.5 + float64((v-threshold)/(threshold-lo))
+			if !(w > 0) {
+				continue
+			} else if w > 1 {
+				w = 1
+			}
+			sw += w
+			sx += w * float64(x)
+			sy += w * float64(y)
+		}
+	}
+	if sw == 0 {
+		return c, 0, errors.New("no disc found")
+	}
+	return star.Point2D{X: float32(sx / sw), Y: float32(sy / sw)}, float32(math.Sqrt(sw / math.Pi)), nil
+}
+
+// Registers images against a reference frame by phase correlation of a region, e.g. for surface
+// detail of the moon or the sun without stars. Detects translations only
+type PhaseCorrelator struct {
+	Region Rect      // region of the reference frame used for correlation
+	coarse *spectrum // reference spectrum of the binned region
+	fine   *spectrum // reference spectrum of the central window at full resolution, nil if not binned
+}
+
+// Conjugate spectrum of a windowed image region, zero padded to powers of two
+type spectrum struct {
+	rect          Rect  // source rectangle in full resolution pixels
+	bin           int32 // binning factor
+	width, height int   // padded size
+	data          []complex128
+}
+
+// Creates a new phase correlator for the given region of the reference frame, or the whole frame
+// if the region is empty
+func NewPhaseCorrelator(ref *Image, region Rect) (*PhaseCorrelator, error) {
+	r := ref.clipRect(region)
+	if r.Width < 8 || r.Height < 8 {
+		return nil, errors.New("phase correlation region is too small")
+	}
+	bin := int32(1)
+	for r.Width/bin > phaseCorrMaxSize || r.Height/bin > phaseCorrMaxSize {
+		bin *= 2
+	}
+	pc := &PhaseCorrelator{Region: r, coarse: newSpectrum(ref, r, bin)}
+	if bin > 1 {
+		pc.fine = newSpectrum(ref, centerRect(r, phaseCorrMaxSize), 1)
+	}
+	return pc, nil
+}
+
+// Determines the translation of the given image relative to the reference frame. Returns the
+// transformation from image to reference coordinates, and the height of the normalized correlation
+// peak in [0,1] as a quality measure
+func (pc *PhaseCorrelator) Align(img *Image) (trans star.Transform2D, peak float32) {
+	dx, dy, peak := pc.coarse.correlate(img, 0, 0)
+	dx, dy = dx*float32(pc.coarse.bin), dy*float32(pc.coarse.bin)
+	if pc.fine != nil {
+		// refine on a full resolution window, displaced by the rounded coarse estimate
+		ix, iy := int32(math.Round(float64(dx))), int32(math.Round(float64(dy)))
+		fx, fy, finePeak := pc.fine.correlate(img, ix, iy)
+		dx, dy, peak = float32(ix)+fx, float32(iy)+fy, finePeak
+	}
+	return star.Transform2D{A: 1, B: 0, C: -dx, D: 0, E: 1, F: -dy}, peak
+}
+
+// Returns a rectangle of at most the given size centered on the given one
+func centerRect(r Rect, size int32) Rect {
+	w, h := r.Width, r.Height
+	if w > size {
+		w = size
+	}
+	if h > size {
+		h = size
+	}
+	return Rect{r.X + (r.Width-w)/2, r.Y + (r.Height-h)/2, w, h}
+}
+
+// Computes the conjugate spectrum of the given reference image region binned by the given factor
+func newSpectrum(img *Image, r Rect, bin int32) *spectrum {
+	s := &spectrum{rect: r, bin: bin, width: nextPowerOf2(int(r.Width / bin)), height: nextPowerOf2(int(r.Height / bin))}
+	s.data = s.window(img, 0, 0)
+	fft2D(s.data, s.width, s.height, false)
+	for i, v := range s.data {
+		s.data[i] = cmplx.Conj(v)
+	}
+	return s
+}
+
+// Extracts the region of the given image displaced by (dx,dy) pixels and binned,
+// subtracts the mean and applies a Hann window against edge effects. Pixels outside the image or
+// not a number are treated as the mean. Returns the data zero padded to the spectrum size
+func (s *spectrum) window(img *Image, dx, dy int32) []complex128 {
+	width, height, bin := img.Naxisn[0], img.Naxisn[1], s.bin
+	w, h := int(s.rect.Width/bin), int(s.rect.Height/bin)
+	vals := make([]float64, w*h)
+	valid := make([]bool, w*h)
+	sum, n := 0.0, 0
+	for by := 0; by < h; by++ {
+		for bx := 0; bx < w; bx++ {
+			acc, cnt := 0.0, 0
+			for y := s.rect.Y + dy + int32(by)*bin; y < s.rect.Y+dy+int32(by+1)*bin; y++ {
+				for x := s.rect.X + dx + int32(bx)*bin; x < s.rect.X+dx+int32(bx+1)*bin; x++ {
+					if x < 0 || y < 0 || x >= width || y >= height {
+						continue
+					}
+					if v := img.Data[y*width+x]; v == v {
+						acc += float64(v)
+						cnt++
+					}
+				}
+			}
+			if cnt > 0 {
+				vals[by*w+bx], valid[by*w+bx] = acc/float64(cnt), true
+				sum += acc / float64(cnt)
+				n++
+			}
+		}
+	}
+	mean := 0.0
+	if n > 0 {
+		mean = sum / float64(n)
+	}
+
+	data := make([]complex128, s.width*s.height)
+	for y := 0; y < h; y++ {
+		wy := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(y)+0.5)/float64(h))
+		for x := 0; x < w; x++ {
+			if !valid[y*w+x] {
+				continue
+			}
+			wx := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(x)+0.5)/float64(w))
+			data[y*s.width+x] = complex((vals[y*w+x]-mean)*wx*wy, 0)
+		}
+	}
+	return data
+}
+
+// Correlates the given image region, displaced by (dx,dy) full resolution pixels, with the reference
+// spectrum. Returns the subpixel shift of the image content in binned pixels, and the normalized peak height
+func (s *spectrum) correlate(img *Image, dx, dy int32) (sx, sy, peak float32) {
+	data := s.window(img, dx, dy)
+	fft2D(data, s.width, s.height, false)
+
+	// normalized cross power spectrum
+	for i, v := range data {
+		p := v * s.data[i]
+		if a := cmplx.Abs(p); a > 1e-20 {
+			data[i] = p / complex(a, 0)
+		} else {
+			data[i] = 0
+		}
+	}
+	fft2D(data, s.width, s.height, true)
+
+	// locate the peak and refine it with a parabola along each axis
+	best, bestIdx := math.Inf(-1), 0
+	for i, v := range data {
+		if re := real(v); re > best {
+			best, bestIdx = re, i
+		}
+	}
+	px, py := bestIdx%s.width, bestIdx/s.width
+	at := func(x, y int) float64 {
+		return real(data[((y+s.height)%s.height)*s.width+(x+s.width)%s.width])
+	}
+	fx := float64(px) + parabolaPeak(at(px-1, py), best, at(px+1, py))
+	fy := float64(py) + parabolaPeak(at(px, py-1), best, at(px, py+1))
+	if fx >= float64(s.width)/2 {
+		fx -= float64(s.width)
+	}
+	if fy >= float64(s.height)/2 {
+		fy -= float64(s.height)
+	}
+	norm := float64(s.width * s.height)
+	return float32(fx), float32(fy), float32(best / norm)
+}
+
+// Returns the offset of the vertex of a parabola through three equidistant samples from the middle one
+func parabolaPeak(l, c, r float64) float64 {
+	denom := l - 2*c + r
+	if denom >= 0 {
+		return 0
+	}
+	off := 0.5 * (l - r) / denom
+	if off < -0.5 || off > 0.5 {
+		return 0
+	}
+	return off
+}
+
+// Returns the smallest power of two greater or equal to n
+func nextPowerOf2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// Computes the 2D discrete Fourier transform of the given row-major data in place,
+// or the unnormalized inverse
+func fft2D(data []complex128, width, height int, inverse bool) {
+	transform := func(fft *fourier.CmplxFFT, buf []complex128) {
+		if inverse {
+			fft.Sequence(buf, buf)
+		} else {
+			fft.Coefficients(buf, buf)
+		}
+	}
+	rowFFT := fourier.NewCmplxFFT(width)
+	for y := 0; y < height; y++ {
+		transform(rowFFT, data[y*width:(y+1)*width])
+	}
+	colFFT, col := fourier.NewCmplxFFT(height), make([]complex128, height)
+	for x := 0; x < width; x++ {
+		for y := range col {
+			col[y] = data[y*width+x]
+		}
+		transform(colFFT, col)
+		for y, v := range col {
+			data[y*width+x] = v
+		}
+	}
+}
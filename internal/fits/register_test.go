@@ -0,0 +1,122 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Renders a limb-darkened disc with some surface bands and background noise
+func newTestDisc(width, height int32, cx, cy, r float32, rng *rand.Rand) *Image {
+	img := NewImageFromNaxisn([]int32{width, height}, nil)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			v := 100 + float32(rng.NormFloat64())*5
+			for sy := float32(0.125); sy < 1; sy += 0.25 { // 4x4 supersampling for a smooth limb
+				for sx := float32(0.125); sx < 1; sx += 0.25 {
+					dx, dy := float32(x)-0.5+sx-cx, float32(y)-0.5+sy-cy
+					if d2 := (dx*dx + dy*dy) / (r * r); d2 < 1 {
+						band := 1 + 0.2*float32(math.Sin(float64(dy)/3))
+						v += 1000 * float32(math.Sqrt(float64(1-d2))) * band / 16
+					}
+				}
+			}
+			img.Data[y*width+x] = v
+		}
+	}
+	return img
+}
+
+// Renders a surface texture of random blobs, with its content shifted by (dx,dy)
+func newTestTexture(width, height int32, dx, dy float32, seed int64) *Image {
+	rng := rand.New(rand.NewSource(seed))
+	type blob struct{ x, y, s, a float32 }
+	blobs := make([]blob, 400)
+	for i := range blobs {
+		blobs[i] = blob{rng.Float32() * float32(width), rng.Float32() * float32(height), 2 + rng.Float32()*8, rng.Float32()*200 - 100}
+	}
+	img := NewImageFromNaxisn([]int32{width, height}, nil)
+	for i := range img.Data {
+		img.Data[i] = 500
+	}
+	for _, b := range blobs {
+		for y := int32(b.y+dy-4*b.s) - 1; y <= int32(b.y+dy+4*b.s)+1; y++ {
+			for x := int32(b.x+dx-4*b.s) - 1; x <= int32(b.x+dx+4*b.s)+1; x++ {
+				if x < 0 || y < 0 || x >= width || y >= height {
+					continue
+				}
+				ex, ey := float32(x)-b.x-dx, float32(y)-b.y-dy
+				img.Data[y*width+x] += b.a * float32(math.Exp(float64(-(ex*ex+ey*ey)/(2*b.s*b.s))))
+			}
+		}
+	}
+	return img
+}
+
+func TestDiscCentroid(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	ref, refRadius, err := newTestDisc(200, 150, 80, 60, 30, rng).DiscCentroid(Rect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(ref.X-80)) > 0.25 || math.Abs(float64(ref.Y-60)) > 0.25 || math.Abs(float64(refRadius-30)) > 1 {
+		t.Errorf("got centroid %v radius %g; want (80,60) radius 30", ref, refRadius)
+	}
+
+	// the bands bias the absolute centroid slightly, but shifts between frames must be exact
+	for _, c := range [][2]float32{{52.3, 71.8}, {120.6, 40.2}} {
+		centroid, radius, err := newTestDisc(200, 150, c[0], c[1], 30, rng).DiscCentroid(Rect{Width: 200, Height: 150})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dx, dy := centroid.X-ref.X, centroid.Y-ref.Y; math.Abs(float64(dx-c[0]+80)) > 0.05 || math.Abs(float64(dy-c[1]+60)) > 0.05 {
+			t.Errorf("disc at (%g,%g): got shift (%g,%g)", c[0], c[1], dx, dy)
+		}
+		if math.Abs(float64(radius-refRadius)) > 0.1 {
+			t.Errorf("disc at (%g,%g): got radius %g; want %g", c[0], c[1], radius, refRadius)
+		}
+	}
+
+	if _, _, err := NewImageFromNaxisn([]int32{10, 10}, nil).DiscCentroid(Rect{}); err == nil {
+		t.Errorf("expected error for flat image")
+	}
+}
+
+func TestPhaseCorrelator(t *testing.T) {
+	for _, size := range [][2]int32{{300, 200}, {1100, 700}} { // the latter needs binning and refinement
+		ref := newTestTexture(size[0], size[1], 0, 0, 5)
+		pc, err := NewPhaseCorrelator(ref, Rect{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range [][2]float32{{0, 0}, {7.3, -4.6}, {-23.5, 11.2}} {
+			img := newTestTexture(size[0], size[1], d[0], d[1], 5)
+			trans, peak := pc.Align(img)
+			if math.Abs(float64(trans.C+d[0])) > 0.2 || math.Abs(float64(trans.F+d[1])) > 0.2 || trans.A != 1 || trans.E != 1 {
+				t.Errorf("size %v shift %v: got transform %v", size, d, trans)
+			}
+			if peak < 0.2 || peak > 1.001 {
+				t.Errorf("size %v shift %v: got peak %g", size, d, peak)
+			}
+		}
+	}
+
+	if _, err := NewPhaseCorrelator(newTestTexture(100, 100, 0, 0, 1), Rect{X: 98, Y: 98, Width: 10, Height: 10}); err == nil {
+		t.Errorf("expected error for tiny region")
+	}
+}
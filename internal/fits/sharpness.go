@@ -0,0 +1,102 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import "errors"
+
+// Metric for the sharpness of an image, e.g. for lucky imaging
+type SharpnessMetric int
+
+const (
+	SMLaplacian SharpnessMetric = iota // Variance of the Laplacian
+	SMGradient                         // Mean squared gradient magnitude, also known as gradient energy
+)
+
+// Measures the sharpness of the image within the given rectangle, or the whole image if the rectangle
+// is empty. Pixels are binned NxN first, e.g. to hide the color filter array of raw frames. The result
+// is normalized by the squared mean of the region, so it does not depend on brightness or transparency.
+// Higher is sharper. Pixels that are not a number are ignored
+func (img *Image) Sharpness(metric SharpnessMetric, r Rect, bin int32) (float32, error) {
+	if bin < 1 {
+		bin = 1
+	}
+	r = img.clipRect(r)
+	w, h := r.Width/bin, r.Height/bin
+	if w < 3 || h < 3 {
+		return 0, errors.New("sharpness region is too small")
+	}
+
+	// bin the region
+	width := img.Naxisn[0]
+	vals := make([]float64, w*h)
+	mean, n := 0.0, 0
+	for by := int32(0); by < h; by++ {
+		for bx := int32(0); bx < w; bx++ {
+			sum := 0.0
+			for y := r.Y + by*bin; y < r.Y+(by+1)*bin; y++ {
+				for _, v := range img.Data[y*width+r.X+bx*bin : y*width+r.X+(bx+1)*bin] {
+					sum += float64(v)
+				}
+			}
+			v := sum / float64(bin*bin)
+			vals[by*w+bx] = v
+			if v == v {
+				mean += v
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0, errors.New("no valid pixels in sharpness region")
+	}
+	mean /= float64(n)
+	if mean == 0 {
+		return 0, errors.New("zero mean in sharpness region")
+	}
+
+	// accumulate the metric over the interior of the region
+	var sum, sumSq float64
+	cnt := 0
+	for y := int32(1); y < h-1; y++ {
+		for x := int32(1); x < w-1; x++ {
+			i := y*w + x
+			var m float64
+			switch metric {
+			case SMLaplacian:
+				m = vals[i-1] + vals[i+1] + vals[i-w] + vals[i+w] - 4*vals[i]
+			case SMGradient:
+				gx, gy := (vals[i+1]-vals[i-1])/2, (vals[i+w]-vals[i-w])/2
+				m = gx*gx + gy*gy
+			default:
+				return 0, errors.New("unknown sharpness metric")
+			}
+			if m != m {
+				continue
+			}
+			sum += m
+			sumSq += m * m
+			cnt++
+		}
+	}
+	if cnt == 0 {
+		return 0, errors.New("no valid pixels in sharpness region")
+	}
+	res := sum / float64(cnt)
+	if metric == SMLaplacian {
+		res = sumSq/float64(cnt) - res*res
+	}
+	return float32(res / (mean * mean)), nil
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A world coordinate system with gnomonic (TAN) projection, as defined by the FITS WCS standard.
+// Pixel coordinates passed to the methods are zero-based as everywhere in nightlight, whereas
+// CRPIX follows the one-based FITS convention
+type WCS struct {
+	CRVAL [2]float64    // right ascension and declination of the reference point, in degrees
+	CRPIX [2]float64    // reference pixel, one-based
+	CD    [2][2]float64 // linear transformation from pixel offsets to intermediate world coordinates, in degrees per pixel
+}
+
+func (w WCS) String() string {
+	return fmt.Sprintf("RA %.5f Dec %+.5f scale %.4f\"/px rotation %.2f° %s", w.CRVAL[0], w.CRVAL[1], w.PixelScale(), w.Rotation(),
+		map[bool]string{false: "normal", true: "mirrored"}[w.Mirrored()])
+}
+
+// Converts zero-based pixel coordinates to right ascension and declination in degrees
+func (w *WCS) PixelToWorld(x, y float64) (ra, dec float64) {
+	dx, dy := x+1-w.CRPIX[0], y+1-w.CRPIX[1]
+	xi := w.CD[0][0]*dx + w.CD[0][1]*dy
+	eta := w.CD[1][0]*dx + w.CD[1][1]*dy
+	return InverseGnomonic(w.CRVAL[0], w.CRVAL[1], xi, eta)
+}
+
+// Converts right ascension and declination in degrees to zero-based pixel coordinates.
+// Returns false for points on the far side of the celestial sphere, or for a singular CD matrix
+func (w *WCS) WorldToPixel(ra, dec float64) (x, y float64, ok bool) {
+	xi, eta, ok := Gnomonic(w.CRVAL[0], w.CRVAL[1], ra, dec)
+	if !ok {
+		return 0, 0, false
+	}
+	det := w.CD[0][0]*w.CD[1][1] - w.CD[0][1]*w.CD[1][0]
+	if det == 0 {
+		return 0, 0, false
+	}
+	dx := (w.CD[1][1]*xi - w.CD[0][1]*eta) / det
+	dy := (-w.CD[1][0]*xi + w.CD[0][0]*eta) / det
+	return dx + w.CRPIX[0] - 1, dy + w.CRPIX[1] - 1, true
+}
+
+// Returns the pixel scale in arc seconds per pixel
+func (w *WCS) PixelScale() float64 {
+	det := w.CD[0][0]*w.CD[1][1] - w.CD[0][1]*w.CD[1][0]
+	return math.Sqrt(math.Abs(det)) * 3600
+}
+
+// Returns the rotation angle in degrees, equivalent to the FITS CROTA2 keyword
+func (w *WCS) Rotation() float64 {
+	return math.Atan2(-w.CD[0][1], w.CD[1][1]) * 180 / math.Pi
+}
+
+// Returns true if the image is mirrored relative to the sky as seen from the ground,
+// i.e. east is clockwise from north instead of counterclockwise
+func (w *WCS) Mirrored() bool {
+	return w.CD[0][0]*w.CD[1][1]-w.CD[0][1]*w.CD[1][0] > 0
+}
+
+// Projects right ascension and declination onto the plane tangent to the sphere at ra0, dec0.
+// All angles in degrees. Returns standard coordinates xi (positive towards east) and eta (positive
+// towards north) in degrees, or false if the point is on the far hemisphere
+func Gnomonic(ra0, dec0, ra, dec float64) (xi, eta float64, ok bool) {
+	const rad = math.Pi / 180
+	sinD0, cosD0 := math.Sincos(dec0 * rad)
+	sinD, cosD := math.Sincos(dec * rad)
+	sinDA, cosDA := math.Sincos((ra - ra0) * rad)
+	cosC := sinD0*sinD + cosD0*cosD*cosDA
+	if cosC <= 0 {
+		return 0, 0, false
+	}
+	xi = cosD * sinDA / cosC / rad
+	eta = (cosD0*sinD - sinD0*cosD*cosDA) / cosC / rad
+	return xi, eta, true
+}
+
+// Inverts the gnomonic projection of standard coordinates xi, eta on the plane tangent at ra0, dec0.
+// All angles in degrees. Returns right ascension in [0,360) and declination
+func InverseGnomonic(ra0, dec0, xi, eta float64) (ra, dec float64) {
+	const rad = math.Pi / 180
+	x, y := xi*rad, eta*rad
+	rho := math.Hypot(x, y)
+	if rho == 0 {
+		return ra0, dec0
+	}
+	c := math.Atan(rho)
+	sinC, cosC := math.Sincos(c)
+	sinD0, cosD0 := math.Sincos(dec0 * rad)
+	dec = math.Asin(cosC*sinD0+y*sinC*cosD0/rho) / rad
+	ra = ra0 + math.Atan2(x*sinC, rho*cosD0*cosC-y*sinD0*sinC)/rad
+	ra = math.Mod(ra, 360)
+	if ra < 0 {
+		ra += 360
+	}
+	return ra, dec
+}
+
+// Returns the angular distance between two points on the sphere in degrees
+func AngularDistance(ra1, dec1, ra2, dec2 float64) float64 {
+	const rad = math.Pi / 180
+	sinDDec, sinDRA := math.Sin((dec2-dec1)*rad/2), math.Sin((ra2-ra1)*rad/2)
+	a := sinDDec*sinDDec + math.Cos(dec1*rad)*math.Cos(dec2*rad)*sinDRA*sinDRA
+	return 2 * math.Asin(math.Min(1, math.Sqrt(a))) / rad
+}
+
+// Header keys of other WCS representations, which must not coexist with the CD matrix
+var conflictingWCSKeys = []string{"CDELT1", "CDELT2", "CROTA1", "CROTA2", "PC1_1", "PC1_2", "PC2_1", "PC2_2",
+	"A_ORDER", "B_ORDER", "AP_ORDER", "BP_ORDER"}
+
+// Reads a TAN world coordinate system from the header, given either as CD matrix, or as
+// CDELTn with optional CROTA2. Returns nil if the header holds no such WCS
+func (h *Header) WCS() *WCS {
+	if !strings.HasSuffix(strings.TrimSpace(h.Strings["CTYPE1"]), "-TAN") ||
+		!strings.HasSuffix(strings.TrimSpace(h.Strings["CTYPE2"]), "-TAN") {
+		return nil
+	}
+	w := &WCS{}
+	var ok [4]bool
+	w.CRVAL[0], ok[0] = h.Float64("CRVAL1")
+	w.CRVAL[1], ok[1] = h.Float64("CRVAL2")
+	w.CRPIX[0], ok[2] = h.Float64("CRPIX1")
+	w.CRPIX[1], ok[3] = h.Float64("CRPIX2")
+	if !ok[0] || !ok[1] || !ok[2] || !ok[3] {
+		return nil
+	}
+
+	if cd11, ok := h.Float64("CD1_1"); ok {
+		w.CD[0][0] = cd11
+		w.CD[0][1], _ = h.Float64("CD1_2")
+		w.CD[1][0], _ = h.Float64("CD2_1")
+		w.CD[1][1], _ = h.Float64("CD2_2")
+	} else {
+		cdelt1, ok1 := h.Float64("CDELT1")
+		cdelt2, ok2 := h.Float64("CDELT2")
+		if !ok1 || !ok2 {
+			return nil
+		}
+		crota, _ := h.Float64("CROTA2")
+		sin, cos := math.Sincos(crota * math.Pi / 180)
+		w.CD = [2][2]float64{{cdelt1 * cos, -cdelt2 * sin}, {cdelt1 * sin, cdelt2 * cos}}
+	}
+	if w.CD[0][0]*w.CD[1][1]-w.CD[0][1]*w.CD[1][0] == 0 {
+		return nil
+	}
+	return w
+}
+
+// Writes the given TAN world coordinate system into the header as CD matrix,
+// removing other WCS representations and distortion terms
+func (h *Header) SetWCS(w *WCS) {
+	for _, k := range conflictingWCSKeys {
+		delete(h.Ints, k)
+		delete(h.Floats, k)
+	}
+	h.Strings["CTYPE1"], h.Strings["CTYPE2"] = "RA---TAN", "DEC--TAN"
+	h.Strings["CUNIT1"], h.Strings["CUNIT2"] = "deg", "deg"
+	h.Strings["RADESYS"] = "ICRS"
+	delete(h.Ints, "EQUINOX")
+	h.Floats["EQUINOX"] = 2000
+	values := map[string]float64{
+		"CRVAL1": w.CRVAL[0], "CRVAL2": w.CRVAL[1], "CRPIX1": w.CRPIX[0], "CRPIX2": w.CRPIX[1],
+		"CD1_1": w.CD[0][0], "CD1_2": w.CD[0][1], "CD2_1": w.CD[1][0], "CD2_2": w.CD[1][1],
+	}
+	for k, v := range values {
+		delete(h.Ints, k)
+		h.Floats[k] = v
+	}
+}
+
+// Removes the world coordinate system from the header, e.g. after a geometric transformation of the image
+// which invalidates it
+func (h *Header) DeleteWCS() {
+	keys := append([]string{"CTYPE1", "CTYPE2", "CUNIT1", "CUNIT2", "CRVAL1", "CRVAL2", "CRPIX1", "CRPIX2",
+		"CD1_1", "CD1_2", "CD2_1", "CD2_2"}, conflictingWCSKeys...)
+	for _, k := range keys {
+		delete(h.Ints, k)
+		delete(h.Floats, k)
+		delete(h.Strings, k)
+	}
+}
+
+// Header keys for telescope pointing and optics, which remain valid for stacks and mosaics of a frame
+var pointingKeys = []string{"RA", "DEC", "OBJCTRA", "OBJCTDEC", "OBJECT", "FOCALLEN", "XPIXSZ", "YPIXSZ", "PIXSCALE", "SCALE"}
+
+// Copies the pointing and optics keys from the given header, e.g. so plate solving a stack can use them as hints
+func (h *Header) CopyPointing(src *Header) {
+	for _, k := range pointingKeys {
+		if v, ok := src.Ints[k]; ok {
+			h.Ints[k] = v
+		}
+		if v, ok := src.Floats[k]; ok {
+			h.Floats[k] = v
+		}
+		if v, ok := src.Strings[k]; ok {
+			h.Strings[k] = v
+		}
+	}
+}
+
+// Returns a numeric header value as float64, whether it was stored as integer or floating point
+func (h *Header) Float64(key string) (float64, bool) {
+	if v, ok := h.Floats[key]; ok {
+		return v, true
+	}
+	if v, ok := h.Ints[key]; ok {
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,119 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGnomonicRoundTrip(t *testing.T) {
+	for _, c := range [][4]float64{{10, 20, 10.5, 20.3}, {359.8, -30, 0.3, -29.5}, {120, 89.5, 300, 89.2}} {
+		xi, eta, ok := Gnomonic(c[0], c[1], c[2], c[3])
+		if !ok {
+			t.Fatalf("%v: projection failed", c)
+		}
+		ra, dec := InverseGnomonic(c[0], c[1], xi, eta)
+		if d := AngularDistance(ra, dec, c[2], c[3]) * 3600; d > 1e-6 {
+			t.Errorf("%v: round trip to %f %f off by %g\"", c, ra, dec, d)
+		}
+	}
+	if _, _, ok := Gnomonic(0, 0, 180, 0); ok {
+		t.Errorf("projection of the antipode should fail")
+	}
+}
+
+func TestWCSHeaderRoundTrip(t *testing.T) {
+	w := &WCS{
+		CRVAL: [2]float64{83.822083333, -5.391111111},
+		CRPIX: [2]float64{512.5, 384.5},
+		CD:    [2][2]float64{{-2.1e-4, 3.5e-5}, {3.5e-5, 2.1e-4}},
+	}
+	img := NewImageFromNaxisn([]int32{4, 3}, nil)
+	img.Header.Floats["CDELT1"] = 1 // conflicting representation, must be removed
+	img.Header.SetWCS(w)
+
+	buf := bytes.Buffer{}
+	if err := img.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read := NewImage()
+	if err := read.Read(&buf, true, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	got := read.Header.WCS()
+	if got == nil {
+		t.Fatalf("no WCS read back from header %v", read.Header)
+	}
+	if _, ok := read.Header.Float64("CDELT1"); ok {
+		t.Errorf("conflicting CDELT1 retained")
+	}
+	for _, p := range [][2]float64{{0, 0}, {1023, 767}} {
+		ra, dec := got.PixelToWorld(p[0], p[1])
+		wantRA, wantDec := w.PixelToWorld(p[0], p[1])
+		if d := AngularDistance(ra, dec, wantRA, wantDec) * 3600; d > 1e-3 {
+			t.Errorf("pixel %v off by %g\" after round trip", p, d)
+		}
+	}
+
+	x, y, ok := got.WorldToPixel(got.PixelToWorld(100, 200))
+	if !ok || math.Abs(x-100) > 1e-6 || math.Abs(y-200) > 1e-6 {
+		t.Errorf("world to pixel round trip got %f %f", x, y)
+	}
+}
+
+func TestWCSFromCDELT(t *testing.T) {
+	h := NewHeader()
+	h.Strings["CTYPE1"], h.Strings["CTYPE2"] = "RA---TAN", "DEC--TAN"
+	h.Floats["CRVAL1"], h.Floats["CRVAL2"] = 10, 20
+	h.Ints["CRPIX1"], h.Ints["CRPIX2"] = 100, 50
+	h.Floats["CDELT1"], h.Floats["CDELT2"] = -0.001, 0.001
+	h.Floats["CROTA2"] = 30
+	w := h.WCS()
+	if w == nil {
+		t.Fatal("no WCS from CDELT keywords")
+	}
+	if math.Abs(w.PixelScale()-3.6) > 1e-4 || math.Abs(w.Rotation()-30) > 1e-4 || w.Mirrored() {
+		t.Errorf("got %v", w)
+	}
+}
+
+func TestDateObsRoundTrip(t *testing.T) {
+	img := NewImageFromNaxisn([]int32{2, 2}, nil)
+	img.Exposure = 120
+	img.Header.Strings["DATE-OBS"] = "2023-03-01T22:15:30.250"
+	buf := bytes.Buffer{}
+	if err := img.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read := NewImage()
+	if err := read.Read(&buf, true, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := read.MidExposure()
+	if want := time.Date(2023, 3, 1, 22, 16, 30, 250e6, time.UTC); !ok || !got.Equal(want) {
+		t.Errorf("got mid exposure %v %v, want %v", got, ok, want)
+	}
+
+	h := NewHeader()
+	h.Strings["DATE-OBS"], h.Strings["TIME-OBS"] = "2023-03-01", "01:02:03"
+	if got, ok := h.DateObs(); !ok || !got.Equal(time.Date(2023, 3, 1, 1, 2, 3, 0, time.UTC)) {
+		t.Errorf("got legacy date %v %v", got, ok)
+	}
+}
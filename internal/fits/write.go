@@ -92,8 +92,7 @@ func (fits *Image) Write(f io.Writer) error {
 func (h *Header) Write(w io.Writer) {
 	for k,v:=range(h.Bools  ) { writeBool   (w, k, v, "") }
 	for k,v:=range(h.Ints   ) { writeInt32  (w, k, v, "") }
-	for k,v:=range(h.Floats ) { writeFloat32(w, k, v, "") }
-	for k,v:=range(h.Strings) { writeString (w, k, v, "") }
+	for k,v:=range(h.Floats ) { writeFloat64(w, k, v, "") }
 	for k,v:=range(h.Strings) { writeString (w, k, v, "") }
 	for k,v:=range(h.Dates  ) { writeString (w, k, v, "") }
 	// FIXME: ignoring h.Comments and h.History for now
@@ -137,15 +136,15 @@ func writeInt64(w io.Writer, key string, value int64, comment string) {
 func writeFloat32(w io.Writer, key string, value float32, comment string) {
 	if len(key)>8 { key=key[0:8] }
 	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20g / %-47s", key, value, comment)
+	fmt.Fprintf(w, "%-8s= %20G / %-47s", key, value, comment)
 }
 
 
-// Writes a FITS header float64 value 
+// Writes a FITS header float64 value, with as many significant digits as fit the value field
 func writeFloat64(w io.Writer, key string, value float64, comment string) {
 	if len(key)>8 { key=key[0:8] }
 	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20g / %-47s", key, value, comment)
+	fmt.Fprintf(w, "%-8s= %20.13G / %-47s", key, value, comment)
 }
 
 
@@ -160,6 +159,10 @@ func writeString(w io.Writer, key, value, comment string) {
 
 	if len(value)<=18 {
 		fmt.Fprintf(w, "%-8s= '%s'%s / %-47s", key, value, strings.Repeat(" ", 18-len(value)), comment)
+	} else if len(value)<=65 { // fits on a single card, shortening the comment
+		free:=80-12-len(value)-3
+		if len(comment)>free { comment=comment[0:free] }
+		fmt.Fprintf(w, "%-8s= '%s' / %-*s", key, value, free, comment)
 	} else {
 		fmt.Fprintf(w, "%-8s= '%s&' / %-47s", key, value[0:17], comment)
 		value=value[17:]
@@ -0,0 +1,40 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fits
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteStringLengths(t *testing.T) {
+	for n := 65; n <= 69; n++ {
+		value := strings.Repeat("x", n)
+		buf := bytes.Buffer{}
+		writeString(&buf, "OBJECT", value, "a comment")
+		out := buf.String()
+		if len(out)%80 != 0 {
+			t.Fatalf("%d: got %d characters, not whole cards", n, len(out))
+		}
+		cards := len(out) / 80
+		if n <= 65 && (cards != 1 || !strings.HasPrefix(out, "OBJECT  = '"+value+"'")) {
+			t.Errorf("%d: got %q; want a single card", n, out)
+		} else if n > 65 && (cards < 2 || !strings.HasPrefix(out[80:], "CONTINUE  '")) {
+			t.Errorf("%d: got %q; want a continued value", n, out)
+		}
+	}
+}
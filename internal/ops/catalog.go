@@ -0,0 +1,64 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Saves the star detections of the given image as a catalog under the given filename, with pattern expansion
+// for %d based on the image id. The suffix selects the format: .csv, .json, or .reg for SAO DS9 regions.
+// If trans is not nil, the star coordinates transformed into the reference frame are included.
+// No op if the pattern is empty
+func SaveStarCatalog(f *fits.Image, filePattern string, trans star.Transformation, c *Context) error {
+	if filePattern == "" {
+		return nil
+	}
+	fileName := filePattern
+	if strings.Contains(fileName, "%d") {
+		fileName = fmt.Sprintf(filePattern, f.ID)
+	}
+
+	var write func(stars []star.Star, trans star.Transformation) error
+	file := (*os.File)(nil)
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		write = func(stars []star.Star, trans star.Transformation) error { return star.WriteStarsCSV(file, stars, trans) }
+	case ".json":
+		write = func(stars []star.Star, trans star.Transformation) error { return star.WriteStarsJSON(file, stars, trans) }
+	case ".reg":
+		write = func(stars []star.Star, trans star.Transformation) error { return star.WriteStarsDS9(file, stars, trans) }
+	default:
+		return fmt.Errorf("%d: unknown suffix \"%s\" for star catalog %s", f.ID, filepath.Ext(fileName), fileName)
+	}
+
+	fmt.Fprintf(c.Log, "%d: Writing catalog of %d stars to %s\n", f.ID, len(f.Stars), fileName)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("%d: error creating star catalog %s: %s", f.ID, fileName, err.Error())
+	}
+	defer file.Close()
+	if err = write(f.Stars, trans); err != nil {
+		return fmt.Errorf("%d: error writing star catalog %s: %s", f.ID, fileName, err.Error())
+	}
+	return nil
+}
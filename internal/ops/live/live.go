@@ -0,0 +1,374 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Live stacking of frames appearing in a watched directory during an imaging session
+package live
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/stack"
+)
+
+// Polls a directory for new files matching a pattern. A file is reported once its size and modification
+// time are unchanged between two polls, so files still being written by the capture software are skipped
+type Watcher struct {
+	Dir     string
+	Pattern string // glob pattern for the file names in the directory, e.g. *.fits
+	Retries int    // number of attempts to process a file before giving up on it
+	files   map[string]*watchedFile
+	exclude []string // glob patterns for the absolute paths of files written by the session itself
+}
+
+type watchedFile struct {
+	size     int64
+	modTime  time.Time
+	attempts int
+	done     bool
+}
+
+func NewWatcher(dir, pattern string, retries int) *Watcher {
+	return &Watcher{
+		Dir:     dir,
+		Pattern: pattern,
+		Retries: retries,
+		files:   map[string]*watchedFile{},
+	}
+}
+
+// Matches printf verbs for the image ID in file name patterns, e.g. %04d
+var idVerb = regexp.MustCompile(`%[-+# 0]*[0-9]*d`)
+
+// Matches glob metacharacters, which are escaped in excluded paths. Windows has no glob escapes
+var globMeta = regexp.MustCompile(`[*?[\\]`)
+
+// Excludes the given files from polling, so outputs written into the watched directory are not stacked
+// again. File name patterns with a %d verb for the image ID exclude all files matching the pattern
+func (w *Watcher) Exclude(names ...string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			continue
+		}
+		if runtime.GOOS != "windows" {
+			abs = globMeta.ReplaceAllString(abs, `\$0`)
+		}
+		w.exclude = append(w.exclude, idVerb.ReplaceAllString(abs, "*"))
+	}
+}
+
+// Returns true if the file with the given path is excluded from polling
+func (w *Watcher) excluded(name string) bool {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range w.exclude {
+		if ok, _ := filepath.Match(pattern, abs); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the paths of the files which are complete and not yet processed, oldest first
+func (w *Watcher) Poll() (ready []string, err error) {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+	modTimes := map[string]time.Time{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if ok, err := filepath.Match(w.Pattern, e.Name()); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		name := filepath.Join(w.Dir, e.Name())
+		if w.excluded(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil { // removed since listing the directory
+			continue
+		}
+		wf := w.files[name]
+		if wf == nil {
+			w.files[name] = &watchedFile{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		if wf.done {
+			continue
+		}
+		if wf.size != info.Size() || !wf.modTime.Equal(info.ModTime()) {
+			wf.size, wf.modTime, wf.attempts = info.Size(), info.ModTime(), 0 // still being written
+			continue
+		}
+		if wf.size > 0 {
+			ready = append(ready, name)
+			modTimes[name] = wf.modTime
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		ti, tj := modTimes[ready[i]], modTimes[ready[j]]
+		if ti.Equal(tj) {
+			return ready[i] < ready[j]
+		}
+		return ti.Before(tj)
+	})
+	return ready, nil
+}
+
+// Marks the given file as processed
+func (w *Watcher) Done(name string) {
+	if wf := w.files[name]; wf != nil {
+		wf.done = true
+	}
+}
+
+// Records a failed attempt to process the given file. Returns true if the file should be retried on a
+// later poll, or false if the retries are exhausted and the file was marked as processed
+func (w *Watcher) Failed(name string) bool {
+	wf := w.files[name]
+	if wf == nil {
+		return false
+	}
+	wf.attempts++
+	if wf.attempts >= w.Retries {
+		wf.done = true
+		return false
+	}
+	return true
+}
+
+// Status of a live stacking session, written as JSON after each frame
+type Status struct {
+	Dir         string    `json:"dir"`
+	Frames      int       `json:"frames"`   // frames in the stack
+	Rejected    int       `json:"rejected"` // frames dropped by preprocessing or alignment
+	Failed      int       `json:"failed"`   // files which could not be loaded or processed
+	Exposure    float32   `json:"exposure"`
+	ClippedLow  int64     `json:"clippedLow"`
+	ClippedHigh int64     `json:"clippedHigh"`
+	LastFile    string    `json:"lastFile"`
+	LastResult  string    `json:"lastResult"` // stacked, rejected or failed
+	LastError   string    `json:"lastError,omitempty"`
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+}
+
+// A live stacking session. Each new frame is preprocessed, registered against the references
+// and added to the running stack. Then the output sequence is applied to a copy of the stack
+type Live struct {
+	Watcher    *Watcher
+	Poll       time.Duration   // interval between polls of the directory
+	Idle       time.Duration   // stop after no new frames for this long, 0=run until stopped
+	PreProc    *ops.OpSequence // preprocessing, which may drop frames before reference selection
+	Register   *ops.OpSequence // reference selection, histogram matching and alignment
+	Stack      *stack.RunningStack
+	Output     *ops.OpSequence // saves the running stack after each frame
+	StatusFile string          // file name for the status JSON, empty=none
+	Status     Status
+	nextID     int
+}
+
+func NewLive(watcher *Watcher, poll, idle time.Duration, preProc, register *ops.OpSequence, rs *stack.RunningStack,
+	output *ops.OpSequence, statusFile string) *Live {
+	for _, seq := range []*ops.OpSequence{preProc, register, output} {
+		watcher.Exclude(savedFiles(seq)...)
+	}
+	if statusFile != "" {
+		watcher.Exclude(statusFile, statusFile+".tmp")
+	}
+	return &Live{
+		Watcher:    watcher,
+		Poll:       poll,
+		Idle:       idle,
+		PreProc:    preProc,
+		Register:   register,
+		Stack:      rs,
+		Output:     output,
+		StatusFile: statusFile,
+		Status:     Status{Dir: watcher.Dir},
+	}
+}
+
+// Returns the file name patterns of the save operators in the given sequence, including nested sequences
+func savedFiles(seq *ops.OpSequence) (names []string) {
+	for _, step := range seq.Steps {
+		switch op := step.(type) {
+		case *ops.OpSave:
+			names = append(names, op.FilePattern)
+		case *ops.OpSequence:
+			names = append(names, savedFiles(op)...)
+		}
+	}
+	return names
+}
+
+// Maps a batch reference selection mode to live stacking. Modes which select among all frames, and
+// image IDs, pick the first good frame instead, as later frames are not known yet. File names are kept
+func ReferenceMode(mode string) string {
+	if mode == "" || mode[0] == '%' {
+		return "0"
+	}
+	if _, err := strconv.Atoi(mode); err == nil {
+		return "0"
+	}
+	return mode
+}
+
+// Runs the live stacking session until the idle timeout expires or the stop channel is closed
+func (l *Live) Run(c *ops.Context, stop <-chan struct{}) error {
+	l.Status.Started = time.Now()
+	fmt.Fprintf(c.Log, "Watching %s for files matching %s, polling every %v...\n", l.Watcher.Dir, l.Watcher.Pattern, l.Poll)
+	lastFrame := time.Now()
+	for {
+		ready, err := l.Watcher.Poll()
+		if err != nil {
+			return err
+		}
+		for _, name := range ready {
+			if err := l.processFile(name, c); err != nil {
+				return err
+			}
+			lastFrame = time.Now()
+		}
+
+		if l.Idle > 0 && time.Since(lastFrame) >= l.Idle {
+			fmt.Fprintf(c.Log, "No new frames for %v, stopping.\n", l.Idle)
+			return nil
+		}
+		select {
+		case <-stop:
+			fmt.Fprintf(c.Log, "Stopping live stacking.\n")
+			return nil
+		case <-time.After(l.Poll):
+		}
+	}
+}
+
+// Processes a single file. Load errors are retried on later polls, as the file may still be incomplete.
+// Processing errors skip the frame. Returns an error only if the outputs cannot be written
+func (l *Live) processFile(name string, c *ops.Context) error {
+	l.Status.LastFile, l.Status.LastError = name, ""
+	f, err := ops.NewOpLoad(l.nextID, name).Apply(nil, c)
+	if err != nil {
+		if l.Watcher.Failed(name) {
+			fmt.Fprintf(c.Log, "Unable to load %s, retrying later: %s\n", name, err.Error())
+			return nil
+		}
+		fmt.Fprintf(c.Log, "Unable to load %s, skipping: %s\n", name, err.Error())
+		l.Status.Failed++
+		l.Status.LastResult, l.Status.LastError = "failed", err.Error()
+		return l.writeStatus()
+	}
+	l.Watcher.Done(name)
+	l.nextID++
+
+	f, err = l.apply(f, c)
+	if err != nil {
+		fmt.Fprintf(c.Log, "Unable to process %s, skipping: %s\n", name, err.Error())
+		l.Status.Failed++
+		l.Status.LastResult, l.Status.LastError = "failed", err.Error()
+		return l.writeStatus()
+	}
+	if f == nil {
+		l.Status.Rejected++
+		l.Status.LastResult = "rejected"
+		return l.writeStatus()
+	}
+	if err = l.Stack.Add(f); err != nil {
+		fmt.Fprintf(c.Log, "Unable to stack %s, skipping: %s\n", name, err.Error())
+		l.Status.Failed++
+		l.Status.LastResult, l.Status.LastError = "failed", err.Error()
+		return l.writeStatus()
+	}
+	l.Status.Frames, l.Status.Exposure = l.Stack.Frames, l.Stack.Exposure
+	l.Status.ClippedLow, l.Status.ClippedHigh = l.Stack.ClippedLow, l.Stack.ClippedHigh
+	l.Status.LastResult = "stacked"
+	fmt.Fprintf(c.Log, "%d: Added to live stack, now %d frames with %.0fs exposure\n", f.ID, l.Stack.Frames, l.Stack.Exposure)
+
+	if err = l.writeOutput(c); err != nil {
+		return err
+	}
+	return l.writeStatus()
+}
+
+// Applies preprocessing and registration to the given frame. Returns nil if the frame was dropped
+func (l *Live) apply(f *fits.Image, c *ops.Context) (*fits.Image, error) {
+	for _, seq := range []*ops.OpSequence{l.PreProc, l.Register} {
+		promises, err := seq.MakePromises([]ops.Promise{func() (*fits.Image, error) { return f, nil }}, c)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := ops.MaterializeAll(promises, 1, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(fs) == 0 { // dropped, e.g. too few stars or failed alignment
+			return nil, nil
+		}
+		f = fs[0]
+	}
+	return f, nil
+}
+
+// Applies the output sequence to a copy of the running stack
+func (l *Live) writeOutput(c *ops.Context) error {
+	img, err := l.Stack.Image()
+	if err != nil {
+		return err
+	}
+	promises, err := l.Output.MakePromises([]ops.Promise{func() (*fits.Image, error) { return img, nil }}, c)
+	if err != nil {
+		return err
+	}
+	_, err = ops.MaterializeAll(promises, 1, true)
+	return err
+}
+
+// Writes the status JSON, replacing the previous file atomically so readers never see partial contents
+func (l *Live) writeStatus() error {
+	l.Status.Updated = time.Now()
+	if l.StatusFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&l.Status, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.StatusFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.StatusFile)
+}
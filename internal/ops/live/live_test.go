@@ -0,0 +1,128 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package live
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/stack"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.fits")
+	os.WriteFile(name, []byte("SIMPLE"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("seeing 2\""), 0644)
+	w := NewWatcher(dir, "*.fits", 2)
+
+	poll := func(want int) {
+		t.Helper()
+		ready, err := w.Poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ready) != want || (want == 1 && ready[0] != name) {
+			t.Fatalf("got %v; want %d ready", ready, want)
+		}
+	}
+	poll(0) // first seen
+	poll(1) // unchanged since last poll
+	f, _ := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte("  =                    T"))
+	f.Close()
+	poll(0) // still being written
+	poll(1)
+	if !w.Failed(name) {
+		t.Errorf("first failure: want retry")
+	}
+	poll(1)
+	if w.Failed(name) {
+		t.Errorf("second failure: want no retry")
+	}
+	poll(0)
+}
+
+func TestLive(t *testing.T) {
+	for _, inside := range []bool{false, true} { // outputs in a separate or in the watched directory
+		dir, outDir := t.TempDir(), t.TempDir()
+		if inside {
+			outDir = dir
+		}
+		rng := rand.New(rand.NewSource(4))
+		for i := 0; i < 5; i++ {
+			f := fits.NewImageFromNaxisn([]int32{64, 64}, nil)
+			for j := range f.Data {
+				f.Data[j] = 100 + float32(rng.NormFloat64())
+			}
+			if i == 3 {
+				f.Data[100] = 5000 // cosmic ray
+			}
+			f.Exposure = 30
+			if err := f.WriteFile(filepath.Join(dir, "light"+string(rune('0'+i))+".fits")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// a file cut short, as if the capture software crashed while writing it
+		data, _ := os.ReadFile(filepath.Join(dir, "light0.fits"))
+		os.WriteFile(filepath.Join(dir, "light9.fits"), data[:len(data)/2], 0644)
+
+		out, status := filepath.Join(outDir, "live.fits"), filepath.Join(outDir, "live.json")
+		post := filepath.Join(outDir, "post%d.fits")
+		rs := stack.NewRunningStack(stack.RMSigma, 3, 3)
+		l := NewLive(NewWatcher(dir, "*.fit*", 2), time.Millisecond, 50*time.Millisecond, ops.NewOpSequence(),
+			ops.NewOpSequence(ops.NewOpSave(post, ops.EMMinMax, 1)), rs, ops.NewOpSequence(ops.NewOpSave(out, ops.EMMinMax, 1)), status)
+		if err := l.Run(ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD), make(chan struct{})); err != nil {
+			t.Fatal(err)
+		}
+
+		var got Status
+		content, err := os.ReadFile(status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(content, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Frames != 5 || got.Failed != 1 || got.Exposure != 150 {
+			t.Errorf("inside %v: got status %+v; want 5 frames, 1 failed, 150s", inside, got)
+		}
+		f, err := fits.NewImageFromFile(out, 0, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(f.Data[100]-100)) > 2 {
+			t.Errorf("inside %v: got %g at cosmic ray; want about 100", inside, f.Data[100])
+		}
+	}
+}
+
+func TestReferenceMode(t *testing.T) {
+	for mode, want := range map[string]string{"%starsHFR": "0", "%location": "0", "3": "0", "ref.fits": "ref.fits"} {
+		if got := ReferenceMode(mode); got != want {
+			t.Errorf("%s: got %s; want %s", mode, got, want)
+		}
+	}
+}
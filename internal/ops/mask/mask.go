@@ -0,0 +1,358 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Masks select the parts of an image an operator applies to. A mask is a single-channel image of the same
+// width and height as the image, with values from 0=unselected to 1=selected. Mask operators turn an image
+// into a mask, or modify a given mask. Save masks as FITS with the regular save operator
+package mask
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/stretch"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a new empty mask for the given image
+func newMask(f *fits.Image) *fits.Image {
+	m := fits.NewImageFromNaxisn(f.Naxisn[:2], nil)
+	m.ID, m.FileName = f.ID, f.FileName
+	return m
+}
+
+// Creates a mask of the detected stars, with disks whose radius scales with the half-flux radius of each star
+type OpStarMask struct {
+	ops.OpUnaryBase
+	HFRFactor float32 `json:"hfrFactor"` // disk radius in multiples of the star's HFR
+	MinRadius float32 `json:"minRadius"` // minimum disk radius in pixels
+}
+
+var _ ops.Operator = (*OpStarMask)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpStarMaskDefault() }) } // register the operator for JSON decoding
+
+func NewOpStarMaskDefault() *OpStarMask { return NewOpStarMask(3, 2) }
+
+func NewOpStarMask(hfrFactor, minRadius float32) *OpStarMask {
+	op := &OpStarMask{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "starMask"}},
+		HFRFactor:   hfrFactor,
+		MinRadius:   minRadius,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpStarMask) UnmarshalJSON(data []byte) error {
+	type defaults OpStarMask
+	def := defaults(*NewOpStarMaskDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpStarMask(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpStarMask) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if len(f.Stars) == 0 {
+		fmt.Fprintf(c.Log, "%d: Warning: no stars detected, star mask is empty\n", f.ID)
+	}
+	m := newMask(f)
+	width, height := m.Naxisn[0], m.Naxisn[1]
+	for _, s := range f.Stars {
+		hfr := s.HFR
+		if hfr <= 0 {
+			hfr = f.HFR
+		}
+		r := op.HFRFactor * hfr
+		if r < op.MinRadius {
+			r = op.MinRadius
+		}
+		xMin, xMax := int32(math.Max(0, math.Floor(float64(s.X-r)))), int32(math.Min(float64(width-1), math.Ceil(float64(s.X+r))))
+		yMin, yMax := int32(math.Max(0, math.Floor(float64(s.Y-r)))), int32(math.Min(float64(height-1), math.Ceil(float64(s.Y+r))))
+		for y := yMin; y <= yMax; y++ {
+			for x := xMin; x <= xMax; x++ {
+				if dx, dy := float32(x)-s.X, float32(y)-s.Y; dx*dx+dy*dy <= r*r {
+					m.Data[y*width+x] = 1
+				}
+			}
+		}
+	}
+	fmt.Fprintf(c.Log, "%d: Star mask of %d stars covers %.2f%% of the image\n", f.ID, len(f.Stars), m.Stats.Mean()*100)
+	return m, nil
+}
+
+// Unit for the bounds of a range mask
+type RangeUnit int
+
+const (
+	RUFraction RangeUnit = iota // fraction of the range from minimum to maximum
+	RUSigma                     // standard deviations above the background location
+)
+
+// Creates a mask of the pixels whose luminance lies within a range, with smooth transitions at the bounds
+type OpRangeMask struct {
+	ops.OpUnaryBase
+	Unit      RangeUnit `json:"unit"`
+	Low       float32   `json:"low"`       // lower bound of the range
+	High      float32   `json:"high"`      // upper bound of the range, <=low for none
+	Fuzziness float32   `json:"fuzziness"` // width of the transitions centered on the bounds, 0=hard edges
+	Channel   int       `json:"channel"`   // channel of color images holding the luminance, e.g. 2 for HSLuv. -1=mean of all channels
+}
+
+var _ ops.Operator = (*OpRangeMask)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpRangeMaskDefault() }) } // register the operator for JSON decoding
+
+func NewOpRangeMaskDefault() *OpRangeMask { return NewOpRangeMask(RUFraction, 0.5, 0, 0.1, -1) }
+
+func NewOpRangeMask(unit RangeUnit, low, high, fuzziness float32, channel int) *OpRangeMask {
+	op := &OpRangeMask{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "rangeMask"}},
+		Unit:        unit,
+		Low:         low,
+		High:        high,
+		Fuzziness:   fuzziness,
+		Channel:     channel,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpRangeMask) UnmarshalJSON(data []byte) error {
+	type defaults OpRangeMask
+	def := defaults(*NewOpRangeMaskDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpRangeMask(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpRangeMask) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	m := newMask(f)
+	lum, err := luminance(f, op.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	// express the luminance in the unit of the bounds
+	st := stats.NewStats(lum, m.Naxisn[0])
+	var offset, scale float32
+	switch op.Unit {
+	case RUFraction:
+		offset, scale = st.Min(), st.Max()-st.Min()
+	case RUSigma:
+		offset, scale = st.Location(), st.Scale()
+	default:
+		return nil, fmt.Errorf("invalid range mask unit %d", op.Unit)
+	}
+	if scale <= 0 {
+		return nil, fmt.Errorf("%d: cannot create range mask for an image without contrast", f.ID)
+	}
+
+	for i, v := range lum {
+		if math.IsNaN(float64(v)) {
+			continue
+		}
+		t := (v - offset) / scale
+		mv := ramp(t, op.Low, op.Fuzziness)
+		if op.High > op.Low {
+			mv *= 1 - ramp(t, op.High, op.Fuzziness)
+		}
+		m.Data[i] = mv
+	}
+	fmt.Fprintf(c.Log, "%d: Range mask covers %.2f%% of the image\n", f.ID, m.Stats.Mean()*100)
+	return m, nil
+}
+
+// Rises smoothly from 0 to 1 across a transition of the given width centered on the bound, or steps if width is 0
+func ramp(t, bound, width float32) float32 {
+	if width <= 0 {
+		if t >= bound {
+			return 1
+		}
+		return 0
+	}
+	x := (t-bound)/width + 0.5
+	if x <= 0 {
+		return 0
+	} else if x >= 1 {
+		return 1
+	}
+	return x * x * (3 - 2*x) // smoothstep
+}
+
+// Returns the luminance of the given image: the data of single channel images, the given channel of multi-channel
+// images, or the mean of all channels if the channel is negative
+func luminance(f *fits.Image, channel int) ([]float32, error) {
+	if len(f.Naxisn) < 3 {
+		return f.Data, nil
+	}
+	numCh := int(f.Naxisn[2])
+	plane := len(f.Data) / numCh
+	if channel >= numCh {
+		return nil, fmt.Errorf("%d: luminance channel %d out of range for %d channels", f.ID, channel, numCh)
+	} else if channel >= 0 {
+		return f.Data[channel*plane : (channel+1)*plane], nil
+	}
+	lum := make([]float32, plane)
+	for ch := 0; ch < numCh; ch++ {
+		for i, v := range f.Data[ch*plane : (ch+1)*plane] {
+			lum[i] += v / float32(numCh)
+		}
+	}
+	return lum, nil
+}
+
+// Blurs a mask with a gaussian filter, e.g. to soften its edges
+type OpMaskBlur struct {
+	ops.OpUnaryBase
+	Sigma float32 `json:"sigma"` // standard deviation of the gaussian in pixels, 0=no op
+}
+
+var _ ops.Operator = (*OpMaskBlur)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpMaskBlurDefault() }) } // register the operator for JSON decoding
+
+func NewOpMaskBlurDefault() *OpMaskBlur { return NewOpMaskBlur(2) }
+
+func NewOpMaskBlur(sigma float32) *OpMaskBlur {
+	op := &OpMaskBlur{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "maskBlur"}},
+		Sigma:       sigma,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpMaskBlur) UnmarshalJSON(data []byte) error {
+	type defaults OpMaskBlur
+	def := defaults(*NewOpMaskBlurDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpMaskBlur(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpMaskBlur) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Sigma <= 0 {
+		return f, nil
+	}
+	plane := int(f.Naxisn[0] * f.Naxisn[1])
+	for from := 0; from < len(f.Data); from += plane {
+		stretch.GaussianBlur(f.Data[from:from+plane], int(f.Naxisn[0]), op.Sigma)
+	}
+	f.Stats.Clear()
+	return f, nil
+}
+
+// Inverts a mask, selecting what was unselected and vice versa
+type OpMaskInvert struct {
+	ops.OpUnaryBase
+}
+
+var _ ops.Operator = (*OpMaskInvert)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpMaskInvertDefault() }) } // register the operator for JSON decoding
+
+func NewOpMaskInvertDefault() *OpMaskInvert { return NewOpMaskInvert() }
+
+func NewOpMaskInvert() *OpMaskInvert {
+	op := &OpMaskInvert{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "maskInvert"}},
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpMaskInvert) UnmarshalJSON(data []byte) error {
+	type defaults OpMaskInvert
+	def := defaults(*NewOpMaskInvertDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpMaskInvert(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpMaskInvert) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	for i, v := range f.Data {
+		f.Data[i] = 1 - v
+	}
+	f.Stats.Clear()
+	return f, nil
+}
+
+// Loads a mask from a FITS file in place of the given image, which must have the same width and height
+type OpMaskLoad struct {
+	ops.OpUnaryBase
+	FileName string `json:"fileName"`
+}
+
+var _ ops.Operator = (*OpMaskLoad)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpMaskLoadDefault() }) } // register the operator for JSON decoding
+
+func NewOpMaskLoadDefault() *OpMaskLoad { return NewOpMaskLoad("") }
+
+func NewOpMaskLoad(fileName string) *OpMaskLoad {
+	op := &OpMaskLoad{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "maskLoad"}},
+		FileName:    fileName,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpMaskLoad) UnmarshalJSON(data []byte) error {
+	type defaults OpMaskLoad
+	def := defaults(*NewOpMaskLoadDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpMaskLoad(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpMaskLoad) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	promises, err := ops.NewOpLoad(f.ID, op.FileName).MakePromises(nil, c)
+	if err != nil {
+		return nil, err
+	}
+	m, err := promises[0]()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Naxisn) < 2 || m.Naxisn[0] != f.Naxisn[0] || m.Naxisn[1] != f.Naxisn[1] {
+		return nil, fmt.Errorf("%d: mask %s has size %v, image has %v", f.ID, op.FileName, m.Naxisn, f.Naxisn)
+	}
+	return m, nil
+}
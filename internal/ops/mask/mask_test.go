@@ -0,0 +1,180 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mask
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a gradient image from 0 at the left to 1 at the right border, with the given stars
+func newTestImage(width, height int32, stars []star.Star) *fits.Image {
+	f := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			f.Data[y*width+x] = float32(x) / float32(width-1)
+		}
+	}
+	f.ID, f.Stars, f.HFR = 3, stars, 2
+	return f
+}
+
+func TestMasks(t *testing.T) {
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	f := newTestImage(64, 32, []star.Star{{X: 10, Y: 10, HFR: 2}, {X: 40, Y: 20}})
+
+	// star disks scale with the HFR of each star, falling back to the image HFR
+	m, err := NewOpStarMask(3, 2).Apply(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != f.ID || len(m.Naxisn) != 2 || m.Naxisn[0] != 64 || m.Naxisn[1] != 32 {
+		t.Fatalf("got mask %d of size %v", m.ID, m.Naxisn)
+	}
+	for _, p := range []struct {
+		x, y int32
+		want float32
+	}{{10, 10, 1}, {16, 10, 1}, {17, 10, 0}, {10, 16, 1}, {40, 26, 1}, {40, 27, 0}, {30, 5, 0}} {
+		if got := m.Data[p.y*64+p.x]; got != p.want {
+			t.Errorf("star mask at %d,%d is %g; want %g", p.x, p.y, got, p.want)
+		}
+	}
+
+	// luminance range selection with hard and fuzzy edges
+	m, err = NewOpRangeMask(RUFraction, 0.25, 0.75, 0, -1).Apply(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := int32(0); x < 64; x++ {
+		v := float32(x) / 63
+		want := float32(0)
+		if v >= 0.25 && v < 0.75 {
+			want = 1
+		}
+		if got := m.Data[5*64+x]; got != want {
+			t.Errorf("range mask at x=%d with value %g is %g; want %g", x, v, got, want)
+		}
+	}
+	m, err = NewOpRangeMask(RUFraction, 0.5, 0, 0.2, -1).Apply(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Data[0] != 0 || m.Data[63] != 1 || !(m.Data[31] < 0.5 && m.Data[32] > 0.5) || !(m.Data[30] > 0 && m.Data[34] < 1) {
+		t.Errorf("fuzzy range mask is %v", m.Data[:64])
+	}
+
+	// invert and blur
+	if m, err = NewOpMaskInvert().Apply(m, c); err != nil || m.Data[0] != 1 || m.Data[63] != 0 {
+		t.Errorf("inverted mask is %v, %v", m.Data[:64], err)
+	}
+	m, _ = NewOpStarMask(3, 2).Apply(f, c)
+	sum := m.Stats.Mean()
+	if m, err = NewOpMaskBlur(2).Apply(m, c); err != nil || m.Data[10*64+16] <= 0 || m.Data[10*64+16] >= 1 || m.Data[10*64+18] <= 0 {
+		t.Errorf("blurred star mask edge is %v, %v", m.Data[10*64+14:10*64+20], err)
+	}
+	if math.Abs(float64(m.Stats.Mean()-sum)) > 0.01*float64(sum) {
+		t.Errorf("blurring changed the mask mean from %g to %g", sum, m.Stats.Mean())
+	}
+}
+
+func TestMasked(t *testing.T) {
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	f := newTestImage(64, 32, nil)
+	orig := append([]float32(nil), f.Data...)
+
+	// invert the image through a fuzzy mask selecting its right half, with the operator given as JSON
+	op := ops.NewOpSequence()
+	job := `{"type":"seq", "steps":[{"type":"masked", "mask":{"type":"seq", "steps":[{"type":"rangeMask", "low":0.5, "fuzziness":0.2}]},
+		"steps":{"type":"seq", "steps":[{"type":"maskInvert"}]}}]}`
+	if err := json.Unmarshal([]byte(job), op); err != nil {
+		t.Fatal(err)
+	}
+	outs, err := op.MakePromises([]ops.Promise{func() (*fits.Image, error) { return f, nil }}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := outs[0]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := NewOpRangeMask(RUFraction, 0.5, 0, 0.2, -1).Apply(newTestImage(64, 32, nil), c)
+	for i, o := range orig {
+		if want := m.Data[i]*(1-o) + (1-m.Data[i])*o; math.Abs(float64(got.Data[i]-want)) > 1e-6 {
+			t.Fatalf("pixel %d is %g; want %g", i, got.Data[i], want)
+		}
+	}
+
+	// a single-channel mask applies to all channels, and hues blend along the shorter arc
+	hsl := fits.NewImageFromNaxisn([]int32{2, 1, 3}, []float32{350, 350, 0.5, 0.5, 0.2, 0.2})
+	shift := &ops.OpUnaryBase{OpBase: ops.OpBase{Type: "shift"}}
+	shift.Apply = func(f *fits.Image, c *ops.Context) (*fits.Image, error) {
+		f.Data[0], f.Data[1], f.Data[2], f.Data[3], f.Data[4], f.Data[5] = 30, 30, 0.9, 0.9, 0.6, 0.6
+		return f, nil
+	}
+	half := &ops.OpUnaryBase{OpBase: ops.OpBase{Type: "half"}}
+	half.Apply = func(f *fits.Image, c *ops.Context) (*fits.Image, error) {
+		m := fits.NewImageFromNaxisn(f.Naxisn[:2], []float32{0.5, 0})
+		return m, nil
+	}
+	got, err = NewOpMasked(ops.NewOpSequence(half), ops.NewOpSequence(shift), 0).Apply(hsl, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float32{10, 350, 0.7, 0.5, 0.4, 0.2}
+	for i := range want {
+		if math.Abs(float64(got.Data[i]-want[i])) > 1e-5 {
+			t.Fatalf("got %v; want %v", got.Data, want)
+		}
+	}
+}
+
+func TestMaskSaveLoad(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil { // loading is restricted to relative paths
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	f := newTestImage(64, 32, []star.Star{{X: 10, Y: 10, HFR: 2}})
+	if _, err = applyUnary(ops.NewOpSequence(NewOpStarMask(3, 2), ops.NewOpSave("mask%d.fits", ops.EMMinMax, 1)), f, c); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewOpStarMask(3, 2).Apply(f, c)
+	got, err := NewOpMaskLoad("mask3.fits").Apply(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want.Data {
+		if got.Data[i] != want.Data[i] {
+			t.Fatalf("loaded mask pixel %d is %g; want %g", i, got.Data[i], want.Data[i])
+		}
+	}
+	if _, err = NewOpMaskLoad("mask3.fits").Apply(newTestImage(32, 32, nil), c); err == nil {
+		t.Error("loaded a mask of a different size")
+	}
+}
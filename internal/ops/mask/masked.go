@@ -0,0 +1,130 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mask
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// Applies unary operators through a mask. Creates the mask from a copy of the image, applies the steps to the
+// image, and blends processed and original pixels by mask value. A single-channel mask applies to all channels
+type OpMasked struct {
+	ops.OpUnaryBase
+	Mask       *ops.OpSequence `json:"mask"`       // unary operators creating the mask from the image
+	Steps      *ops.OpSequence `json:"steps"`      // unary operators to apply through the mask
+	HueChannel int             `json:"hueChannel"` // channel holding a hue in degrees, blended along the shorter arc, e.g. 0 for HSLuv. -1=none
+}
+
+var _ ops.Operator = (*OpMasked)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpMaskedDefault() }) } // register the operator for JSON decoding
+
+func NewOpMaskedDefault() *OpMasked { return NewOpMasked(ops.NewOpSequence(), ops.NewOpSequence(), -1) }
+
+func NewOpMasked(mask, steps *ops.OpSequence, hueChannel int) *OpMasked {
+	op := &OpMasked{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "masked"}},
+		Mask:        mask,
+		Steps:       steps,
+		HueChannel:  hueChannel,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpMasked) UnmarshalJSON(data []byte) error {
+	type defaults OpMasked
+	def := defaults(*NewOpMaskedDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpMasked(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpMasked) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Steps == nil || len(op.Steps.Steps) == 0 {
+		return f, nil
+	}
+	if op.Mask == nil || len(op.Mask.Steps) == 0 {
+		return nil, errors.New("masked operator without steps to create the mask")
+	}
+
+	// create the mask first, as the steps may modify the image in place
+	copied := fits.NewImageFromImage(f)
+	copy(copied.Data, f.Data)
+	m, err := applyUnary(op.Mask, copied, c)
+	if err != nil {
+		return nil, err
+	}
+	width, plane := f.Naxisn[0], f.Naxisn[0]*f.Naxisn[1]
+	if len(m.Naxisn) < 2 || m.Naxisn[0] != width || (len(m.Data) != int(plane) && len(m.Data) != len(f.Data)) {
+		return nil, fmt.Errorf("%d: mask size %v does not match image size %v", f.ID, m.Naxisn, f.Naxisn)
+	}
+
+	orig := append([]float32(nil), f.Data...)
+	if result, err = applyUnary(op.Steps, f, c); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(orig) || result.Naxisn[0] != width {
+		return nil, fmt.Errorf("%d: masked operators changed the image size from %v to %v", f.ID, f.Naxisn, result.Naxisn)
+	}
+
+	// blend processed and original pixels, repeating a single-channel mask for all channels
+	hueFrom, hueTo := -1, -1
+	if op.HueChannel >= 0 {
+		hueFrom, hueTo = op.HueChannel*int(plane), (op.HueChannel+1)*int(plane)
+	}
+	for i, o := range orig {
+		mv := m.Data[i%len(m.Data)]
+		if !(mv > 0) { // also catches NaN
+			result.Data[i] = o
+			continue
+		} else if mv >= 1 {
+			continue
+		}
+		d := result.Data[i] - o
+		if i >= hueFrom && i < hueTo {
+			d = float32(math.Remainder(float64(d), 360)) // shorter arc
+			result.Data[i] = float32(math.Mod(float64(o+mv*d)+360, 360))
+			continue
+		}
+		result.Data[i] = o + mv*d
+	}
+	result.Stats.Clear()
+	fmt.Fprintf(c.Log, "%d: Applied %d operators through mask covering %.2f%% of the image\n", f.ID, len(op.Steps.Steps), m.Stats.Mean()*100)
+	return result, nil
+}
+
+// Applies the given sequence of unary operators to a single image
+func applyUnary(seq *ops.OpSequence, f *fits.Image, c *ops.Context) (*fits.Image, error) {
+	outs, err := seq.MakePromises([]ops.Promise{func() (*fits.Image, error) { return f, nil }}, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(outs) != 1 {
+		return nil, fmt.Errorf("%d: masked operators must produce one image, got %d", f.ID, len(outs))
+	}
+	return outs[0]()
+}
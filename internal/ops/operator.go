@@ -44,15 +44,17 @@ type Context struct {
 	FlatFrame       *fits.Image
 	AlignNaxisn     []int32
 	AlignStars      []star.Star
+	AlignImage      *fits.Image // copy of the reference frame, e.g. for star-less alignment. Never modified, as frames are processed in place
 	AlignHFR        float32
 	MatchHisto      *stats.Stats
 	RefFrameError   error
 	LumFrame        *fits.Image
+	Sessions        []SessionInfo // imaging sessions of the frames, if loaded per session
 
-	StatsTotal     int
-	StatsProcessed int
-	StatsFile      *os.File      `json:"-"` // the output file being written to. do not use directly
-	StatsBufWriter *bufio.Writer `json:"-"` // buffered writer for the output file. use this
+	StackWeights   map[int]float32 `json:"-"` // weights applied by stacking, by image ID
+	StatsFile      *os.File        `json:"-"` // the output file being written to. do not use directly
+	StatsBufWriter *bufio.Writer   `json:"-"` // buffered writer for the output file. use this
+	StatsFooter    func()          `json:"-"` // completes the statistics export once the frames are stacked, if set
 }
 
 func NewContext(log io.Writer, stMemory int, lsEstimatorMode stats.LSEstimatorMode) *Context {
@@ -66,6 +68,46 @@ func NewContext(log io.Writer, stMemory int, lsEstimatorMode stats.LSEstimatorMo
 	}
 }
 
+// Records the weight which stacking applied to the frame with the given ID
+func (c *Context) RecordStackWeight(id int, weight float32) {
+	if c.StackWeights == nil {
+		c.StackWeights = make(map[int]float32)
+	}
+	c.StackWeights[id] = weight
+}
+
+// Completes the statistics export, if any, after the frames have been stacked
+func (c *Context) FinishStats() {
+	if footer := c.StatsFooter; footer != nil {
+		c.StatsFooter = nil
+		footer()
+	}
+}
+
+// Returns true if the given image is the alignment reference frame, or derived from it
+func (c *Context) IsAlignReference(f *fits.Image) bool {
+	return f != nil && c.AlignImage != nil && f.ID == c.AlignImage.ID
+}
+
+// Information on an imaging session, e.g. one night with its own calibration frames.
+// Frame IDs are assigned contiguously per session
+type SessionInfo struct {
+	Name      string `json:"name"`
+	FirstID   int    `json:"firstID"`
+	NumFrames int    `json:"numFrames"`
+	Masters   int    `json:"masters"` // number of master calibration frames held for this session
+}
+
+// Returns the index of the session of the frame with the given ID, or -1 if unknown
+func (c *Context) SessionOf(id int) int {
+	for i, s := range c.Sessions {
+		if id >= s.FirstID && id < s.FirstID+s.NumFrames {
+			return i
+		}
+	}
+	return -1
+}
+
 // A promise for a FITS image. Returns a materialized image, or an error
 type Promise func() (f *fits.Image, err error)
 
@@ -311,11 +353,8 @@ func (op *OpLoadMany) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Turn filename wildcards into list of file load operators
-func (op *OpLoadMany) MakePromises(ins []Promise, c *Context) (outs []Promise, err error) {
-	if len(ins) > 0 {
-		return nil, fmt.Errorf("%s operator with non-zero input", op.Type)
-	}
+// Expands the filename wildcards into the list of files to load. The index into the list is the image ID
+func (op *OpLoadMany) FileNames(log io.Writer) (fileNames []string, err error) {
 	for _, pattern := range op.FilePatterns {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
@@ -323,19 +362,34 @@ func (op *OpLoadMany) MakePromises(ins []Promise, c *Context) (outs []Promise, e
 		}
 		for _, match := range matches {
 			if !isPathAllowed(match) {
-				fmt.Fprintf(c.Log, "Pattern match outside current directory tree, skipping\n")
+				fmt.Fprintf(log, "Pattern match outside current directory tree, skipping\n")
 				continue
 			}
-			opLoad := NewOpLoad(len(outs), match)
-			promises, err := opLoad.MakePromises(nil, c)
-			if err != nil {
-				return nil, err
-			}
-			if len(promises) != 1 {
-				return nil, fmt.Errorf("%s operator did not return exactly one promise", opLoad.Type)
-			}
-			outs = append(outs, promises[0])
+			fileNames = append(fileNames, match)
+		}
+	}
+	return fileNames, nil
+}
+
+// Turn filename wildcards into list of file load operators
+func (op *OpLoadMany) MakePromises(ins []Promise, c *Context) (outs []Promise, err error) {
+	if len(ins) > 0 {
+		return nil, fmt.Errorf("%s operator with non-zero input", op.Type)
+	}
+	fileNames, err := op.FileNames(c.Log)
+	if err != nil {
+		return nil, err
+	}
+	for id, fileName := range fileNames {
+		opLoad := NewOpLoad(id, fileName)
+		promises, err := opLoad.MakePromises(nil, c)
+		if err != nil {
+			return nil, err
+		}
+		if len(promises) != 1 {
+			return nil, fmt.Errorf("%s operator did not return exactly one promise", opLoad.Type)
 		}
+		outs = append(outs, promises[0])
 	}
 	if len(outs) == 0 {
 		return nil, fmt.Errorf("%s operator with no files to load from pattern %v", op.Type, op.FilePatterns)
@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Multi-point local alignment. Corrects residual misregistration of globally aligned frames, e.g. from
+// field distortion in the corners of wide fields or from seeing on planetary frames. Measures shifts against
+// the reference frame on a grid of alignment points, and resamples along the interpolated displacement field.
+// As part of the global alignment, frames are resampled only once along the composed transformation
+type OpAlignLocal struct {
+	ops.OpUnaryBase
+	Method   fits.LocalAlignMethod `json:"method"`   // how to measure shifts at the alignment points
+	Spacing  int32                 `json:"spacing"`  // spacing of the alignment points in pixels, 0=no op
+	MaxShift float32               `json:"maxShift"` // discard shifts larger than this many pixels as mismatches
+	Interp   fits.Interpolation    `json:"interpolation"`
+}
+
+var _ ops.Operator = (*OpAlignLocal)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpAlignLocalDefault() }) } // register the operator for JSON decoding
+
+func NewOpAlignLocalDefault() *OpAlignLocal {
+	return NewOpAlignLocal(fits.LAStars, 0, 5, fits.IPBilinear)
+}
+
+func NewOpAlignLocal(method fits.LocalAlignMethod, spacing int32, maxShift float32, interp fits.Interpolation) *OpAlignLocal {
+	op := &OpAlignLocal{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "alignLocal"}},
+		Method:      method,
+		Spacing:     spacing,
+		MaxShift:    maxShift,
+		Interp:      interp,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpAlignLocal) UnmarshalJSON(data []byte) error {
+	type defaults OpAlignLocal
+	def := defaults(*NewOpAlignLocalDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpAlignLocal(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpAlignLocal) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if f == nil || op.Spacing <= 0 || c.IsAlignReference(f) {
+		return f, nil
+	}
+	trans, err := op.measure(f, c)
+	if err != nil || trans == nil {
+		return f, err
+	}
+	return f.Project(f.Naxisn, trans, float32(math.NaN()), op.Interp, c.MaxThreads)
+}
+
+// Measures the displacement field of the globally aligned image against the reference frame. Returns the
+// transformation from image to reference coordinates, or nil if the measurement failed
+func (op *OpAlignLocal) measure(f *fits.Image, c *ops.Context) (trans star.Transformation, err error) {
+	if c.AlignImage == nil {
+		return nil, errors.New("Unable to align locally without reference frame")
+	}
+
+	field, measured, err := f.LocalShifts(c.AlignImage, c.AlignStars, op.Method, op.Spacing, op.MaxShift)
+	if err != nil {
+		fmt.Fprintf(c.Log, "%d: Local alignment failed: %s, keeping global alignment\n", f.ID, err.Error())
+		return nil, nil
+	}
+	fmt.Fprintf(c.Log, "%d: Local alignment with %d of %d points measured, field %v\n", f.ID, measured, field.Cols*field.Rows, field)
+
+	// the field maps reference to image coordinates, so projecting needs its inverse
+	return field.Inverse()
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Renders the given stars onto a noisy background, displacing them by the given distortion
+func renderDistorted(width, height int32, stars []star.Star, distort func(x, y float32) (float32, float32), rng *rand.Rand) *fits.Image {
+	f := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+	for i := range f.Data {
+		f.Data[i] = 100 + 2*float32(rng.NormFloat64())
+	}
+	for _, s := range stars {
+		dx, dy := distort(s.X, s.Y)
+		x, y := s.X+dx, s.Y+dy
+		for yy := int32(y) - 6; yy <= int32(y)+6; yy++ {
+			for xx := int32(x) - 6; xx <= int32(x)+6; xx++ {
+				if xx >= 0 && xx < width && yy >= 0 && yy < height {
+					ex, ey := float32(xx)-x, float32(yy)-y
+					f.Data[yy*width+xx] += s.Value * float32(math.Exp(float64(-(ex*ex+ey*ey)/(2*1.5*1.5))))
+				}
+			}
+		}
+	}
+	return f
+}
+
+// Returns the intensity-weighted centroid of the given box above the background
+func boxCentroid(f *fits.Image, px, py, r int32) (x, y float64) {
+	var sw, sx, sy float64
+	for yy := py - r; yy <= py+r; yy++ {
+		for xx := px - r; xx <= px+r; xx++ {
+			if w := float64(f.Data[yy*f.Naxisn[0]+xx] - 100); w > 10 {
+				sw, sx, sy = sw+w, sx+w*float64(xx), sy+w*float64(yy)
+			}
+		}
+	}
+	return sx / sw, sy / sw
+}
+
+// Returns the root mean square distance of the centroids of bright stars in the image from those in the reference
+func centroidRMS(f, ref *fits.Image, stars []star.Star) float32 {
+	sum, n := 0.0, 0
+	for _, s := range stars {
+		px, py := int32(math.Round(float64(s.X))), int32(math.Round(float64(s.Y)))
+		if s.Value < 1000 || px < 10 || py < 10 || px >= f.Naxisn[0]-10 || py >= f.Naxisn[1]-10 {
+			continue
+		}
+		x, y := boxCentroid(f, px, py, 5)
+		rx, ry := boxCentroid(ref, px, py, 5)
+		sum, n = sum+(x-rx)*(x-rx)+(y-ry)*(y-ry), n+1
+	}
+	return float32(math.Sqrt(sum / float64(n)))
+}
+
+func TestAlignLocal(t *testing.T) {
+	width, height := int32(400), int32(300)
+	rng := rand.New(rand.NewSource(5))
+	stars := make([]star.Star, 300)
+	for i := range stars {
+		amp := 300 + rng.Float32()*4000
+		stars[i] = star.Star{X: 8 + rng.Float32()*float32(width-16), Y: 8 + rng.Float32()*float32(height-16), Value: amp, Mass: amp, HFR: 1.5}
+	}
+	none := func(x, y float32) (float32, float32) { return 0, 0 }
+	distortion := func(x, y float32) (float32, float32) { // residual field distortion, largest in the corners
+		u, v := (x-float32(width)/2)/(float32(width)/2), (y-float32(height)/2)/(float32(height)/2)
+		return 2.5 * u * u, -1.5 * u * v
+	}
+
+	for _, method := range []fits.LocalAlignMethod{fits.LAStars, fits.LACorrelation} {
+		ref := renderDistorted(width, height, stars, none, rng)
+		f := renderDistorted(width, height, stars, distortion, rng)
+		f.ID = 1
+		c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+		c.AlignNaxisn, c.AlignStars, c.AlignImage = ref.Naxisn, stars, ref
+
+		before := centroidRMS(f, ref, stars)
+		res, err := NewOpAlignLocal(method, 50, 5, fits.IPBicubic).Apply(f, c)
+		if err != nil || res == nil {
+			t.Fatalf("method %d: got %v, err %v", method, res, err)
+		}
+		if after := centroidRMS(res, ref, stars); before < 0.8 || after > 0.25 {
+			t.Errorf("method %d: star position rms %.3f before and %.3f after local alignment; want >=0.8 and <=0.25", method, before, after)
+		}
+	}
+
+	// the reference frame itself and a disabled operator are no ops
+	f := renderDistorted(width, height, stars, distortion, rng)
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignImage = f
+	if res, err := NewOpAlignLocal(fits.LAStars, 50, 5, fits.IPBilinear).Apply(f, c); res != f || err != nil {
+		t.Errorf("reference frame: got %v, err %v", res, err)
+	}
+	if res, err := NewOpAlignLocal(fits.LAStars, 0, 5, fits.IPBilinear).Apply(f, c); res != f || err != nil {
+		t.Errorf("disabled: got %v, err %v", res, err)
+	}
+}
+
+func TestAlignWithLocal(t *testing.T) {
+	width, height := int32(400), int32(300)
+	rng := rand.New(rand.NewSource(7))
+	stars := make([]star.Star, 300)
+	for i := range stars {
+		amp := 300 + rng.Float32()*4000
+		stars[i] = star.Star{X: 8 + rng.Float32()*float32(width-16), Y: 8 + rng.Float32()*float32(height-16), Value: amp, Mass: amp, HFR: 1.5}
+	}
+	none := func(x, y float32) (float32, float32) { return 0, 0 }
+	shifted := func(x, y float32) (float32, float32) { // a global shift plus residual field distortion
+		u, v := (x-float32(width)/2)/(float32(width)/2), (y-float32(height)/2)/(float32(height)/2)
+		return 3 + 2.5*u*u, -2 - 1.5*u*v
+	}
+	ref := renderDistorted(width, height, stars, none, rng)
+	f := renderDistorted(width, height, stars, shifted, rng)
+	f.ID = 1
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignNaxisn, c.AlignStars, c.AlignImage = ref.Naxisn, stars, ref
+
+	// the local alignment is measured after the global one, and both are applied in a single projection
+	op := NewOpAlign(0, 1, OOBModeNaN, star.RMAffine, fits.IPBicubic, "", AMPhase, fits.Rect{}, 0.1,
+		NewOpAlignLocal(fits.LAStars, 50, 5, fits.IPBicubic))
+	res, err := op.Apply(f, c)
+	if err != nil || res == nil {
+		t.Fatalf("got %v, err %v", res, err)
+	}
+	if rms := centroidRMS(res, ref, stars); rms > 0.25 {
+		t.Errorf("star position rms %.3f after global and local alignment; want <=0.25", rms)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+// Minimum width and height of the coarsest pyramid level
+const minPyramidSize = 8
+
+// Accumulates weighted panels on a common canvas and blends them
+type blender struct {
+	sum       []float32 // weighted sum of panel values at full resolution
+	weightSum []float32 // sum of weights at full resolution
+	levels    []pyramidLevel
+}
+
+// A level of the multi-band blending pyramid, with accumulated weighted laplacians and weights
+type pyramidLevel struct {
+	width, height int32
+	sum           []float32
+	weightSum     []float32
+}
+
+func newBlender(naxisn []int32, mode BlendMode, levels int32) *blender {
+	w, h := naxisn[0], naxisn[1]
+	b := &blender{sum: make([]float32, w*h), weightSum: make([]float32, w*h)}
+	if mode == BlendMultiBand {
+		for l := int32(0); l < levels && w >= minPyramidSize && h >= minPyramidSize; l++ {
+			b.levels = append(b.levels, pyramidLevel{w, h, make([]float32, w*h), make([]float32, w*h)})
+			w, h = (w+1)/2, (h+1)/2
+		}
+	}
+	return b
+}
+
+// Adds a panel with the given per-pixel weights. Panel values with zero weight are ignored,
+// NaNs are replaced with the given fill value for building the pyramid
+func (b *blender) add(data, weights []float32, fill float32) {
+	for i, w := range weights {
+		if w > 0 {
+			b.sum[i] += w * data[i]
+			b.weightSum[i] += w
+		}
+	}
+	if len(b.levels) == 0 {
+		return
+	}
+
+	img := make([]float32, len(data))
+	for i, v := range data {
+		if weights[i] > 0 {
+			img[i] = v
+		} else {
+			img[i] = fill
+		}
+	}
+	wgt := append([]float32(nil), weights...)
+
+	for l := range b.levels {
+		level := &b.levels[l]
+		var band []float32
+		var nextImg, nextWgt []float32
+		if l+1 < len(b.levels) {
+			// laplacian band is the difference to the expanded next coarser gaussian level
+			next := b.levels[l+1]
+			nextImg = pyrDown(img, level.width, level.height)
+			nextWgt = pyrDown(wgt, level.width, level.height)
+			band = pyrUp(nextImg, next.width, next.height, level.width, level.height)
+			for i, v := range img {
+				band[i] = v - band[i]
+			}
+		} else {
+			band = img // coarsest level keeps the gaussian
+		}
+		for i, w := range wgt {
+			if w > 0 {
+				level.sum[i] += w * band[i]
+				level.weightSum[i] += w
+			}
+		}
+		img, wgt = nextImg, nextWgt
+	}
+}
+
+// Returns the blended mosaic. Pixels not covered by any panel are set to the given fill value
+func (b *blender) result(fill float32) []float32 {
+	res := make([]float32, len(b.sum))
+	if len(b.levels) == 0 {
+		for i, w := range b.weightSum {
+			if w > 0 {
+				res[i] = b.sum[i] / w
+			} else {
+				res[i] = fill
+			}
+		}
+		return res
+	}
+
+	// collapse the pyramid from the coarsest level
+	var img []float32
+	for l := len(b.levels) - 1; l >= 0; l-- {
+		level := b.levels[l]
+		if img == nil {
+			img = make([]float32, len(level.sum))
+		} else {
+			next := b.levels[l+1]
+			img = pyrUp(img, next.width, next.height, level.width, level.height)
+		}
+		for i, w := range level.weightSum {
+			if w > 0 {
+				img[i] += level.sum[i] / w
+			} else if l == len(b.levels)-1 {
+				img[i] = fill
+			}
+		}
+	}
+	for i, w := range b.weightSum {
+		if w > 0 {
+			res[i] = img[i]
+		} else {
+			res[i] = fill
+		}
+	}
+	return res
+}
+
+// Blurs the given image with a 5-tap binomial filter and subsamples it by a factor of two in each dimension.
+// Clamps at the borders
+func pyrDown(src []float32, width, height int32) []float32 {
+	dw, dh := (width+1)/2, (height+1)/2
+	tmp := make([]float32, dw*height)
+	for y := int32(0); y < height; y++ {
+		row := src[y*width : (y+1)*width]
+		for x := int32(0); x < dw; x++ {
+			sx := 2 * x
+			tmp[y*dw+x] = (row[clampIndex(sx-2, width)] + 4*row[clampIndex(sx-1, width)] + 6*row[sx] +
+				4*row[clampIndex(sx+1, width)] + row[clampIndex(sx+2, width)]) / 16
+		}
+	}
+	dst := make([]float32, dw*dh)
+	for y := int32(0); y < dh; y++ {
+		sy := 2 * y
+		r0, r1, r3, r4 := clampIndex(sy-2, height)*dw, clampIndex(sy-1, height)*dw, clampIndex(sy+1, height)*dw, clampIndex(sy+2, height)*dw
+		r2 := sy * dw
+		for x := int32(0); x < dw; x++ {
+			dst[y*dw+x] = (tmp[r0+x] + 4*tmp[r1+x] + 6*tmp[r2+x] + 4*tmp[r3+x] + tmp[r4+x]) / 16
+		}
+	}
+	return dst
+}
+
+// Expands the given image of size sw x sh to size width x height by upsampling with
+// the 5-tap binomial filter used in pyrDown. Clamps at the borders
+func pyrUp(src []float32, sw, sh, width, height int32) []float32 {
+	tmp := make([]float32, width*sh)
+	for y := int32(0); y < sh; y++ {
+		row := src[y*sw : (y+1)*sw]
+		for x := int32(0); x < width; x++ {
+			tmp[y*width+x] = expand(row[clampIndex(x/2-1, sw)], row[clampIndex(x/2, sw)], row[clampIndex(x/2+1, sw)], x)
+		}
+	}
+	dst := make([]float32, width*height)
+	for y := int32(0); y < height; y++ {
+		r0, r1, r2 := clampIndex(y/2-1, sh)*width, clampIndex(y/2, sh)*width, clampIndex(y/2+1, sh)*width
+		for x := int32(0); x < width; x++ {
+			dst[y*width+x] = expand(tmp[r0+x], tmp[r1+x], tmp[r2+x], y)
+		}
+	}
+	return dst
+}
+
+// Interpolates the expanded value at position i from the coarse values at i/2-1, i/2 and i/2+1
+func expand(prev, center, next float32, i int32) float32 {
+	if i%2 == 0 {
+		return (prev + 6*center + next) / 8
+	}
+	return (center + next) / 2
+}
+
+// Clamps the index to [0, n-1]
+func clampIndex(i, n int32) int32 {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/qsort"
+	"github.com/mlnoga/nightlight/internal/solve"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Maximum distance in pixels between the projected catalog position and a detected star to match them
+const colorCalMatchRadius = 3
+
+// Stars with aperture pixels above this fraction of the channel maximum are saturated
+const colorCalSaturation = 0.95
+
+// Calibrates the colors of a linear RGB image photometrically. Matches detected stars against catalog stars
+// with color indices, measures their flux per channel with aperture photometry, and scales the red and blue
+// channels around their background location so the median star colors match the catalog. Requires star
+// detection upstream. Images without WCS are plate solved first
+type OpColorCalibrate struct {
+	ops.OpUnaryBase
+	Solve    *OpSolve `json:"solve"`    // catalog with color indices and plate solving hints. Empty catalog=no op
+	Aperture float32  `json:"aperture"` // aperture radius for star photometry in pixels, 0=three times the HFR
+	MinStars int      `json:"minStars"` // minimum number of matched stars for a calibration
+}
+
+var _ ops.Operator = (*OpColorCalibrate)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpColorCalibrateDefault() }) } // register the operator for JSON decoding
+
+func NewOpColorCalibrateDefault() *OpColorCalibrate {
+	return NewOpColorCalibrate(NewOpSolveDefault(), 0, 10)
+}
+
+func NewOpColorCalibrate(solve *OpSolve, aperture float32, minStars int) *OpColorCalibrate {
+	op := &OpColorCalibrate{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "colorCalibrate"}},
+		Solve:       solve,
+		Aperture:    aperture,
+		MinStars:    minStars,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpColorCalibrate) UnmarshalJSON(data []byte) error {
+	type defaults OpColorCalibrate
+	def := defaults(*NewOpColorCalibrateDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpColorCalibrate(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+// Flux of a star per color channel, with the B-V color index from the catalog
+type colorCalStar struct {
+	flux fits.RGB
+	bv   float32
+}
+
+func (op *OpColorCalibrate) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Solve == nil || op.Solve.Catalog == "" {
+		return f, nil
+	}
+	if len(f.Naxisn) != 3 || f.Naxisn[2] != 3 {
+		return nil, fmt.Errorf("%d: photometric color calibration needs an RGB image, got size %v", f.ID, f.Naxisn)
+	}
+	if len(f.Stars) == 0 {
+		return nil, fmt.Errorf("%d: cannot calibrate colors without detected stars", f.ID)
+	}
+	w := f.Header.WCS()
+	if w == nil {
+		if f, err = op.Solve.Apply(f, c); err != nil {
+			return nil, err
+		}
+		if w = f.Header.WCS(); w == nil {
+			return nil, fmt.Errorf("%d: photometric color calibration needs a WCS, and plate solving failed", f.ID)
+		}
+	}
+	cat, err := loadCatalog(op.Solve.Catalog, c)
+	if err != nil {
+		return nil, err
+	}
+
+	stars, candidates := op.measureStars(f, w, cat)
+	if len(stars) < op.MinStars || len(stars) == 0 {
+		return nil, fmt.Errorf("%d: only %d of %d catalog stars with color index match unsaturated detected stars, need %d for photometric color calibration",
+			f.ID, len(stars), candidates, op.MinStars)
+	}
+
+	// fit the ratio of expected to measured flux, relative to the green channel, robustly with the median
+	ratiosR, ratiosB := make([]float32, len(stars)), make([]float32, len(stars))
+	for i, s := range stars {
+		want := fits.BVToLinearRGB(s.bv)
+		ratiosR[i] = (want.R / want.G) / (s.flux.R / s.flux.G)
+		ratiosB[i] = (want.B / want.G) / (s.flux.B / s.flux.G)
+	}
+	factors := fits.RGB{R: qsort.QSelectMedianFloat32(ratiosR), G: 1, B: qsort.QSelectMedianFloat32(ratiosB)}
+	fmt.Fprintf(c.Log, "%d: Photometric color calibration from %d of %d catalog stars, factors r=%.4f g=%.4f b=%.4f\n",
+		f.ID, len(stars), candidates, factors.R, factors.G, factors.B)
+
+	// normalize the factors to at most one, and scale each channel around its background location
+	max := float32(math.Max(float64(factors.R), math.Max(float64(factors.G), float64(factors.B))))
+	width := f.Naxisn[0]
+	locR := stats.NewStatsForChannel(f.Data, width, 0, 3).Location()
+	locG := stats.NewStatsForChannel(f.Data, width, 1, 3).Location()
+	locB := stats.NewStatsForChannel(f.Data, width, 2, 3).Location()
+	aR, aG, aB := factors.R/max, factors.G/max, factors.B/max
+	f.ScaleOffsetClampRGB(aR, locR*(1-aR), aG, locG*(1-aG), aB, locB*(1-aB))
+	return f, nil
+}
+
+// Matches the catalog stars with color index inside the image to detected stars, and measures their flux per
+// channel. Returns the stars which are unsaturated with positive flux in all channels, and the number of candidates
+func (op *OpColorCalibrate) measureStars(f *fits.Image, w *fits.WCS, cat *solve.Catalog) (stars []colorCalStar, candidates int) {
+	width, height := f.Naxisn[0], f.Naxisn[1]
+	aperture := op.Aperture
+	if aperture <= 0 {
+		aperture = 3 * f.HFR
+	}
+	if aperture < 2 {
+		aperture = 2
+	}
+	saturation := make([]float32, 3)
+	for ch := range saturation {
+		saturation[ch] = colorCalSaturation * stats.NewStatsForChannel(f.Data, width, ch, 3).Max()
+	}
+
+	// sort the detected stars by x coordinate, so the candidates for a match form a contiguous range
+	detected := append([]star.Star(nil), f.Stars...)
+	sort.Slice(detected, func(a, b int) bool { return detected[a].X < detected[b].X })
+	used := make([]bool, len(detected))
+
+	ra, dec := w.PixelToWorld(float64(width)/2, float64(height)/2)
+	radius := math.Hypot(float64(width), float64(height)) / 2 * w.PixelScale() / 3600
+	for _, cs := range cat.Cone(ra, dec, radius) { // brightest first
+		if !cs.HasBV {
+			continue
+		}
+		x64, y64, ok := w.WorldToPixel(cs.RA, cs.Dec)
+		x, y := float32(x64), float32(y64)
+		if !ok || x < 0 || y < 0 || x >= float32(width) || y >= float32(height) {
+			continue
+		}
+		candidates++
+
+		from := sort.Search(len(detected), func(j int) bool { return detected[j].X >= x-colorCalMatchRadius })
+		best, bestDsq := -1, float32(colorCalMatchRadius*colorCalMatchRadius)
+		for j := from; j < len(detected) && detected[j].X <= x+colorCalMatchRadius; j++ {
+			dx, dy := detected[j].X-x, detected[j].Y-y
+			if dsq := dx*dx + dy*dy; dsq <= bestDsq && !used[j] {
+				best, bestDsq = j, dsq
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		used[best] = true
+		if flux, ok := aperturePhotometry(f.Data, width, height, detected[best].X, detected[best].Y, aperture, saturation); ok {
+			stars = append(stars, colorCalStar{flux: flux, bv: cs.BV})
+		}
+	}
+	return stars, candidates
+}
+
+// Measures the background-subtracted flux of a star per channel in a circular aperture of the given radius
+// around the given position. The background is the median of an annulus from 1.5 to 2.5 times the radius.
+// Returns false for stars near the border, with missing or saturated pixels, or with non-positive flux
+func aperturePhotometry(data []float32, width, height int32, x, y, radius float32, saturation []float32) (flux fits.RGB, ok bool) {
+	inner, outer := 1.5*radius, 2.5*radius
+	xMin, xMax := int32(math.Floor(float64(x-outer))), int32(math.Ceil(float64(x+outer)))
+	yMin, yMax := int32(math.Floor(float64(y-outer))), int32(math.Ceil(float64(y+outer)))
+	if xMin < 0 || yMin < 0 || xMax >= width || yMax >= height {
+		return flux, false
+	}
+	plane := width * height
+	fluxes := make([]float32, 3)
+	annulus := []float32{}
+	for ch := range fluxes {
+		channel := data[int32(ch)*plane : int32(ch+1)*plane]
+		sum, n := float32(0), 0
+		annulus = annulus[:0]
+		for yy := yMin; yy <= yMax; yy++ {
+			for xx := xMin; xx <= xMax; xx++ {
+				dx, dy := float32(xx)-x, float32(yy)-y
+				dsq, v := dx*dx+dy*dy, channel[yy*width+xx]
+				if dsq <= radius*radius {
+					if math.IsNaN(float64(v)) || v >= saturation[ch] {
+						return flux, false
+					}
+					sum += v
+					n++
+				} else if dsq >= inner*inner && dsq <= outer*outer && !math.IsNaN(float64(v)) {
+					annulus = append(annulus, v)
+				}
+			}
+		}
+		if len(annulus) == 0 {
+			return flux, false
+		}
+		fluxes[ch] = sum - float32(n)*qsort.QSelectMedianFloat32(annulus)
+		if fluxes[ch] <= 0 {
+			return flux, false
+		}
+	}
+	return fits.RGB{R: fluxes[0], G: fluxes[1], B: fluxes[2]}, true
+}
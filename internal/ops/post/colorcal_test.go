@@ -0,0 +1,112 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/qsort"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates an RGB image with a WCS and stars of random color index, whose channels are scaled with the given gains.
+// Writes the stars as catalog to the given file, with colors if requested
+func newTestColorImage(t *testing.T, catalog string, withColors bool, gains fits.RGB) *fits.Image {
+	width, height := int32(256), int32(256)
+	rng := rand.New(rand.NewSource(5))
+	w := &fits.WCS{CRVAL: [2]float64{100, 20}, CRPIX: [2]float64{129, 129}, CD: [2][2]float64{{-2.0 / 3600, 0}, {0, 2.0 / 3600}}}
+	f := fits.NewImageFromNaxisn([]int32{width, height, 3}, nil)
+	f.ID, f.HFR = 1, 1.5
+	f.Header.SetWCS(w)
+	plane := width * height
+	for i := range f.Data {
+		f.Data[i] = 0.1 + 0.002*float32(rng.NormFloat64())
+	}
+
+	csv := strings.Builder{}
+	csv.WriteString("ra,dec,vmag,b-v\n")
+	for i := 0; i < 60; i++ {
+		x, y := 12+rng.Float32()*float32(width-24), 12+rng.Float32()*float32(height-24)
+		amp, bv := 0.05+rng.Float32()*0.4, rng.Float32()*1.5
+		color := fits.BVToLinearRGB(bv)
+		chAmps := []float32{amp * color.R * gains.R, amp * color.G * gains.G, amp * color.B * gains.B}
+		for ch, chAmp := range chAmps {
+			for yy := int32(y) - 8; yy <= int32(y)+8; yy++ {
+				for xx := int32(x) - 8; xx <= int32(x)+8; xx++ {
+					dx, dy := float32(xx)-x, float32(yy)-y
+					f.Data[int32(ch)*plane+yy*width+xx] += chAmp * float32(math.Exp(float64(-(dx*dx+dy*dy)/(2*1.5*1.5))))
+				}
+			}
+		}
+		f.Stars = append(f.Stars, star.Star{X: x, Y: y, Value: amp, HFR: 1.5})
+		ra, dec := w.PixelToWorld(float64(x), float64(y))
+		if withColors {
+			fmt.Fprintf(&csv, "%.8f,%.8f,%.2f,%.4f\n", ra, dec, 10-math.Log10(float64(amp)), bv)
+		} else {
+			fmt.Fprintf(&csv, "%.8f,%.8f,%.2f,\n", ra, dec, 10-math.Log10(float64(amp)))
+		}
+	}
+	if err := os.WriteFile(catalog, []byte(csv.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestColorCalibrate(t *testing.T) {
+	dir := t.TempDir()
+	catalog := filepath.Join(dir, "colors.csv")
+	f := newTestColorImage(t, catalog, true, fits.RGB{R: 0.6, G: 1, B: 1.4})
+	op := NewOpColorCalibrate(NewOpSolve(catalog, -1, 0, 5, 0), 0, 10)
+	got, err := op.Apply(f, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after calibration, the measured star colors match the catalog
+	cat, _ := loadCatalog(catalog, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+	stars, _ := op.measureStars(got, got.Header.WCS(), cat)
+	if len(stars) < 10 {
+		t.Fatalf("only %d stars measured after calibration", len(stars))
+	}
+	rs, bs := make([]float32, len(stars)), make([]float32, len(stars))
+	for i, s := range stars {
+		want := fits.BVToLinearRGB(s.bv)
+		rs[i], bs[i] = (s.flux.R/s.flux.G)/(want.R/want.G), (s.flux.B/s.flux.G)/(want.B/want.G)
+	}
+	if r, b := qsort.QSelectMedianFloat32(rs), qsort.QSelectMedianFloat32(bs); math.Abs(float64(r-1)) > 0.01 || math.Abs(float64(b-1)) > 0.01 {
+		t.Errorf("median relative star color after calibration is r=%.4f b=%.4f; want 1", r, b)
+	}
+	if loc := stats.NewStatsForChannel(got.Data, 256, 2, 3).Location(); math.Abs(float64(loc-0.1)) > 0.002 {
+		t.Errorf("blue background moved to %g; want 0.1", loc)
+	}
+
+	// a catalog without color indices fails
+	catalog = filepath.Join(dir, "nocolors.csv")
+	f = newTestColorImage(t, catalog, false, fits.RGB{R: 0.6, G: 1, B: 1.4})
+	if _, err := NewOpColorCalibrate(NewOpSolve(catalog, -1, 0, 5, 0), 0, 10).Apply(f, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)); err == nil {
+		t.Error("calibrated colors without catalog color indices")
+	}
+}
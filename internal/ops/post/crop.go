@@ -0,0 +1,126 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// Crops images to the largest axis-aligned rectangle in which at least the given fraction of frames
+// contributed to each pixel, using the coverage recorded during stacking. All inputs are cropped to the
+// same rectangle, e.g. the color channels before RGB combination, where every channel must qualify
+type OpAutoCrop struct {
+	ops.OpBase
+	MinCoverage float32 `json:"minCoverage"` // minimum fraction of frames covering each pixel, 0=no op
+}
+
+var _ ops.Operator = (*OpAutoCrop)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpAutoCropDefault() }) } // register the operator for JSON decoding
+
+func NewOpAutoCropDefault() *OpAutoCrop { return NewOpAutoCrop(0) }
+
+func NewOpAutoCrop(minCoverage float32) *OpAutoCrop {
+	return &OpAutoCrop{
+		OpBase:      ops.OpBase{Type: "autoCrop"},
+		MinCoverage: minCoverage,
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpAutoCrop) UnmarshalJSON(data []byte) error {
+	type defaults OpAutoCrop
+	def := defaults(*NewOpAutoCropDefault())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	*op = OpAutoCrop(def)
+	return nil
+}
+
+// Creates one output promise per input. The first output to be materialized materializes all inputs
+// to determine the common crop rectangle
+func (op *OpAutoCrop) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if op.MinCoverage <= 0 {
+		return ins, nil
+	}
+	if len(ins) == 0 {
+		return nil, fmt.Errorf("%s operator needs inputs", op.Type)
+	}
+
+	once, results := sync.Once{}, []*fits.Image(nil)
+	outs = make([]ops.Promise, len(ins))
+	for i := range ins {
+		i := i
+		outs[i] = func() (f *fits.Image, err error) {
+			once.Do(func() {
+				var fs []*fits.Image
+				if fs, err = ops.MaterializeAll(ins, c.MaxThreads, false); err == nil {
+					results, err = op.Apply(fs, c)
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+			if results == nil {
+				return nil, fmt.Errorf("%s operator failed on another input", op.Type)
+			}
+			f, results[i] = results[i], nil // remove reference to free memory
+			return f, nil
+		}
+	}
+	return outs, nil
+}
+
+// Crops all given images to the largest rectangle with sufficient coverage in all of them
+func (op *OpAutoCrop) Apply(fs []*fits.Image, c *ops.Context) (results []*fits.Image, err error) {
+	width, height := fs[0].Naxisn[0], fs[0].Naxisn[1]
+	coverage := make([]float32, width*height)
+	for i := range coverage {
+		coverage[i] = 1
+	}
+	for _, f := range fs {
+		if f.Naxisn[0] != width || f.Naxisn[1] != height {
+			return nil, fmt.Errorf("%d: cannot crop images of different sizes %dx%d and %dx%d", f.ID, width, height, f.Naxisn[0], f.Naxisn[1])
+		}
+		for i, v := range f.CoverageOrEstimate() {
+			if v < coverage[i] {
+				coverage[i] = v
+			}
+		}
+	}
+
+	r := fits.LargestCoveredRect(coverage, width, height, op.MinCoverage)
+	if r.Area() == 0 {
+		return nil, fmt.Errorf("no pixels with coverage of at least %.1f%% for cropping", 100*op.MinCoverage)
+	}
+	fmt.Fprintf(c.Log, "Auto-cropping %d images from %dx%d to %v with coverage of at least %.1f%%\n",
+		len(fs), width, height, r, 100*op.MinCoverage)
+
+	results = make([]*fits.Image, len(fs))
+	for i, f := range fs {
+		if results[i], err = f.Crop(r); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
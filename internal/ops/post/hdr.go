@@ -0,0 +1,254 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/stretch"
+	"github.com/mlnoga/nightlight/internal/qsort"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Method for scaling HDR inputs to a common flux unit
+type HDRScaleMode int
+
+const (
+	HDRScaleStars    HDRScaleMode = iota // Median flux ratio of stars matched between the inputs, unsaturated in both
+	HDRScaleExposure                     // Ratio of exposure times per frame
+)
+
+// Maximum distance in pixels between star positions in different inputs to match them
+const hdrMatchRadius = 2
+
+// Minimum number of matched stars for a flux ratio
+const hdrMinMatches = 3
+
+// Composes a high dynamic range image from registered stacks with different exposure times. Scales all
+// stacks to the flux unit of the longest one, and replaces its saturated regions with data from the
+// next shorter stack which is not saturated there, blending smoothly across the transitions
+type OpHDR struct {
+	ops.OpBase
+	Mode       HDRScaleMode `json:"mode"`
+	Exposures  []float32    `json:"exposures"`  // exposure per frame of each input in seconds, overriding the images if given
+	Saturation float32      `json:"saturation"` // values above this fraction of an input's maximum are saturated
+	Transition float32      `json:"transition"` // width of the blending ramp below the saturation level, as fraction of the maximum
+	Feather    float32      `json:"feather"`    // sigma of the spatial blur of the blending mask in pixels, 0=none
+}
+
+var _ ops.Operator = (*OpHDR)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpHDRDefault() }) } // register the operator for JSON decoding
+
+func NewOpHDRDefault() *OpHDR { return NewOpHDR(HDRScaleStars, nil, 0.95, 0.2, 4) }
+
+func NewOpHDR(mode HDRScaleMode, exposures []float32, saturation, transition, feather float32) *OpHDR {
+	return &OpHDR{
+		OpBase:     ops.OpBase{Type: "hdr"},
+		Mode:       mode,
+		Exposures:  exposures,
+		Saturation: saturation,
+		Transition: transition,
+		Feather:    feather,
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpHDR) UnmarshalJSON(data []byte) error {
+	type defaults OpHDR
+	def := defaults(*NewOpHDRDefault())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	*op = OpHDR(def)
+	return nil
+}
+
+func (op *OpHDR) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if len(ins) < 2 {
+		return nil, fmt.Errorf("%s operator needs at least two inputs, got %d", op.Type, len(ins))
+	}
+	out := func() (f *fits.Image, err error) {
+		fs, err := ops.MaterializeAll(ins, c.MaxThreads, false) // materialize all input promises
+		if err != nil {
+			return nil, err
+		}
+		return op.Apply(fs, c)
+	}
+	return []ops.Promise{out}, nil
+}
+
+// Composes the given registered stacks into one HDR image
+func (op *OpHDR) Apply(fs []*fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if len(fs) < 2 {
+		return nil, fmt.Errorf("need at least two stacks for HDR composition, got %d", len(fs))
+	}
+	if op.Saturation <= 0 || op.Saturation > 1 {
+		return nil, errors.New("HDR saturation level must be within (0,1]")
+	}
+	if op.Exposures != nil && len(op.Exposures) != len(fs) {
+		return nil, fmt.Errorf("got %d exposures for %d HDR stacks", len(op.Exposures), len(fs))
+	}
+	for _, f := range fs[1:] {
+		if len(f.Data) != len(fs[0].Data) || f.Naxisn[0] != fs[0].Naxisn[0] {
+			return nil, fmt.Errorf("%d: size %v differs from stack %d with %v, HDR inputs must be registered", f.ID, f.Naxisn, fs[0].ID, fs[0].Naxisn)
+		}
+	}
+
+	// determine the relative flux of each input, and sort from the shortest to the longest
+	flux, err := op.relativeFlux(fs, c)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]int, len(fs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return flux[order[a]] < flux[order[b]] })
+	longest := fs[order[len(order)-1]]
+	refLoc, refFlux := longest.Stats.Location(), flux[order[len(order)-1]]
+
+	// start with the shortest stack, and let each longer stack take over where it is not saturated
+	result = fits.NewImageFromImage(longest)
+	result.Stars, result.HFR, result.FWHM, result.Eccentricity = nil, 0, 0, 0
+	for n, i := range order {
+		f := fs[i]
+		scale, loc := refFlux/flux[i], f.Stats.Location()
+		satLevel := op.Saturation * f.Stats.Max()
+		fmt.Fprintf(c.Log, "%d: HDR relative flux %.4g scale %.4g, saturated above %.4g\n", f.ID, flux[i], scale, satLevel)
+		if n == 0 {
+			for j, v := range f.Data {
+				result.Data[j] = (v-loc)*scale + refLoc
+			}
+			continue
+		}
+		mask := op.replaceMask(f)
+		for j, v := range f.Data {
+			if m := mask[j]; m < 1 {
+				result.Data[j] = m*result.Data[j] + (1-m)*((v-loc)*scale+refLoc)
+			}
+		}
+	}
+	result.Stats.Clear()
+	return result, nil
+}
+
+// Returns the flux of each input relative to the first one
+func (op *OpHDR) relativeFlux(fs []*fits.Image, c *ops.Context) (flux []float32, err error) {
+	flux = make([]float32, len(fs))
+	switch op.Mode {
+	case HDRScaleExposure:
+		for i, f := range fs {
+			flux[i] = f.Exposure
+			if op.Exposures != nil {
+				flux[i] = op.Exposures[i]
+			}
+			if flux[i] <= 0 {
+				return nil, fmt.Errorf("%d: missing exposure information for HDR composition", f.ID)
+			}
+		}
+		for i := len(flux) - 1; i >= 0; i-- {
+			flux[i] /= flux[0]
+		}
+	case HDRScaleStars:
+		flux[0] = 1
+		for i, f := range fs[1:] {
+			ratio, matches, err := op.starFluxRatio(f, fs[0])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(c.Log, "%d: Star flux ratio %.4g to stack %d from %d matched stars\n", f.ID, ratio, fs[0].ID, matches)
+			flux[i+1] = ratio
+		}
+	default:
+		return nil, fmt.Errorf("invalid HDR scale mode %d", op.Mode)
+	}
+	return flux, nil
+}
+
+// Returns the median flux ratio of the stars in f to those in ref, with the number of matches. Only considers
+// stars at the same position in both images, with a positive flux and below the saturation level in both
+func (op *OpHDR) starFluxRatio(f, ref *fits.Image) (ratio float32, matches int, err error) {
+	if len(f.Stars) == 0 || len(ref.Stars) == 0 {
+		return 0, 0, fmt.Errorf("%d: no stars detected for the HDR flux ratio, use exposure scaling instead", f.ID)
+	}
+	fSat, refSat := op.Saturation*f.Stats.Max(), op.Saturation*ref.Stats.Max()
+
+	// sort the reference stars by x coordinate, so the candidates for a match form a contiguous range
+	refStars := append([]star.Star(nil), ref.Stars...)
+	sort.Slice(refStars, func(a, b int) bool { return refStars[a].X < refStars[b].X })
+	ratios := []float32{}
+	for _, s := range f.Stars {
+		if s.Mass <= 0 || s.Value >= fSat {
+			continue
+		}
+		from := sort.Search(len(refStars), func(j int) bool { return refStars[j].X >= s.X-hdrMatchRadius })
+		best, bestDsq := -1, float32(hdrMatchRadius*hdrMatchRadius)
+		for j := from; j < len(refStars) && refStars[j].X <= s.X+hdrMatchRadius; j++ {
+			dx, dy := refStars[j].X-s.X, refStars[j].Y-s.Y
+			if dsq := dx*dx + dy*dy; dsq <= bestDsq {
+				best, bestDsq = j, dsq
+			}
+		}
+		if best < 0 || refStars[best].Mass <= 0 || refStars[best].Value >= refSat {
+			continue
+		}
+		ratios = append(ratios, s.Mass/refStars[best].Mass)
+	}
+	if len(ratios) < hdrMinMatches {
+		return 0, len(ratios), fmt.Errorf("%d: only %d unsaturated stars match stack %d for the HDR flux ratio, use exposure scaling instead",
+			f.ID, len(ratios), ref.ID)
+	}
+	return qsort.QSelectMedianFloat32(ratios), len(ratios), nil
+}
+
+// Returns the weight per pixel of the data composed so far, as opposed to the given longer stack. The weight
+// ramps up smoothly from zero below the transition to one at the saturation level, and is feathered spatially
+func (op *OpHDR) replaceMask(f *fits.Image) []float32 {
+	max := f.Stats.Max()
+	satLevel, width := op.Saturation*max, op.Transition*max
+	mask := make([]float32, len(f.Data))
+	for i, v := range f.Data {
+		switch {
+		case math.IsNaN(float64(v)) || v >= satLevel:
+			mask[i] = 1
+		case width <= 0 || v <= satLevel-width:
+			mask[i] = 0
+		default:
+			t := (v - (satLevel - width)) / width
+			mask[i] = t * t * (3 - 2*t) // smoothstep
+		}
+	}
+	if op.Feather <= 0 {
+		return mask
+	}
+
+	// widen the mask into the surroundings, keeping saturated pixels fully replaced
+	blurred := stretch.GaussianBlur(append([]float32(nil), mask...), int(f.Naxisn[0]), op.Feather)
+	for i, b := range blurred {
+		if b > mask[i] {
+			mask[i] = b
+		}
+	}
+	return mask
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates an exposure of the given sky with the given gain, clipped at a full well of 3000
+func newTestExposure(id int, sky []float32, stars []star.Star, width int32, gain, exposure float32) *fits.Image {
+	data := make([]float32, len(sky))
+	for i, v := range sky {
+		data[i] = float32(math.Min(float64(v*gain), 3000))
+	}
+	f := fits.NewImageFromNaxisn([]int32{width, int32(len(sky)) / width}, data)
+	f.ID, f.Exposure = id, exposure
+	for _, s := range stars {
+		s.Value = float32(math.Min(float64((s.Value+100)*gain), 3000))
+		s.Mass = s.Mass * gain
+		f.Stars = append(f.Stars, s)
+	}
+	return f
+}
+
+func TestHDR(t *testing.T) {
+	width, height := int32(256), int32(256)
+	sky, stars := newTestSky(width, height, 60, rand.New(rand.NewSource(3)))
+	for i := range stars {
+		stars[i].Mass = stars[i].Value * 2 * math.Pi * 1.5 * 1.5
+	}
+
+	for _, mode := range []HDRScaleMode{HDRScaleStars, HDRScaleExposure} {
+		long := newTestExposure(1, sky, stars, width, 4, 120)
+		short := newTestExposure(0, sky, stars, width, 1, 30)
+		longSat := 0
+		for _, v := range long.Data {
+			if v >= 3000 {
+				longSat++
+			}
+		}
+		if longSat == 0 {
+			t.Fatal("long exposure not saturated")
+		}
+
+		op := NewOpHDR(mode, nil, 0.95, 0.2, 2)
+		got, err := op.Apply([]*fits.Image{long, short}, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+		if err != nil {
+			t.Fatalf("mode %d: %s", mode, err.Error())
+		}
+		for i, v := range sky {
+			if v*1 >= 0.95*3000 { // saturated in both exposures
+				continue
+			}
+			if want := 4 * v; math.Abs(float64(got.Data[i]-want)) > 0.01*float64(want) {
+				t.Fatalf("mode %d: pixel %d is %g; want %g", mode, i, got.Data[i], want)
+			}
+		}
+		if got.Stats.Max() <= 3000 {
+			t.Errorf("mode %d: got maximum %g; want saturated regions replaced with scaled short exposure", mode, got.Stats.Max())
+		}
+	}
+
+	// scaling by exposure fails without exposure information
+	long, short := newTestExposure(1, sky, stars, width, 4, 0), newTestExposure(0, sky, stars, width, 1, 0)
+	if _, err := NewOpHDR(HDRScaleExposure, nil, 0.95, 0.2, 2).Apply([]*fits.Image{long, short}, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)); err == nil {
+		t.Error("scaled by exposure without exposure information")
+	}
+	if _, err := NewOpHDR(HDRScaleExposure, []float32{120, 30}, 0.95, 0.2, 2).Apply([]*fits.Image{long, short}, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)); err != nil {
+		t.Errorf("scaling by given exposures: %s", err.Error())
+	}
+}
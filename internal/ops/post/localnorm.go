@@ -0,0 +1,210 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/pre"
+	"github.com/mlnoga/nightlight/internal/qsort"
+)
+
+// Local normalization of aligned frames against the alignment reference frame. Fits a smooth per-pixel
+// scale and offset surface, so that differing sky gradients from moon or light pollution do not integrate
+// into a blotchy background. Complements the global OpMatchHistogram, and runs after alignment
+type OpLocalNorm struct {
+	ops.OpUnaryBase
+	GridSize   int32       `json:"gridSize"`   // spacing of the normalization grid in pixels, 0=off. Larger is smoother
+	HFRFactor  float32     `json:"hfrFactor"`  // mask out stars within this multiple of their HFR
+	SaveScale  *ops.OpSave `json:"saveScale"`  // optionally save the scale map
+	SaveOffset *ops.OpSave `json:"saveOffset"` // optionally save the offset map
+	mutex      sync.Mutex  `json:"-"`
+	ref        *localNormGrid
+}
+
+var _ ops.Operator = (*OpLocalNorm)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpLocalNormDefault() }) } // register the operator for JSON decoding
+
+func NewOpLocalNormDefault() *OpLocalNorm { return NewOpLocalNorm(0, 4.0, "", "") }
+
+func NewOpLocalNorm(gridSize int32, hfrFactor float32, saveScale, saveOffset string) *OpLocalNorm {
+	op := &OpLocalNorm{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "localNorm"}},
+		GridSize:    gridSize,
+		HFRFactor:   hfrFactor,
+		SaveScale:   ops.NewOpSave(saveScale, ops.EMMinMax, 1),
+		SaveOffset:  ops.NewOpSave(saveOffset, ops.EMMinMax, 1),
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpLocalNorm) UnmarshalJSON(data []byte) error {
+	type defaults OpLocalNorm
+	def := defaults(*NewOpLocalNormDefault())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	// *op = OpLocalNorm(def) would copy the mutex, hence:
+	op.OpUnaryBase = def.OpUnaryBase
+	op.GridSize, op.HFRFactor = def.GridSize, def.HFRFactor
+	op.SaveScale, op.SaveOffset = def.SaveScale, def.SaveOffset
+	op.mutex, op.ref = sync.Mutex{}, nil
+
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+// Robust location and scale of the background per grid cell
+type localNormGrid struct {
+	loc, scale *pre.Background
+}
+
+func (op *OpLocalNorm) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if f == nil || op.GridSize <= 0 {
+		return f, nil
+	}
+
+	// the reference frame is normalized as well, as it may have been histogram matched to another frame
+	ref, err := op.reference(c)
+	if err != nil {
+		return nil, err
+	}
+	if f.Naxisn[0] != ref.loc.Width || int32(len(f.Data))/f.Naxisn[0] != ref.loc.Height {
+		return nil, fmt.Errorf("%d: frame size %v differs from the reference frame for local normalization", f.ID, f.Naxisn)
+	}
+	grid, err := op.fitGrid(f.Data, c)
+	if err != nil {
+		return nil, fmt.Errorf("%d: %s", f.ID, err.Error())
+	}
+
+	// scale and offset per cell, so that frame values map onto the reference
+	scale, offset := op.newGrid(ref.loc.Width, ref.loc.Height, c), op.newGrid(ref.loc.Width, ref.loc.Height, c)
+	nan := float32(math.NaN())
+	for i := range scale.Cells {
+		s := ref.scale.Cells[i] / grid.scale.Cells[i]
+		if grid.scale.Cells[i] <= 0 || math.IsNaN(float64(s)) || math.IsInf(float64(s), 0) {
+			scale.Cells[i], offset.Cells[i] = nan, nan
+			continue
+		}
+		scale.Cells[i], offset.Cells[i] = s, ref.loc.Cells[i]-grid.loc.Cells[i]*s
+	}
+	scale.InterpolateAndSmoothe()
+	offset.InterpolateAndSmoothe()
+	fmt.Fprintf(c.Log, "%d: Local normalization with %dx%d cells, scale [%.3g...%.3g] offset [%.3g...%.3g]\n",
+		f.ID, scale.GridCellsX, scale.GridCellsY, scale.Min, scale.Max, offset.Min, offset.Max)
+
+	scaleData, offsetData := scale.Render(), offset.Render()
+	for i, v := range f.Data {
+		f.Data[i] = v*scaleData[i] + offsetData[i] // NaNs stay NaN
+	}
+	if err = op.saveMap(op.SaveScale, f, scaleData, c); err != nil {
+		return nil, err
+	}
+	if err = op.saveMap(op.SaveOffset, f, offsetData, c); err != nil {
+		return nil, err
+	}
+	f.Stats.Clear()
+	return f, nil
+}
+
+// Returns the grid of the alignment reference frame, fitting it on first use
+func (op *OpLocalNorm) reference(c *ops.Context) (*localNormGrid, error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if op.ref != nil {
+		return op.ref, nil
+	}
+	if c.AlignImage == nil || c.AlignImage.Data == nil {
+		return nil, errors.New("missing alignment reference for local normalization")
+	}
+	ref, err := op.fitGrid(c.AlignImage.Data, c)
+	if err != nil {
+		return nil, fmt.Errorf("reference frame: %s", err.Error())
+	}
+	op.ref = ref
+	return ref, nil
+}
+
+// Creates an empty grid for the given image size, with the given spacing reduced for small images
+// so there are at least two cells in each direction, and with the reference stars masked out
+func (op *OpLocalNorm) newGrid(width, height int32, c *ops.Context) *pre.Background {
+	gridSize := op.GridSize
+	if gridSize > width/2 {
+		gridSize = width / 2
+	}
+	if gridSize > height/2 {
+		gridSize = height / 2
+	}
+	return pre.NewBackgroundGrid(width, height, gridSize, c.AlignStars, op.HFRFactor)
+}
+
+// Fits the robust location and scale of each grid cell of the given aligned image data. The median
+// estimates the location, the normalized median absolute deviation the scale. Cells with too few
+// valid pixels, e.g. outside the area covered after alignment, are interpolated from their neighbors
+func (op *OpLocalNorm) fitGrid(data []float32, c *ops.Context) (*localNormGrid, error) {
+	width := c.AlignImage.Naxisn[0]
+	height := int32(len(data)) / width
+	loc, scale := op.newGrid(width, height, c), op.newGrid(width, height, c)
+	bufSize := int32(loc.GridSpacingX+1.5) * int32(loc.GridSpacingY+1.5)
+	buffer, madBuffer := make([]float32, bufSize), make([]float32, bufSize)
+
+	valid := 0
+	nan := float32(math.NaN())
+	for y := int32(0); y < loc.GridCellsY; y++ {
+		for x := int32(0); x < loc.GridCellsX; x++ {
+			i := y*loc.GridCellsX + x
+			values := loc.GatherCell(data, x, y, buffer)
+			if len(values) < int(bufSize)/4 {
+				loc.Cells[i], scale.Cells[i] = nan, nan
+				continue
+			}
+			median := qsort.QSelectMedianFloat32(values)
+			for j, v := range values {
+				madBuffer[j] = float32(math.Abs(float64(v - median)))
+			}
+			mad := qsort.QSelectMedianFloat32(madBuffer[:len(values)])
+			loc.Cells[i], scale.Cells[i] = median, mad*1.4826 // factor normalizes MAD to Gaussian standard deviation
+			valid++
+		}
+	}
+	if valid == 0 {
+		return nil, errors.New("no grid cell with enough background pixels for local normalization")
+	}
+	loc.InterpolateAndSmoothe()
+	scale.InterpolateAndSmoothe()
+	return &localNormGrid{loc: loc, scale: scale}, nil
+}
+
+// Saves the given normalization map with the ID of the given frame, if a file pattern is set
+func (op *OpLocalNorm) saveMap(save *ops.OpSave, f *fits.Image, data []float32, c *ops.Context) error {
+	if save == nil || save.FilePattern == "" {
+		return nil
+	}
+	m := fits.NewImageFromNaxisn(f.Naxisn, data)
+	m.ID = f.ID
+	_, err := save.Apply(m, c)
+	return err
+}
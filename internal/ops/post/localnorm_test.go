@@ -0,0 +1,84 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestLocalNorm(t *testing.T) {
+	const width, height = 256, 192
+	rng := rand.New(rand.NewSource(5))
+	ref := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+	for i := range ref.Data {
+		ref.Data[i] = 100 + 10*float32(rng.NormFloat64())
+	}
+	// the same sky under a brighter, tilted gradient, partially out of bounds after alignment
+	f := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+	f.ID = 1
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			f.Data[y*width+x] = 1.2*ref.Data[y*width+x] + 30 + 0.1*float32(x) + 0.05*float32(y)
+			if x < 10 {
+				f.Data[y*width+x] = float32(math.NaN())
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignNaxisn, c.AlignImage = ref.Naxisn, ref
+	op := NewOpLocalNorm(64, 4, "", filepath.Join(dir, "offset%d.fits"))
+	res, err := op.Apply(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(float64(res.Data[5])) {
+		t.Errorf("out of bounds pixel: got %g; want NaN", res.Data[5])
+	}
+	sumAbs, n := 0.0, 0
+	for y := 32; y < height-32; y++ {
+		for x := 32; x < width-32; x++ {
+			sumAbs += math.Abs(float64(res.Data[y*width+x] - ref.Data[y*width+x]))
+			n++
+		}
+	}
+	if mae := sumAbs / float64(n); mae > 1.5 {
+		t.Errorf("mean absolute difference to reference %.3f; want below 1.5", mae)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "offset1.fits")); err != nil {
+		t.Errorf("offset map not saved: %s", err)
+	}
+
+	// the reference frame itself is left essentially unchanged
+	refCopy := fits.NewImageFromNaxisn(ref.Naxisn, append([]float32(nil), ref.Data...))
+	res, err = op.Apply(refCopy, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := math.Abs(float64(res.Data[width*height/2] - ref.Data[width*height/2])); d > 0.1 {
+		t.Errorf("reference frame changed by %g", d)
+	}
+}
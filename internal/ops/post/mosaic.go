@@ -0,0 +1,361 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Seam blending mode for mosaics
+type BlendMode int
+
+const (
+	BlendFeather   BlendMode = iota // Weighted average, with weights ramping up from the panel edges
+	BlendMultiBand                  // Laplacian pyramid blending. Blends coarse structures over wide and fine detail over narrow seams
+)
+
+// Maximum number of overlap pixels sampled for normalizing a panel against the mosaic
+const mosaicNormSamples = 256 * 1024
+
+// Maximum canvas area of a mosaic of n panels, as multiple of n squared times the reference panel area. Panels
+// overlapping their neighbors span at most n panel sizes per axis, so this leaves slack for rotated and larger panels
+const mosaicMaxAreaFactor = 2
+
+// Assembles a mosaic from panels with partial overlap. Aligns each panel to the reference frame, directly or via
+// a chain of other panels. Projects all panels into a canvas covering the union of their extents, normalizes them
+// against each other in their overlaps, and blends the seams
+type OpMosaic struct {
+	ops.OpBase
+	K         int32                  `json:"k"`
+	Threshold float32                `json:"threshold"`
+	MinMatch  float32                `json:"minMatch"` // minimum fraction of stars matching between overlapping panels
+	Model     star.RegistrationModel `json:"model"`
+	Interp    fits.Interpolation     `json:"interpolation"`
+	Normalize bool                   `json:"normalize"` // match location and scale of each panel to the mosaic in their overlap
+	Blend     BlendMode              `json:"blend"`
+	Feather   float32                `json:"feather"` // width of the blending ramp at panel edges in pixels, 0=ramp up to the panel center
+	Levels    int32                  `json:"levels"`  // number of pyramid levels for multi-band blending
+}
+
+var _ ops.Operator = (*OpMosaic)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpMosaicDefault() }) } // register the operator for JSON decoding
+
+func NewOpMosaicDefault() *OpMosaic {
+	return NewOpMosaic(50, 1.0, 0.1, star.RMAffine, fits.IPBilinear, true, BlendMultiBand, 0, 6)
+}
+
+func NewOpMosaic(k int32, threshold, minMatch float32, model star.RegistrationModel, interp fits.Interpolation,
+	normalize bool, blend BlendMode, feather float32, levels int32) *OpMosaic {
+	return &OpMosaic{
+		OpBase:    ops.OpBase{Type: "mosaic"},
+		K:         k,
+		Threshold: threshold,
+		MinMatch:  minMatch,
+		Model:     model,
+		Interp:    interp,
+		Normalize: normalize,
+		Blend:     blend,
+		Feather:   feather,
+		Levels:    levels,
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpMosaic) UnmarshalJSON(data []byte) error {
+	type defaults OpMosaic
+	def := defaults(*NewOpMosaicDefault())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	*op = OpMosaic(def)
+	return nil
+}
+
+func (op *OpMosaic) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if len(ins) == 0 {
+		return nil, fmt.Errorf("%s operator needs inputs", op.Type)
+	}
+	out := func() (f *fits.Image, err error) {
+		fs, err := ops.MaterializeAll(ins, c.MaxThreads, false) // materialize all input promises
+		if err != nil {
+			return nil, err
+		}
+		return op.Apply(fs, c)
+	}
+	return []ops.Promise{out}, nil
+}
+
+// Assembles the given panels into a mosaic. Releases the panels from the given slice as they are processed
+func (op *OpMosaic) Apply(fs []*fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if len(fs) == 0 {
+		return nil, errors.New("no panels for mosaic")
+	}
+	if op.Blend < BlendFeather || op.Blend > BlendMultiBand {
+		return nil, fmt.Errorf("invalid blend mode %d", op.Blend)
+	}
+
+	refIndex := mosaicReference(fs, c)
+	order, trans := op.alignPanels(fs, refIndex, c)
+
+	// determine the canvas covering all aligned panels, and shift its origin to zero
+	canvas, originX, originY, err := mosaicCanvas(fs, order, trans, refIndex)
+	if err != nil {
+		return nil, err
+	}
+	shift := &star.Transform2D{A: 1, B: 0, C: -originX, D: 0, E: 1, F: -originY}
+	fmt.Fprintf(c.Log, "Mosaic of %d panels on %dx%d canvas with origin (%g,%g) in coordinates of reference panel %d\n",
+		len(order), canvas[0], canvas[1], originX, originY, fs[refIndex].ID)
+
+	// project, normalize and blend the panels in order of alignment
+	refID, refHeader, fill := fs[refIndex].ID, fs[refIndex].Header, fs[refIndex].Stats.Location()
+	b := newBlender(canvas, op.Blend, op.Levels)
+	exposure := float32(0)
+	for _, i := range order {
+		f := fs[i]
+		toCanvas := star.Compose(trans[i], shift)
+		proj, err := f.Project(canvas, toCanvas, float32(math.NaN()), op.Interp, c.MaxThreads)
+		if err != nil {
+			return nil, err
+		}
+		weights, err := fits.NewImageFromNaxisn(f.Naxisn, featherWeights(f.Naxisn, op.Feather)).Project(canvas, toCanvas, 0, fits.IPBilinear, c.MaxThreads)
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range proj.Data {
+			if math.IsNaN(float64(v)) {
+				weights.Data[j] = 0
+			}
+		}
+
+		loc := f.Stats.Location()
+		if op.Normalize && i != refIndex {
+			scale, offset, overlap := b.normalization(proj.Data, weights.Data)
+			if overlap > 0 {
+				fmt.Fprintf(c.Log, "%d: Normalizing panel with scale %.4g offset %.4g from %d overlap pixels\n", f.ID, scale, offset, overlap)
+				for j, v := range proj.Data {
+					proj.Data[j] = v*scale + offset
+				}
+				loc = loc*scale + offset
+			} else {
+				fmt.Fprintf(c.Log, "%d: Warning: no overlap for normalizing panel\n", f.ID)
+			}
+		}
+
+		b.add(proj.Data, weights.Data, loc)
+		exposure += f.Exposure
+		fs[i] = nil // free memory
+	}
+
+	result = fits.NewImageFromNaxisn(canvas, b.result(fill))
+	result.ID, result.Exposure = refID, exposure
+	result.Header.CopyPointing(&refHeader)
+	return result, nil
+}
+
+// Returns the index of the panel serving as alignment reference in the context, or zero if none
+func mosaicReference(fs []*fits.Image, c *ops.Context) int {
+	if len(c.AlignStars) > 0 {
+		for i, f := range fs {
+			if len(f.Stars) == len(c.AlignStars) && &f.Stars[0] == &c.AlignStars[0] {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// A candidate alignment of one panel onto another
+type panelLink struct {
+	trans    star.Transformation
+	residual float32
+	parity   string // parity of the affine alignment, i.e. whether the panel is mirrored
+}
+
+// Determines the canvas covering the given aligned panels, in coordinates of the reference panel. Returns the
+// canvas size and its origin. Fails for panel outlines mapping to non-finite positions, and for canvases beyond
+// a sane multiple of the reference panel area, both of which indicate a bad alignment
+func mosaicCanvas(fs []*fits.Image, order []int, trans []star.Transformation, refIndex int) (canvas []int32, originX, originY float32, err error) {
+	minX, minY, maxX, maxY := float32(math.MaxFloat32), float32(math.MaxFloat32), float32(-math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, i := range order {
+		for _, p := range outline(fs[i].Naxisn) {
+			q := trans[i].Apply(p)
+			if math.IsNaN(float64(q.X)) || math.IsNaN(float64(q.Y)) || math.IsInf(float64(q.X), 0) || math.IsInf(float64(q.Y), 0) {
+				return nil, 0, 0, fmt.Errorf("%d: panel outline maps to non-finite position %v in the mosaic", fs[i].ID, q)
+			}
+			minX, minY = float32(math.Min(float64(minX), float64(q.X))), float32(math.Min(float64(minY), float64(q.Y)))
+			maxX, maxY = float32(math.Max(float64(maxX), float64(q.X))), float32(math.Max(float64(maxY), float64(q.Y)))
+		}
+	}
+	refArea := float64(fs[refIndex].Naxisn[0]) * float64(fs[refIndex].Naxisn[1])
+	maxArea := mosaicMaxAreaFactor * float64(len(order)*len(order)) * refArea
+	if area := (float64(maxX-minX) + 1) * (float64(maxY-minY) + 1); area > maxArea {
+		return nil, 0, 0, fmt.Errorf("mosaic canvas of %.0fx%.0f pixels exceeds %d times the reference panel area, check the alignment",
+			float64(maxX-minX)+1, float64(maxY-minY)+1, int(maxArea/refArea))
+	}
+	originX, originY = float32(math.Floor(float64(minX))), float32(math.Floor(float64(minY)))
+	canvas = []int32{int32(math.Ceil(float64(maxX-originX))) + 1, int32(math.Ceil(float64(maxY-originY))) + 1}
+	return canvas, originX, originY, nil
+}
+
+// Aligns all panels with the reference panel. Panels without sufficient overlap with the reference are aligned
+// to other already aligned panels, chaining their transformations. Grows the set of aligned panels greedily,
+// always accepting the link with the lowest residual next, so spurious matches lose against true overlaps.
+// Returns the indices of aligned panels in order of alignment, and the transformations from each panel into
+// reference frame coordinates
+func (op *OpMosaic) alignPanels(fs []*fits.Image, refIndex int, c *ops.Context) (order []int, trans []star.Transformation) {
+	trans = make([]star.Transformation, len(fs))
+	id := star.IdentityTransform2D()
+	trans[refIndex], order = &id, []int{refIndex}
+	links := make(map[[2]int]panelLink) // cached alignments of panel i onto panel j
+
+	for {
+		bestI, bestJ, best := -1, -1, panelLink{nil, float32(math.MaxFloat32), ""}
+		for _, j := range order {
+			var aligner *star.Aligner
+			for i, f := range fs {
+				if trans[i] != nil || len(f.Stars) == 0 || len(fs[j].Stars) == 0 {
+					continue
+				}
+				link, ok := links[[2]int{i, j}]
+				if !ok {
+					if aligner == nil {
+						aligner = star.NewAligner(fs[j].Naxisn, fs[j].Stars, op.K)
+						aligner.MinMatch = op.MinMatch
+					}
+					link = op.alignPanel(aligner, f, c)
+					links[[2]int{i, j}] = link
+				}
+				if link.trans != nil && link.residual < best.residual {
+					bestI, bestJ, best = i, j, link
+				}
+			}
+		}
+		if bestI < 0 {
+			break
+		}
+		trans[bestI] = star.Compose(best.trans, trans[bestJ])
+		order = append(order, bestI)
+		fmt.Fprintf(c.Log, "%d: Aligned to panel %d with residual %.3g parity %s\n", fs[bestI].ID, fs[bestJ].ID, best.residual, best.parity)
+	}
+	for i, f := range fs {
+		if trans[i] == nil {
+			fmt.Fprintf(c.Log, "%d: Unable to align panel to any other panel, skipping\n", f.ID)
+		}
+	}
+	return order, trans
+}
+
+// Aligns the panel with the reference stars of the given aligner. Returns a link without
+// transformation if the residual is above the threshold
+func (op *OpMosaic) alignPanel(aligner *star.Aligner, f *fits.Image, c *ops.Context) panelLink {
+	// panels share the same pixel scale even if their sizes differ, so do not rescale triangles
+	t, residual := aligner.Align(aligner.Naxisn, f.Stars, f.ID)
+	if residual > op.Threshold {
+		return panelLink{nil, residual, ""}
+	}
+	var model star.Transformation = &t
+	if op.Model != star.RMAffine {
+		refined, refinedResidual, err := aligner.Refine(f.Stars, t, op.Model)
+		if err != nil {
+			fmt.Fprintf(c.Log, "%d: Warning: %s, using affine alignment\n", f.ID, err.Error())
+		} else {
+			model, residual = refined, refinedResidual
+		}
+	}
+	return panelLink{model, residual, t.Parity()}
+}
+
+// Returns points along the outline of an image with the given size, for bounding non-affine transformations
+func outline(naxisn []int32) []star.Point2D {
+	const steps = 16
+	w, h := float32(naxisn[0]-1), float32(naxisn[1]-1)
+	ps := make([]star.Point2D, 0, 4*steps)
+	for i := 0; i < steps; i++ {
+		t := float32(i) / steps
+		ps = append(ps, star.Point2D{X: t * w, Y: 0}, star.Point2D{X: w, Y: t * h},
+			star.Point2D{X: (1 - t) * w, Y: h}, star.Point2D{X: 0, Y: (1 - t) * h})
+	}
+	return ps
+}
+
+// Creates blending weights for an image of the given size, ramping up linearly from the edges
+// over the given width in pixels. Width zero ramps up all the way to the center
+func featherWeights(naxisn []int32, width float32) []float32 {
+	w, h := naxisn[0], naxisn[1]
+	weights := make([]float32, w*h)
+	for y := int32(0); y < h; y++ {
+		dy := y + 1
+		if h-y < dy {
+			dy = h - y
+		}
+		for x := int32(0); x < w; x++ {
+			d := x + 1
+			if w-x < d {
+				d = w - x
+			}
+			if dy < d {
+				d = dy
+			}
+			v := float32(d)
+			if width > 0 && v > width {
+				v = width
+			}
+			weights[y*w+x] = v
+		}
+	}
+	return weights
+}
+
+// Returns the scale and offset to match the location and scale of the given panel to the mosaic so far,
+// in their overlap. Also returns the number of overlapping pixels
+func (b *blender) normalization(data, weights []float32) (scale, offset float32, overlap int) {
+	for j, w := range weights {
+		if w > 0 && b.weightSum[j] > 0 {
+			overlap++
+		}
+	}
+	if overlap < 16 {
+		return 1, 0, 0
+	}
+	step := (overlap + mosaicNormSamples - 1) / mosaicNormSamples
+	panel, mosaic := make([]float32, 0, overlap/step+1), make([]float32, 0, overlap/step+1)
+	k := 0
+	for j, w := range weights {
+		if w > 0 && b.weightSum[j] > 0 {
+			if k%step == 0 {
+				panel, mosaic = append(panel, data[j]), append(mosaic, b.sum[j]/b.weightSum[j])
+			}
+			k++
+		}
+	}
+	panelLoc, panelScale := stats.SigmaClippedMedianAndMAD(panel, 3, 3)
+	mosaicLoc, mosaicScale := stats.SigmaClippedMedianAndMAD(mosaic, 3, 3)
+	if panelScale <= 0 || mosaicScale <= 0 {
+		return 1, mosaicLoc - panelLoc, overlap
+	}
+	scale = mosaicScale / panelScale
+	return scale, mosaicLoc - panelLoc*scale, overlap
+}
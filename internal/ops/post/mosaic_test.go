@@ -0,0 +1,182 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a synthetic sky with noisy background 100 and Gaussian stars. Returns the sky and the star list
+func newTestSky(width, height int32, numStars int, rng *rand.Rand) ([]float32, []star.Star) {
+	sky := make([]float32, width*height)
+	for i := range sky {
+		sky[i] = 100 + 2*float32(rng.NormFloat64())
+	}
+	stars := make([]star.Star, numStars)
+	for i := range stars {
+		x, y := 5+rng.Float32()*float32(width-10), 5+rng.Float32()*float32(height-10)
+		amp := 200 + rng.Float32()*5000
+		stars[i] = star.Star{X: x, Y: y, Value: amp, HFR: 1.5}
+		for yy := int32(y) - 6; yy <= int32(y)+6; yy++ {
+			for xx := int32(x) - 6; xx <= int32(x)+6; xx++ {
+				if xx < 0 || xx >= width || yy < 0 || yy >= height {
+					continue
+				}
+				dx, dy := float32(xx)-x, float32(yy)-y
+				sky[yy*width+xx] += amp * float32(math.Exp(float64(-(dx*dx+dy*dy)/(2*1.5*1.5))))
+			}
+		}
+	}
+	return sky, stars
+}
+
+// Cuts a panel out of the sky at the given offset, applying scale and offset to the values
+func newTestPanel(id int, sky []float32, skyWidth int32, stars []star.Star, x0, y0, width, height int32, scale, offset float32) *fits.Image {
+	data := make([]float32, width*height)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			data[y*width+x] = sky[(y+y0)*skyWidth+x+x0]*scale + offset
+		}
+	}
+	f := fits.NewImageFromNaxisn([]int32{width, height}, data)
+	f.ID = id
+	for _, s := range stars {
+		s.X, s.Y = s.X-float32(x0), s.Y-float32(y0)
+		if s.X >= 3 && s.X < float32(width-3) && s.Y >= 3 && s.Y < float32(height-3) {
+			f.Stars = append(f.Stars, s)
+		}
+	}
+	sort.Slice(f.Stars, func(i, j int) bool { return f.Stars[i].Value > f.Stars[j].Value })
+	return f
+}
+
+func TestMosaicTwoPanels(t *testing.T) {
+	skyWidth, skyHeight := int32(700), int32(400)
+	sky, stars := newTestSky(skyWidth, skyHeight, 120, rand.New(rand.NewSource(7)))
+
+	for _, blend := range []BlendMode{BlendFeather, BlendMultiBand} {
+		// second panel overlaps the first by 150 pixels, with different sky brightness and gain
+		panels := []*fits.Image{
+			newTestPanel(0, sky, skyWidth, stars, 0, 0, 400, 400, 1, 0),
+			newTestPanel(1, sky, skyWidth, stars, 250, 0, 450, 400, 1.2, 50),
+		}
+		c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+		c.AlignStars = panels[0].Stars
+		op := NewOpMosaic(20, 1.0, 0.1, star.RMAffine, fits.IPBilinear, true, blend, 50, 6)
+		res, err := op.Apply(panels, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Naxisn[0] != skyWidth || res.Naxisn[1] != skyHeight {
+			t.Fatalf("blend %d: canvas %v; want [%d %d]", blend, res.Naxisn, skyWidth, skyHeight)
+		}
+
+		// the normalized mosaic must match the sky everywhere, including the overlap and the second panel
+		for _, region := range [][2]int32{{10, 240}, {260, 390}, {410, 690}} {
+			diffs := []float32{}
+			for y := int32(10); y < skyHeight-10; y++ {
+				for x := region[0]; x < region[1]; x++ {
+					diffs = append(diffs, float32(math.Abs(float64(res.Data[y*skyWidth+x]-sky[y*skyWidth+x]))))
+				}
+			}
+			sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+			if median := diffs[len(diffs)/2]; median > 2 {
+				t.Errorf("blend %d: median deviation from sky in columns %v is %g; want <= 2", blend, region, median)
+			}
+		}
+	}
+}
+
+func TestMosaicChainedAlignment(t *testing.T) {
+	skyWidth, skyHeight := int32(1000), int32(300)
+	sky, stars := newTestSky(skyWidth, skyHeight, 150, rand.New(rand.NewSource(11)))
+
+	// the last panel does not overlap the reference panel in the middle, and must be aligned via the first
+	panels := []*fits.Image{
+		newTestPanel(0, sky, skyWidth, stars, 300, 0, 400, 300, 1, 0),
+		newTestPanel(1, sky, skyWidth, stars, 100, 0, 400, 300, 1, 0),
+		newTestPanel(2, sky, skyWidth, stars, 0, 0, 250, 300, 1, 0),
+		newTestPanel(3, sky, skyWidth, stars, 600, 0, 400, 300, 1, 0),
+	}
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignStars = panels[0].Stars
+	res, err := NewOpMosaic(20, 1.0, 0.1, star.RMAffine, fits.IPBilinear, false, BlendFeather, 0, 0).Apply(panels, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Naxisn[0] != skyWidth || res.Naxisn[1] != skyHeight {
+		t.Fatalf("canvas %v; want [%d %d]", res.Naxisn, skyWidth, skyHeight)
+	}
+	for _, x := range []int32{20, 500, 980} {
+		i := 150*skyWidth + x
+		if d := res.Data[i] - sky[i]; d < -0.5 || d > 0.5 {
+			t.Errorf("at x=%d got %g; want %g", x, res.Data[i], sky[i])
+		}
+	}
+}
+
+func TestMosaicCanvas(t *testing.T) {
+	panels := []*fits.Image{fits.NewImageFromNaxisn([]int32{400, 300}, nil), fits.NewImageFromNaxisn([]int32{400, 300}, nil)}
+	panels[1].ID = 1
+	identity := star.IdentityTransform2D()
+	shifted := &star.Transform2D{A: 1, B: 0, C: 350.5, D: 0, E: 1, F: -20}
+	canvas, originX, originY, err := mosaicCanvas(panels, []int{0, 1}, []star.Transformation{&identity, shifted}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canvas[0] != 751 || canvas[1] != 320 || originX != 0 || originY != -20 {
+		t.Errorf("canvas %v with origin (%g,%g); want [751 320] with origin (0,-20)", canvas, originX, originY)
+	}
+
+	// degenerate alignments are rejected
+	for _, bad := range []star.Transformation{
+		&star.Transform2D{A: 40, B: 0, C: 0, D: 0, E: 40, F: 0},
+		&star.Homography{H: [9]float64{1, 0, 0, 0, 1, 0, -1.0 / 399, 0, 1}}, // singular at the right border,
+	} {
+		if _, _, _, err = mosaicCanvas(panels, []int{0, 1}, []star.Transformation{&identity, bad}, 0); err == nil {
+			t.Errorf("accepted canvas for alignment %v", bad)
+		}
+	}
+}
+
+func TestPyramidRoundTrip(t *testing.T) {
+	// expanding a reduced image reproduces smooth data
+	width, height := int32(37), int32(22)
+	img := make([]float32, width*height)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			img[y*width+x] = 10 + float32(x)*0.1 + float32(y)*0.05
+		}
+	}
+	down := pyrDown(img, width, height)
+	up := pyrUp(down, (width+1)/2, (height+1)/2, width, height)
+	for y := int32(4); y < height-4; y++ {
+		for x := int32(4); x < width-4; x++ {
+			if d := up[y*width+x] - img[y*width+x]; d < -1e-3 || d > 1e-3 {
+				t.Fatalf("(%d,%d): got %g want %g", x, y, up[y*width+x], img[y*width+x])
+			}
+		}
+	}
+}
@@ -102,25 +102,56 @@ const (
 	OOBModeOwnLocation        // Replace with location estimate for the current frame. Good for projecting RGB, where locations can differ
 )
 
+// Registration method for alignment
+type AlignMethod int
+
+const (
+	AMStars AlignMethod = iota // Match triangles of stars. Supports all registration models
+	AMDisc                     // Match the centroid of a planetary, lunar or solar disc. Translation only
+	AMPhase                    // Phase correlation of the frame or a region, for lunar and solar surface detail. Translation only
+)
+
 type OpAlign struct {
 	ops.OpUnaryBase
-	K         int32           `json:"k"`
-	Threshold float32         `json:"threshold"`
-	OobMode   OutOfBoundsMode `json:"oobMode"`
-	Aligner   *star.Aligner   `json:"-"`
-	mutex     sync.Mutex      `json:"-"`
+	K         int32                  `json:"k"`
+	Threshold float32                `json:"threshold"`
+	OobMode   OutOfBoundsMode        `json:"oobMode"`
+	Model     star.RegistrationModel `json:"model"` // registration model. Non-affine models refine the initial affine alignment
+	Interp    fits.Interpolation     `json:"interpolation"`
+	Catalog   string                 `json:"catalog"` // file pattern for saving the star list with reference frame coordinates as .csv, .json or DS9 .reg
+	Method    AlignMethod            `json:"method"`  // registration method. Disc and phase correlation do not need stars
+	Region    fits.Rect              `json:"region"`  // region of the reference frame for disc and phase correlation, empty=whole frame
+	MinPeak   float32                `json:"minPeak"` // skip frames whose phase correlation peak height in [0,1] is lower than this
+	Local     *OpAlignLocal          `json:"local"`   // optional local alignment, measured on the globally aligned frame
+	Aligner   *star.Aligner          `json:"-"`
+	mutex     sync.Mutex             `json:"-"`
+
+	naxisn     []int32               // reference frame size for star-less methods
+	refDisc    star.Point2D          // disc centroid in the reference frame
+	refRadius  float32               // disc radius in the reference frame
+	correlator *fits.PhaseCorrelator // phase correlator with the reference frame spectrum
 }
 
 func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpAlignDefault() }) } // register the operator for JSON decoding
 
-func NewOpAlignDefault() *OpAlign { return NewOpAlign(50, 1.0, OOBModeNaN) }
+func NewOpAlignDefault() *OpAlign {
+	return NewOpAlign(50, 1.0, OOBModeNaN, star.RMAffine, fits.IPBilinear, "", AMStars, fits.Rect{}, 0.1, nil)
+}
 
-func NewOpAlign(alignK int32, alignThreshold float32, oobMode OutOfBoundsMode) *OpAlign {
+func NewOpAlign(alignK int32, alignThreshold float32, oobMode OutOfBoundsMode, model star.RegistrationModel, interp fits.Interpolation,
+	catalogPattern string, method AlignMethod, region fits.Rect, minPeak float32, local *OpAlignLocal) *OpAlign {
 	op := &OpAlign{
 		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "align"}},
 		K:           alignK,
 		Threshold:   alignThreshold,
 		OobMode:     oobMode,
+		Model:       model,
+		Interp:      interp,
+		Catalog:     catalogPattern,
+		Method:      method,
+		Region:      region,
+		MinPeak:     minPeak,
+		Local:       local,
 	}
 	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
 	return op
@@ -147,42 +178,55 @@ func (op *OpAlign) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err
 	if err = op.init(c); err != nil {
 		return nil, err
 	} // initialize the aligner
+	if op.Method != AMStars {
+		return op.alignStarless(f, c)
+	}
 
 	// Is alignment to the reference frame required?
 	if op.K <= 0 || op.Aligner == nil || len(op.Aligner.RefStars) == 0 {
 		// Generally not required
 		f.Trans = star.IdentityTransform2D()
+		if err = ops.SaveStarCatalog(f, op.Catalog, nil, c); err != nil {
+			return nil, err
+		}
 	} else if len(op.Aligner.RefStars) == len(f.Stars) && (&op.Aligner.RefStars[0] == &f.Stars[0]) {
 		// Not required for reference frame itself
 		f.Trans = star.IdentityTransform2D()
+		if err = ops.SaveStarCatalog(f, op.Catalog, &f.Trans, c); err != nil {
+			return nil, err
+		}
 	} else if len(f.Stars) == 0 {
 		// No stars - skip alignment and warn
 		fmt.Fprintf(c.Log, "%d: No alignment stars found, skipping frame\n", f.ID)
 		return nil, nil
 	} else {
 		// Alignment is required
-		// determine out of bounds fill value
-		var outOfBounds float32
-		switch op.OobMode {
-		case OOBModeNaN:
-			outOfBounds = float32(math.NaN())
-		case OOBModeRefLocation:
-			outOfBounds = c.MatchHisto.Location()
-		case OOBModeOwnLocation:
-			outOfBounds = f.Stats.Location()
-		}
+		outOfBounds := op.outOfBounds(f, c)
 
 		// Determine alignment of the image to the reference frame
 		trans, residual := op.Aligner.Align(f.Naxisn, f.Stars, f.ID)
+		var model star.Transformation = &trans
+		if op.Model != star.RMAffine && residual <= op.Threshold {
+			// Refine the affine alignment with the selected model, falling back to affine on failure
+			refined, refinedResidual, err := op.Aligner.Refine(f.Stars, trans, op.Model)
+			if err != nil {
+				fmt.Fprintf(c.Log, "%d: Warning: %s, using affine alignment\n", f.ID, err.Error())
+			} else {
+				model, residual = refined, refinedResidual
+			}
+		}
 		if residual > op.Threshold {
 			fmt.Fprintf(c.Log, "%d: Alignment residual %g is above threshold %g, skipping frame\n", f.ID, residual, op.Threshold)
 			return nil, nil
 		}
 		f.Trans, f.Residual = trans, residual
-		fmt.Fprintf(c.Log, "%d: Transform %v; residual %.3g oob %.3g\n", f.ID, f.Trans, f.Residual, outOfBounds)
+		fmt.Fprintf(c.Log, "%d: Transform %v; residual %.3g oob %.3g parity %s\n", f.ID, model, f.Residual, outOfBounds, trans.Parity())
+		if err = ops.SaveStarCatalog(f, op.Catalog, model, c); err != nil {
+			return nil, err
+		}
 
 		// Project image into reference frame
-		f, err = f.Project(op.Aligner.Naxisn, trans, outOfBounds)
+		f, err = op.project(f, op.Aligner.Naxisn, model, outOfBounds, c)
 		if err != nil {
 			return nil, err
 		}
@@ -190,10 +234,84 @@ func (op *OpAlign) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err
 	return f, nil
 }
 
+// Aligns the image to the reference frame with the disc centroid or phase correlation. Residuals are the
+// difference in disc radius in pixels, checked against the threshold, or one minus the correlation peak height
+func (op *OpAlign) alignStarless(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if c.IsAlignReference(f) {
+		f.Trans = star.IdentityTransform2D() // not required for reference frame itself
+		return f, nil
+	}
+
+	var trans star.Transform2D
+	var residual float32
+	switch op.Method {
+	case AMDisc:
+		centroid, radius, err := f.DiscCentroid(op.Region)
+		if err != nil {
+			fmt.Fprintf(c.Log, "%d: %s, skipping frame\n", f.ID, err.Error())
+			return nil, nil
+		}
+		trans = star.Transform2D{A: 1, B: 0, C: op.refDisc.X - centroid.X, D: 0, E: 1, F: op.refDisc.Y - centroid.Y}
+		residual = float32(math.Abs(float64(radius - op.refRadius)))
+		if residual > op.Threshold {
+			fmt.Fprintf(c.Log, "%d: Alignment residual %g is above threshold %g, skipping frame\n", f.ID, residual, op.Threshold)
+			return nil, nil
+		}
+	case AMPhase:
+		var peak float32
+		trans, peak = op.correlator.Align(f)
+		if peak < op.MinPeak {
+			fmt.Fprintf(c.Log, "%d: Phase correlation peak %g is below minimum %g, skipping frame\n", f.ID, peak, op.MinPeak)
+			return nil, nil
+		}
+		residual = 1 - peak
+	}
+	f.Trans, f.Residual = trans, residual
+	outOfBounds := op.outOfBounds(f, c)
+	fmt.Fprintf(c.Log, "%d: Transform %v; residual %.3g oob %.3g\n", f.ID, trans, f.Residual, outOfBounds)
+	if err = ops.SaveStarCatalog(f, op.Catalog, &trans, c); err != nil {
+		return nil, err
+	}
+	return op.project(f, op.naxisn, &trans, outOfBounds, c)
+}
+
+// Projects the image into the reference frame with the given model. With local alignment, measures the
+// displacement field on the projected image, and projects the original image once more with the model
+// composed with the field, so pixels are interpolated only once
+func (op *OpAlign) project(f *fits.Image, naxisn []int32, model star.Transformation, outOfBounds float32, c *ops.Context) (*fits.Image, error) {
+	projected, err := f.Project(naxisn, model, outOfBounds, op.Interp, c.MaxThreads)
+	if err != nil || op.Local == nil || op.Local.Spacing <= 0 {
+		return projected, err
+	}
+	local, err := op.Local.measure(projected, c)
+	if err != nil || local == nil {
+		return projected, err
+	}
+	return f.Project(naxisn, star.Compose(model, local), outOfBounds, op.Interp, c.MaxThreads)
+}
+
+// Determines the out of bounds fill value for projecting the given image
+func (op *OpAlign) outOfBounds(f *fits.Image, c *ops.Context) float32 {
+	switch op.OobMode {
+	case OOBModeRefLocation:
+		return c.MatchHisto.Location()
+	case OOBModeOwnLocation:
+		return f.Stats.Location()
+	}
+	return float32(math.NaN())
+}
+
 func (op *OpAlign) init(c *ops.Context) error {
 	op.mutex.Lock()
 	defer op.mutex.Unlock()
-	if op.K <= 0 || op.Aligner != nil {
+	if op.Aligner != nil || op.naxisn != nil {
+		return nil
+	}
+
+	if op.Method != AMStars {
+		return op.initStarless(c) // star-less methods do not use K
+	}
+	if op.K <= 0 {
 		return nil
 	}
 
@@ -205,3 +323,27 @@ func (op *OpAlign) init(c *ops.Context) error {
 	op.Aligner = star.NewAligner(c.AlignNaxisn, c.AlignStars, op.K)
 	return nil
 }
+
+// Measures the disc or computes the spectrum of the reference frame for star-less alignment
+func (op *OpAlign) initStarless(c *ops.Context) (err error) {
+	ref := c.AlignImage
+	if ref == nil {
+		return errors.New("Unable to align without reference frame")
+	}
+	switch op.Method {
+	case AMDisc:
+		if op.refDisc, op.refRadius, err = ref.DiscCentroid(op.Region); err != nil {
+			return fmt.Errorf("reference frame %d: %s", ref.ID, err.Error())
+		}
+		fmt.Fprintf(c.Log, "Reference disc centroid %v radius %.2f\n", op.refDisc, op.refRadius)
+	case AMPhase:
+		if op.correlator, err = fits.NewPhaseCorrelator(ref, op.Region); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Log, "Phase correlation on reference region %v\n", op.correlator.Region)
+	default:
+		return fmt.Errorf("unknown alignment method %d", op.Method)
+	}
+	op.naxisn = ref.Naxisn
+	return nil
+}
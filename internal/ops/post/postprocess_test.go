@@ -0,0 +1,102 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"io"
+	"math"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a frame with a planetary disc with a bright spot, without any stars
+func newTestPlanet(id int, width, height int32, cx, cy float32) *fits.Image {
+	img := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+	img.ID = id
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			v := float32(100)
+			for sy := float32(0.125); sy < 1; sy += 0.25 {
+				for sx := float32(0.125); sx < 1; sx += 0.25 {
+					dx, dy := float32(x)-0.5+sx-cx, float32(y)-0.5+sy-cy
+					if dx*dx+dy*dy < 25*25 {
+						v += 50
+					}
+					if (dx-8)*(dx-8)+dy*dy < 4*4 {
+						v += 30
+					}
+				}
+			}
+			img.Data[y*width+x] = v
+		}
+	}
+	return img
+}
+
+func TestAlignDisc(t *testing.T) {
+	ref := newTestPlanet(0, 120, 100, 60, 50)
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignNaxisn, c.AlignImage = ref.Naxisn, ref
+	op := NewOpAlign(0, 1.0, OOBModeNaN, star.RMAffine, fits.IPBilinear, "", AMDisc, fits.Rect{}, 0.1, nil) // star-less alignment needs no K
+
+	res, err := op.Apply(ref, c)
+	if err != nil || res != ref || res.Trans != star.IdentityTransform2D() {
+		t.Fatalf("reference frame: got %v %v, err %v", res, res.Trans, err)
+	}
+
+	f := newTestPlanet(1, 120, 100, 65.5, 46.75)
+	res, err = op.Apply(f, c)
+	if err != nil || res == nil {
+		t.Fatalf("got %v, err %v", res, err)
+	}
+	if math.Abs(float64(f.Trans.C+5.5)) > 0.05 || math.Abs(float64(f.Trans.F-3.25)) > 0.05 {
+		t.Errorf("got transform %v; want translation by (-5.5, 3.25)", f.Trans)
+	}
+	if f.Residual > 0.1 {
+		t.Errorf("got residual %g; want near zero", f.Residual)
+	}
+	if v := res.Data[50*120+68]; math.Abs(float64(v-ref.Data[50*120+68])) > 1 {
+		t.Errorf("projected bright spot %g; want %g", v, ref.Data[50*120+68])
+	}
+}
+
+func TestAlignPhaseMinPeak(t *testing.T) {
+	ref := newTestPlanet(0, 128, 128, 64, 64)
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.AlignNaxisn, c.AlignImage = ref.Naxisn, ref
+
+	// the correlation peak height is checked against the minimum, not the residual threshold
+	for _, tc := range []struct {
+		threshold, minPeak float32
+		aligned            bool
+	}{{0, 0.1, true}, {1, 1.01, false}} {
+		op := NewOpAlign(0, tc.threshold, OOBModeNaN, star.RMAffine, fits.IPBilinear, "", AMPhase, fits.Rect{}, tc.minPeak, nil)
+		f := newTestPlanet(1, 128, 128, 67, 62)
+		res, err := op.Apply(f, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res != nil) != tc.aligned {
+			t.Errorf("threshold %g min peak %g: aligned=%v; want %v", tc.threshold, tc.minPeak, res != nil, tc.aligned)
+		} else if res != nil && (math.Abs(float64(f.Trans.C+3)) > 0.1 || math.Abs(float64(f.Trans.F-2)) > 0.1) {
+			t.Errorf("got transform %v; want translation by (-3, 2)", f.Trans)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/solve"
+)
+
+// Relative tolerance applied to a known pixel scale
+const solveScaleTolerance = 0.2
+
+// Plate solves images against a local star catalog and writes a TAN WCS into the header.
+// Requires star detection upstream. Hints not given explicitly are taken from the FITS header if present
+type OpSolve struct {
+	ops.OpUnaryBase
+	Catalog string  `json:"catalog"` // catalog file name, CSV or binary. Empty=no op
+	RA      float64 `json:"ra"`      // right ascension hint in degrees, negative=from header
+	Dec     float64 `json:"dec"`     // declination hint in degrees
+	Radius  float64 `json:"radius"`  // search radius around the hint in degrees, 0=whole catalog
+	Scale   float64 `json:"scale"`   // pixel scale hint in arc seconds per pixel, 0=from header or blind
+}
+
+// Catalogs loaded so far, by file name, shared by all solve operators
+var (
+	catalogsMutex sync.Mutex
+	catalogs      = map[string]*solve.Catalog{}
+)
+
+var _ ops.Operator = (*OpSolve)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpSolveDefault() }) } // register the operator for JSON decoding
+
+func NewOpSolveDefault() *OpSolve { return NewOpSolve("", -1, 0, 5, 0) }
+
+func NewOpSolve(catalog string, ra, dec, radius, scale float64) *OpSolve {
+	op := &OpSolve{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "solve"}},
+		Catalog:     catalog,
+		RA:          ra,
+		Dec:         dec,
+		Radius:      radius,
+		Scale:       scale,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpSolve) UnmarshalJSON(data []byte) error {
+	type defaults OpSolve
+	def := defaults(*NewOpSolveDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpSolve(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpSolve) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Catalog == "" {
+		return f, nil
+	}
+	cat, err := loadCatalog(op.Catalog, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Stars) == 0 {
+		return nil, fmt.Errorf("%d: cannot plate solve without detected stars", f.ID)
+	}
+
+	hint := op.hint(&f.Header, f.Naxisn[0], f.Naxisn[1])
+	sol, err := solve.Solve(cat, f.Stars, f.Naxisn[0], f.Naxisn[1], hint, c.Log)
+	if err != nil {
+		fmt.Fprintf(c.Log, "%d: Plate solving failed: %s\n", f.ID, err.Error())
+		return f, nil
+	}
+	f.Header.SetWCS(&sol.WCS)
+	ra, dec := sol.WCS.PixelToWorld(float64(f.Naxisn[0])/2, float64(f.Naxisn[1])/2)
+	fmt.Fprintf(c.Log, "%d: Solved center RA %s Dec %s, scale %.3f\"/px, rotation %.2f°, mirrored %v, %d matches with rms %.2fpx\n",
+		f.ID, formatSexagesimal(ra/15), formatSexagesimal(dec), sol.WCS.PixelScale(), sol.WCS.Rotation(), sol.WCS.Mirrored(), sol.Matches, sol.RMS)
+	return f, nil
+}
+
+// Loads the catalog with the given file name once, and returns the cached copy afterwards
+func loadCatalog(fileName string, c *ops.Context) (*solve.Catalog, error) {
+	catalogsMutex.Lock()
+	defer catalogsMutex.Unlock()
+	if cat, ok := catalogs[fileName]; ok {
+		return cat, nil
+	}
+	cat, err := solve.LoadCatalog(fileName)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.Log, "Loaded %d stars from catalog %s\n", len(cat.Stars), fileName)
+	catalogs[fileName] = cat
+	return cat, nil
+}
+
+// Combines the explicit hints with those from the header
+func (op *OpSolve) hint(h *fits.Header, width, height int32) solve.Hint {
+	hint := solve.Hint{}
+	ra, dec, scale, hasPos := headerHint(h, width, height)
+	if op.RA >= 0 {
+		ra, dec, hasPos = op.RA, op.Dec, true
+	}
+	if hasPos {
+		hint.RA, hint.Dec, hint.Radius = ra, dec, op.Radius
+	}
+	if op.Scale > 0 {
+		scale = op.Scale
+	}
+	if scale > 0 {
+		hint.ScaleLow, hint.ScaleHigh = scale*(1-solveScaleTolerance), scale*(1+solveScaleTolerance)
+	}
+	return hint
+}
+
+// Reads the approximate image center and pixel scale from the header. Uses an existing WCS if present,
+// else common pointing and optics keywords written by capture software
+func headerHint(h *fits.Header, width, height int32) (ra, dec, scale float64, hasPos bool) {
+	if w := h.WCS(); w != nil {
+		ra, dec = w.PixelToWorld(float64(width)/2, float64(height)/2)
+		return ra, dec, w.PixelScale(), true
+	}
+
+	raOk, decOk := false, false
+	if ra, raOk = h.Float64("RA"); !raOk {
+		if s, ok := h.Strings["OBJCTRA"]; ok {
+			if ra, raOk = parseSexagesimal(s); raOk {
+				ra *= 15
+			}
+		}
+	}
+	if dec, decOk = h.Float64("DEC"); !decOk {
+		if s, ok := h.Strings["OBJCTDEC"]; ok {
+			dec, decOk = parseSexagesimal(s)
+		}
+	}
+	hasPos = raOk && decOk
+
+	if s, ok := h.Float64("PIXSCALE"); ok {
+		scale = s
+	} else if s, ok := h.Float64("SCALE"); ok {
+		scale = s
+	} else if px, ok := h.Float64("XPIXSZ"); ok {
+		if fl, ok := h.Float64("FOCALLEN"); ok && fl > 0 {
+			scale = 206.265 * px / fl
+		}
+	}
+	return ra, dec, scale, hasPos
+}
+
+// Parses a sexagesimal value like "05 35 17.3" or "-05:23:28". Returns false on error
+func parseSexagesimal(s string) (v float64, ok bool) {
+	fields := strings.FieldsFunc(strings.TrimSpace(s), func(r rune) bool { return r == ' ' || r == ':' })
+	if len(fields) == 0 || len(fields) > 3 {
+		return 0, false
+	}
+	sign := 1.0
+	if strings.HasPrefix(fields[0], "-") {
+		sign = -1
+	}
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, false
+		}
+		v += math.Abs(x) / math.Pow(60, float64(i))
+	}
+	return sign * v, true
+}
+
+// Formats a value as sexagesimal with two digits for the integer part
+func formatSexagesimal(v float64) string {
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	d := math.Floor(v)
+	m := math.Floor((v - d) * 60)
+	s := (v - d - m/60) * 3600
+	return fmt.Sprintf("%s%02.0f:%02.0f:%04.1f", sign, d, m, s)
+}
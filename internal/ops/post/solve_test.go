@@ -0,0 +1,46 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+)
+
+func TestSolveHintFromHeader(t *testing.T) {
+	h := fits.NewHeader()
+	h.Strings["OBJCTRA"] = "05 35 17.3"
+	h.Strings["OBJCTDEC"] = "-05 23 28"
+	h.Floats["XPIXSZ"] = 3.76
+	h.Ints["FOCALLEN"] = 400
+
+	hint := NewOpSolveDefault().hint(&h, 100, 100)
+	if math.Abs(hint.RA-83.822083) > 1e-5 || math.Abs(hint.Dec+5.391111) > 1e-5 || hint.Radius != 5 {
+		t.Errorf("got position hint %v", hint)
+	}
+	if scale := 206.265 * 3.76 / 400; math.Abs(hint.ScaleLow-0.8*scale) > 1e-6 || math.Abs(hint.ScaleHigh-1.2*scale) > 1e-6 {
+		t.Errorf("got scale hint %v", hint)
+	}
+
+	if hint := NewOpSolve("", 10, 20, 0, 0).hint(&h, 100, 100); hint.RA != 10 || hint.Dec != 20 || hint.Radius != 0 {
+		t.Errorf("explicit hint not applied, got %v", hint)
+	}
+	if _, ok := parseSexagesimal("12:xx"); ok {
+		t.Errorf("invalid sexagesimal parsed")
+	}
+}
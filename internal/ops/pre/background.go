@@ -66,24 +66,7 @@ func (b *Background) CellsString() string {
 
 // Creates new background by fitting linear gradients to grid cells of the given image, masking out areas in given mask
 func NewBackground(src []float32, width int32, gridSpacing int32, sigma float32, backClip int32, stars []star.Star, hfrFactor float32, logWriter io.Writer) (b *Background) {
-	// Allocate space for gradient cells
-	height := int32(len(src) / int(width))
-
-	gridCellsX := (width + gridSpacing/2) / gridSpacing
-	gridCellsY := (height + gridSpacing/2) / gridSpacing
-	gridCells := gridCellsX * gridCellsY
-	gridSpacingX := float32(width) / float32(gridCellsX)
-	gridSpacingY := float32(height) / float32(gridCellsY)
-	cells := make([]float32, gridCells)
-	cellStars := make([][]star.Star, gridCells)
-
-	//LogPrintf("GridCells x %d y %d total %d GridSpacing x %.2f y %.2f\n", gridCellsX, gridCellsY, gridCells, gridSpacingX, gridSpacingY)
-	b = &Background{Width: width, Height: height, GridSpacing: gridSpacing,
-		GridSpacingX: gridSpacingX, GridSpacingY: gridSpacingY,
-		GridCellsX: gridCellsX, GridCellsY: gridCellsY, GridCells: gridCells, Cells: cells,
-		CellStars: cellStars, HFRFactor: hfrFactor}
-
-	b.binStarsIntoCells(stars)
+	b = NewBackgroundGrid(width, int32(len(src)/int(width)), gridSpacing, stars, hfrFactor)
 
 	b.init(src, sigma)
 	//LogPrintf("Sigma %f\n", sigma)
@@ -104,6 +87,28 @@ func NewBackground(src []float32, width int32, gridSpacing int32, sigma float32,
 	return b
 }
 
+// Creates a background grid with the given approximate spacing for an image of the given size, with cells
+// set to zero. Bins the given stars into the cells for masking
+func NewBackgroundGrid(width, height int32, gridSpacing int32, stars []star.Star, hfrFactor float32) (b *Background) {
+	// Allocate space for gradient cells
+	gridCellsX := (width + gridSpacing/2) / gridSpacing
+	gridCellsY := (height + gridSpacing/2) / gridSpacing
+	gridCells := gridCellsX * gridCellsY
+	gridSpacingX := float32(width) / float32(gridCellsX)
+	gridSpacingY := float32(height) / float32(gridCellsY)
+	cells := make([]float32, gridCells)
+	cellStars := make([][]star.Star, gridCells)
+
+	//LogPrintf("GridCells x %d y %d total %d GridSpacing x %.2f y %.2f\n", gridCellsX, gridCellsY, gridCells, gridSpacingX, gridSpacingY)
+	b = &Background{Width: width, Height: height, GridSpacing: gridSpacing,
+		GridSpacingX: gridSpacingX, GridSpacingY: gridSpacingY,
+		GridCellsX: gridCellsX, GridCellsY: gridCellsY, GridCells: gridCells, Cells: cells,
+		CellStars: cellStars, HFRFactor: hfrFactor}
+
+	b.binStarsIntoCells(stars)
+	return b
+}
+
 // For each grid cell, put the stars relevant for it into the respective bin
 func (b *Background) binStarsIntoCells(stars []star.Star) {
 	cs := b.CellStars
@@ -150,18 +155,8 @@ func (b *Background) init(src []float32, sigma float32) {
 
 	// For all grid cells
 	for y := int32(0); y < b.GridCellsY; y++ {
-		yStart := int32(float32(y)*b.GridSpacingY + 0.5)
-		yEnd := int32((float32(y)+1)*b.GridSpacingY + 0.5)
-		if yEnd > b.Height {
-			yEnd = b.Height
-		}
-
 		for x := int32(0); x < b.GridCellsX; x++ {
-			xStart := int32(float32(x)*b.GridSpacingX + 0.5)
-			xEnd := int32((float32(x)+1)*b.GridSpacingX + 0.5)
-			if xEnd > b.Width {
-				xEnd = b.Width
-			}
+			xStart, xEnd, yStart, yEnd := b.CellBounds(x, y)
 
 			//LogPrintf("y %d yS %d yE %d x %d xS %d xE %d \n", y, yStart, yEnd, x, xStart, xEnd)
 			// Fit linear gradient to masked source image within that cell
@@ -171,6 +166,42 @@ func (b *Background) init(src []float32, sigma float32) {
 	}
 }
 
+// Returns the pixel bounds of the grid cell with the given coordinates
+func (b *Background) CellBounds(x, y int32) (xStart, xEnd, yStart, yEnd int32) {
+	yStart = int32(float32(y)*b.GridSpacingY + 0.5)
+	yEnd = int32((float32(y)+1)*b.GridSpacingY + 0.5)
+	if yEnd > b.Height {
+		yEnd = b.Height
+	}
+	xStart = int32(float32(x)*b.GridSpacingX + 0.5)
+	xEnd = int32((float32(x)+1)*b.GridSpacingX + 0.5)
+	if xEnd > b.Width {
+		xEnd = b.Width
+	}
+	return xStart, xEnd, yStart, yEnd
+}
+
+// Gathers the pixels of the grid cell with the given coordinates into the buffer, masking out stars
+func (b *Background) GatherCell(src []float32, x, y int32, buffer []float32) []float32 {
+	xStart, xEnd, yStart, yEnd := b.CellBounds(x, y)
+	return gatherWithoutStars(src, b.Width, xStart, xEnd, yStart, yEnd, b.CellStars[y*b.GridCellsX+x], b.HFRFactor, buffer)
+}
+
+// Replaces NaN cells with interpolations of neighboring cells, then smoothes the grid.
+// Returns the number of cells replaced
+func (b *Background) InterpolateAndSmoothe() int32 {
+	numNaNs := int32(0)
+	for _, c := range b.Cells {
+		if math.IsNaN(float64(c)) {
+			numNaNs++
+		}
+	}
+	b.interpolateNaNs()
+	b.smoothe()
+	b.calculateStats()
+	return numNaNs
+}
+
 // Clips the top n entries from the background gradient
 func (b *Background) clip(n int32, logWriter io.Writer) {
 	buffer := make([]float32, b.GridCells)
@@ -191,13 +222,18 @@ func (b *Background) clip(n int32, logWriter io.Writer) {
 	b.OutlierCells = ignoredCells
 
 	// Then replace cells with interpolations
+	b.interpolateNaNs()
+	buffer = nil
+}
+
+// Replaces NaN cells with interpolations of neighboring cells, preferring cells with more valid neighbors
+func (b *Background) interpolateNaNs() {
 	for neighbors := 8; neighbors >= 0; neighbors-- {
 		numChanged := 1
 		for numChanged > 0 {
 			numChanged = interpolate(b.Cells, b.GridCellsX, b.GridCellsY, neighbors)
 		}
 	}
-	buffer = nil
 }
 
 func (b *Background) smoothe() {
@@ -263,7 +299,7 @@ func interpolate(params []float32, width, height int32, neighbors int) (numChang
 			p := params[index]
 			if math.IsNaN(float64(p)) {
 				predict, numGathered := MedianInterpolation(params, width, height, x, y, temp)
-				if numGathered >= neighbors {
+				if numGathered >= neighbors && numGathered > 0 { // cells without valid neighbors wait for a later pass
 					//LogPrintf("Replacing prediction for x%d y%d of %f with %f\n", x, y, p, predict)
 					params[index] = predict
 					numChanges++
@@ -490,7 +526,7 @@ func FitCell(src []float32, width int32, sigma float32, xStart, xEnd, yStart, yE
 	return trimmedMedian
 }
 
-// Calculates the median and the MAD of the given grid cell of the image, masking out stars
+// Gathers the pixels of the given grid cell of the image, masking out stars and skipping NaNs
 func gatherWithoutStars(src []float32, width int32, xStart, xEnd, yStart, yEnd int32, stars []star.Star, hfrFactor float32, buffer []float32) (res []float32) {
 	numSamples := 0
 	for y := yStart; y < yEnd; y++ {
@@ -507,8 +543,10 @@ func gatherWithoutStars(src []float32, width int32, xStart, xEnd, yStart, yEnd i
 			}
 
 			offset := x + y*width
-			buffer[numSamples] = src[offset]
-			numSamples++
+			if v := src[offset]; !math.IsNaN(float64(v)) {
+				buffer[numSamples] = v
+				numSamples++
+			}
 		}
 	}
 	return buffer[:numSamples]
@@ -0,0 +1,286 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pre
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/median"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Replacement mode for pixels identified as cosmic ray hits
+type CosmicRayReplaceMode int
+
+const (
+	CRReplaceMedian CosmicRayReplaceMode = iota // Replace with the local median. Safe for all subsequent operations
+	CRReplaceNaN                                // Replace with NaN. Stackers ignore NaNs, but star detection and statistics do not
+)
+
+// Single-frame cosmic ray rejection with the L.A.Cosmic algorithm.
+// Unlike OpBadPixel, which targets fixed hot and cold pixels by their deviation from
+// the local median, this detects sharp-edged hits via the Laplacian of the image, and
+// spares undersampled star cores via a fine structure criterion. Run it before debayering:
+// on CFA data, each of the four color filter phases is processed as a separate plane.
+// See P. G. van Dokkum, "Cosmic-Ray Rejection by Laplacian Edge Detection",
+// PASP 113, pp. 1420-1427, Nov. 2001.
+type OpCosmicRay struct {
+	ops.OpUnaryBase
+	Sigma      float32              `json:"sigma"`      // Detection limit for the noise-normalized Laplacian, 0=off
+	SigmaFrac  float32              `json:"sigmaFrac"`  // Fraction of sigma for including neighboring pixels
+	ObjLimit   float32              `json:"objLimit"`   // Minimum contrast of the Laplacian over the fine structure image
+	Iterations int32                `json:"iterations"` // Maximum number of detect and repair iterations
+	Replace    CosmicRayReplaceMode `json:"replace"`
+	Debayer    *OpDebayer           `json:"-"`
+}
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpCosmicRayDefaults() }) } // register the operator for JSON decoding
+
+func NewOpCosmicRayDefaults() *OpCosmicRay {
+	return NewOpCosmicRay(4.5, 0.3, 5, 4, CRReplaceMedian, nil)
+}
+
+func NewOpCosmicRay(sigma, sigmaFrac, objLimit float32, iterations int32, replace CosmicRayReplaceMode, debayer *OpDebayer) *OpCosmicRay {
+	op := &OpCosmicRay{
+		OpUnaryBase: ops.OpUnaryBase{OpBase: ops.OpBase{Type: "cosmicRay"}},
+		Sigma:       sigma,
+		SigmaFrac:   sigmaFrac,
+		ObjLimit:    objLimit,
+		Iterations:  iterations,
+		Replace:     replace,
+		Debayer:     debayer,
+	}
+	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
+	return op
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpCosmicRay) UnmarshalJSON(data []byte) error {
+	type defaults OpCosmicRay
+	def := defaults(*NewOpCosmicRayDefaults())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	*op = OpCosmicRay(def)
+	op.OpUnaryBase.Apply = op.Apply // make method receiver point to op, not def
+	return nil
+}
+
+func (op *OpCosmicRay) Apply(f *fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Sigma <= 0 || op.Iterations <= 0 {
+		return f, nil
+	}
+	if len(f.Naxisn) != 2 {
+		return nil, fmt.Errorf("%d: cosmic ray rejection requires a mono image, got %s", f.ID, f.DimensionsToString())
+	}
+
+	width := f.Naxisn[0]
+	all, iter, noise := []int32{}, int32(0), float32(0)
+	if op.Debayer == nil || op.Debayer.Channel == "" {
+		all, iter, noise = op.reject(f.Data, width)
+	} else {
+		// process each phase of the color filter array as a separate plane, so hits are
+		// judged against pixels of the same color, and map indices back into the mosaic
+		height := int32(len(f.Data)) / width
+		for yOffset := int32(0); yOffset < 2; yOffset++ {
+			for xOffset := int32(0); xOffset < 2; xOffset++ {
+				subWidth, subHeight := (width-xOffset+1)/2, (height-yOffset+1)/2
+				sub := make([]float32, subWidth*subHeight)
+				for y := int32(0); y < subHeight; y++ {
+					for x := int32(0); x < subWidth; x++ {
+						sub[y*subWidth+x] = f.Data[(2*y+yOffset)*width+2*x+xOffset]
+					}
+				}
+				crm, subIter, subNoise := op.reject(sub, subWidth)
+				for y := int32(0); y < subHeight; y++ {
+					for x := int32(0); x < subWidth; x++ {
+						f.Data[(2*y+yOffset)*width+2*x+xOffset] = sub[y*subWidth+x]
+					}
+				}
+				for _, i := range crm {
+					all = append(all, (2*(i/subWidth)+yOffset)*width+2*(i%subWidth)+xOffset)
+				}
+				if subIter > iter {
+					iter = subIter
+				}
+				noise += 0.25 * subNoise
+			}
+		}
+	}
+	if noise <= 0 {
+		fmt.Fprintf(c.Log, "%d: Zero noise estimate, skipping cosmic ray rejection\n", f.ID)
+		return f, nil
+	}
+	if op.Replace == CRReplaceNaN {
+		nan := float32(math.NaN())
+		for _, i := range all {
+			f.Data[i] = nan
+		}
+	}
+	f.Stats.Clear()
+
+	fmt.Fprintf(c.Log, "%d: Removed %d cosmic ray pixels (%.3f%%) in %d iterations with sigma=%.2f frac=%.2f objLimit=%.2f noise=%.4g\n",
+		f.ID, len(all), 100.0*float32(len(all))/float32(f.Pixels), iter, op.Sigma, op.SigmaFrac, op.ObjLimit, noise)
+	return f, nil
+}
+
+// Detects and repairs cosmic ray hits in a single plane with the given width, iteratively, as large hits
+// are peeled off from the outside in. Returns the indices of all repaired pixels, the number of iterations
+// and the noise estimate, which is zero if the plane was skipped
+func (op *OpCosmicRay) reject(data []float32, width int32) (all []int32, iter int32, noise float32) {
+	// estimate noise directly, as the image statistics may refer to other data
+	noise = stats.EstimateNoise(data, width)
+	if noise <= 0 {
+		return nil, 0, 0
+	}
+	mask := star.CreateMask(width, 2.5)
+	for ; iter < op.Iterations; iter++ {
+		crm := CosmicRayMap(data, width, noise, op.Sigma, op.SigmaFrac, op.ObjLimit)
+		if len(crm) == 0 {
+			break
+		}
+		MedianFilterSparse(data, crm, mask)
+		all = append(all, crm...)
+	}
+	return all, iter, noise
+}
+
+// Generate cosmic ray map with one pass of the L.A.Cosmic algorithm. Candidates are pixels where
+// the noise-normalized Laplacian of the 2x supersampled image, minus its 5x5 median, exceeds sigma.
+// Stars are spared if the ratio of that value over the noise-normalized fine structure image
+// (3x3 median minus 7x7 median of the 3x3 median) is below objLimit. Accepted hits are grown into
+// neighbors exceeding sigma, and then into neighbors exceeding sigmaFrac*sigma.
+// Returns a sorted array of indices into the data.
+func CosmicRayMap(data []float32, width int32, noise, sigma, sigmaFrac, objLimit float32) (crm []int32) {
+	height := int32(len(data)) / width
+	if width < 8 || height < 8 {
+		return nil
+	}
+
+	// Laplacian of the 2x supersampled image, clipped to positive values, block averaged back
+	// to the original resolution and normalized by noise. Computed directly: each subpixel of a
+	// block shares two neighbors with its own block and has one horizontal and one vertical
+	// neighbor from the adjacent blocks
+	s := make([]float32, len(data))
+	norm := 0.25 / (2 * noise)
+	for y := int32(1); y < height-1; y++ {
+		for x := int32(1); x < width-1; x++ {
+			i := y*width + x
+			v2 := 2 * data[i]
+			l, r, u, d := data[i-1], data[i+1], data[i-width], data[i+width]
+			s[i] = norm * (positive(v2-l-u) + positive(v2-r-u) + positive(v2-l-d) + positive(v2-r-d))
+		}
+	}
+
+	// subtract local 5x5 median of s to remove smooth structures. As s is non-negative,
+	// only pixels with s above the lowest threshold can pass, so skip all others
+	lowThreshold := sigma * sigmaFrac
+	if lowThreshold > sigma {
+		lowThreshold = sigma
+	}
+	sp := make([]float32, len(data))
+	mask5 := createSquareMask(width, 2)
+	buffer := make([]float32, 7*7)
+	numCandidates := 0
+	for y := int32(3); y < height-3; y++ {
+		for x := int32(3); x < width-3; x++ {
+			i := y*width + x
+			if s[i] <= lowThreshold {
+				continue
+			}
+			sp[i] = s[i] - median.GatherAndMedian(s, i, mask5, buffer[:len(mask5)])
+			if sp[i] > lowThreshold {
+				numCandidates++
+			}
+		}
+	}
+	s = nil
+	if numCandidates == 0 {
+		return nil
+	}
+
+	// fine structure image, evaluated on demand for candidates only
+	med3 := make([]float32, len(data))
+	median.MedianFilter3x3(med3, data, width)
+	mask7 := createSquareMask(width, 3)
+
+	// accept candidates above sigma whose Laplacian dominates the fine structure
+	isCR := make([]bool, len(data))
+	crm = make([]int32, 0, numCandidates)
+	for i, v := range sp {
+		if v <= sigma {
+			continue
+		}
+		fine := (med3[i] - median.GatherAndMedian(med3, int32(i), mask7, buffer[:len(mask7)])) / noise
+		if fine < 0.01 {
+			fine = 0.01
+		}
+		if v/fine > objLimit {
+			isCR[i] = true
+			crm = append(crm, int32(i))
+		}
+	}
+	med3 = nil
+
+	// grow detections into neighbors above sigma, then into neighbors above the lower threshold
+	crm = growCosmicRays(crm, isCR, sp, width, sigma)
+	crm = growCosmicRays(crm, isCR, sp, width, lowThreshold)
+	sort.Slice(crm, func(i, j int) bool { return crm[i] < crm[j] })
+	return crm
+}
+
+// Adds the 8-neighbors of the given cosmic ray pixels to the map if their value exceeds the threshold.
+// The sp map is zero within 3 pixels of the image border, so no bounds checks are required
+func growCosmicRays(crm []int32, isCR []bool, sp []float32, width int32, threshold float32) []int32 {
+	neighbors := []int32{-width - 1, -width, -width + 1, -1, 1, width - 1, width, width + 1}
+	numOrig := len(crm)
+	for _, i := range crm[:numOrig] {
+		for _, o := range neighbors {
+			j := i + o
+			if !isCR[j] && sp[j] > threshold {
+				isCR[j] = true
+				crm = append(crm, j)
+			}
+		}
+	}
+	return crm
+}
+
+// Creates a square mask of size (2*halfSize+1)^2. Returns a list of index offsets
+func createSquareMask(width, halfSize int32) []int32 {
+	mask := []int32{}
+	for y := -halfSize; y <= halfSize; y++ {
+		for x := -halfSize; x <= halfSize; x++ {
+			mask = append(mask, y*width+x)
+		}
+	}
+	return mask
+}
+
+// Returns x if positive, else zero
+func positive(x float32) float32 {
+	if x > 0 {
+		return x
+	}
+	return 0
+}
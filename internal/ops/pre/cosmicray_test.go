@@ -0,0 +1,125 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pre
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestCosmicRayMap(t *testing.T) {
+	width, height := int32(64), int32(64)
+	data := make([]float32, width*height)
+	rng := rand.New(rand.NewSource(42))
+	for i := range data {
+		data[i] = 100 + float32(rng.NormFloat64())
+	}
+
+	// well-sampled star with sigma=2 pixels
+	starX, starY := int32(20), int32(20)
+	for y := starY - 8; y <= starY+8; y++ {
+		for x := starX - 8; x <= starX+8; x++ {
+			dx, dy := float64(x-starX), float64(y-starY)
+			data[y*width+x] += float32(200 * math.Exp(-(dx*dx+dy*dy)/(2*2*2)))
+		}
+	}
+
+	// single pixel cosmic ray hit
+	hit := 45*width + 40
+	data[hit] += 500
+
+	crm := CosmicRayMap(data, width, 1, 4.5, 0.3, 5)
+	found := false
+	for _, i := range crm {
+		if i == hit {
+			found = true
+		}
+		x, y := i%width, i/width
+		if x >= starX-4 && x <= starX+4 && y >= starY-4 && y <= starY+4 {
+			t.Errorf("star pixel (%d,%d) flagged as cosmic ray", x, y)
+		}
+	}
+	if !found {
+		t.Errorf("hit at %d not found in %v", hit, crm)
+	}
+	if len(crm) > 5 {
+		t.Errorf("len(crm)=%d; want <=%d", len(crm), 5)
+	}
+}
+
+// Creates a 64x64 frame with unit noise around a level of 100 times the given color filter gains,
+// which are indexed by the position in the 2x2 filter pattern, and a well-sampled star at 20,20
+func newTestRawFrame(gains [4]float32) *fits.Image {
+	width := int32(64)
+	f := fits.NewImageFromNaxisn([]int32{width, width}, nil)
+	rng := rand.New(rand.NewSource(7))
+	for y := int32(0); y < width; y++ {
+		for x := int32(0); x < width; x++ {
+			dx, dy := float64(x-20), float64(y-20)
+			v := 100 + 200*float32(math.Exp(-(dx*dx+dy*dy)/(2*2*2)))
+			f.Data[y*width+x] = gains[(y%2)*2+x%2]*v + float32(rng.NormFloat64())
+		}
+	}
+	return f
+}
+
+func TestOpCosmicRay(t *testing.T) {
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	hit, starCore := int32(44*64+40), int32(20*64+20) // the hit is on a red pixel
+	for _, tc := range []struct {
+		name    string
+		gains   [4]float32
+		debayer *OpDebayer
+		replace CosmicRayReplaceMode
+	}{
+		{"mono repair", [4]float32{1, 1, 1, 1}, nil, CRReplaceMedian},
+		{"mono NaN", [4]float32{1, 1, 1, 1}, nil, CRReplaceNaN},
+		{"CFA repair", [4]float32{1.2, 1, 1, 0.8}, NewOpDebayer("R", "RGGB"), CRReplaceMedian},
+	} {
+		f := newTestRawFrame(tc.gains)
+		orig := append([]float32(nil), f.Data...)
+		f.Data[hit] += 500
+
+		got, err := NewOpCosmicRay(4.5, 0.3, 5, 4, tc.replace, tc.debayer).Apply(f, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := got.Data[hit]; tc.replace == CRReplaceNaN {
+			if !math.IsNaN(float64(v)) {
+				t.Errorf("%s: hit is %g; want NaN", tc.name, v)
+			}
+		} else if math.Abs(float64(v-orig[hit])) > 5 {
+			t.Errorf("%s: hit repaired to %g; want %g", tc.name, v, orig[hit])
+		}
+
+		// the star and the color filter pattern are untouched
+		changed := 0
+		for i, v := range got.Data {
+			if int32(i) != hit && v != orig[i] {
+				changed++
+			}
+		}
+		if got.Data[starCore] != orig[starCore] || changed > 4 {
+			t.Errorf("%s: star core %g; want %g, %d other pixels changed", tc.name, got.Data[starCore], orig[starCore], changed)
+		}
+	}
+}
@@ -400,25 +400,29 @@ func (op *OpBackExtract) Apply(f *fits.Image, c *ops.Context) (result *fits.Imag
 
 type OpStarDetect struct {
 	ops.OpUnaryBase
-	Radius        int32       `json:"radius"`
-	Sigma         float32     `json:"sigma"`
-	BadPixelSigma float32     `json:"badPixelSigma"`
-	InOutRatio    float32     `json:"inOutRatio"`
-	Save          *ops.OpSave `json:"save"`
+	Radius        int32         `json:"radius"`
+	Sigma         float32       `json:"sigma"`
+	BadPixelSigma float32       `json:"badPixelSigma"`
+	InOutRatio    float32       `json:"inOutRatio"`
+	PSF           star.PSFModel `json:"psf"`
+	Save          *ops.OpSave   `json:"save"`
+	Catalog       string        `json:"catalog"` // file pattern for saving the star list as .csv, .json or DS9 .reg
 }
 
 func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpStarDetectDefault() }) } // register the operator for JSON decoding
 
-func NewOpStarDetectDefault() *OpStarDetect { return NewOpStarDetect(16, 10, 0, 10, "") }
+func NewOpStarDetectDefault() *OpStarDetect { return NewOpStarDetect(16, 10, 0, 10, star.PSFNone, "", "") }
 
-func NewOpStarDetect(starRadius int32, starSig, starBpSig, starInOut float32, savePattern string) *OpStarDetect {
+func NewOpStarDetect(starRadius int32, starSig, starBpSig, starInOut float32, psf star.PSFModel, savePattern, catalogPattern string) *OpStarDetect {
 	op := &OpStarDetect{
 		OpUnaryBase:   ops.OpUnaryBase{OpBase: ops.OpBase{Type: "starDetect"}},
 		Radius:        starRadius,
 		Sigma:         starSig,
 		BadPixelSigma: starBpSig,
 		InOutRatio:    starInOut,
+		PSF:           psf,
 		Save:          ops.NewOpSave(savePattern, ops.EMMinMax, 1),
+		Catalog:       catalogPattern,
 	}
 	op.OpUnaryBase.Apply = op.Apply // assign class method to superclass abstract method
 	return op
@@ -446,7 +450,13 @@ func (op *OpStarDetect) Apply(f *fits.Image, c *ops.Context) (result *fits.Image
 	}
 
 	f.Stars, _, f.HFR = star.FindStars(f.Data, f.Naxisn[0], f.Stats.Location(), f.Stats.Scale(), op.Sigma, op.BadPixelSigma, op.InOutRatio, op.Radius, f.MedianDiffStats)
-	fmt.Fprintf(c.Log, "%d: Stars %d HFR %.2f %v\n", f.ID, len(f.Stars), f.HFR, f.Stats)
+	if op.PSF != star.PSFNone {
+		var numFitted int
+		numFitted, f.FWHM, f.Eccentricity = star.FitPSFs(f.Stars, f.Data, f.Naxisn[0], f.Stats.Location(), f.Stats.Noise(), op.Radius, op.PSF)
+		fmt.Fprintf(c.Log, "%d: Stars %d HFR %.2f PSF fits %d FWHM %.2f Ecc %.2f %v\n", f.ID, len(f.Stars), f.HFR, numFitted, f.FWHM, f.Eccentricity, f.Stats)
+	} else {
+		fmt.Fprintf(c.Log, "%d: Stars %d HFR %.2f %v\n", f.ID, len(f.Stars), f.HFR, f.Stats)
+	}
 
 	if op.Save != nil && op.Save.FilePattern != "" {
 		stars := fits.NewImageFromStars(f, 2.0)
@@ -461,5 +471,14 @@ func (op *OpStarDetect) Apply(f *fits.Image, c *ops.Context) (result *fits.Image
 		}
 	}
 
+	// include reference frame coordinates if a transformation is already known
+	var trans star.Transformation
+	if f.Trans != star.IdentityTransform2D() && f.Trans != (star.Transform2D{}) {
+		trans = &f.Trans
+	}
+	if err = ops.SaveStarCatalog(f, op.Catalog, trans, c); err != nil {
+		return nil, err
+	}
+
 	return f, nil
 }
@@ -0,0 +1,110 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pre
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// An imaging session, e.g. one night, with its own light frames and calibration frames
+type Session struct {
+	Name         string   `json:"name"`
+	FilePatterns []string `json:"filePatterns"`
+	Dark         string   `json:"dark"`
+	Flat         string   `json:"flat"`
+}
+
+// Loads light frames of several sessions, and calibrates each with the dark and flat of its session.
+// Takes zero inputs, produces one output per frame across all sessions. The subsequent steps share one
+// alignment and histogram reference and one integration with rejection across sessions.
+// Frame IDs are assigned contiguously per session and recorded in the context, for the statistics export
+type OpSessions struct {
+	ops.OpBase
+	Sessions []*Session `json:"sessions"`
+}
+
+var _ ops.Operator = (*OpSessions)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpSessionsDefault() }) } // register the operator for JSON decoding
+
+func NewOpSessionsDefault() *OpSessions { return NewOpSessions(nil) }
+
+func NewOpSessions(sessions []*Session) *OpSessions {
+	return &OpSessions{
+		OpBase:   ops.OpBase{Type: "sessions"},
+		Sessions: sessions,
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpSessions) UnmarshalJSON(data []byte) error {
+	type defaults OpSessions
+	def := defaults(*NewOpSessionsDefault())
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return err
+	}
+	*op = OpSessions(def)
+	return nil
+}
+
+func (op *OpSessions) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if len(ins) > 0 {
+		return nil, fmt.Errorf("%s operator with non-zero input", op.Type)
+	}
+
+	c.Sessions = nil
+	for i, s := range op.Sessions {
+		name := s.Name
+		if name == "" {
+			name = fmt.Sprintf("session %d", i+1)
+		}
+		fileNames, err := ops.NewOpLoadMany(s.FilePatterns).FileNames(c.Log)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(c.Log, "Session %s: found %d files, dark '%s', flat '%s'\n", name, len(fileNames), s.Dark, s.Flat)
+
+		// calibrate with a session context holding the master frames of this session only
+		sessionContext := *c
+		sessionContext.DarkFrame, sessionContext.FlatFrame = nil, nil
+		opCalibrate := NewOpCalibrate(s.Dark, s.Flat)
+
+		firstID := len(outs)
+		for j, fileName := range fileNames {
+			loads, err := ops.NewOpLoad(firstID+j, fileName).MakePromises(nil, c)
+			if err != nil {
+				return nil, err
+			}
+			outs = append(outs, opCalibrate.MakePromise(loads[0], &sessionContext))
+		}
+		masters := 0
+		for _, master := range []string{s.Dark, s.Flat} {
+			if master != "" {
+				masters++
+			}
+		}
+		c.Sessions = append(c.Sessions, ops.SessionInfo{Name: name, FirstID: firstID, NumFrames: len(fileNames), Masters: masters})
+	}
+	if len(outs) == 0 {
+		return nil, fmt.Errorf("%s operator with no files to load", op.Type)
+	}
+	fmt.Fprintf(c.Log, "Found %d files in %d sessions.\n", len(outs), len(op.Sessions))
+	return outs, nil
+}
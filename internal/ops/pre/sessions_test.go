@@ -0,0 +1,99 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pre
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Writes a 64x64 frame whose left half has the first and right half the second value
+func writeTestFrame(t *testing.T, name string, left, right float32) {
+	f := fits.NewImageFromNaxisn([]int32{64, 64}, nil)
+	for i := range f.Data {
+		if i%64 < 32 {
+			f.Data[i] = left
+		} else {
+			f.Data[i] = right
+		}
+	}
+	if err := f.WriteFile(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	// loading is restricted to relative paths, so work in a temporary directory
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// the first night needs a dark, the second night a flat with vignetting on the left
+	os.Mkdir("night1", 0755)
+	os.Mkdir("night2", 0755)
+	for i := 0; i < 3; i++ {
+		writeTestFrame(t, fmt.Sprintf("night1/light%d.fits", i), 110, 110)
+	}
+	for i := 0; i < 2; i++ {
+		writeTestFrame(t, fmt.Sprintf("night2/light%d.fits", i), 50, 100)
+	}
+	writeTestFrame(t, "dark1.fits", 10, 10)
+	writeTestFrame(t, "flat2.fits", 1, 2)
+
+	var op OpSessions
+	job := `{"type":"sessions","sessions":[
+		{"name":"night1","filePatterns":["night1/*.fits"],"dark":"dark1.fits"},
+		{"filePatterns":["night2/*.fits"],"flat":"flat2.fits"}]}`
+	if err := json.Unmarshal([]byte(job), &op); err != nil {
+		t.Fatal(err)
+	}
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	promises, err := op.MakePromises(nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ops.MaterializeAll(promises, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 5 {
+		t.Fatalf("got %d frames; want 5", len(fs))
+	}
+	for i, f := range fs {
+		if f.ID != i || f.Data[0] != 100 || f.Data[63] != 100 {
+			t.Errorf("frame %d: got ID %d, values %g and %g; want %d, 100 and 100", i, f.ID, f.Data[0], f.Data[63], i)
+		}
+	}
+	if c.DarkFrame != nil || c.FlatFrame != nil {
+		t.Errorf("session calibration frames leaked into the shared context")
+	}
+	want := []ops.SessionInfo{{Name: "night1", FirstID: 0, NumFrames: 3, Masters: 1}, {Name: "session 2", FirstID: 3, NumFrames: 2, Masters: 1}}
+	if len(c.Sessions) != 2 || c.Sessions[0] != want[0] || c.Sessions[1] != want[1] {
+		t.Errorf("got sessions %v; want %v", c.Sessions, want)
+	}
+	if c.SessionOf(2) != 0 || c.SessionOf(4) != 1 || c.SessionOf(5) != -1 {
+		t.Errorf("wrong session lookup")
+	}
+}
@@ -32,6 +32,20 @@ type OpExportStats struct {
 	mutex        sync.Mutex    `json:"-"`
 	materialized []*fits.Image `json:"-"`
 	opError      error         `json:"-"`
+	rows         []statsRow    `json:"-"`
+	sessionSums  []sessionSum  `json:"-"`
+}
+
+// Statistics of one frame, written with its stacking weight once the frames are stacked
+type statsRow struct {
+	id, session int
+	values      string // formatted values up to the weight column
+}
+
+// Sums of per-frame statistics for one session, for the session summary
+type sessionSum struct {
+	frames                                   int
+	location, scale, stars, hfr, snr, weight float64
 }
 
 func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpExportStatsDefault() }) } // register the operator for JSON decoding
@@ -69,18 +83,14 @@ func (op *OpExportStats) Apply(f *fits.Image, c *ops.Context) (result *fits.Imag
 	op.mutex.Lock()         // lock so a single thread is active
 	defer op.mutex.Unlock() // always release lock on exit
 
-	// write stats
-	if c.StatsProcessed == 0 {
+	// write stats. The header goes with the first frame of this run, which may resume after a checkpoint
+	if c.StatsBufWriter == nil {
 		err = op.writeHeader(c)
 		if err != nil {
 			return nil, err
 		}
 	}
 	op.writeStats(f, c)
-	c.StatsProcessed++
-	if c.StatsProcessed == c.StatsTotal {
-		op.writeFooter(c)
-	}
 
 	return f, nil
 }
@@ -92,23 +102,89 @@ func (op *OpExportStats) writeHeader(c *ops.Context) (err error) {
 		return fmt.Errorf("error creating file %s: %s", op.FileName, err.Error())
 	}
 	c.StatsBufWriter = bufio.NewWriter(c.StatsFile)
+	c.StatsFooter = func() {
+		op.mutex.Lock()
+		defer op.mutex.Unlock()
+		op.writeFooter(c)
+	}
 
 	c.StatsBufWriter.WriteString(sessionStatsHeader)
-	fmt.Fprintf(c.StatsBufWriter, "[  ['ID','Min','Mean','Max','Location','Scale','Stars','HFR']\n")
+	sessionColumn := ""
+	if len(c.Sessions) > 0 {
+		sessionColumn = ",'Session'"
+	}
+	op.rows, op.sessionSums = nil, make([]sessionSum, len(c.Sessions))
+	fmt.Fprintf(c.StatsBufWriter, "[  ['ID','Min','Mean','Max','Location','Scale','Stars','HFR','FWHM','Eccentricity','SNR','PSFSignal','Weight'%s]\n", sessionColumn)
 
 	return nil
 }
 
+// Records the statistics of the given frame. They are written with the footer, once the stacking weight is known
 func (op *OpExportStats) writeStats(f *fits.Image, c *ops.Context) {
 	fmt.Fprintf(c.Log, "%d: writing statistics to file %s ...\n", f.ID, op.FileName)
 	s := f.Stats
-	fmt.Fprintf(c.StatsBufWriter, "  ,[%d,%f,%f,%f,%f,%f,%d,%f]\n",
-		f.ID, s.Min(), s.Mean(), s.Max(), s.Location(), s.Scale(), len(f.Stars), f.HFR)
+	snr, _ := f.SNR()             // zero if unavailable
+	psfSignal, _ := f.PSFSignal() // zero if unavailable
+	row := statsRow{id: f.ID, session: -1}
+	row.values = fmt.Sprintf("%d,%f,%f,%f,%f,%f,%d,%f,%f,%f,%f,%f",
+		f.ID, s.Min(), s.Mean(), s.Max(), s.Location(), s.Scale(), len(f.Stars), f.HFR, f.FWHM, f.Eccentricity,
+		snr, psfSignal)
+	if len(c.Sessions) > 0 {
+		row.session = c.SessionOf(f.ID)
+		if row.session >= 0 && row.session < len(op.sessionSums) {
+			sum := &op.sessionSums[row.session]
+			sum.frames++
+			sum.location += float64(s.Location())
+			sum.scale += float64(s.Scale())
+			sum.stars += float64(len(f.Stars))
+			sum.hfr += float64(f.HFR)
+			sum.snr += float64(snr)
+		}
+	}
+	op.rows = append(op.rows, row)
+}
+
+// Writes the recorded statistics with the weight stacking applied to each frame, zero if a frame was not stacked
+func (op *OpExportStats) writeRows(c *ops.Context) {
+	for _, row := range op.rows {
+		weight := c.StackWeights[row.id]
+		fmt.Fprintf(c.StatsBufWriter, "  ,[%s,%f", row.values, weight)
+		if len(c.Sessions) > 0 {
+			fmt.Fprintf(c.StatsBufWriter, ",%d", row.session+1)
+			if row.session >= 0 && row.session < len(op.sessionSums) {
+				op.sessionSums[row.session].weight += float64(weight)
+			}
+		}
+		fmt.Fprintf(c.StatsBufWriter, "]\n")
+	}
+	op.rows = nil
+}
+
+// Writes the per-session averages as a javascript array, or null if the frames were not loaded per session
+func (op *OpExportStats) writeSessionSummary(c *ops.Context) {
+	if len(c.Sessions) == 0 {
+		fmt.Fprintf(c.StatsBufWriter, "var sessionSummary = null")
+		return
+	}
+	fmt.Fprintf(c.StatsBufWriter, "var sessionSummary =\n[  ['Session','Frames','Location','Scale','Stars','HFR','SNR','Weight']\n")
+	for i, info := range c.Sessions {
+		sum := op.sessionSums[i]
+		n := float64(sum.frames)
+		if n == 0 {
+			n = 1 // all averages are zero
+		}
+		name, _ := json.Marshal(info.Name)
+		fmt.Fprintf(c.StatsBufWriter, "  ,[%s,%d,%f,%f,%f,%f,%f,%f]\n", name, sum.frames,
+			sum.location/n, sum.scale/n, sum.stars/n, sum.hfr/n, sum.snr/n, sum.weight/n)
+	}
+	fmt.Fprintf(c.StatsBufWriter, "]")
 }
 
 func (op *OpExportStats) writeFooter(c *ops.Context) {
 	fmt.Fprintf(c.Log, "Writing statistics footer to file %s ...\n", op.FileName)
-	fmt.Fprintf(c.StatsBufWriter, "]")
+	op.writeRows(c)
+	fmt.Fprintf(c.StatsBufWriter, "];\n")
+	op.writeSessionSummary(c)
 	c.StatsBufWriter.WriteString(sessionStatsTrailer)
 	c.StatsBufWriter.Flush()
 	c.StatsBufWriter = nil
@@ -124,10 +200,12 @@ const sessionStatsHeader = `<html>
     <table height="100%" width="100%"><tr height="100%">
       <td width="90%"><div id="sessionStatsChart" style="width: 100%; height: 100%"></div></td>
       <td width="10%"><form><input type="checkbox" id="normalize" name="normalize" checked="true" onchange="toggleNormalize()"><label for="normalize">Normalize</label></form></td>
+    </tr><tr>
+      <td colspan="2"><div id="sessionSummaryTable"></div></td>
     </tr></table>
   </body>
   <script type="text/javascript">
-google.charts.load('current', {'packages':['corechart']});
+google.charts.load('current', {'packages':['corechart','table']});
 google.charts.setOnLoadCallback(drawChart);
 
 var dataArray =
@@ -177,6 +255,10 @@ function toggleNormalize() {
 function drawChart() {
   chart = new google.visualization.LineChart(document.getElementById('sessionStatsChart'));
   toggleNormalize();
+  if(sessionSummary) {
+    var table = new google.visualization.Table(document.getElementById('sessionSummaryTable'));
+    table.draw(google.visualization.arrayToDataTable(sessionSummary), {});
+  }
 }
 
 function calcColumnMedians(d) {
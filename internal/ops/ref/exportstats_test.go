@@ -0,0 +1,119 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ref
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/ops/stack"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestExportStatsSessions(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	name := filepath.Join(t.TempDir(), "stats.html")
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	c.Sessions = []ops.SessionInfo{{Name: "night1", FirstID: 0, NumFrames: 2}, {Name: "night2", FirstID: 2, NumFrames: 1}}
+	op := NewOpExportStats(name)
+	for id := 0; id < 3; id++ {
+		f := fits.NewImageFromNaxisn([]int32{64, 64}, nil)
+		f.ID = id
+		for i := range f.Data {
+			f.Data[i] = 100 + float32(id) + float32(rng.NormFloat64())
+		}
+		if _, err := op.Apply(f, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.RecordStackWeight(0, 1) // frame 2 is not stacked
+	c.RecordStackWeight(1, 0.5)
+	c.FinishStats()
+
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(content)
+	for _, want := range []string{"'Weight','Session']", ",0.500000,1]", ",0.000000,2]", `["night1",2,`, `,0.750000]`, `["night2",1,`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("statistics export lacks %s", want)
+		}
+	}
+}
+
+func TestExportStatsResume(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	fs := make([]*fits.Image, 20)
+	for i := range fs {
+		fs[i] = fits.NewImageFromNaxisn([]int32{256, 256}, nil)
+		for j := range fs[i].Data {
+			fs[i].Data[j] = 100 + float32(rng.NormFloat64())
+		}
+	}
+	loads := 0
+	promises := func(failAt int) []ops.Promise {
+		loads = 0
+		ins := make([]ops.Promise, len(fs))
+		for i := range fs {
+			i := i
+			ins[i] = func() (*fits.Image, error) {
+				loads++
+				if loads == failAt {
+					return nil, errors.New("interrupted")
+				}
+				f := fits.NewImageFromNaxisn(fs[i].Naxisn, append([]float32(nil), fs[i].Data...))
+				f.ID, f.FileName = i, fmt.Sprintf("light%02d.fits", i)
+				return f, nil
+			}
+		}
+		return ins
+	}
+	name, dir := filepath.Join(t.TempDir(), "stats.html"), t.TempDir()
+	newOp := func(resume bool) *stack.OpStackBatches {
+		seq := ops.NewOpSequence(NewOpExportStats(name),
+			stack.NewOpStack(stack.StSigma, stack.StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true))
+		return stack.NewOpStackBatches(seq, "", false, 0, dir, resume)
+	}
+	newContext := func() *ops.Context { return ops.NewContext(io.Discard, 2, stats.LSEMedianMAD) } // fits only a few frames
+
+	// interrupted in the last batch, then resumed with the frames of the completed batches counted as processed
+	if _, err := newOp(false).Apply(promises(len(fs)), newContext()); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if _, err := newOp(true).Apply(promises(-1), newContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(content)
+	for _, want := range []string{"'Weight']", ",1.000000]", "var sessionSummary"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("statistics export of resumed run lacks %s", want)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/mlnoga/nightlight/internal/ops"
 	"github.com/mlnoga/nightlight/internal/ops/pre"
 	"github.com/mlnoga/nightlight/internal/qsort"
+	"github.com/mlnoga/nightlight/internal/stats"
 	"math"
 	"strconv"
 	"sync"
@@ -98,7 +99,7 @@ func (op *OpSelectReference) applySingle(i int, ins []ops.Promise, c *ops.Contex
 			op.mutex.Unlock() // return immediately with the same error
 			return nil, errors.New("same error")
 		}
-		if (op.Target == SRAlign && c.AlignStars != nil) ||
+		if (op.Target == SRAlign && c.AlignNaxisn != nil) ||
 			(op.Target == SRHisto && c.MatchHisto != nil) { // if a reference frame already exists
 			op.mutex.Unlock() // unlock immediately to allow ...
 			if op.materialized == nil || op.materialized[i] == nil {
@@ -201,6 +202,10 @@ func (op *OpSelectReference) assignResults(c *ops.Context, refFrame *fits.Image)
 	if op.Target == SRAlign {
 		c.AlignNaxisn = refFrame.Naxisn
 		c.AlignStars = refFrame.Stars
+		// snapshot the pixels, as later operators modify frames in place while others read the reference
+		c.AlignImage = fits.NewImageFromImage(refFrame)
+		copy(c.AlignImage.Data, refFrame.Data)
+		c.AlignImage.Stats = stats.NewStats(c.AlignImage.Data, c.AlignImage.Naxisn[0])
 		c.AlignHFR = refFrame.HFR
 	} else if op.Target == SRHisto {
 		c.MatchHisto = refFrame.Stats
@@ -215,9 +220,15 @@ func selectReferenceStarsOverHFR(lights []*fits.Image) (refFrame *fits.Image, re
 		if lightP == nil {
 			continue
 		}
-		score := float32(len(lightP.Stars)) / lightP.HFR
-		if len(lightP.Stars) == 0 || lightP.HFR == 0 {
-			score = 0
+		// prefer PSF fit results if available, penalizing elongated stars. Else estimate the
+		// FWHM as twice the HFR, which is exact for Gaussian stars, so all frames share one metric
+		fwhm, eccentricity := lightP.FWHM, lightP.Eccentricity
+		if fwhm <= 0 {
+			fwhm, eccentricity = 2*lightP.HFR, 0
+		}
+		score := float32(0)
+		if len(lightP.Stars) > 0 && fwhm > 0 {
+			score = float32(len(lightP.Stars)) / (fwhm * (1 + eccentricity))
 		}
 		if score > refScore {
 			refFrame, refScore = lightP, score
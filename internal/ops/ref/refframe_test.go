@@ -0,0 +1,57 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ref
+
+import (
+	"io"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestSelectReferenceStarsOverHFR(t *testing.T) {
+	// a frame without PSF fit and with worse seeing, and a frame with PSF fit
+	stars := make([]star.Star, 10)
+	noFit := &fits.Image{ID: 0, Stars: stars, HFR: 3}
+	fitted := &fits.Image{ID: 1, Stars: stars, HFR: 2, FWHM: 4}
+	elongated := &fits.Image{ID: 2, Stars: stars, HFR: 2, FWHM: 4, Eccentricity: 0.5}
+	got, score, err := selectReferenceStarsOverHFR([]*fits.Image{noFit, elongated, fitted, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != fitted || score != 2.5 {
+		t.Errorf("got reference %d with score %g; want 1 with score 2.5", got.ID, score)
+	}
+}
+
+func TestAssignAlignReference(t *testing.T) {
+	// the alignment reference is a snapshot, unaffected by processing the frame in place
+	f := fits.NewImageFromNaxisn([]int32{4, 2}, []float32{1, 2, 3, 4, 5, 6, 7, 8})
+	f.ID, f.Stars = 3, make([]star.Star, 2)
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	NewOpSelectReference(SRAlign, "%starsHFR", nil).assignResults(c, f)
+	f.Data[0] = 100
+
+	if c.AlignImage == f || c.AlignImage.Data[0] != 1 || c.AlignImage.Data[7] != 8 {
+		t.Errorf("alignment reference changed with the frame: %v", c.AlignImage.Data)
+	}
+	if !c.IsAlignReference(f) || c.IsAlignReference(&fits.Image{ID: 4}) || len(c.AlignStars) != 2 {
+		t.Errorf("reference frame not recognized by ID, or stars %d", len(c.AlignStars))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ref
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// Ranks frames by sharpness and passes on only the best ones, e.g. for lucky imaging of planets and the moon.
+// Scores all inputs first, materializing only as many frames at a time as there are threads, then returns
+// the promises of the selected uncalibrated frames in input order. These are materialized again downstream,
+// so place this operator before stacking batches to rank globally
+type OpSelectBest struct {
+	ops.OpBase
+	Metric    fits.SharpnessMetric `json:"metric"`    // sharpness metric
+	Region    fits.Rect            `json:"region"`    // region to score, empty=whole frame
+	Bin       int32                `json:"bin"`       // bin pixels NxN before scoring, e.g. 2 for raw color frames
+	Percent   float32              `json:"percent"`   // keep this percentage of the best frames, 0=all
+	Count     int                  `json:"count"`     // keep this many of the best frames. Overrides the percentage if >0
+	Calibrate *ops.OpSequence      `json:"calibrate"` // unary operators to apply before scoring, e.g. dark and flat calibration and bad pixel removal
+}
+
+var _ ops.Operator = (*OpSelectBest)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpSelectBestDefault() }) } // register the operator for JSON decoding
+
+func NewOpSelectBestDefault() *OpSelectBest {
+	return NewOpSelectBest(fits.SMLaplacian, fits.Rect{}, 1, 0, 0, ops.NewOpSequence())
+}
+
+func NewOpSelectBest(metric fits.SharpnessMetric, region fits.Rect, bin int32, percent float32, count int, calibrate *ops.OpSequence) *OpSelectBest {
+	return &OpSelectBest{
+		OpBase:    ops.OpBase{Type: "selectBest"},
+		Metric:    metric,
+		Region:    region,
+		Bin:       bin,
+		Percent:   percent,
+		Count:     count,
+		Calibrate: calibrate,
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpSelectBest) UnmarshalJSON(data []byte) error {
+	type defaults OpSelectBest
+	def := defaults(*NewOpSelectBestDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpSelectBest(def)
+	return nil
+}
+
+// Returns the number of frames to keep out of the given total
+func (op *OpSelectBest) keep(total int) int {
+	keep := total
+	if op.Count > 0 {
+		keep = op.Count
+	} else if op.Percent > 0 {
+		keep = int(math.Ceil(float64(total) * float64(op.Percent) / 100))
+	}
+	if keep > total {
+		keep = total
+	}
+	return keep
+}
+
+func (op *OpSelectBest) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if len(ins) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s operator needs inputs", op.Type))
+	}
+	keep := op.keep(len(ins))
+	if keep == len(ins) {
+		return ins, nil
+	}
+
+	calibrated := ins
+	if op.Calibrate != nil && len(op.Calibrate.Steps) > 0 {
+		if calibrated, err = op.Calibrate.MakePromises(ins, c); err != nil {
+			return nil, err
+		}
+		if len(calibrated) != len(ins) {
+			return nil, fmt.Errorf("%s operator: calibration must produce one image per frame, got %d for %d", op.Type, len(calibrated), len(ins))
+		}
+	}
+	scores, err := op.score(calibrated, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// rank by descending score and select the best, preserving input order
+	order := make([]int, len(ins))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	for keep > 0 && math.IsInf(float64(scores[order[keep-1]]), -1) {
+		keep-- // never select frames which could not be scored
+	}
+	if keep == 0 {
+		return nil, errors.New("no frames could be scored for sharpness")
+	}
+	selected := append([]int(nil), order[:keep]...)
+	sort.Ints(selected)
+	outs = make([]ops.Promise, keep)
+	for i, s := range selected {
+		outs[i] = ins[s]
+	}
+	fmt.Fprintf(c.Log, "Selected the best %d of %d frames with sharpness %.4g to %.4g\n",
+		keep, len(ins), scores[order[keep-1]], scores[order[0]])
+	return outs, nil
+}
+
+// Materializes the given promises with limited concurrency and scores them by sharpness. Frames are
+// released right after scoring. Frames which are skipped upstream or cannot be scored get negative infinity
+func (op *OpSelectBest) score(ins []ops.Promise, c *ops.Context) (scores []float32, err error) {
+	scores = make([]float32, len(ins))
+	errs := make([]error, len(ins))
+	limiter := make(chan bool, c.MaxThreads)
+	for i, in := range ins {
+		limiter <- true
+		go func(i int, in ops.Promise) {
+			defer func() { <-limiter }()
+			scores[i] = float32(math.Inf(-1))
+			f, err := in()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if f == nil {
+				return
+			}
+			s, err := f.Sharpness(op.Metric, op.Region, op.Bin)
+			if err != nil {
+				fmt.Fprintf(c.Log, "%d: %s, skipping frame\n", f.ID, err.Error())
+				return
+			}
+			scores[i] = s
+			fmt.Fprintf(c.Log, "%d: Sharpness %.4g\n", f.ID, s)
+		}(i, in)
+	}
+	for i := 0; i < cap(limiter); i++ { // wait for goroutines to finish
+		limiter <- true
+	}
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
+		}
+	}
+	return scores, nil
+}
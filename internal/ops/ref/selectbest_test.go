@@ -0,0 +1,152 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ref
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a promise for a frame of surface detail blurred by the given sigma and scaled by the given transparency
+func newTestSurface(id int, sigma, transparency float32) ops.Promise {
+	return func() (*fits.Image, error) {
+		rng := rand.New(rand.NewSource(1))
+		width, height := int32(96), int32(64)
+		img := fits.NewImageFromNaxisn([]int32{width, height}, nil)
+		img.ID = id
+		for i := range img.Data {
+			img.Data[i] = 1000
+		}
+		for b := 0; b < 60; b++ {
+			bx, by, flux := rng.Float32()*float32(width), rng.Float32()*float32(height), 1000+rng.Float32()*2000
+			amp := flux / (sigma * sigma) // blurring preserves the flux
+			for y := int32(0); y < height; y++ {
+				for x := int32(0); x < width; x++ {
+					dx, dy := float32(x)-bx, float32(y)-by
+					img.Data[y*width+x] += amp * float32(math.Exp(float64(-(dx*dx+dy*dy)/(2*sigma*sigma))))
+				}
+			}
+		}
+		for i := range img.Data {
+			img.Data[i] = img.Data[i]*transparency + float32(rng.NormFloat64())
+		}
+		return img, nil
+	}
+}
+
+func TestSelectBest(t *testing.T) {
+	// the sharpest frames are 1 and 3, and frame 3 is dimmed by thin clouds
+	sigmas := []float32{3, 1.2, 2.5, 1.5, 4}
+	transparencies := []float32{1, 1, 1, 0.5, 0.8}
+	for _, metric := range []fits.SharpnessMetric{fits.SMLaplacian, fits.SMGradient} {
+		for _, keep := range []struct {
+			percent float32
+			count   int
+			want    []int
+		}{{30, 0, []int{1, 3}}, {0, 3, []int{1, 2, 3}}, {0, 0, []int{0, 1, 2, 3, 4}}} {
+			ins := make([]ops.Promise, len(sigmas))
+			for i := range ins {
+				ins[i] = newTestSurface(i, sigmas[i], transparencies[i])
+			}
+			ins = append(ins, func() (*fits.Image, error) { return nil, nil }) // frame skipped upstream
+
+			c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+			c.MaxThreads = 2
+			op := NewOpSelectBest(metric, fits.Rect{X: 4, Y: 4, Width: 88, Height: 56}, 1, keep.percent, keep.count, ops.NewOpSequence())
+			outs, err := op.MakePromises(ins, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep.percent == 0 && keep.count == 0 {
+				if len(outs) != len(ins) {
+					t.Errorf("metric %d: got %d promises; want all %d", metric, len(outs), len(ins))
+				}
+				continue
+			}
+			got := []int{}
+			for _, out := range outs {
+				f, err := out()
+				if err != nil || f == nil {
+					t.Fatalf("metric %d: got %v, err %v", metric, f, err)
+				}
+				got = append(got, f.ID)
+			}
+			if len(got) != len(keep.want) {
+				t.Fatalf("metric %d percent %g count %d: got frames %v; want %v", metric, keep.percent, keep.count, got, keep.want)
+			}
+			for i := range got {
+				if got[i] != keep.want[i] {
+					t.Errorf("metric %d percent %g count %d: got frames %v; want %v", metric, keep.percent, keep.count, got, keep.want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestSelectBestCalibrated(t *testing.T) {
+	// the blurriest frame has a strong fixed pattern, which calibration removes before scoring
+	pattern := func(f *fits.Image, sign float32) {
+		for i := range f.Data {
+			if i%7 == 0 {
+				f.Data[i] += sign * 500
+			}
+		}
+	}
+	sigmas := []float32{3, 1.2, 2.5, 1.5, 4}
+	ins := make([]ops.Promise, len(sigmas))
+	for i := range ins {
+		in := newTestSurface(i, sigmas[i], 1)
+		ins[i] = func() (*fits.Image, error) {
+			f, err := in()
+			if err == nil && f.ID == 4 {
+				pattern(f, 1)
+			}
+			return f, err
+		}
+	}
+	calibrate := &ops.OpUnaryBase{OpBase: ops.OpBase{Type: "calibrate"}}
+	calibrate.Apply = func(f *fits.Image, c *ops.Context) (*fits.Image, error) {
+		if f.ID == 4 {
+			pattern(f, -1)
+		}
+		return f, nil
+	}
+
+	for _, tc := range []struct {
+		calibrate *ops.OpSequence
+		want      int
+	}{{ops.NewOpSequence(), 4}, {ops.NewOpSequence(calibrate), 1}} {
+		c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+		outs, err := NewOpSelectBest(fits.SMLaplacian, fits.Rect{}, 1, 0, 1, tc.calibrate).MakePromises(ins, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := outs[0]()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ID != tc.want {
+			t.Errorf("with %d calibration steps selected frame %d; want %d", len(tc.calibrate.Steps), f.ID, tc.want)
+		}
+	}
+}
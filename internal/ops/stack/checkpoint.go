@@ -0,0 +1,317 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+const checkpointFile = "checkpoint.json"
+
+// State of batched stacking after a completed batch, persisted so an interrupted run can resume with the
+// remaining batches. Metadata is stored as JSON, pixel data as raw float32 files like the spill files
+type checkpoint struct {
+	NumFrames   int               `json:"numFrames"`
+	NumBatches  int64             `json:"numBatches"`
+	BatchSize   int64             `json:"batchSize"`
+	Perm        []int             `json:"perm"` // random permutation of the input frames into batches
+	BatchesDone int64             `json:"batchesDone"`
+	WeightSum   int64             `json:"weightSum"` // sum of batch weights in the stack of stacks
+	Files       []string          `json:"files"`     // files loaded in the completed batches
+	Stack       *checkpointImage  `json:"stack"`     // running stack of stacks, not yet finalized
+	AlignImage  *checkpointImage  `json:"alignImage"`
+	AlignNaxisn []int32           `json:"alignNaxisn"`
+	AlignStars  []star.Star       `json:"alignStars"`
+	AlignHFR    float32           `json:"alignHFR"`
+	MatchHisto  *stats.Cached     `json:"matchHisto"`
+	Maps        []*checkpointMaps `json:"maps"` // diagnostic maps accumulated by each stack operator
+}
+
+// Diagnostic maps of a stack operator accumulated over the completed batches, with the names of the raw
+// files. Names are empty for maps which are not saved
+type checkpointMaps struct {
+	Frames   int    `json:"frames"`
+	Low      string `json:"low"`
+	High     string `json:"high"`
+	Coverage string `json:"coverage"`
+	StdError string `json:"stdError"`
+}
+
+// Metadata of an image in a checkpoint, with data and coverage in separate raw files
+type checkpointImage struct {
+	ID           int         `json:"id"`
+	FileName     string      `json:"fileName"`
+	Header       fits.Header `json:"header"`
+	Bitpix       int32       `json:"bitpix"`
+	Bzero        float32     `json:"bzero"`
+	Bscale       float32     `json:"bscale"`
+	Naxisn       []int32     `json:"naxisn"`
+	Exposure     float32     `json:"exposure"`
+	Stars        []star.Star `json:"stars"`
+	HFR          float32     `json:"hfr"`
+	FWHM         float32     `json:"fwhm"`
+	Eccentricity float32     `json:"eccentricity"`
+	Data         string      `json:"data"`     // name of the raw data file in the checkpoint directory
+	Coverage     string      `json:"coverage"` // name of the raw coverage file, empty if none
+}
+
+func newCheckpoint(numFrames int, numBatches, batchSize int64, perm []int) *checkpoint {
+	return &checkpoint{NumFrames: numFrames, NumBatches: numBatches, BatchSize: batchSize, Perm: perm}
+}
+
+// Loads the checkpoint from the given directory, and restores the reference frame into the context.
+// Returns nil if there is no checkpoint, or an error if it belongs to a different set of frames
+func loadCheckpoint(dir string, numFrames int, c *ops.Context) (cp *checkpoint, stack *fits.Image, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		fmt.Fprintf(c.Log, "No checkpoint in %s, starting from the first batch.\n", dir)
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	cp = &checkpoint{}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, nil, fmt.Errorf("checkpoint in %s: %s", dir, err.Error())
+	}
+	if cp.NumFrames != numFrames || len(cp.Perm) != numFrames || cp.Stack == nil {
+		return nil, nil, fmt.Errorf("checkpoint in %s is for %d frames, not %d", dir, cp.NumFrames, numFrames)
+	}
+
+	if stack, err = cp.Stack.read(dir); err != nil {
+		return nil, nil, err
+	}
+	if cp.AlignImage != nil {
+		if c.AlignImage, err = cp.AlignImage.read(dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.AlignNaxisn, c.AlignStars, c.AlignHFR = cp.AlignNaxisn, cp.AlignStars, cp.AlignHFR
+	if cp.MatchHisto != nil {
+		c.MatchHisto = stats.NewStatsFromCached(nil, *cp.MatchHisto)
+	}
+	return cp, stack, nil
+}
+
+// Saves the checkpoint with the given running stack, the maps accumulated by the given stack operators, and
+// the reference frame from the context. The JSON is replaced atomically after the raw files are written, so
+// an interruption leaves the prior checkpoint intact
+func (cp *checkpoint) save(dir string, stack *fits.Image, stacks []*OpStack, c *ops.Context) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	prev, prevMaps := cp.Stack, cp.Maps
+	next, err := writeCheckpointImage(dir, fmt.Sprintf("stack-%d", cp.BatchesDone), stack)
+	if err != nil {
+		return err
+	}
+	cp.Stack = next
+	if cp.Maps, err = writeCheckpointMaps(dir, cp.BatchesDone, stack.Naxisn, stacks); err != nil {
+		return err
+	}
+	if cp.AlignImage == nil && c.AlignImage != nil { // the reference frame does not change after the first batch
+		if cp.AlignImage, err = writeCheckpointImage(dir, "reference", c.AlignImage); err != nil {
+			return err
+		}
+	}
+	cp.AlignNaxisn, cp.AlignStars, cp.AlignHFR = c.AlignNaxisn, c.AlignStars, c.AlignHFR
+	if c.MatchHisto != nil {
+		cached := c.MatchHisto.Cached()
+		cp.MatchHisto = &cached
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, checkpointFile)
+	if err = os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if prev != nil && prev.Data != next.Data {
+		prev.remove(dir)
+		for _, cm := range prevMaps {
+			cm.remove(dir)
+		}
+	}
+	return nil
+}
+
+// Removes the checkpoint files from the given directory, after a successful run
+func (cp *checkpoint) remove(dir string) {
+	for _, ci := range []*checkpointImage{cp.Stack, cp.AlignImage} {
+		if ci != nil {
+			ci.remove(dir)
+		}
+	}
+	for _, cm := range cp.Maps {
+		cm.remove(dir)
+	}
+	os.Remove(filepath.Join(dir, checkpointFile))
+}
+
+// Wraps the given promises to record the file names of the loaded frames. Fails on files which were
+// processed before the checkpoint, as the inputs then differ from the interrupted run
+func (cp *checkpoint) recordFiles(ins []ops.Promise, done map[string]bool, lock *sync.Mutex) []ops.Promise {
+	outs := make([]ops.Promise, len(ins))
+	for i, in := range ins {
+		in := in
+		outs[i] = func() (*fits.Image, error) {
+			f, err := in()
+			if err != nil || f == nil {
+				return f, err
+			}
+			if done[f.FileName] {
+				return nil, fmt.Errorf("%d: file %s was already stacked before the checkpoint, inputs have changed", f.ID, f.FileName)
+			}
+			lock.Lock()
+			cp.Files = append(cp.Files, f.FileName)
+			lock.Unlock()
+			return f, nil
+		}
+	}
+	return outs
+}
+
+// Writes data and coverage of the given image to raw files with the given base name
+func writeCheckpointImage(dir, base string, f *fits.Image) (ci *checkpointImage, err error) {
+	ci = &checkpointImage{
+		ID:           f.ID,
+		FileName:     f.FileName,
+		Header:       f.Header,
+		Bitpix:       f.Bitpix,
+		Bzero:        f.Bzero,
+		Bscale:       f.Bscale,
+		Naxisn:       f.Naxisn,
+		Exposure:     f.Exposure,
+		Stars:        f.Stars,
+		HFR:          f.HFR,
+		FWHM:         f.FWHM,
+		Eccentricity: f.Eccentricity,
+		Data:         base + ".raw",
+	}
+	if _, err = writeSpill(filepath.Join(dir, ci.Data), f); err != nil {
+		return nil, err
+	}
+	if f.Coverage != nil {
+		ci.Coverage = base + "-coverage.raw"
+		if _, err = writeSpill(filepath.Join(dir, ci.Coverage), fits.NewImageFromNaxisn(f.Naxisn, f.Coverage)); err != nil {
+			return nil, err
+		}
+	}
+	return ci, nil
+}
+
+// Reads the image with data and coverage from the raw files
+func (ci *checkpointImage) read(dir string) (f *fits.Image, err error) {
+	f = fits.NewImageFromNaxisn(ci.Naxisn, nil)
+	f.ID, f.FileName, f.Header = ci.ID, ci.FileName, ci.Header
+	f.Bitpix, f.Bzero, f.Bscale, f.Exposure = ci.Bitpix, ci.Bzero, ci.Bscale, ci.Exposure
+	f.Stars, f.HFR, f.FWHM, f.Eccentricity = ci.Stars, ci.HFR, ci.FWHM, ci.Eccentricity
+	s := &spillFile{name: filepath.Join(dir, ci.Data), width: f.Naxisn[0], rows: f.Pixels / f.Naxisn[0]}
+	if err = s.readRows(0, s.rows, f.Data); err != nil {
+		return nil, fmt.Errorf("checkpoint file %s: %s", s.name, err.Error())
+	}
+	if ci.Coverage != "" {
+		f.Coverage = make([]float32, len(f.Data))
+		s.name = filepath.Join(dir, ci.Coverage)
+		if err = s.readRows(0, s.rows, f.Coverage); err != nil {
+			return nil, fmt.Errorf("checkpoint file %s: %s", s.name, err.Error())
+		}
+	}
+	return f, nil
+}
+
+func (ci *checkpointImage) remove(dir string) {
+	os.Remove(filepath.Join(dir, ci.Data))
+	if ci.Coverage != "" {
+		os.Remove(filepath.Join(dir, ci.Coverage))
+	}
+}
+
+// Writes the maps accumulated by the given stack operators to raw files, named with the given batch number
+func writeCheckpointMaps(dir string, batch int64, naxisn []int32, stacks []*OpStack) (cms []*checkpointMaps, err error) {
+	for i, st := range stacks {
+		cm := &checkpointMaps{Frames: st.batchFrames}
+		m := st.batchMaps
+		if m == nil {
+			m = &StackMaps{}
+		}
+		for _, p := range []struct {
+			name *string
+			kind string
+			data []float32
+		}{{&cm.Low, "low", m.Low}, {&cm.High, "high", m.High}, {&cm.Coverage, "coverage", m.Coverage}, {&cm.StdError, "stderr", m.StdError}} {
+			if p.data == nil {
+				continue
+			}
+			*p.name = fmt.Sprintf("maps%d-%s-%d.raw", i, p.kind, batch)
+			if _, err = writeSpill(filepath.Join(dir, *p.name), fits.NewImageFromNaxisn(naxisn, p.data)); err != nil {
+				return nil, err
+			}
+		}
+		cms = append(cms, cm)
+	}
+	return cms, nil
+}
+
+// Restores the maps accumulated by the given stack operators from the raw files, for images of the given size
+func (cp *checkpoint) readMaps(dir string, naxisn []int32, stacks []*OpStack) error {
+	if len(cp.Maps) != len(stacks) {
+		return fmt.Errorf("checkpoint in %s has maps of %d stack operators, not %d", dir, len(cp.Maps), len(stacks))
+	}
+	pixels := int32(1)
+	for _, n := range naxisn {
+		pixels *= n
+	}
+	for i, cm := range cp.Maps {
+		m := &StackMaps{}
+		for _, p := range []struct {
+			name string
+			data *[]float32
+		}{{cm.Low, &m.Low}, {cm.High, &m.High}, {cm.Coverage, &m.Coverage}, {cm.StdError, &m.StdError}} {
+			if p.name == "" {
+				continue
+			}
+			*p.data = make([]float32, pixels)
+			s := &spillFile{name: filepath.Join(dir, p.name), width: naxisn[0], rows: pixels / naxisn[0]}
+			if err := s.readRows(0, s.rows, *p.data); err != nil {
+				return fmt.Errorf("checkpoint file %s: %s", s.name, err.Error())
+			}
+		}
+		stacks[i].batchMaps, stacks[i].batchFrames = m, cm.Frames
+	}
+	return nil
+}
+
+func (cm *checkpointMaps) remove(dir string) {
+	for _, name := range []string{cm.Low, cm.High, cm.Coverage, cm.StdError} {
+		if name != "" {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestStackBatchesCheckpoint(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	fs := make([]*fits.Image, 20)
+	for i := range fs {
+		fs[i] = fits.NewImageFromNaxisn([]int32{256, 256}, nil)
+		for j := range fs[i].Data {
+			fs[i].Data[j] = 100 + float32(rng.NormFloat64())
+		}
+		fs[i].Data[i*256+i] = 1000 // an outlier, so rejection depends on the batches
+	}
+	loads := 0
+	promises := func(failAt int) []ops.Promise {
+		loads = 0
+		ins := make([]ops.Promise, len(fs))
+		for i := range fs {
+			i := i
+			ins[i] = func() (*fits.Image, error) {
+				loads++
+				if loads == failAt {
+					return nil, errors.New("interrupted")
+				}
+				f := fits.NewImageFromNaxisn(fs[i].Naxisn, append([]float32(nil), fs[i].Data...))
+				f.ID, f.FileName, f.Exposure = i, fmt.Sprintf("light%02d.fits", i), 60
+				return f, nil
+			}
+		}
+		return ins
+	}
+	opStack := NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true)
+	newContext := func() *ops.Context { return ops.NewContext(io.Discard, 2, stats.LSEMedianMAD) } // fits only a few frames
+
+	// uninterrupted run
+	rand.Seed(1)
+	want, err := NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, "", false).Apply(promises(-1), newContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastLoad := loads
+
+	// run interrupted in the last batch, with a reference frame in the context
+	dir := t.TempDir()
+	c := newContext()
+	ref := fits.NewImageFromNaxisn([]int32{256, 256}, append([]float32(nil), fs[0].Data...))
+	ref.Data[0] = float32(math.NaN())
+	c.AlignNaxisn, c.AlignImage, c.AlignHFR = ref.Naxisn, ref, 2.5
+	c.AlignStars = []star.Star{{Index: 257, X: 1, Y: 1, Mass: 10, HFR: 2.5}}
+	c.MatchHisto = stats.NewStats(fs[1].Data, 256)
+	wantLoc := c.MatchHisto.Location()
+	rand.Seed(1)
+	if _, err = NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, dir, false).Apply(promises(lastLoad), c); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if _, err = os.Stat(filepath.Join(dir, checkpointFile)); err != nil {
+		t.Fatalf("no checkpoint after interruption: %s", err.Error())
+	}
+
+	// resumed run with a different random permutation, which must be ignored
+	c = newContext()
+	rand.Seed(2)
+	got, err := NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, dir, true).Apply(promises(-1), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Exposure != want.Exposure {
+		t.Errorf("got exposure %g; want %g", got.Exposure, want.Exposure)
+	}
+	for i := range want.Data {
+		if got.Data[i] != want.Data[i] || got.Coverage[i] != want.Coverage[i] {
+			t.Fatalf("pixel %d is %g coverage %g; want %g coverage %g", i, got.Data[i], got.Coverage[i], want.Data[i], want.Coverage[i])
+		}
+	}
+	if c.AlignImage == nil || !math.IsNaN(float64(c.AlignImage.Data[0])) || c.AlignImage.Data[1] != ref.Data[1] ||
+		len(c.AlignStars) != 1 || c.AlignStars[0].Mass != 10 || c.AlignHFR != 2.5 || c.AlignNaxisn[1] != 256 {
+		t.Errorf("alignment reference not restored")
+	}
+	if c.MatchHisto == nil || c.MatchHisto.Location() != wantLoc {
+		t.Errorf("histogram reference not restored")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d files in checkpoint directory after completion; want none", len(entries))
+	}
+
+	// a checkpoint for a different number of frames is rejected
+	rand.Seed(1)
+	if _, err = NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, dir, false).Apply(promises(lastLoad), newContext()); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if _, err = NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, dir, true).Apply(promises(-1)[1:], newContext()); err == nil {
+		t.Error("resumed from a checkpoint for different frames")
+	}
+}
+
+func TestStackBatchesCheckpointMaps(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	fs := make([]*fits.Image, 20)
+	for i := range fs {
+		fs[i] = fits.NewImageFromNaxisn([]int32{256, 256}, nil)
+		for j := range fs[i].Data {
+			fs[i].Data[j] = 100 + float32(rng.NormFloat64())
+		}
+		fs[i].Data[i*256+i] = 1000 // an outlier in each frame
+	}
+	loads := 0
+	promises := func(failAt int) []ops.Promise {
+		loads = 0
+		ins := make([]ops.Promise, len(fs))
+		for i := range fs {
+			i := i
+			ins[i] = func() (*fits.Image, error) {
+				loads++
+				if loads == failAt {
+					return nil, errors.New("interrupted")
+				}
+				f := fits.NewImageFromNaxisn(fs[i].Naxisn, append([]float32(nil), fs[i].Data...))
+				f.ID, f.FileName = i, fmt.Sprintf("light%02d.fits", i)
+				return f, nil
+			}
+		}
+		return ins
+	}
+	newOpStack := func(dir string) *OpStack {
+		return NewOpStack(StSigma, StWeightNone, 1.5, 1.5, 0, 0, 0, 0, 0, 0, 0, 0,
+			filepath.Join(dir, "low%d.fits"), filepath.Join(dir, "high%d.fits"), filepath.Join(dir, "coverage%d.fits"), filepath.Join(dir, "stderr%d.fits"), false)
+	}
+	newContext := func() *ops.Context { return ops.NewContext(io.Discard, 4, stats.LSEMedianMAD) } // fits only a few frames besides the maps
+
+	// uninterrupted run
+	wantDir := t.TempDir()
+	rand.Seed(1)
+	if _, err := NewOpStackBatches(ops.NewOpSequence(newOpStack(wantDir)), "", false, 0, "", false).Apply(promises(-1), newContext()); err != nil {
+		t.Fatal(err)
+	}
+	lastLoad := loads
+
+	// run interrupted in the last batch, then resumed
+	gotDir, dir := t.TempDir(), t.TempDir()
+	rand.Seed(1)
+	if _, err := NewOpStackBatches(ops.NewOpSequence(newOpStack(gotDir)), "", false, 0, dir, false).Apply(promises(lastLoad), newContext()); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if _, err := NewOpStackBatches(ops.NewOpSequence(newOpStack(gotDir)), "", false, 0, dir, true).Apply(promises(-1), newContext()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the maps cover the batches before the interruption
+	for _, name := range []string{"low0.fits", "high0.fits", "coverage0.fits", "stderr0.fits"} {
+		want, err := fits.NewImageFromFile(filepath.Join(wantDir, name), 0, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fits.NewImageFromFile(filepath.Join(gotDir, name), 0, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want.Data {
+			if got.Data[i] != want.Data[i] {
+				t.Fatalf("%s pixel %d is %g; want %g", name, i, got.Data[i], want.Data[i])
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d files in checkpoint directory after completion; want none", len(entries))
+	}
+}
+
+func TestStackBatchesCheckpointComet(t *testing.T) {
+	ins := make([]ops.Promise, 4)
+	for i := range ins {
+		f := fits.NewImageFromNaxisn([]int32{16, 16}, nil)
+		ins[i] = func() (*fits.Image, error) { return f, nil }
+	}
+	opComet := NewOpStackComet(NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true),
+		nil, [2]float32{1, 0}, 6, fits.IPBilinear, "", "")
+	seq := ops.NewOpSequence(ops.NewOpSequence(opComet))
+	if _, err := NewOpStackBatches(seq, "", false, 0, t.TempDir(), false).Apply(ins, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)); err == nil {
+		t.Error("checkpointed comet stacking succeeded")
+	}
+}
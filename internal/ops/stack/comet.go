@@ -0,0 +1,376 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/star"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Radius of the disk excluded around the comet from the star-aligned stack by default, as fraction of the
+// smaller image dimension. Rejection alone leaves a slow comet in the star-aligned stack, doubling it
+const cometAutoRadius = 0.1
+
+// A comet position in the coordinates of the star-aligned frames, at the observation time of the given frame
+type CometAnchor struct {
+	ID   int       `json:"id"`   // image ID of the frame
+	X    float32   `json:"x"`    // comet position in star-aligned coordinates
+	Y    float32   `json:"y"`    // comet position in star-aligned coordinates
+	Time time.Time `json:"time"` // midpoint of the exposure, zero=from DATE-OBS of the frame when stacking
+}
+
+// Stacks star-aligned frames in comet mode. The comet is assumed to move linearly, with the motion derived from
+// its position in two frames, or from a rate and the observation times of the frames. Frames are shifted to
+// follow the comet for a comet-aligned stack, in which rejection removes the trailed stars. The star-aligned
+// stack rejects the comet, optionally helped by excluding a disk around it. Returns their combination, and
+// optionally saves both stacks. Takes n inputs, produces one output
+type OpStackComet struct {
+	ops.OpBase
+	Stack     *OpStack           `json:"stack"`     // stacking mode, weighting and rejection for both stacks
+	Anchors   []CometAnchor      `json:"anchors"`   // comet positions, two for deriving the motion, one for rate-based motion
+	Rate      [2]float32         `json:"rate"`      // comet motion in star-aligned pixels per hour, if fewer than two anchors
+	ByFrameID bool               `json:"byFrameID"` // interpolate comet motion by image ID for frames without observation times
+	Radius    float32            `json:"radius"`    // radius around the comet to exclude from the star stack, 0=auto, <0=rejection only. Needs an anchor
+	Interp    fits.Interpolation `json:"interp"`    // interpolation for shifting frames along the comet motion
+	SaveComet *ops.OpSave        `json:"saveComet"` // optional comet-aligned stack
+	SaveStars *ops.OpSave        `json:"saveStars"` // optional star-aligned stack with the comet rejected
+
+	motion    *cometMotion // comet motion, fixed with the first batch
+	cometSum  *fits.Image  // running sum of comet-aligned stacks over batches, if saved
+	starsSum  *fits.Image  // running sum of star-aligned stacks over batches, if saved
+	weightSum float32      // number of frames in the running sums
+}
+
+var _ ops.Operator = (*OpStackComet)(nil) // this type is an Operator
+
+func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpStackCometDefault() }) } // register the operator for JSON decoding
+
+func NewOpStackCometDefault() *OpStackComet {
+	return NewOpStackComet(NewOpStackDefault(), nil, [2]float32{}, 0, fits.IPBilinear, "", "")
+}
+
+func NewOpStackComet(stack *OpStack, anchors []CometAnchor, rate [2]float32, radius float32, interp fits.Interpolation,
+	saveComet, saveStars string) *OpStackComet {
+	if stack != nil {
+		stack.Coverage = true // combining the comet and star stacks needs coverage
+	}
+	return &OpStackComet{
+		OpBase:    ops.OpBase{Type: "stackComet"},
+		Stack:     stack,
+		Anchors:   anchors,
+		Rate:      rate,
+		Radius:    radius,
+		Interp:    interp,
+		SaveComet: ops.NewOpSave(saveComet, ops.EMMinMax, 1),
+		SaveStars: ops.NewOpSave(saveStars, ops.EMMinMax, 1),
+	}
+}
+
+// Unmarshal the type from JSON with default values for missing entries
+func (op *OpStackComet) UnmarshalJSON(data []byte) error {
+	type defaults OpStackComet
+	def := defaults(*NewOpStackCometDefault())
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+	*op = OpStackComet(def)
+	if op.Stack != nil {
+		op.Stack.Coverage = true // combining the comet and star stacks needs coverage
+	}
+	return nil
+}
+
+func (op *OpStackComet) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.Promise, err error) {
+	if len(ins) == 0 {
+		return nil, fmt.Errorf("%s operator needs inputs", op.Type)
+	}
+	out := func() (f *fits.Image, err error) {
+		fs, err := ops.MaterializeAll(ins, c.MaxThreads, false) // materialize all input promises
+		if err != nil {
+			return nil, err
+		}
+		return op.Apply(fs, c)
+	}
+	return []ops.Promise{out}, nil
+}
+
+// Sets missing anchor times from the DATE-OBS headers of the given files, indexed by image ID. Reads
+// headers only. Falls back to interpolating by image ID if an anchor frame lacks an observation time
+func (op *OpStackComet) ResolveAnchorTimes(fileNames []string, log io.Writer) error {
+	for i, a := range op.Anchors {
+		if !a.Time.IsZero() {
+			continue
+		}
+		if a.ID < 0 || a.ID >= len(fileNames) {
+			return fmt.Errorf("comet position refers to unknown image ID %d", a.ID)
+		}
+		f, err := fits.NewImageMasterDataFromFile(fileNames[a.ID], a.ID, log)
+		if err != nil {
+			return err
+		}
+		t, ok := f.MidExposure()
+		if !ok {
+			fmt.Fprintf(log, "%d: Warning: no DATE-OBS for comet position, interpolating comet motion by image ID\n", a.ID)
+			op.ByFrameID = true
+			continue
+		}
+		op.Anchors[i].Time = t
+	}
+	return nil
+}
+
+// Stacks the star-aligned frames in comet mode. Modifies the frames
+func (op *OpStackComet) Apply(fs []*fits.Image, c *ops.Context) (result *fits.Image, err error) {
+	if op.Stack == nil {
+		return nil, errors.New("missing stacking parameters for comet mode")
+	}
+	if op.motion == nil {
+		if op.motion, err = op.newCometMotion(fs, c); err != nil {
+			return nil, err
+		}
+	}
+	offsets := make([][2]float32, len(fs))
+	for i, f := range fs {
+		if offsets[i], err = op.motion.offset(f); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(c.Log, "%d: Comet offset (%.2f, %.2f)\n", f.ID, offsets[i][0], offsets[i][1])
+	}
+
+	// Stack the star-aligned frames, excluding a disk around the comet unless disabled
+	var excluded [][]float32
+	radius := op.radius(fs[0])
+	if radius > 0 && op.motion.hasPos {
+		excluded = make([][]float32, len(fs))
+		for i, f := range fs {
+			excluded[i] = exchangeDisk(f, op.motion.x0+offsets[i][0], op.motion.y0+offsets[i][1], radius, nil)
+		}
+	} else if radius > 0 {
+		fmt.Fprintf(c.Log, "Warning: comet position unknown, relying on rejection to remove it from the star-aligned stack\n")
+	}
+	fmt.Fprintf(c.Log, "Stacking star-aligned frames:\n")
+	stars, err := op.Stack.Apply(fs, c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range excluded {
+		exchangeDisk(fs[i], op.motion.x0+offsets[i][0], op.motion.y0+offsets[i][1], radius, excluded[i])
+	}
+
+	// Shift the frames along the comet motion and stack them, without saving the diagnostic maps again
+	for i, f := range fs {
+		shift := star.Transform2D{A: 1, B: 0, C: -offsets[i][0], D: 0, E: 1, F: -offsets[i][1]}
+		shifted, err := f.Project(f.Naxisn, &shift, float32(math.NaN()), op.Interp, c.MaxThreads)
+		if err != nil {
+			return nil, err
+		}
+		f.Data = shifted.Data
+	}
+	cometOp := *op.Stack
+	cometOp.SaveLow, cometOp.SaveHigh, cometOp.SaveCoverage, cometOp.SaveStdError = nil, nil, nil, nil
+	cometOp.endBatches()
+	fmt.Fprintf(c.Log, "Stacking comet-aligned frames:\n")
+	comet, err := cometOp.Apply(fs, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = op.saveRunning(stars, comet, float32(len(fs)), c); err != nil {
+		return nil, err
+	}
+	return combineCometAndStars(comet, stars), nil
+}
+
+// Returns the radius of the disk around the comet to exclude from the star-aligned stack for the given frame
+func (op *OpStackComet) radius(f *fits.Image) float32 {
+	if op.Radius != 0 {
+		return op.Radius
+	}
+	return cometAutoRadius * float32(math.Min(float64(f.Naxisn[0]), float64(f.Naxisn[1])))
+}
+
+// Adds the comet on a background-subtracted comet-aligned stack onto the star-aligned stack.
+// Uses whichever stack has coverage where the other one has none
+func combineCometAndStars(comet, stars *fits.Image) *fits.Image {
+	res := fits.NewImageFromImage(stars)
+	res.Coverage = stars.Coverage
+	background := stats.NewStats(comet.Data, comet.Naxisn[0]).Location()
+	for i, s := range stars.Data {
+		if comet.Coverage != nil && comet.Coverage[i] == 0 {
+			res.Data[i] = s
+		} else if stars.Coverage != nil && stars.Coverage[i] == 0 {
+			res.Data[i] = comet.Data[i]
+		} else {
+			res.Data[i] = s + comet.Data[i] - background
+		}
+	}
+	res.Stats = stats.NewStats(res.Data, res.Naxisn[0])
+	return res
+}
+
+// Adds the stacks of this batch to the running sums, and saves the stacks over all batches so far.
+// Saving after each batch leaves the complete stacks in the files after the last one
+func (op *OpStackComet) saveRunning(stars, comet *fits.Image, weight float32, c *ops.Context) error {
+	op.weightSum += weight
+	pairs := []struct {
+		sum   **fits.Image
+		stack *fits.Image
+		save  *ops.OpSave
+	}{
+		{&op.starsSum, stars, op.SaveStars},
+		{&op.cometSum, comet, op.SaveComet},
+	}
+	for _, p := range pairs {
+		if p.save == nil || p.save.FilePattern == "" {
+			continue
+		}
+		*p.sum = StackIncremental(*p.sum, p.stack, weight)
+		final := fits.NewImageFromImage(*p.sum)
+		copy(final.Data, (*p.sum).Data)
+		StackIncrementalFinalize(final, op.weightSum)
+		if _, err := p.save.Apply(final, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swaps the pixels in the disk with the given center and radius with the given values, or with NaN if
+// values are nil. Returns the previous pixel values in row-major order
+func exchangeDisk(f *fits.Image, xc, yc, r float32, values []float32) (previous []float32) {
+	width, height := f.Naxisn[0], f.Naxisn[1]
+	x0, x1 := int32(math.Max(0, math.Floor(float64(xc-r)))), int32(math.Min(float64(width-1), math.Ceil(float64(xc+r))))
+	y0, y1 := int32(math.Max(0, math.Floor(float64(yc-r)))), int32(math.Min(float64(height-1), math.Ceil(float64(yc+r))))
+	nan := float32(math.NaN())
+	k := 0
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			dx, dy := float32(x)-xc, float32(y)-yc
+			if dx*dx+dy*dy > r*r {
+				continue
+			}
+			i := y*width + x
+			previous = append(previous, f.Data[i])
+			if values != nil {
+				f.Data[i] = values[k]
+			} else {
+				f.Data[i] = nan
+			}
+			k++
+		}
+	}
+	return previous
+}
+
+// Linear comet motion in star-aligned coordinates
+type cometMotion struct {
+	byID   bool      // time measured in image IDs instead of observation times
+	t0     time.Time // reference time, at which the comet-aligned stack shows the comet
+	id0    int       // reference image ID if by ID
+	vx, vy float64   // velocity in pixels per hour, or per image ID
+	hasPos bool      // true if the position at reference time is known
+	x0, y0 float32   // position at reference time
+}
+
+// Derives the comet motion from the anchors or the rate. Missing anchor times are taken from the given frames
+func (op *OpStackComet) newCometMotion(fs []*fits.Image, c *ops.Context) (m *cometMotion, err error) {
+	m = &cometMotion{byID: op.ByFrameID}
+	if !m.byID {
+		for i, a := range op.Anchors {
+			if !a.Time.IsZero() {
+				continue
+			}
+			for _, f := range fs {
+				if f.ID == a.ID {
+					t, ok := f.MidExposure()
+					if !ok {
+						return nil, fmt.Errorf("%d: comet position needs an observation time from DATE-OBS", f.ID)
+					}
+					op.Anchors[i].Time = t
+				}
+			}
+			if op.Anchors[i].Time.IsZero() {
+				return nil, fmt.Errorf("%d: unknown observation time of comet position", a.ID)
+			}
+		}
+	}
+
+	switch {
+	case len(op.Anchors) >= 2:
+		a, b := op.Anchors[0], op.Anchors[1]
+		dt := float64(b.ID - a.ID)
+		if !m.byID {
+			dt = b.Time.Sub(a.Time).Hours()
+		}
+		if dt == 0 {
+			return nil, errors.New("comet positions must be from frames taken at different times")
+		}
+		m.vx, m.vy = float64(b.X-a.X)/dt, float64(b.Y-a.Y)/dt
+		m.t0, m.id0, m.hasPos, m.x0, m.y0 = a.Time, a.ID, true, a.X, a.Y
+
+	case op.Rate[0] != 0 || op.Rate[1] != 0:
+		if m.byID {
+			return nil, errors.New("comet motion by rate needs observation times")
+		}
+		m.vx, m.vy = float64(op.Rate[0]), float64(op.Rate[1])
+		if len(op.Anchors) == 1 {
+			a := op.Anchors[0]
+			m.t0, m.hasPos, m.x0, m.y0 = a.Time, true, a.X, a.Y
+		} else {
+			for _, f := range fs { // align the comet to its position in the earliest frame of the first batch
+				t, ok := f.MidExposure()
+				if !ok {
+					return nil, fmt.Errorf("%d: comet stacking by rate needs an observation time from DATE-OBS", f.ID)
+				}
+				if m.t0.IsZero() || t.Before(m.t0) {
+					m.t0 = t
+				}
+			}
+		}
+
+	default:
+		return nil, errors.New("comet mode needs two comet positions, or a rate of motion")
+	}
+
+	unit := "hour"
+	if m.byID {
+		unit = "image"
+	}
+	fmt.Fprintf(c.Log, "Comet moves by (%.3f, %.3f) pixels per %s\n", m.vx, m.vy, unit)
+	return m, nil
+}
+
+// Returns the comet offset in the given frame relative to the reference time
+func (m *cometMotion) offset(f *fits.Image) (d [2]float32, err error) {
+	dt := float64(f.ID - m.id0)
+	if !m.byID {
+		t, ok := f.MidExposure()
+		if !ok {
+			return d, fmt.Errorf("%d: comet stacking needs an observation time from DATE-OBS", f.ID)
+		}
+		dt = t.Sub(m.t0).Hours()
+	}
+	return [2]float32{float32(m.vx * dt), float32(m.vy * dt)}, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Adds a gaussian blob with the given peak and sigma at the given position
+func addBlob(data []float32, width int32, xc, yc, peak, sigma float32) {
+	for i := range data {
+		dx, dy := float32(int32(i)%width)-xc, float32(int32(i)/width)-yc
+		data[i] += peak * float32(math.Exp(-float64(dx*dx+dy*dy)/float64(2*sigma*sigma)))
+	}
+}
+
+// Creates star-aligned frames with a fixed star and a comet moving the given pixels per minute to the right,
+// taken one minute apart
+func cometFrames(n int, speed float32) []*fits.Image {
+	width, height := int32(80), int32(40)
+	rng := rand.New(rand.NewSource(5))
+	start := time.Date(2023, 3, 1, 22, 0, 0, 0, time.UTC)
+	fs := make([]*fits.Image, n)
+	for i := range fs {
+		data := make([]float32, width*height)
+		for j := range data {
+			data[j] = 100 + float32(rng.NormFloat64())
+		}
+		addBlob(data, width, 60, 30, 500, 1.2)              // star
+		addBlob(data, width, 10+speed*float32(i), 12, 200, 2.0) // comet
+		fs[i] = fits.NewImageFromNaxisn([]int32{width, height}, data)
+		fs[i].ID, fs[i].Exposure = i, 60
+		fs[i].Header.Strings["DATE-OBS"] = start.Add(time.Duration(i) * time.Minute).Add(-30 * time.Second).Format("2006-01-02T15:04:05")
+		fs[i].Stats = stats.NewStats(fs[i].Data, width)
+	}
+	return fs
+}
+
+func TestStackCometByAnchors(t *testing.T) {
+	fs := cometFrames(9, 4)
+	width := fs[0].Naxisn[0]
+	op := NewOpStackComet(NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true),
+		[]CometAnchor{{ID: 2, X: 18, Y: 12}, {ID: 6, X: 34, Y: 12}}, [2]float32{}, 6, fits.IPBilinear, "", "")
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+
+	res, err := op.Apply(fs, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.motion.vx < 239 || op.motion.vx > 241 || op.motion.vy != 0 {
+		t.Errorf("got motion (%g, %g) pixels per hour, want (240, 0)", op.motion.vx, op.motion.vy)
+	}
+	at := func(x, y int32) float32 { return res.Data[y*width+x] }
+	if v := at(18, 12); v < 250 {
+		t.Errorf("comet at anchor position %g, want about 300", v)
+	}
+	if v := at(60, 30); v < 550 {
+		t.Errorf("star %g, want about 600", v)
+	}
+	for _, x := range []int32{10, 26, 42} { // other comet positions along its path must be background
+		if v := at(x, 12); v > 110 {
+			t.Errorf("comet trail at x=%d is %g, want background", x, v)
+		}
+	}
+}
+
+func TestStackCometByRate(t *testing.T) {
+	fs := cometFrames(9, 4)
+	op := NewOpStackComet(NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true),
+		nil, [2]float32{240, 0}, 0, fits.IPBilinear, "", "")
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	res, err := op.Apply(fs, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without anchors, the comet is aligned to its position in the earliest frame
+	if v := res.Data[12*res.Naxisn[0]+10]; v < 250 {
+		t.Errorf("comet at first position %g, want about 300", v)
+	}
+}
+
+func TestStackCometSlow(t *testing.T) {
+	// a slow comet survives rejection in the star-aligned stack, so only the excluded disk avoids doubling it
+	for _, tc := range []struct {
+		radius  float32
+		doubled bool
+	}{{0, false}, {-1, true}} {
+		fs := cometFrames(9, 0.25)
+		op := NewOpStackComet(NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true),
+			[]CometAnchor{{ID: 0, X: 10, Y: 12}, {ID: 8, X: 12, Y: 12}}, [2]float32{}, tc.radius, fits.IPBilinear, "", "")
+		res, err := op.Apply(fs, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := res.Data[12*res.Naxisn[0]+10]; (v > 400) != tc.doubled {
+			t.Errorf("radius %g: comet at anchor position %g, doubled=%v", tc.radius, v, tc.doubled)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+)
+
+// Mode of a running stack
+type RunningMode int
+
+const (
+	RMMean  RunningMode = iota // Running mean of all frames
+	RMSigma                    // Running mean, rejecting values which deviate from the running mean by more than the given sigmas
+)
+
+// A running stack which incorporates one frame at a time, for live stacking. Keeps the per-pixel
+// mean and sum of squared deviations with Welford's algorithm, so memory does not grow with the
+// number of frames. Sigma rejection approximates batch sigma clipping by testing each new value
+// against the statistics of the values accepted so far
+type RunningStack struct {
+	Mode        RunningMode `json:"mode"`
+	SigmaLow    float32     `json:"sigmaLow"`
+	SigmaHigh   float32     `json:"sigmaHigh"`
+	MinFrames   int32       `json:"minFrames"` // number of values per pixel before rejection starts
+	Naxisn      []int32     `json:"-"`
+	Header      fits.Header `json:"-"` // pointing and optics keys of the first frame
+	Mean        []float32   `json:"-"` // running mean of the accepted values per pixel
+	M2          []float32   `json:"-"` // running sum of squared deviations from the mean per pixel
+	Count       []int32     `json:"-"` // number of accepted values per pixel
+	Frames      int         `json:"frames"`
+	Exposure    float32     `json:"exposure"`
+	ClippedLow  int64       `json:"clippedLow"`
+	ClippedHigh int64       `json:"clippedHigh"`
+}
+
+func NewRunningStack(mode RunningMode, sigmaLow, sigmaHigh float32) *RunningStack {
+	return &RunningStack{
+		Mode:      mode,
+		SigmaLow:  sigmaLow,
+		SigmaHigh: sigmaHigh,
+		MinFrames: 3,
+	}
+}
+
+// Adds the given frame to the running stack. NaN values, e.g. out of bounds after alignment, are skipped
+func (rs *RunningStack) Add(f *fits.Image) error {
+	if rs.Mode < RMMean || rs.Mode > RMSigma {
+		return errors.New("invalid running stack mode")
+	}
+	if rs.Frames == 0 {
+		rs.Naxisn = append([]int32(nil), f.Naxisn...)
+		rs.Header = fits.NewHeader()
+		rs.Header.CopyPointing(&f.Header)
+		rs.Mean = make([]float32, len(f.Data))
+		rs.M2 = make([]float32, len(f.Data))
+		rs.Count = make([]int32, len(f.Data))
+	} else if len(f.Data) != len(rs.Mean) {
+		return fmt.Errorf("%d: frame size %v differs from running stack size %v", f.ID, f.Naxisn, rs.Naxisn)
+	}
+
+	clipLow, clipHigh := int64(0), int64(0)
+	for i, v := range f.Data {
+		if math.IsNaN(float64(v)) {
+			continue
+		}
+		n, mean := rs.Count[i], rs.Mean[i]
+		if rs.Mode == RMSigma && n >= rs.MinFrames {
+			stdDev := float32(math.Sqrt(float64(rs.M2[i] / float32(n-1))))
+			if stdDev > 0 { // identical values so far give no basis for rejection
+				if v < mean-rs.SigmaLow*stdDev {
+					clipLow++
+					continue
+				} else if v > mean+rs.SigmaHigh*stdDev {
+					clipHigh++
+					continue
+				}
+			}
+		}
+		n++
+		delta := v - mean
+		mean += delta / float32(n)
+		rs.Count[i], rs.Mean[i], rs.M2[i] = n, mean, rs.M2[i]+delta*(v-mean)
+	}
+
+	rs.Frames++
+	rs.Exposure += f.Exposure
+	rs.ClippedLow, rs.ClippedHigh = rs.ClippedLow+clipLow, rs.ClippedHigh+clipHigh
+	return nil
+}
+
+// Returns the current state of the running stack as a new image, with coverage as fraction of frames.
+// Pixels without data are set to the average of the pixels with data, see StackMedian on why this is not NaN
+func (rs *RunningStack) Image() (*fits.Image, error) {
+	if rs.Frames == 0 {
+		return nil, errors.New("running stack is empty")
+	}
+	data := make([]float32, len(rs.Mean))
+	coverage := make([]float32, len(rs.Mean))
+	invFrames := 1 / float32(rs.Frames)
+	sum, covered := float64(0), 0
+	for i, n := range rs.Count {
+		if n > 0 {
+			data[i] = rs.Mean[i]
+			sum, covered = sum+float64(rs.Mean[i]), covered+1
+		}
+		coverage[i] = float32(n) * invFrames
+	}
+	if covered < len(data) {
+		fill := float32(0)
+		if covered > 0 {
+			fill = float32(sum / float64(covered))
+		}
+		for i, n := range rs.Count {
+			if n == 0 {
+				data[i] = fill
+			}
+		}
+	}
+	img := fits.NewImageFromNaxisn(rs.Naxisn, data)
+	img.Exposure = rs.Exposure
+	img.Coverage = coverage
+	img.Header.CopyPointing(&rs.Header)
+	return img, nil
+}
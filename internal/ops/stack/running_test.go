@@ -0,0 +1,67 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+)
+
+func TestRunningStack(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	nan := float32(math.NaN())
+	for _, mode := range []RunningMode{RMMean, RMSigma} {
+		rs := NewRunningStack(mode, 3, 3)
+		sum := float32(0)
+		for i := 0; i < 20; i++ {
+			data := []float32{100 + float32(rng.NormFloat64()), 50, nan}
+			if i == 10 {
+				data[0] = 1000 // satellite trail
+			}
+			if i == 15 {
+				data[1] = nan // out of bounds after alignment
+			}
+			sum += data[0]
+			f := fits.NewImageFromNaxisn([]int32{3, 1}, data)
+			f.Exposure = 60
+			if err := rs.Add(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		img, err := rs.Image()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Exposure != 1200 || img.Data[1] != 50 || img.Coverage[1] != 0.95 || img.Coverage[2] != 0 {
+			t.Errorf("mode %d: got exposure %g, pixel %g, coverage %v", mode, img.Exposure, img.Data[1], img.Coverage)
+		}
+		if mode == RMMean && math.Abs(float64(img.Data[0]-sum/20)) > 1e-3 {
+			t.Errorf("mean: got %g; want %g", img.Data[0], sum/20)
+		}
+		if mode == RMSigma && (math.Abs(float64(img.Data[0]-100)) > 1 || rs.ClippedHigh < 1) {
+			t.Errorf("sigma: got %g with %d clipped high; want trail rejected", img.Data[0], rs.ClippedHigh)
+		}
+	}
+
+	rs := NewRunningStack(RMMean, 3, 3)
+	rs.Add(fits.NewImageFromNaxisn([]int32{2, 2}, nil))
+	if err := rs.Add(fits.NewImageFromNaxisn([]int32{3, 2}, nil)); err == nil {
+		t.Errorf("expected error for differing frame size")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"github.com/mlnoga/nightlight/internal/fits"
@@ -39,11 +40,16 @@ const (
 	StMADSigma
 	StLinearFit
 	StAuto
+	StESD        // generalized extreme studentized deviate rejection, for large stacks
+	StPercentile // percentile clipping around the median, for tiny stacks
+	StMinMax     // dropping the lowest and highest values, for tiny stacks
 )
 
 // Auto-select stacking mode based on number of frames
 func autoSelectStackingMode(l int) StackMode {
-	if l>=25 {
+	if l>=100 {
+		return StESD
+	} else if l>=25 {
 		return StLinearFit   
     } else if l>=15 {
     	return StWinsorSigma 
@@ -60,6 +66,10 @@ const (
 	StWeightExposure
 	StWeightInverseNoise
 	StWeightInverseHFR
+	StWeightInverseVariance // inverse of the squared noise estimate
+	StWeightSNR             // squared signal to noise ratio
+	StWeightPSFSignal       // squared PSF signal, combining star flux, FWHM and noise
+	StWeightManual          // manual per-file weights
 )
 
 
@@ -67,23 +77,57 @@ type OpStack struct {
 	ops.OpBase
 	Mode         StackMode       `json:"mode"`
 	Weighting    StackWeighting  `json:"weighting"`
+	Weights      map[string]float32 `json:"weights"`  // manual weights by file name, with or without path
 	SigmaLow     float32         `json:"sigmaLow"`
 	SigmaHigh    float32         `json:"sigmaHigh"`
+	ClipPercLow  float32         `json:"clipPercLow"`   // desired percentage of low rejections if the low bound is negative
+	ClipPercHigh float32         `json:"clipPercHigh"`  // desired percentage of high rejections if the high bound is negative
+	PercLow      float32         `json:"percLow"`       // percentile clipping: reject values below the median by more than this fraction of it
+	PercHigh     float32         `json:"percHigh"`      // percentile clipping: reject values above the median by more than this fraction of it
+	ESDFraction  float32         `json:"esdFraction"`   // ESD rejection: maximum fraction of outliers per pixel
+	ESDAlpha     float32         `json:"esdAlpha"`      // ESD rejection: significance level of the outlier test
+	DropLow      int             `json:"dropLow"`       // min/max rejection: number of lowest values to drop per pixel
+	DropHigh     int             `json:"dropHigh"`      // min/max rejection: number of highest values to drop per pixel
 	RefFrameLoc  float32         `json:"-"`
+	SaveLow      *ops.OpSave     `json:"saveLow"`       // optional map of per-pixel low rejection counts
+	SaveHigh     *ops.OpSave     `json:"saveHigh"`      // optional map of per-pixel high rejection counts
+	SaveCoverage *ops.OpSave     `json:"saveCoverage"`  // optional map of per-pixel number of valid frames
+	SaveStdError *ops.OpSave     `json:"saveStdError"`  // optional map of per-pixel standard error
+	Coverage     bool            `json:"coverage"`      // record the fraction of frames covering each pixel on the stack, e.g. for auto-cropping
+
+	batchMaps    *StackMaps      // if set, maps are accumulated here over batches and saved after the last one
+	batchFrames  int             // number of frames in the accumulated maps
 }
 
 func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpStackDefault() })} // register the operator for JSON decoding
 
-func NewOpStackDefault() *OpStack { return NewOpStack(StAuto, StWeightNone, 2.75, 2.75) }
+func NewOpStackDefault() *OpStack { 
+	return NewOpStack(StAuto, StWeightNone, 2.75, 2.75, 0.5, 0.5, 0.2, 0.1, 0.3, 0.05, 1, 1, "", "", "", "", false) 
+}
 
-func NewOpStack(mode StackMode, weighting StackWeighting, sigmaLow, sigmaHigh float32) *OpStack {
+func NewOpStack(mode StackMode, weighting StackWeighting, sigmaLow, sigmaHigh, clipPercLow, clipPercHigh, 
+	            percLow, percHigh, esdFraction, esdAlpha float32, dropLow, dropHigh int,
+	            saveLow, saveHigh, saveCoverage, saveStdError string, coverage bool) *OpStack {
 	op:=&OpStack{
 	  	OpBase      : ops.OpBase{Type: "stack"},
 		Mode        : mode, 
 		Weighting   : weighting, 
 		SigmaLow    : sigmaLow, 
 		SigmaHigh   : sigmaHigh, 
+		ClipPercLow : clipPercLow,
+		ClipPercHigh: clipPercHigh,
+		PercLow     : percLow,
+		PercHigh    : percHigh,
+		ESDFraction : esdFraction,
+		ESDAlpha    : esdAlpha,
+		DropLow     : dropLow,
+		DropHigh    : dropHigh,
 		RefFrameLoc : 0,
+		SaveLow     : ops.NewOpSave(saveLow,      ops.EMMinMax, 1),
+		SaveHigh    : ops.NewOpSave(saveHigh,     ops.EMMinMax, 1),
+		SaveCoverage: ops.NewOpSave(saveCoverage, ops.EMMinMax, 1),
+		SaveStdError: ops.NewOpSave(saveStdError, ops.EMMinMax, 1),
+		Coverage    : coverage,
 	}
 	return op
 }
@@ -111,25 +155,120 @@ func (op *OpStack) MakePromises(ins []ops.Promise, c *ops.Context) (outs []ops.P
 }
 
 
-// Stack a set of light frames. Limits parallelism to the number of available cores
+// Stack a set of light frames. Limits parallelism to the number of available cores.
+// If the rejection bounds of the stacking mode are negative, they are goal-seeked
+// to reach the desired clipping percentages
 func (op *OpStack) Apply(f []*fits.Image, c *ops.Context) (result *fits.Image, err error) {
-	// validate stacking modes and perform automatic mode selection if necesssary
-	mode:=op.Mode
-	if mode<StMedian || mode>StAuto {
-		return nil, errors.New("invalid stacking mode")
+	mode, weights, err:=op.prepare(f, c)
+	if err!=nil { return nil, err }
+
+	// stack, goal-seeking the bounds if requested
+	var data []float32
+	var maps *StackMaps
+	var numClippedLow, numClippedHigh int32
+	if low, high:=op.bounds(mode); low<0 || high<0 {
+		data, maps, numClippedLow, numClippedHigh, _, _=op.FindSigmasAndStack(f, mode, weights, c)
+	} else {
+		fmt.Fprintf(c.Log, "Stacking %d frames with stacking mode %d and %s:\n", len(f), mode, op.describe(mode, low, high))
+		data, maps, numClippedLow, numClippedHigh=op.stack(f, mode, weights, low, high, c)
+	}
+	return op.assemble(f, mode, data, maps, numClippedLow, numClippedHigh, c)
+}
+
+// Assembles the stacked data of the given frames into an image, reporting the clipping and saving the diagnostic maps
+func (op *OpStack) assemble(f []*fits.Image, mode StackMode, data []float32, maps *StackMaps, numClippedLow, numClippedHigh int32, c *ops.Context) (result *fits.Image, err error) {
+	// report back on clipping for modes that apply clipping
+	if mode>=StSigma {
+		fmt.Fprintf(c.Log, "Clipped low %d (%.2f%%) high %d (%.2f%%)\n", 
+			numClippedLow,  float32(numClippedLow )*100.0/(float32(len(data)*len(f))),
+			numClippedHigh, float32(numClippedHigh)*100.0/(float32(len(data)*len(f))) )
+	}
+
+	exposureSum:=float32(0)
+	for _,l :=range f { exposureSum+=l.Exposure }
+
+	// Assemble into in-memory FITS
+	stack:=fits.NewImageFromNaxisn(f[0].Naxisn, data)
+	stack.Exposure = exposureSum
+	stack.Header.CopyPointing(&f[0].Header)
+
+	// Save optional diagnostic maps, or accumulate them if stacking in batches
+	if op.batchMaps!=nil {
+		op.accumulateMaps(maps, len(f))
+	} else {
+		err=maps.Save(stack.Naxisn, stack.ID, op.SaveLow, op.SaveHigh, op.SaveCoverage, op.SaveStdError, c)
+		if err!=nil { return nil, err }
+	}
+
+	// Keep coverage as fraction of frames, reusing the map
+	if maps!=nil && maps.Coverage!=nil {
+		invFrames:=1.0/float32(len(f))
+		for i,v:=range maps.Coverage { maps.Coverage[i]=v*invFrames }
+		stack.Coverage=maps.Coverage
+	}
+	return stack, nil
+}
+
+// Validates the stacking mode and performs automatic mode selection if necessary. 
+// Selects and logs the weights of the given frames if applicable
+func (op *OpStack) prepare(f []*fits.Image, c *ops.Context) (mode StackMode, weights []float32, err error) {
+	mode=op.Mode
+	if mode<StMedian || mode>StMinMax {
+		return mode, nil, errors.New("invalid stacking mode")
 	}
 	if mode==StAuto { 
 		mode=autoSelectStackingMode(len(f))
+		fmt.Fprintf(c.Log, "Auto-selected stacking mode %d based on %d frames\n", mode, len(f))
 	}
-	fmt.Fprintf(c.Log, "Stacking %d frames with stacking mode %d and sigma low %g high %g:\n", 
-				len(f), mode, op.SigmaLow, op.SigmaHigh)
 
-	// select weights if applicable
-	weights, err:=getWeights(f, op.Weighting)
-	if err!=nil { return nil, err }
+	weights, err=getWeights(f, op.Weighting, op.Weights)
+	if err!=nil { return mode, nil, err }
+	for i,l:=range f {
+		w:=float32(1) // unweighted
+		if weights!=nil {
+			w=weights[i]
+			fmt.Fprintf(c.Log, "%d: stacking weight %.3f\n", l.ID, w)
+		}
+		c.RecordStackWeight(l.ID, w) // for the statistics export
+	}
+	return mode, weights, nil
+}
+
+// Returns the lower and upper rejection bounds of the given stacking mode which can be goal-seeked:
+// sigmas for the sigma clipping modes, fractions of the median for percentile clipping, else zero
+func (op *OpStack) bounds(mode StackMode) (low, high float32) {
+	switch mode {
+	case StSigma, StWinsorSigma, StMADSigma, StLinearFit:
+		return op.SigmaLow, op.SigmaHigh
+	case StPercentile:
+		return op.PercLow, op.PercHigh
+	}
+	return 0, 0
+}
 
+// Describes the rejection parameters of the given stacking mode for logging
+func (op *OpStack) describe(mode StackMode, low, high float32) string {
+	switch mode {
+	case StMedian, StMean:
+		return "no rejection"
+	case StESD:
+		return fmt.Sprintf("ESD outlier fraction %g significance %g", op.ESDFraction, op.ESDAlpha)
+	case StPercentile:
+		return fmt.Sprintf("percentile low %g high %g", low, high)
+	case StMinMax:
+		return fmt.Sprintf("dropping %d lowest and %d highest values", op.DropLow, op.DropHigh)
+	}
+	return fmt.Sprintf("sigma low %g high %g", low, high)
+}
+
+// Stacks a set of light frames with the given mode, weights and rejection bounds, in parallel batches.
+// Returns the stacked data, the diagnostic maps and the total number of values clipped low and high
+func (op *OpStack) stack(f []*fits.Image, mode StackMode, weights []float32, low, high float32, c *ops.Context) (data []float32, maps *StackMaps, numClippedLow, numClippedHigh int32) {
 	// create return value array
-	data:=make([]float32,len(f[0].Data))
+	data=make([]float32,len(f[0].Data))
+
+	// create diagnostic maps
+	maps=op.newMaps(len(data))
 
 	// split into 8 MB work packages, no fewer than 8*NumCPU()
 	numBatches:=4*len(f)*len(f[0].Data)/(8192*1024)
@@ -137,7 +276,7 @@ func (op *OpStack) Apply(f []*fits.Image, c *ops.Context) (result *fits.Image, e
 	batchSize:=(len(data)+numBatches-1)/(numBatches)
 	sem   :=make(chan bool, runtime.NumCPU()) // limit parallelism to NumCPUs()
 
-	numClippedLock, numClippedLow, numClippedHigh:=sync.Mutex{}, int32(0), int32(0)
+	numClippedLock:=sync.Mutex{}
 	progressLock, progress:=sync.Mutex{}, float32(0)
 	for lower:=0; lower<len(data); lower+=batchSize {
 		upper:=lower+batchSize
@@ -150,43 +289,65 @@ func (op *OpStack) Apply(f []*fits.Image, c *ops.Context) (result *fits.Image, e
 			// subslice f data elements for given batch
 			ldBatch:=make([][]float32, len(f))
 			for i, l:=range f { ldBatch[i]=l.Data[lower:upper] }
+			mapsBatch:=maps.Slice(lower, upper)
 
 			var clipLow, clipHigh int32
 			// run stacking for the given batch
 			switch mode {
 			case StMedian:
-				StackMedian(ldBatch, op.RefFrameLoc, data[lower:upper])
+				StackMedian(ldBatch, op.RefFrameLoc, data[lower:upper], mapsBatch)
 
 			case StMean: 
 				if weights==nil {
-					StackMean(ldBatch, op.RefFrameLoc, data[lower:upper])
+					StackMean(ldBatch, op.RefFrameLoc, data[lower:upper], mapsBatch)
 				} else {
-					StackMeanWeighted(ldBatch, weights, op.RefFrameLoc, data[lower:upper])
+					StackMeanWeighted(ldBatch, weights, op.RefFrameLoc, data[lower:upper], mapsBatch)
 				}
 
 			case StSigma:
 				if weights==nil {
-					clipLow, clipHigh=StackSigma(ldBatch, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+					clipLow, clipHigh=StackSigma(ldBatch, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
 				} else {
-					clipLow, clipHigh=StackSigmaWeighted(ldBatch, weights, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+					clipLow, clipHigh=StackSigmaWeighted(ldBatch, weights, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
 				}
 
 			case StWinsorSigma:
 				if weights==nil {
-					clipLow, clipHigh=StackWinsorSigma(ldBatch, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+					clipLow, clipHigh=StackWinsorSigma(ldBatch, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
 				} else {
-					clipLow, clipHigh=StackWinsorSigmaWeighted(ldBatch, weights, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+					clipLow, clipHigh=StackWinsorSigmaWeighted(ldBatch, weights, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
 				}
 
 			case StMADSigma:
 				if weights==nil {
-					clipLow, clipHigh=StackMADSigma(ldBatch, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+					clipLow, clipHigh=StackMADSigma(ldBatch, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
 				} else {
 					panic("MADSigma stacking with weights is still unimplemented")
 				}
 
 			case StLinearFit:
-				clipLow, clipHigh=StackLinearFit(ldBatch, op.RefFrameLoc, op.SigmaLow, op.SigmaHigh, data[lower:upper])
+				clipLow, clipHigh=StackLinearFit(ldBatch, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
+
+			case StESD:
+				if weights==nil {
+					clipLow, clipHigh=StackESD(ldBatch, op.RefFrameLoc, op.ESDFraction, op.ESDAlpha, data[lower:upper], mapsBatch)
+				} else {
+					clipLow, clipHigh=StackESDWeighted(ldBatch, weights, op.RefFrameLoc, op.ESDFraction, op.ESDAlpha, data[lower:upper], mapsBatch)
+				}
+
+			case StPercentile:
+				if weights==nil {
+					clipLow, clipHigh=StackPercentile(ldBatch, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
+				} else {
+					clipLow, clipHigh=StackPercentileWeighted(ldBatch, weights, op.RefFrameLoc, low, high, data[lower:upper], mapsBatch)
+				}
+
+			case StMinMax:
+				if weights==nil {
+					clipLow, clipHigh=StackMinMax(ldBatch, op.RefFrameLoc, op.DropLow, op.DropHigh, data[lower:upper], mapsBatch)
+				} else {
+					clipLow, clipHigh=StackMinMaxWeighted(ldBatch, weights, op.RefFrameLoc, op.DropLow, op.DropHigh, data[lower:upper], mapsBatch)
+				}
 			} 
 
 			// update clipping totals
@@ -210,28 +371,38 @@ func (op *OpStack) Apply(f []*fits.Image, c *ops.Context) (result *fits.Image, e
 	}
 	fmt.Fprintf(c.Log, "\r")
 
-	// report back on clipping for modes that apply clipping
-	if mode>=StSigma {
-		fmt.Fprintf(c.Log, "Clipped low %d (%.2f%%) high %d (%.2f%%)\n", 
-			numClippedLow,  float32(numClippedLow )*100.0/(float32(len(data)*len(f))),
-			numClippedHigh, float32(numClippedHigh)*100.0/(float32(len(data)*len(f))) )
-	}
+	return data, maps, numClippedLow, numClippedHigh
+}
 
-	exposureSum:=float32(0)
-	for _,l :=range f { exposureSum+=l.Exposure }
+// Creates the diagnostic maps to record while stacking the given number of pixels
+func (op *OpStack) newMaps(pixels int) *StackMaps {
+	return NewStackMaps(pixels, wantsMap(op.SaveLow), wantsMap(op.SaveHigh), op.Coverage || wantsMap(op.SaveCoverage), wantsMap(op.SaveStdError))
+}
 
-	// Assemble into in-memory FITS
-	stack:=fits.NewImageFromNaxisn(f[0].Naxisn, data)
-	stack.Exposure = exposureSum
-	return stack, nil
+// Returns true if the given save operator would write a file
+func wantsMap(save *ops.OpSave) bool {
+	return save!=nil && save.FilePattern!=""
 }
 
 
-// Prepare weights for stacking based on selected weighting mode and given images 
-func getWeights(f []*fits.Image, weighting StackWeighting) (weights []float32, err error)  {
+// Prepare weights for stacking based on selected weighting mode and given images. 
+// Manual weights are looked up by file name
+func getWeights(f []*fits.Image, weighting StackWeighting, manual map[string]float32) (weights []float32, err error)  {
 	weights=[]float32(nil)
 	if weighting==StWeightNone {
 		weights=nil
+	} else if weighting>=StWeightInverseVariance && weighting<=StWeightManual { // per-frame weights, normalized to a maximum of one
+		weights =make([]float32, len(f))
+		maxWeight:=float32(0)
+		for i:=0; i<len(f); i+=1 {
+			weights[i], err=FrameWeight(f[i], weighting, manual)
+			if err!=nil { return nil, err }
+			if weights[i]>maxWeight { maxWeight=weights[i] }
+		}
+		if maxWeight<=0 { return nil, errors.New("All frame weights are zero") }
+		for i:=0; i<len(f); i+=1 {
+			weights[i]/=maxWeight
+		}
 	} else if weighting==StWeightExposure { // exposure weighted stacking, longer exposure gets bigger weight
 		weights =make([]float32, len(f))
 		for i:=0; i<len(f); i+=1 {
@@ -270,8 +441,45 @@ func getWeights(f []*fits.Image, weighting StackWeighting) (weights []float32, e
 }
 
 
+// Returns the weight of the given frame for the given weighting mode, before stacking normalizes the
+// weights to a maximum of one. Inverse noise and inverse HFR weights depend on the other frames in the
+// stack and are not available per frame. Manual weights are looked up by file name, with or without path
+func FrameWeight(f *fits.Image, weighting StackWeighting, manual map[string]float32) (float32, error) {
+	switch weighting {
+	case StWeightNone:
+		return 1, nil
+
+	case StWeightExposure:
+		if f.Exposure==0 { return 0, errors.New(fmt.Sprintf("%d: Missing exposure information for exposure-weighted stacking", f.ID)) }
+		return f.Exposure, nil
+
+	case StWeightInverseVariance:
+		if f.Stats==nil { return 0, errors.New(fmt.Sprintf("%d: Missing stats information for inverse variance weighted stacking", f.ID)) }
+		noise:=f.Stats.Noise()
+		if noise<=0 { return 0, errors.New(fmt.Sprintf("%d: Zero noise estimate for inverse variance weighted stacking", f.ID)) }
+		return 1/(noise*noise), nil
+
+	case StWeightSNR:
+		snr, err:=f.SNR()
+		if err!=nil { return 0, errors.New(fmt.Sprintf("%d: %s", f.ID, err.Error())) }
+		return snr*snr, nil
+
+	case StWeightPSFSignal:
+		psf, err:=f.PSFSignal()
+		if err!=nil { return 0, errors.New(fmt.Sprintf("%d: %s", f.ID, err.Error())) }
+		return psf*psf, nil
+
+	case StWeightManual:
+		if w, ok:=manual[f.FileName]; ok { return w, nil }
+		if w, ok:=manual[filepath.Base(f.FileName)]; ok { return w, nil }
+		return 0, errors.New(fmt.Sprintf("%d: Missing manual weight for file %s", f.ID, f.FileName))
+	}
+	return 0, errors.New(fmt.Sprintf("%d: Weighting mode %d has no per-frame weight", f.ID, weighting))
+}
+
+
 // Stacking with median function
-func StackMedian(lightsData [][]float32, RefFrameLoc float32, res []float32) {
+func StackMedian(lightsData [][]float32, RefFrameLoc float32, res []float32, maps *StackMaps) {
 	gatheredFull:=make([]float32,len(lightsData))
 
 	// for all pixels
@@ -298,24 +506,31 @@ func StackMedian(lightsData [][]float32, RefFrameLoc float32, res []float32) {
 		gatheredCur:=gatheredFull[:numGathered]
 
 		res[i]=qsort.QSelectMedianFloat32(gatheredCur)
+		maps.setCounts(i, 0, 0, numGathered)
+		maps.setStdErrorOfMedian(i, gatheredCur)
 	}
 	gatheredFull=nil
 }
 
 
 // Stacking with mean function
-func StackMean(lightsData [][]float32, RefFrameLoc float32, res []float32) {
+func StackMean(lightsData [][]float32, RefFrameLoc float32, res []float32, maps *StackMaps) {
 	// for all pixels
 	for i, _:=range res {
 
 		// gather data for this pixel across all lights, skipping NaNs
 		numGathered:=0
 		sum:=float32(0)
+		sum64, sumSquares64:=float64(0), float64(0)
 		for li, _:=range lightsData {
 			value:=lightsData[li][i]
 			if !math.IsNaN(float64(value)) {
 				sum+=value
 				numGathered++
+				if maps!=nil {
+					sum64+=float64(value)
+					sumSquares64+=float64(value)*float64(value)
+				}
 			}
 		}
 		if numGathered==0 {
@@ -329,12 +544,14 @@ func StackMean(lightsData [][]float32, RefFrameLoc float32, res []float32) {
 			continue	
 		}
 		res[i]=sum/float32(numGathered)
+		maps.setCounts(i, 0, 0, numGathered)
+		maps.setStdErrorOfMoments(i, numGathered, sum64, sumSquares64)
 	}
 }
 
 
 // Stacking with mean function and weights
-func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc float32, res []float32) {
+func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc float32, res []float32, maps *StackMaps) {
 	// for all pixels
 	for i, _:=range res {
 
@@ -342,6 +559,7 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc fl
 		numGathered:=0
 		sum:=float32(0)
 		weightSum:=float32(0)
+		sum64, sumSquares64:=float64(0), float64(0)
 		for li, _:=range lightsData {
 			value:=lightsData[li][i]
 			if !math.IsNaN(float64(value)) {
@@ -349,6 +567,10 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc fl
 				sum+=value*weight
 				weightSum+=weight
 				numGathered++
+				if maps!=nil {
+					sum64+=float64(value)
+					sumSquares64+=float64(value)*float64(value)
+				}
 			}
 		}
 		if numGathered==0 {
@@ -362,6 +584,8 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc fl
 			continue	
 		}
 		res[i]=sum/float32(weightSum)
+		maps.setCounts(i, 0, 0, numGathered)
+		maps.setStdErrorOfMoments(i, numGathered, sum64, sumSquares64)
 	}
 }
 
@@ -369,7 +593,7 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, RefFrameLoc fl
 // Mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are excluded from the average calculation.
 // The standard deviation is calculated w.r.t the mean for robustness.
-func StackSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
 
@@ -396,6 +620,7 @@ func StackSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32
 			continue	
 		}
 		gatheredCur:=gatheredFull[:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		// repeat until results for this pixelare stable
 		for {
@@ -426,6 +651,8 @@ func StackSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32
 			// terminate if no more values are out of bounds, or all but one value consumed
             if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
 				res[i]=mean
+				maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+				maps.setStdErrorOfMean(i, gatheredCur)
             	break
             }
 		}
@@ -439,7 +666,7 @@ func StackSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are excluded from the average calculation.
 // The standard deviation is calculated w.r.t the mean for robustness.
-func StackSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	weightsFull :=make([]float32,len(weights))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
@@ -469,6 +696,7 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc,
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 		weightsCur :=weightsFull [:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		/*
 		// gather data for this pixel across all frames
@@ -519,6 +747,8 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc,
             		weightsSum +=weightsCur[i]
             	}
 				res[i]=weightedSum/weightsSum
+				maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+				maps.setStdErrorOfMean(i, gatheredCur)
             	break
             }
 		}
@@ -533,7 +763,7 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc,
 
 // Mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // MADs away from the median are excluded from the average calculation.
-func StackMADSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackMADSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	adGatheredFull:=make([]float32,len(lightsData))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
@@ -561,6 +791,7 @@ func StackMADSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh floa
 			continue	
 		}
 		gatheredCur:=gatheredFull[:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		// calculate median across gathered data
 		median:=qsort.QSelectMedianFloat32(gatheredCur)
@@ -598,6 +829,8 @@ func StackMADSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh floa
 		for _,g:=range(gatheredCur) { mean+=g }
 		mean/=float32(len(gatheredCur))
 		res[i]=mean		
+		maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+		maps.setStdErrorOfMean(i, gatheredCur)
 	}
 
 	gatheredFull=nil
@@ -608,7 +841,7 @@ func StackMADSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh floa
 
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are replaced with the lowest/highest valid value.
-func StackWinsorSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackWinsorSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull  :=make([]float32,len(lightsData))
 	winsorizedFull:=make([]float32,len(lightsData))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
@@ -636,6 +869,7 @@ func StackWinsorSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh f
 			continue	
 		}
 		gatheredCur:=gatheredFull[:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		// repeat until results for this pixel are stable
 		for {
@@ -693,6 +927,8 @@ func StackWinsorSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh f
 			// terminate if no more values are out of bounds, or all but one value consumed
             if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
 				res[i]=mean
+				maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+				maps.setStdErrorOfMean(i, gatheredCur)
             	break
             }
         }
@@ -707,7 +943,7 @@ func StackWinsorSigma(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh f
 
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are replaced with the lowest/highest valid value.
-func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull  :=make([]float32,len(lightsData))
 	weightsFull   :=make([]float32,len(weights))
 	winsorizedFull:=make([]float32,len(lightsData))
@@ -738,6 +974,7 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, RefFram
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 		weightsCur :=weightsFull [:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		/*
 		// gather data for this pixel across all frames
@@ -816,6 +1053,8 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, RefFram
             		weightsSum +=weightsCur[i]
             	}
 				res[i]=weightedSum/weightsSum
+				maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+				maps.setStdErrorOfMean(i, gatheredCur)
             	break
             }
         }
@@ -831,7 +1070,7 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, RefFram
 
 // Stacking with linear regression fit. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from linear fit  are excluded from the average calculation.
-func StackLinearFit(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackLinearFit(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	xs:=make([]float32,len(lightsData))
 	for i, _:=range(xs) {
@@ -864,6 +1103,7 @@ func StackLinearFit(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh flo
 			continue	
 		}
 		gatheredCur:=gatheredFull[:numGathered]
+		prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 
 		// reject outliers until none left
 		mean:=float32(0)
@@ -904,11 +1144,14 @@ func StackLinearFit(lightsData [][]float32, RefFrameLoc, sigmaLow, sigmaHigh flo
 			}
 
 			if left==0 || len(gatheredCur)<3{
+				gatheredCur=gatheredCur[left:]
             	break
             }
 			gatheredCur=gatheredCur[left:]
 		}
 		res[i]=mean
+		maps.setCounts(i, numClippedLow-prevClippedLow, numClippedHigh-prevClippedHigh, numGathered)
+		maps.setStdErrorOfMean(i, gatheredCur)
 	}
 
 	gatheredFull=nil
@@ -927,11 +1170,24 @@ func StackIncremental(stack, light *fits.Image, weight float32) *fits.Image {
 		for i,d:=range light.Data {
 			stack.Data[i]=d*weight
 		}
+		if light.Coverage!=nil {
+			stack.Coverage=make([]float32, len(light.Coverage))
+			for i,c:=range light.Coverage {
+				stack.Coverage[i]=c*weight
+			}
+		}
 	} else {
 		stack.Exposure+=light.Exposure
 		for i,d:=range light.Data {
 			stack.Data[i]+=d*weight
 		}
+		if stack.Coverage!=nil && light.Coverage!=nil {
+			for i,c:=range light.Coverage {
+				stack.Coverage[i]+=c*weight
+			}
+		} else {
+			stack.Coverage=nil
+		}
 	}
 	return stack
 }
@@ -940,5 +1196,6 @@ func StackIncremental(stack, light *fits.Image, weight float32) *fits.Image {
 func StackIncrementalFinalize(stack *fits.Image, weightSum float32) {
 	factor:=1.0/weightSum
 	for i,d:=range stack.Data { stack.Data[i]=d*factor }
+	for i,c:=range stack.Coverage { stack.Coverage[i]=c*factor }
 	stack.Stats=stats.NewStats(stack.Data, stack.Naxisn[0])
 }
\ No newline at end of file
@@ -0,0 +1,111 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+// Creates a frame of Gaussian noise with the given standard deviation around 100
+func newTestNoise(id int, fileName string, sigma float32, rng *rand.Rand) *fits.Image {
+	f := fits.NewImageFromNaxisn([]int32{200, 200}, nil)
+	f.ID, f.FileName = id, fileName
+	for i := range f.Data {
+		f.Data[i] = 100 + sigma*float32(rng.NormFloat64())
+	}
+	f.Stats = stats.NewStats(f.Data, f.Naxisn[0])
+	return f
+}
+
+func TestGetWeights(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	fs := []*fits.Image{
+		newTestNoise(0, "/data/m31/light_001.fits", 1, rng),
+		newTestNoise(1, "/data/m31/light_002.fits", 2, rng),
+	}
+
+	weights, err := getWeights(fs, StWeightInverseVariance, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[0] != 1 || math.Abs(float64(weights[1]-0.25)) > 0.02 {
+		t.Errorf("inverse variance: got %v; want 1 and 0.25", weights)
+	}
+
+	manual := map[string]float32{"/data/m31/light_001.fits": 3, "light_002.fits": 6}
+	weights, err = getWeights(fs, StWeightManual, manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[0] != 0.5 || weights[1] != 1 {
+		t.Errorf("manual: got %v; want 0.5 and 1", weights)
+	}
+	delete(manual, "light_002.fits")
+	if _, err = getWeights(fs, StWeightManual, manual); err == nil {
+		t.Errorf("manual: expected error for missing weight")
+	}
+
+	if w, err := FrameWeight(fs[1], StWeightNone, nil); err != nil || w != 1 {
+		t.Errorf("unweighted: got %g, err %v; want 1", w, err)
+	}
+	if _, err := FrameWeight(fs[1], StWeightInverseNoise, nil); err == nil {
+		t.Errorf("inverse noise: got a per-frame weight; want weights relative to the stack")
+	}
+}
+
+func TestStackPointing(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	fs := []*fits.Image{newTestNoise(0, "a.fits", 1, rng), newTestNoise(1, "b.fits", 1, rng), newTestNoise(2, "c.fits", 1, rng)}
+	for _, f := range fs {
+		f.Header.Strings["OBJCTRA"], f.Header.Strings["OBJCTDEC"] = "05 35 17.3", "-05 23 28"
+		f.Header.Ints["FOCALLEN"], f.Header.Floats["XPIXSZ"] = 400, 3.76
+	}
+	stack, err := NewOpStack(StMean, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", false).
+		Apply(fs, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := stack.Header
+	if h.Strings["OBJCTRA"] != "05 35 17.3" || h.Strings["OBJCTDEC"] != "-05 23 28" || h.Ints["FOCALLEN"] != 400 || h.Floats["XPIXSZ"] != 3.76 {
+		t.Errorf("pointing and optics keys not kept on stack, got %v %v %v", h.Strings, h.Ints, h.Floats)
+	}
+}
+
+func TestStackRecordsWeights(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	fs := []*fits.Image{newTestNoise(3, "a.fits", 1, rng), newTestNoise(5, "b.fits", 2, rng), newTestNoise(7, "c.fits", 1, rng)}
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	op := NewOpStack(StMean, StWeightInverseVariance, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", false)
+	if _, err := op.Apply(fs, c); err != nil {
+		t.Fatal(err)
+	}
+	want, err := getWeights(fs, StWeightInverseVariance, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range fs {
+		if got := c.StackWeights[f.ID]; got != want[i] {
+			t.Errorf("%d: recorded weight %g; want %g as applied", f.ID, got, want[i])
+		}
+	}
+}
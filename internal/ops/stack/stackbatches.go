@@ -22,6 +22,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sort"
+	"sync"
 
 	"github.com/mlnoga/nightlight/internal/fits"
 	"github.com/mlnoga/nightlight/internal/ops"
@@ -29,17 +30,30 @@ import (
 
 type OpStackBatches struct {
 	ops.OpBase
-	PerBatch *ops.OpSequence `json:"perBatch"`
+	PerBatch   *ops.OpSequence `json:"perBatch"`
+	SpillDir   string          `json:"spillDir"`   // if set, frames exceeding memory are spilled to temporary files in this directory and stacked with global rejection, instead of in batches
+	KeepSpill  bool            `json:"keepSpill"`  // keep the temporary spill files after stacking
+	SpillMaxMB int64           `json:"spillMaxMB"` // maximum disk space for spill files in MiB, 0=unlimited
+	Checkpoint string          `json:"checkpoint"` // if set, the state is saved to this directory after each batch
+	Resume     bool            `json:"resume"`     // resume from the checkpoint, skipping completed batches
 }
 
 func init() { ops.SetOperatorFactory(func() ops.Operator { return NewOpStackBatchesDefault() }) } // register the operator for JSON decoding
 
-func NewOpStackBatchesDefault() *OpStackBatches { return NewOpStackBatches(ops.NewOpSequence()) }
+func NewOpStackBatchesDefault() *OpStackBatches {
+	return NewOpStackBatches(ops.NewOpSequence(), "", false, 0, "", false)
+}
 
-func NewOpStackBatches(perBatch *ops.OpSequence) (op *OpStackBatches) {
+func NewOpStackBatches(perBatch *ops.OpSequence, spillDir string, keepSpill bool, spillMaxMB int64,
+	checkpoint string, resume bool) (op *OpStackBatches) {
 	return &OpStackBatches{
-		OpBase:   ops.OpBase{Type: "stackBatches"},
-		PerBatch: perBatch,
+		OpBase:     ops.OpBase{Type: "stackBatches"},
+		PerBatch:   perBatch,
+		SpillDir:   spillDir,
+		KeepSpill:  keepSpill,
+		SpillMaxMB: spillMaxMB,
+		Checkpoint: checkpoint,
+		Resume:     resume,
 	}
 }
 
@@ -55,18 +69,74 @@ func (op *OpStackBatches) MakePromises(ins []ops.Promise, c *ops.Context) (outs
 
 func (op *OpStackBatches) Apply(ins []ops.Promise, c *ops.Context) (fOut *fits.Image, err error) {
 	// Partition the loaders into optimal batches
-	insPerm, numBatches, batchSize, maxThreads, err := op.partition(ins, c)
+	perm, numBatches, batchSize, maxThreads, err := op.partition(ins, c)
 	if err != nil {
 		return nil, err
 	}
 	c.MaxThreads = int(maxThreads)
-	c.StatsTotal = len(insPerm)
-	c.StatsProcessed = 0
+	if op.PerBatch == nil {
+		return nil, errors.New("Missing batch parameters")
+	}
 
-	// Process each batch. The first batch sets the reference image
+	// Resume with the batches and the reference image of the interrupted run, if a checkpoint exists
 	stack := (*fits.Image)(nil)
 	stackFrames := int64(0)
-	for b := int64(0); b < numBatches; b++ {
+	cp, done := (*checkpoint)(nil), map[string]bool{}
+	if op.Checkpoint != "" && op.Resume {
+		if cp, stack, err = loadCheckpoint(op.Checkpoint, len(ins), c); err != nil {
+			return nil, err
+		}
+		if cp != nil {
+			perm, numBatches, batchSize, stackFrames = cp.Perm, cp.NumBatches, cp.BatchSize, cp.WeightSum
+			for _, name := range cp.Files {
+				done[name] = true
+			}
+			fmt.Fprintf(c.Log, "Resuming from checkpoint in %s after batch %d of %d with %d files.\n",
+				op.Checkpoint, cp.BatchesDone, cp.NumBatches, len(cp.Files))
+		}
+	}
+	insPerm := ins
+	if perm != nil {
+		insPerm = make([]ops.Promise, len(ins))
+		for i := range ins {
+			insPerm[i] = ins[perm[i]]
+		}
+	}
+	if numBatches > 1 && op.SpillDir != "" {
+		if op.Checkpoint != "" {
+			return nil, errors.New("checkpoints are not supported with out-of-core stacking")
+		}
+		return op.applySpill(insPerm, batchSize, c)
+	}
+	if op.Checkpoint != "" && hasCometStack(op.PerBatch) {
+		return nil, errors.New("checkpoints are not supported with comet stacking")
+	}
+	if cp == nil && op.Checkpoint != "" && numBatches > 1 {
+		cp = newCheckpoint(len(ins), numBatches, batchSize, perm)
+	}
+
+	// Save the diagnostic maps of stacking once for all batches, instead of once per batch
+	stacks := []*OpStack(nil)
+	if numBatches > 1 {
+		stacks = stacksIn(op.PerBatch)
+		for _, st := range stacks {
+			st.beginBatches()
+			defer st.endBatches()
+		}
+		if cp != nil && cp.BatchesDone > 0 {
+			if err = cp.readMaps(op.Checkpoint, stack.Naxisn, stacks); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Process each batch. The first batch sets the reference image
+	lock := sync.Mutex{}
+	firstBatch := int64(0)
+	if cp != nil {
+		firstBatch = cp.BatchesDone
+	}
+	for b := firstBatch; b < numBatches; b++ {
 		// Cut out relevant part of the overall input filenames
 		batchStartOffset := b * batchSize
 		batchEndOffset := (b + 1) * batchSize
@@ -76,11 +146,11 @@ func (op *OpStackBatches) Apply(ins []ops.Promise, c *ops.Context) (fOut *fits.I
 		batchFrames := batchEndOffset - batchStartOffset
 		insBatch := insPerm[batchStartOffset:batchEndOffset]
 		fmt.Fprintf(c.Log, "\nStarting batch %d of %d with %d frames...\n", b+1, numBatches, len(insBatch))
+		if cp != nil {
+			insBatch = cp.recordFiles(insBatch, done, &lock)
+		}
 
 		// Stack the files in this batch
-		if op.PerBatch == nil {
-			return nil, errors.New("Missing batch parameters")
-		}
 		batchPromises, err := op.PerBatch.MakePromises(insBatch, c)
 		if err != nil {
 			return nil, err
@@ -97,6 +167,13 @@ func (op *OpStackBatches) Apply(ins []ops.Promise, c *ops.Context) (fOut *fits.I
 		if numBatches > 1 {
 			stack = StackIncremental(stack, batch, float32(batchFrames))
 			stackFrames += batchFrames
+			if cp != nil {
+				cp.BatchesDone, cp.WeightSum = b+1, stackFrames
+				if err = cp.save(op.Checkpoint, stack, stacks, c); err != nil {
+					return nil, err
+				}
+				fmt.Fprintf(c.Log, "Saved checkpoint after batch %d of %d to %s\n", b+1, numBatches, op.Checkpoint)
+			}
 		} else {
 			stack = batch
 		}
@@ -113,12 +190,61 @@ func (op *OpStackBatches) Apply(ins []ops.Promise, c *ops.Context) (fOut *fits.I
 	if numBatches > 1 {
 		// Finalize stack of stacks
 		StackIncrementalFinalize(stack, float32(stackFrames))
+		for _, st := range stacks {
+			if err = st.saveBatchMaps(stack.Naxisn, stack.ID, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.FinishStats() // all frames stacked, so their weights are known
+	if cp != nil {
+		cp.remove(op.Checkpoint) // run complete, checkpoint no longer needed
 	}
 
 	return stack, nil
 }
 
-func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (insPerm []ops.Promise,
+// Returns the stack operators in the given sequence, including nested sequences and comet stacking
+func stacksIn(seq *ops.OpSequence) (stacks []*OpStack) {
+	if seq == nil {
+		return nil
+	}
+	for _, step := range seq.Steps {
+		switch s := step.(type) {
+		case *ops.OpSequence:
+			stacks = append(stacks, stacksIn(s)...)
+		case *OpStack:
+			stacks = append(stacks, s)
+		case *OpStackComet:
+			if s.Stack != nil {
+				stacks = append(stacks, s.Stack)
+			}
+		}
+	}
+	return stacks
+}
+
+// Returns true if the given sequence contains comet stacking, including nested sequences
+func hasCometStack(seq *ops.OpSequence) bool {
+	if seq == nil {
+		return false
+	}
+	for _, step := range seq.Steps {
+		switch s := step.(type) {
+		case *ops.OpSequence:
+			if hasCometStack(s) {
+				return true
+			}
+		case *OpStackComet:
+			return true
+		}
+	}
+	return false
+}
+
+// Partitions the inputs into batches which fit into memory. Returns a random permutation of the inputs
+// which groups them into batches, or nil if there is only one batch
+func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (perm []int,
 	numBatches, batchSize, maxThreads int64, err error) {
 	numFrames := int64(len(ins))
 	width, height := int64(0), int64(0)
@@ -148,12 +274,26 @@ func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (insPerm
 	fmt.Fprintf(c.Log, "CPU has %d threads. Physical memory is %d MiB, -op.Memory is %d MiB, this fits %d frames.\n",
 		maxThreads, c.MemoryMB, c.StackMemoryMB, availableFrames)
 
+	// Count the frame-sized buffers of the stack operators for diagnostic maps and coverage
+	perBatchBuffers, multiBatchBuffers := int64(0), int64(0)
+	for _, st := range stacksIn(op.PerBatch) {
+		perBatch, multiBatch := st.buffers()
+		perBatchBuffers, multiBatchBuffers = perBatchBuffers+perBatch, multiBatchBuffers+multiBatch
+	}
+
+	// Count the master calibration frames of all sessions, as frames are batched across sessions
+	// and each session keeps its masters once loaded
+	sessionMasters := int64(0)
+	for _, s := range c.Sessions {
+		sessionMasters += int64(s.Masters)
+	}
+
 	// Calculate batch sizes for preprocessing
 	for ; maxThreads >= 1; maxThreads-- {
-		// Besides the lights in the current batch, we need one temp frame per thread,
-		// the optional dark and flat, the reference frame from batch 0 (if >1 batches),
-		// and the stack of stacks (if >1 bacthes)
-		batchSize = availableFrames - int64(maxThreads)
+		// Besides the lights in the current batch, we need one temp frame per thread, the snapshot
+		// of the reference frame, the optional dark and flat of the run and of each session, and the
+		// maps recorded while stacking
+		batchSize = availableFrames - int64(maxThreads) - 1 - sessionMasters - perBatchBuffers
 		if c.DarkFrame != nil {
 			batchSize--
 		} // FIXME may not be loaded yet...
@@ -164,13 +304,15 @@ func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (insPerm
 			continue
 		}
 
-		// correct for multi-batch memory requirements
+		// correct for multi-batch memory requirements: the stack of stacks, and the maps accumulated
+		// over batches
 		numBatches = (numFrames + batchSize - 1) / batchSize
 		if numBatches > 1 {
-			batchSize -= 2 // reference frame from batch 0, and stack of stacks
-		}
-		if batchSize < 2 {
-			continue
+			batchSize -= 1 + multiBatchBuffers
+			if batchSize < 2 {
+				continue
+			}
+			numBatches = (numFrames + batchSize - 1) / batchSize
 		}
 		if batchSize < int64(maxThreads) {
 			continue
@@ -185,12 +327,7 @@ func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (insPerm
 	}
 	fmt.Fprintf(c.Log, "Using %d random batches of size %d with %d images in parallel.\n", numBatches, batchSize, maxThreads)
 
-	insPerm = ins
 	if numBatches > 1 {
-		perm := make([]int, len(ins))
-		for i, _ := range perm {
-			perm[i] = i
-		}
 		fmt.Fprintf(c.Log, "Randomizing input files into batches...\n")
 		perm = rand.Perm(len(ins))
 		for i := 0; i < int(numBatches); i++ {
@@ -201,10 +338,6 @@ func (op *OpStackBatches) partition(ins []ops.Promise, c *ops.Context) (insPerm
 			}
 			sort.Ints(perm[from:to])
 		}
-		insPerm = make([]ops.Promise, len(ins))
-		for i, _ := range ins {
-			insPerm[i] = ins[perm[i]]
-		}
 	}
-	return insPerm, numBatches, batchSize, maxThreads, nil
+	return perm, numBatches, batchSize, maxThreads, nil
 }
@@ -0,0 +1,52 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestPartitionSessionMasters(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	ins := make([]ops.Promise, 40)
+	for i := range ins {
+		ins[i] = func() (*fits.Image, error) { return fits.NewImageFromNaxisn([]int32{64, 64}, nil), nil }
+	}
+	op := NewOpStackBatches(ops.NewOpSequence(NewOpStackDefault()), "", false, 0, "", false)
+	op.PerBatch.Steps[0].(*OpStack).Coverage = false
+
+	// 1 MiB fits 64 frames. The master frames of all sessions take memory away from the batches
+	for _, tc := range []struct {
+		masters    int
+		numBatches int64
+	}{{0, 1}, {30, 2}} {
+		c := ops.NewContext(io.Discard, 1, stats.LSEMedianMAD)
+		c.Sessions = []ops.SessionInfo{{Name: "night1", NumFrames: 20, Masters: tc.masters / 2}, {Name: "night2", FirstID: 20, NumFrames: 20, Masters: tc.masters - tc.masters/2}}
+		_, numBatches, batchSize, _, err := op.partition(ins, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numBatches != tc.numBatches || numBatches*batchSize < 40 {
+			t.Errorf("%d session masters: got %d batches of %d frames; want %d batches covering 40 frames", tc.masters, numBatches, batchSize, tc.numBatches)
+		}
+	}
+}
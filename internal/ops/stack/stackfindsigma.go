@@ -17,37 +17,40 @@
 package stack
 
 import (
-	// "runtime/debug"
-	// "github.com/mlnoga/nightlight/internal/fits"
-	// "github.com/mlnoga/nightlight/internal/ops"
+	"fmt"
+	"runtime/debug"
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
 )
 
-/*
-// Find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func FindSigmasAndStack(lights []*fits.Image, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *fits.Image, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
-	// If desired, auto-select stacking mode based on number of frames    
-	if mode==StAuto { 
-		mode=autoSelectStackingMode(len(lights))
-		LogPrintf("Auto-selected stacking mode %d based on %d frames\n", mode, len(lights))
-	}
-
+// Find lower and upper rejection bounds given desired clipping percentages, and stack using these values.
+// The bounds are sigmas for the sigma clipping modes, and fractions of the median for percentile clipping.
+// Modes without goal-seekable bounds are stacked normally. Returns the bounds found
+func (op *OpStack) FindSigmasAndStack(lights []*fits.Image, mode StackMode, weights []float32, c *ops.Context) (data []float32, maps *StackMaps, numClippedLow, numClippedHigh int32, low, high float32) {
     // Binary search does not work for linear fit stacking, as changing one bound has an impact on the other.
     // However, Newton search in two dimensions is slower than dual binary search.
-	if mode==StLinearFit {
-		return newtonMethodAndStack(lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh)
-	} else if mode==StWinsorSigma || mode==StSigma {
-		return binarySearchAndStack(lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh) 
-	} else {
-		LogPrintf("Stacking mode %d does not support sigmas, proceeding with normal stack.\n", mode)
-		result, numClippedLow, numClippedHigh, err = Stack(lights, mode, weights, refMedian, 0.0, 0.0)
-		return result, numClippedLow, numClippedHigh, 0.0, 0.0, err
+	switch mode {
+	case StLinearFit:
+		return op.newtonMethodAndStack(lights, mode, weights, c)
+	case StSigma, StWinsorSigma, StMADSigma:
+		return op.binarySearchAndStack(lights, mode, weights, 1, 11, c) 
+	case StPercentile:
+		return op.binarySearchAndStack(lights, mode, weights, 0, 2, c) 
+	default:
+		fmt.Fprintf(c.Log, "Stacking mode %d does not support goal-seeking, proceeding with normal stack.\n", mode)
+		data, maps, numClippedLow, numClippedHigh=op.stack(lights, mode, weights, 0, 0, c)
+		return data, maps, numClippedLow, numClippedHigh, 0, 0
 	}
 }
 
-// With binary search, find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func binarySearchAndStack(lights []*fits.Image, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *fits.Image, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
+// Returns the percentage of the given number of clipped values
+func clipPerc(numClipped int32, data []float32, lights []*fits.Image) float32 {
+	return float32(numClipped)*100.0/float32(len(data)*len(lights))
+}
+
+// With binary search in the given interval, find lower and upper bounds given desired clipping percentages, and stack using these values
+func (op *OpStack) binarySearchAndStack(lights []*fits.Image, mode StackMode, weights []float32, initialLeft, initialRight float32, c *ops.Context) (data []float32, maps *StackMaps, numClippedLow, numClippedHigh int32, low, high float32) {
 	// initialize binary search intervals
-	initialLeft, initialRight:=float32(1.0), float32(11.0)
 	lowLeft, lowRight:=initialLeft, initialRight
 	lowMid:=0.5*(lowLeft+lowRight)
 	highLeft, highRight:=initialLeft, initialRight
@@ -55,29 +58,26 @@ func binarySearchAndStack(lights []*fits.Image, mode StackMode, weights []float3
 
 	for i:=0; ; i++ {
 		// Calculate value for midpoint of each interval
-		LogPrintf("Step %d: stSigLow %.2f stSigHigh %.2f\n", i, lowMid, highMid)
-		var numClippedLow, numClippedHigh int32
-		var err error
-		stack, numClippedLow, numClippedHigh, err:=Stack(lights, mode, weights, refMedian, lowMid, highMid)
-		if err!=nil { return stack, numClippedLow, numClippedHigh, -1, -1, err }
-		percL:=float32(numClippedLow )*100.0/float32(len(stack.Data)*len(lights))
-		percH:=float32(numClippedHigh)*100.0/float32(len(stack.Data)*len(lights))
-		deltaL:=int(100*percL+0.5)-int(100*stClipPercLow)
-		deltaH:=int(100*percH+0.5)-int(100*stClipPercHigh)
+		fmt.Fprintf(c.Log, "Step %d: %s\n", i, op.describe(mode, lowMid, highMid))
+		data, maps, numClippedLow, numClippedHigh=op.stack(lights, mode, weights, lowMid, highMid, c)
+		percL:=clipPerc(numClippedLow,  data, lights)
+		percH:=clipPerc(numClippedHigh, data, lights)
+		deltaL:=int(100*percL+0.5)-int(100*op.ClipPercLow)
+		deltaH:=int(100*percH+0.5)-int(100*op.ClipPercHigh)
 		// Test completion and abort criteria
 		if deltaL==0 && deltaH==0 {
-			LogPrintf("Reached %.2f%% and %.2f%% clipping. Settings are -stSigLow %.3f -stSigHigh %.3f\n", stClipPercLow, stClipPercHigh, lowMid, highMid)
-			return stack, numClippedLow, numClippedHigh, lowMid, highMid, nil
+			fmt.Fprintf(c.Log, "Reached %.2f%% and %.2f%% clipping. Settings are %s\n", op.ClipPercLow, op.ClipPercHigh, op.describe(mode, lowMid, highMid))
+			return data, maps, numClippedLow, numClippedHigh, lowMid, highMid
 		}
 		if i>=20 {
-			LogPrintf("Warning: Binary search did not converge, proceeding with last approximation %.2f and %.2f\n", lowMid, highMid)
-			return stack, numClippedLow, numClippedHigh, lowMid, highMid, nil
+			fmt.Fprintf(c.Log, "Warning: Binary search did not converge, proceeding with last approximation %.3f and %.3f\n", lowMid, highMid)
+			return data, maps, numClippedLow, numClippedHigh, lowMid, highMid
 		}
 
-		stack=nil // mark memory for free-up
+		data, maps=nil, nil // mark memory for free-up
 		debug.FreeOSMemory()
 
-		// Adjust binary search interval for lower stacking sigma
+		// Adjust binary search interval for lower bound
 		if deltaL>0 {
 			lowLeft=lowMid
 			lowMid=0.5*(lowLeft+lowRight)
@@ -86,7 +86,7 @@ func binarySearchAndStack(lights []*fits.Image, mode StackMode, weights []float3
 			lowMid=0.5*(lowLeft+lowRight)
 		}
 
-		// Adjust binary search interval for upper stacking sigma
+		// Adjust binary search interval for upper bound
 		if deltaH>0 {
 			highLeft=highMid
 			highMid=0.5*(highLeft+highRight)
@@ -98,74 +98,62 @@ func binarySearchAndStack(lights []*fits.Image, mode StackMode, weights []float3
 }
 
 // With Newton's method, find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func newtonMethodAndStack(lights []*fits.Image, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *fits.Image, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
+func (op *OpStack) newtonMethodAndStack(lights []*fits.Image, mode StackMode, weights []float32, c *ops.Context) (data []float32, maps *StackMaps, numClippedLow, numClippedHigh int32, low, high float32) {
 	sigLow, sigHigh, epsilon :=float32(6.0), float32(6.0), float32(0.005)
 
 	for i:=0; ; i++ {
 		// Calculate value for current sigmas
-		LogPrintf("Step %d: stSigLow %.2f stSigHigh %.2f\n", i, sigLow, sigHigh)
-		var numClippedLow, numClippedHigh int32
-		var err error
-		stack, numClippedLow, numClippedHigh, err:=Stack(lights, mode, weights, refMedian, sigLow, sigHigh)
-		if err!=nil { return stack, numClippedLow, numClippedHigh, stClipPercLow, stClipPercHigh, err }
-		percL:=float32(numClippedLow )*100.0/float32(len(stack.Data)*len(lights))
-		percH:=float32(numClippedHigh)*100.0/float32(len(stack.Data)*len(lights))
-		deltaL:=percL-stClipPercLow
-		deltaH:=percH-stClipPercLow
+		fmt.Fprintf(c.Log, "Step %d: %s\n", i, op.describe(mode, sigLow, sigHigh))
+		data, maps, numClippedLow, numClippedHigh=op.stack(lights, mode, weights, sigLow, sigHigh, c)
+		deltaL:=clipPerc(numClippedLow,  data, lights)-op.ClipPercLow
+		deltaH:=clipPerc(numClippedHigh, data, lights)-op.ClipPercHigh
 
 		deltaLi:=int(100*deltaL+0.5)
 		deltaHi:=int(100*deltaH+0.5)
 
 		// Test completion and abort criteria
 		if deltaLi==0 && deltaHi==0 {
-			LogPrintf("Reached %.2f%% and %.2f%% clipping. Settings are -stSigLow %.3f -stSigHigh %.3f\n", stClipPercLow, stClipPercHigh, sigLow, sigHigh)
-			return stack, numClippedLow, numClippedHigh, sigLow, sigHigh, nil
+			fmt.Fprintf(c.Log, "Reached %.2f%% and %.2f%% clipping. Settings are %s\n", op.ClipPercLow, op.ClipPercHigh, op.describe(mode, sigLow, sigHigh))
+			return data, maps, numClippedLow, numClippedHigh, sigLow, sigHigh
 		}
 		if i>=20 {
-			LogPrintf("Warning: Newton method did not converge, proceeding with last approximation %.2f and %.2f\n", sigLow, sigHigh)
-			return stack, numClippedLow, numClippedHigh, sigLow, sigHigh, nil
+			fmt.Fprintf(c.Log, "Warning: Newton method did not converge, proceeding with last approximation %.3f and %.3f\n", sigLow, sigHigh)
+			return data, maps, numClippedLow, numClippedHigh, sigLow, sigHigh
 		}
-		stack=nil // mark memory for free-up
-		debug.FreeOSMemory()
 
 		// Vary sigmaLow by epsilon, and compute new value via Newton's rule x_n+1 = x_n - f(x_n)/f'(x_n)
 		i++
-		LogPrintf("Step %d: stSigLow+eps %.2f, stSigHigh %.2f\n", i, sigLow+epsilon, sigHigh)
-		stack2, numClippedLow2, numClippedHigh2, err:=Stack(lights, mode, weights, refMedian, sigLow+epsilon, sigHigh)
-		if err!=nil { return stack2, numClippedLow2, numClippedHigh2, sigLow+epsilon, sigHigh, err }
-		percL2:=float32(numClippedLow2 )*100.0/float32(len(stack2.Data)*len(lights))
-		deltaL2:=percL2-stClipPercLow
+		fmt.Fprintf(c.Log, "Step %d: %s\n", i, op.describe(mode, sigLow+epsilon, sigHigh))
+		data2, _, numClippedLow2, _:=op.stack(lights, mode, weights, sigLow+epsilon, sigHigh, c)
+		deltaL2:=clipPerc(numClippedLow2, data2, lights)-op.ClipPercLow
 		deltaLDiff:=(deltaL2-deltaL)/epsilon
 		if deltaLDiff==0 {
-			LogPrintf("Warning: Newton method did not converge, proceeding with last approximation %.2f and %.2f\n", sigLow, sigHigh)
-			return stack, numClippedLow, numClippedHigh, sigLow, sigHigh, nil
+			fmt.Fprintf(c.Log, "Warning: Newton method did not converge, proceeding with last approximation %.3f and %.3f\n", sigLow, sigHigh)
+			return data, maps, numClippedLow, numClippedHigh, sigLow, sigHigh
 		}
 		newSigLow:=sigLow-deltaL/deltaLDiff
 		if newSigLow<0.1 { newSigLow=0.1 }
 		if newSigLow>20  { newSigLow=20  }
-		stack2=nil // mark memory for free-up
+		data2=nil // mark memory for free-up
 		debug.FreeOSMemory()
 
 		// Vary sigmaHigh by epsilon, and compute new value via Newton's rule x_n+1 = x_n - f(x_n)/f'(x_n)
 		i++
-		LogPrintf("Step %d: stSigLow %.2f, stSigHigh+eps %.2f\n", i, sigLow, sigHigh+epsilon)
-		stack3, numClippedLow3, numClippedHigh3, err:=Stack(lights, mode, weights, refMedian, sigLow, sigHigh+epsilon)
-		if err!=nil { return stack3, numClippedLow3, numClippedHigh3, sigLow, sigHigh+epsilon, err }
-		percH3:=float32(numClippedHigh3)*100.0/float32(len(stack3.Data)*len(lights))
-		deltaH3:=percH3-stClipPercLow
+		fmt.Fprintf(c.Log, "Step %d: %s\n", i, op.describe(mode, sigLow, sigHigh+epsilon))
+		data3, _, _, numClippedHigh3:=op.stack(lights, mode, weights, sigLow, sigHigh+epsilon, c)
+		deltaH3:=clipPerc(numClippedHigh3, data3, lights)-op.ClipPercHigh
 		deltaHDiff:=(deltaH3-deltaH)/epsilon
 		if deltaHDiff==0 {
-			LogPrintf("Warning: Newton method did not converge, proceeding with last approximation %.2f and %.2f\n", sigLow, sigHigh)
-			return stack, numClippedLow, numClippedHigh, sigLow, sigHigh, nil
+			fmt.Fprintf(c.Log, "Warning: Newton method did not converge, proceeding with last approximation %.3f and %.3f\n", sigLow, sigHigh)
+			return data, maps, numClippedLow, numClippedHigh, sigLow, sigHigh
 		}
 		newSigHigh:=sigHigh-deltaH/deltaHDiff
 		if newSigHigh<0.1 { newSigHigh=0.1 }
 		if newSigHigh>20  { newSigHigh=20  }
-		stack3=nil // mark memory for free-up
+		data3, data, maps=nil, nil, nil // mark memory for free-up
 		debug.FreeOSMemory()
 
 		// Update them last, so the new value for sigLow does not modify the eval for sigHigh
 		sigLow, sigHigh=newSigLow, newSigHigh
 	}
 }
-*/
\ No newline at end of file
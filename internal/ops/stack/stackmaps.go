@@ -0,0 +1,288 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// Optional per-pixel diagnostic maps produced during stacking. Any of the slices may be nil,
+// in which case that map is not recorded
+type StackMaps struct {
+	Low      []float32 // number of frames rejected below the lower bound
+	High     []float32 // number of frames rejected above the upper bound
+	Coverage []float32 // number of frames with valid, i.e. non-NaN, data before rejection
+	StdError []float32 // standard error of the stacked value, from the frames retained after rejection
+}
+
+// Creates stack maps for the given number of pixels. Allocates only the maps with flags set
+func NewStackMaps(pixels int, low, high, coverage, stdError bool) *StackMaps {
+	m := &StackMaps{}
+	if low {
+		m.Low = make([]float32, pixels)
+	}
+	if high {
+		m.High = make([]float32, pixels)
+	}
+	if coverage {
+		m.Coverage = make([]float32, pixels)
+	}
+	if stdError {
+		m.StdError = make([]float32, pixels)
+	}
+	return m
+}
+
+// Returns a view on the maps for the pixel range [lower, upper). Nil safe
+func (m *StackMaps) Slice(lower, upper int) *StackMaps {
+	if m == nil {
+		return nil
+	}
+	s := &StackMaps{}
+	if m.Low != nil {
+		s.Low = m.Low[lower:upper]
+	}
+	if m.High != nil {
+		s.High = m.High[lower:upper]
+	}
+	if m.Coverage != nil {
+		s.Coverage = m.Coverage[lower:upper]
+	}
+	if m.StdError != nil {
+		s.StdError = m.StdError[lower:upper]
+	}
+	return s
+}
+
+// Copies the given maps into these maps, starting at the given pixel offset. Nil safe
+func (m *StackMaps) copyFrom(lower int, src *StackMaps) {
+	if m == nil || src == nil {
+		return
+	}
+	if m.Low != nil {
+		copy(m.Low[lower:], src.Low)
+	}
+	if m.High != nil {
+		copy(m.High[lower:], src.High)
+	}
+	if m.Coverage != nil {
+		copy(m.Coverage[lower:], src.Coverage)
+	}
+	if m.StdError != nil {
+		copy(m.StdError[lower:], src.StdError)
+	}
+}
+
+// Records the rejection counts and coverage for pixel i. Nil safe
+func (m *StackMaps) setCounts(i int, low, high int32, coverage int) {
+	if m == nil {
+		return
+	}
+	if m.Low != nil {
+		m.Low[i] = float32(low)
+	}
+	if m.High != nil {
+		m.High[i] = float32(high)
+	}
+	if m.Coverage != nil {
+		m.Coverage[i] = float32(coverage)
+	}
+}
+
+// Records the standard error of the mean for pixel i from the retained values. Nil safe
+func (m *StackMaps) setStdErrorOfMean(i int, retained []float32) {
+	if m == nil || m.StdError == nil {
+		return
+	}
+	m.StdError[i] = stdErrorOfMean(retained)
+}
+
+// Records the standard error of the median for pixel i from the retained values. Nil safe
+func (m *StackMaps) setStdErrorOfMedian(i int, retained []float32) {
+	if m == nil || m.StdError == nil {
+		return
+	}
+	m.StdError[i] = 1.2533 * stdErrorOfMean(retained) // asymptotic efficiency of the median for Gaussian noise
+}
+
+// Records the standard error of the mean for pixel i from the given moments. Nil safe
+func (m *StackMaps) setStdErrorOfMoments(i int, n int, sum, sumSquares float64) {
+	if m == nil || m.StdError == nil {
+		return
+	}
+	if n < 2 {
+		m.StdError[i] = 0
+		return
+	}
+	mean := sum / float64(n)
+	variance := (sumSquares - float64(n)*mean*mean) / float64(n-1)
+	if variance < 0 {
+		variance = 0
+	}
+	m.StdError[i] = float32(math.Sqrt(variance / float64(n)))
+}
+
+// Standard error of the mean, i.e. the sample standard deviation divided by the square root of the count
+func stdErrorOfMean(values []float32) float32 {
+	n := len(values)
+	if n < 2 {
+		return 0
+	}
+	sum := float64(0)
+	for _, v := range values {
+		sum += float64(v)
+	}
+	mean := sum / float64(n)
+	sumSquares := float64(0)
+	for _, v := range values {
+		d := float64(v) - mean
+		sumSquares += d * d
+	}
+	return float32(math.Sqrt(sumSquares / float64(n-1) / float64(n)))
+}
+
+// Adds the maps of a batch with the given number of frames to these accumulated maps, allocating them on
+// first use. Rejection counts and coverage add up. For the standard error of the frame-weighted mean of the
+// batches, squared standard errors are summed, weighted by the squared number of frames. Nil safe
+func (m *StackMaps) accumulate(src *StackMaps, frames int) {
+	if m == nil || src == nil {
+		return
+	}
+	add := func(dst *[]float32, values []float32) {
+		if values == nil {
+			return
+		}
+		if *dst == nil {
+			*dst = make([]float32, len(values))
+		}
+		for i, v := range values {
+			(*dst)[i] += v
+		}
+	}
+	add(&m.Low, src.Low)
+	add(&m.High, src.High)
+	add(&m.Coverage, src.Coverage)
+	if src.StdError != nil {
+		if m.StdError == nil {
+			m.StdError = make([]float32, len(src.StdError))
+		}
+		weight := float32(frames) * float32(frames)
+		for i, v := range src.StdError {
+			m.StdError[i] += weight * v * v
+		}
+	}
+}
+
+// Returns the number of frame-sized buffers for the maps recorded while stacking a batch, and the number of
+// additional buffers when stacking several batches, for the saved maps accumulated over batches and the
+// coverage of the stack of stacks
+func (op *OpStack) buffers() (perBatch, multiBatch int64) {
+	for _, save := range []*ops.OpSave{op.SaveLow, op.SaveHigh, op.SaveCoverage, op.SaveStdError} {
+		if wantsMap(save) {
+			perBatch, multiBatch = perBatch+1, multiBatch+1
+		}
+	}
+	if op.Coverage {
+		multiBatch++
+		if !wantsMap(op.SaveCoverage) {
+			perBatch++
+		}
+	}
+	return perBatch, multiBatch
+}
+
+// Starts accumulating the diagnostic maps to be saved over several batches, for saving them once
+// with saveBatchMaps after the last batch
+func (op *OpStack) beginBatches() {
+	op.batchMaps, op.batchFrames = &StackMaps{}, 0
+}
+
+// Stops accumulating the diagnostic maps over batches, discarding them
+func (op *OpStack) endBatches() {
+	op.batchMaps, op.batchFrames = nil, 0
+}
+
+// Adds the diagnostic maps of a batch with the given number of frames to the accumulated maps.
+// Skips the maps which are not saved
+func (op *OpStack) accumulateMaps(maps *StackMaps, frames int) {
+	if maps == nil {
+		return
+	}
+	saved := &StackMaps{}
+	if wantsMap(op.SaveLow) {
+		saved.Low = maps.Low
+	}
+	if wantsMap(op.SaveHigh) {
+		saved.High = maps.High
+	}
+	if wantsMap(op.SaveCoverage) {
+		saved.Coverage = maps.Coverage
+	}
+	if wantsMap(op.SaveStdError) {
+		saved.StdError = maps.StdError
+	}
+	op.batchMaps.accumulate(saved, frames)
+	op.batchFrames += frames
+}
+
+// Saves the diagnostic maps accumulated over all batches as images with the given dimensions and ID
+func (op *OpStack) saveBatchMaps(naxisn []int32, id int, c *ops.Context) error {
+	m := op.batchMaps
+	if m == nil || op.batchFrames == 0 {
+		return nil
+	}
+	if m.StdError != nil {
+		inv := 1 / float32(op.batchFrames)
+		for i, v := range m.StdError {
+			m.StdError[i] = float32(math.Sqrt(float64(v))) * inv
+		}
+	}
+	return m.Save(naxisn, id, op.SaveLow, op.SaveHigh, op.SaveCoverage, op.SaveStdError, c)
+}
+
+// Saves the recorded maps as images with the given dimensions and ID, using the given save operators.
+// Maps which were not recorded, and save operators which are nil or have no file pattern, are skipped
+func (m *StackMaps) Save(naxisn []int32, id int, saveLow, saveHigh, saveCoverage, saveStdError *ops.OpSave, c *ops.Context) error {
+	pairs := []struct {
+		data []float32
+		save *ops.OpSave
+	}{
+		{m.Low, saveLow},
+		{m.High, saveHigh},
+		{m.Coverage, saveCoverage},
+		{m.StdError, saveStdError},
+	}
+	for _, p := range pairs {
+		if p.data == nil || p.save == nil || p.save.FilePattern == "" {
+			continue
+		}
+		img := fits.NewImageFromNaxisn(naxisn, p.data)
+		img.ID = id
+		promise := func() (f *fits.Image, err error) { return img, nil }
+		promises, err := p.save.MakePromises([]ops.Promise{promise}, c)
+		if err != nil {
+			return err
+		}
+		_, err = promises[0]()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
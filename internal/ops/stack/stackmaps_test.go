@@ -0,0 +1,167 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestStackSigmaMaps(t *testing.T) {
+	nan := float32(math.NaN())
+	lights := [][]float32{
+		{10, 10, nan},
+		{11, 11, nan},
+		{9, 9, 5},
+		{10, 10, nan},
+		{10, 1000, nan},
+		{11, 11, nan},
+		{9, 9, nan},
+	}
+	res := make([]float32, 3)
+	maps := NewStackMaps(3, true, true, true, true)
+	clipLow, clipHigh := StackSigma(lights, 0, 2, 2, res, maps)
+	if clipLow != 0 || clipHigh != 1 {
+		t.Errorf("clipLow=%d clipHigh=%d; want %d %d", clipLow, clipHigh, 0, 1)
+	}
+
+	wantHigh := []float32{0, 1, 0}
+	wantCoverage := []float32{7, 7, 1}
+	for i := range res {
+		if maps.Low[i] != 0 {
+			t.Errorf("Low[%d]=%g; want %g", i, maps.Low[i], 0.0)
+		}
+		if maps.High[i] != wantHigh[i] {
+			t.Errorf("High[%d]=%g; want %g", i, maps.High[i], wantHigh[i])
+		}
+		if maps.Coverage[i] != wantCoverage[i] {
+			t.Errorf("Coverage[%d]=%g; want %g", i, maps.Coverage[i], wantCoverage[i])
+		}
+	}
+
+	// first pixel: sample std dev of {10,11,9,10,10,11,9} is sqrt(4/6), over sqrt(7)
+	want := float32(math.Sqrt(4.0 / 6.0 / 7.0))
+	if math.Abs(float64(maps.StdError[0]-want)) > 1e-5 {
+		t.Errorf("StdError[0]=%g; want %g", maps.StdError[0], want)
+	}
+	if maps.StdError[2] != 0 {
+		t.Errorf("StdError[2]=%g; want %g", maps.StdError[2], 0.0)
+	}
+}
+
+func TestStackIncrementalCoverage(t *testing.T) {
+	batch1 := fits.NewImageFromNaxisn([]int32{2, 1}, []float32{1, 2})
+	batch1.Coverage = []float32{1, 0.5}
+	batch2 := fits.NewImageFromNaxisn([]int32{2, 1}, []float32{3, 4})
+	batch2.Coverage = []float32{0, 1}
+
+	stack := StackIncremental(nil, batch1, 3)
+	stack = StackIncremental(stack, batch2, 1)
+	StackIncrementalFinalize(stack, 4)
+
+	wantCoverage := []float32{0.75, 0.625}
+	for i, want := range wantCoverage {
+		if stack.Coverage[i] != want {
+			t.Errorf("Coverage[%d]=%g; want %g", i, stack.Coverage[i], want)
+		}
+	}
+	if batch1.Coverage[0] != 1 {
+		t.Errorf("batch coverage modified")
+	}
+}
+
+func TestStackBatchesMaps(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	ins := make([]ops.Promise, 20)
+	for i := range ins {
+		f := fits.NewImageFromNaxisn([]int32{256, 256}, nil)
+		for j := range f.Data {
+			f.Data[j] = 100 + float32(rng.NormFloat64())
+		}
+		f.Data[i*256+i] = 1000 // an outlier in each frame
+		f.ID = i
+		ins[i] = func() (*fits.Image, error) { return f, nil }
+	}
+	dir := t.TempDir()
+	opStack := NewOpStack(StSigma, StWeightNone, 1.5, 1.5, 0, 0, 0, 0, 0, 0, 0, 0,
+		filepath.Join(dir, "low%d.fits"), filepath.Join(dir, "high%d.fits"), filepath.Join(dir, "coverage%d.fits"), filepath.Join(dir, "stderr%d.fits"), false)
+	c := ops.NewContext(io.Discard, 4, stats.LSEMedianMAD) // fits only a few frames besides the maps
+	if _, err := NewOpStackBatches(ops.NewOpSequence(opStack), "", false, 0, "", false).Apply(ins, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the maps are saved once, covering all batches
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Fatalf("got %d map files; want 4", len(entries))
+	}
+	read := func(name string) *fits.Image {
+		f, err := fits.NewImageFromFile(filepath.Join(dir, name), 0, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	high, coverage := read("high0.fits"), read("coverage0.fits")
+	for i := range ins {
+		if v := high.Data[i*256+i]; v < 1 {
+			t.Errorf("high rejections at outlier %d are %g; want at least 1", i, v)
+		}
+	}
+	for i, v := range coverage.Data {
+		if v != 20 {
+			t.Fatalf("coverage at %d is %g; want 20", i, v)
+		}
+	}
+
+	// counts add up, and the standard error is that of the frame-weighted mean of the batches
+	maps := &StackMaps{}
+	maps.accumulate(&StackMaps{High: []float32{1}, Coverage: []float32{3}, StdError: []float32{0.3}}, 3)
+	maps.accumulate(&StackMaps{High: []float32{2}, Coverage: []float32{1}, StdError: []float32{0.4}}, 1)
+	opStack.batchMaps, opStack.batchFrames = maps, 4
+	opStack.SaveLow, opStack.SaveHigh, opStack.SaveCoverage, opStack.SaveStdError = nil, nil, nil, nil
+	if err := opStack.saveBatchMaps([]int32{1, 1}, 0, c); err != nil {
+		t.Fatal(err)
+	}
+	want := float32(math.Sqrt(0.75*0.75*0.3*0.3 + 0.25*0.25*0.4*0.4))
+	if maps.High[0] != 3 || maps.Coverage[0] != 4 || math.Abs(float64(maps.StdError[0]-want)) > 1e-6 {
+		t.Errorf("accumulated high %g coverage %g standard error %g; want 3, 4, %g", maps.High[0], maps.Coverage[0], maps.StdError[0], want)
+	}
+}
+
+func TestStackCoverageJSON(t *testing.T) {
+	seq := ops.NewOpSequence()
+	job := `{"type":"seq", "steps":[{"type":"stack"}, {"type":"stackComet", "stack":{"type":"stack", "mode":3}}, {"type":"stackComet"}]}`
+	if err := json.Unmarshal([]byte(job), seq); err != nil {
+		t.Fatal(err)
+	}
+	if seq.Steps[0].(*OpStack).Coverage {
+		t.Error("plain stack records coverage by default")
+	}
+	for i, step := range seq.Steps[1:] {
+		if comet := step.(*OpStackComet); comet.Stack == nil || !comet.Stack.Coverage {
+			t.Errorf("comet stack %d does not record coverage", i)
+		}
+	}
+}
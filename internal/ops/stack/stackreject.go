@@ -0,0 +1,248 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/qsort"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// Mean stacking with generalized extreme studentized deviate (ESD) rejection after Rosner (1983).
+// Tests up to the given fraction of the values of each pixel as outliers at the given significance
+// level, and excludes the outliers from the average calculation. Needs many frames to be effective
+func StackESD(lightsData [][]float32, RefFrameLoc, fraction, alpha float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackESD(lightsData, nil, RefFrameLoc, fraction, alpha, res, maps)
+}
+
+// Weighted mean stacking with generalized extreme studentized deviate (ESD) rejection.
+// The outlier test itself is unweighted
+func StackESDWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, fraction, alpha float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackESD(lightsData, weights, RefFrameLoc, fraction, alpha, res, maps)
+}
+
+func stackESD(lightsData [][]float32, weights []float32, RefFrameLoc, fraction, alpha float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	values, ws := make([]float32, len(lightsData)), make([]float32, len(lightsData))
+	critical := make([][]float64, len(lightsData)+1) // critical values by number of valid values, computed on demand
+
+	for i := range res {
+		n := gather(lightsData, weights, i, values, ws)
+		if n == 0 {
+			res[i] = RefFrameLoc // see StackMedian on why this is not NaN
+			continue
+		}
+		vs, wsCur := values[:n], ws[:n]
+		sortGathered(vs, wsCur, weights != nil)
+
+		// the outlier candidate with the largest deviation from the mean is always at either end of the sorted values
+		maxOutliers := int(fraction * float32(n))
+		if maxOutliers > n-2 {
+			maxOutliers = n - 2
+		}
+		if maxOutliers > 0 && critical[n] == nil {
+			critical[n] = esdCriticalValues(n, maxOutliers, float64(alpha))
+		}
+		sum, sumSquares := 0.0, 0.0
+		for _, v := range vs {
+			sum, sumSquares = sum+float64(v), sumSquares+float64(v)*float64(v)
+		}
+		lo, hi, keepLo, keepHi := 0, n, 0, n
+		for k := 0; k < maxOutliers; k++ {
+			m := float64(hi - lo)
+			mean := sum / m
+			variance := (sumSquares - m*mean*mean) / (m - 1)
+			if variance <= 0 {
+				break
+			}
+			stdDev := math.Sqrt(variance)
+			var r, v float64
+			if dLo, dHi := mean-float64(vs[lo]), float64(vs[hi-1])-mean; dHi >= dLo {
+				r, v = dHi/stdDev, float64(vs[hi-1])
+				hi--
+			} else {
+				r, v = dLo/stdDev, float64(vs[lo])
+				lo++
+			}
+			sum, sumSquares = sum-v, sumSquares-v*v
+			if r > critical[n][k] { // the number of outliers is the largest k passing the test
+				keepLo, keepHi = lo, hi
+			}
+		}
+
+		res[i] = weightedMean(vs[keepLo:keepHi], wsCur[keepLo:keepHi], weights != nil)
+		clipLow, clipHigh = clipLow+int32(keepLo), clipHigh+int32(n-keepHi)
+		maps.setCounts(i, int32(keepLo), int32(n-keepHi), n)
+		maps.setStdErrorOfMean(i, vs[keepLo:keepHi])
+	}
+	return clipLow, clipHigh
+}
+
+// Returns the critical values of the generalized ESD test for up to the given number of outliers
+// among n values, at the given significance level
+func esdCriticalValues(n, maxOutliers int, alpha float64) []float64 {
+	res := make([]float64, maxOutliers)
+	for k := range res {
+		rest := float64(n - k - 1) // values remaining after removing k+1 candidates
+		t := distuv.StudentsT{Mu: 0, Sigma: 1, Nu: rest - 1}.Quantile(1 - alpha/(2*(rest+1)))
+		res[k] = rest * t / math.Sqrt((rest-1+t*t)*(rest+1))
+	}
+	return res
+}
+
+// Mean stacking with percentile clipping. Values which are below or above the median by more than
+// the given fractions of it are excluded from the average calculation. Suited for tiny stacks,
+// as it does not rely on a standard deviation estimate
+func StackPercentile(lightsData [][]float32, RefFrameLoc, percLow, percHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackPercentile(lightsData, nil, RefFrameLoc, percLow, percHigh, res, maps)
+}
+
+// Weighted mean stacking with percentile clipping
+func StackPercentileWeighted(lightsData [][]float32, weights []float32, RefFrameLoc, percLow, percHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackPercentile(lightsData, weights, RefFrameLoc, percLow, percHigh, res, maps)
+}
+
+func stackPercentile(lightsData [][]float32, weights []float32, RefFrameLoc, percLow, percHigh float32, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	values, ws, scratch := make([]float32, len(lightsData)), make([]float32, len(lightsData)), make([]float32, len(lightsData))
+
+	for i := range res {
+		n := gather(lightsData, weights, i, values, ws)
+		if n == 0 {
+			res[i] = RefFrameLoc // see StackMedian on why this is not NaN
+			continue
+		}
+
+		// median selection reorders, so work on a copy to keep values and weights paired
+		copy(scratch, values[:n])
+		median := qsort.QSelectMedianFloat32(scratch[:n])
+		absMedian := float32(math.Abs(float64(median)))
+		lowBound, highBound := median-percLow*absMedian, median+percHigh*absMedian
+
+		kept, low, high := 0, int32(0), int32(0)
+		for j, v := range values[:n] {
+			if v < lowBound {
+				low++
+			} else if v > highBound {
+				high++
+			} else {
+				values[kept], ws[kept] = v, ws[j]
+				kept++
+			}
+		}
+
+		if kept == 0 { // only possible with zero fractions and an interpolated median
+			res[i] = median
+		} else {
+			res[i] = weightedMean(values[:kept], ws[:kept], weights != nil)
+		}
+		clipLow, clipHigh = clipLow+low, clipHigh+high
+		maps.setCounts(i, low, high, n)
+		maps.setStdErrorOfMean(i, values[:kept])
+	}
+	return clipLow, clipHigh
+}
+
+// Mean stacking with min/max rejection. The given numbers of lowest and highest values of each pixel
+// are excluded from the average calculation. If fewer values are available, at least one is kept
+func StackMinMax(lightsData [][]float32, RefFrameLoc float32, dropLow, dropHigh int, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackMinMax(lightsData, nil, RefFrameLoc, dropLow, dropHigh, res, maps)
+}
+
+// Weighted mean stacking with min/max rejection
+func StackMinMaxWeighted(lightsData [][]float32, weights []float32, RefFrameLoc float32, dropLow, dropHigh int, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	return stackMinMax(lightsData, weights, RefFrameLoc, dropLow, dropHigh, res, maps)
+}
+
+func stackMinMax(lightsData [][]float32, weights []float32, RefFrameLoc float32, dropLow, dropHigh int, res []float32, maps *StackMaps) (clipLow, clipHigh int32) {
+	values, ws := make([]float32, len(lightsData)), make([]float32, len(lightsData))
+
+	for i := range res {
+		n := gather(lightsData, weights, i, values, ws)
+		if n == 0 {
+			res[i] = RefFrameLoc // see StackMedian on why this is not NaN
+			continue
+		}
+		vs, wsCur := values[:n], ws[:n]
+		sortGathered(vs, wsCur, weights != nil)
+
+		// drop fewer values if necessary, alternating sides
+		lo, hi := dropLow, dropHigh
+		for lo+hi >= n {
+			if hi >= lo {
+				hi--
+			} else {
+				lo--
+			}
+		}
+
+		res[i] = weightedMean(vs[lo:n-hi], wsCur[lo:n-hi], weights != nil)
+		clipLow, clipHigh = clipLow+int32(lo), clipHigh+int32(hi)
+		maps.setCounts(i, int32(lo), int32(hi), n)
+		maps.setStdErrorOfMean(i, vs[lo:n-hi])
+	}
+	return clipLow, clipHigh
+}
+
+// Gathers the valid values of pixel i across all lights, skipping NaNs, and their weights if given.
+// Returns the number of values gathered
+func gather(lightsData [][]float32, weights []float32, i int, values, ws []float32) int {
+	n := 0
+	for li := range lightsData {
+		if v := lightsData[li][i]; !math.IsNaN(float64(v)) {
+			values[n] = v
+			if weights != nil {
+				ws[n] = weights[li]
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// Sorts the gathered values in ascending order, keeping the weights paired if weighted
+func sortGathered(values, ws []float32, weighted bool) {
+	if weighted {
+		sort.Sort(valuesAndWeights{values, ws})
+	} else {
+		qsort.QSortFloat32(values)
+	}
+}
+
+// Returns the mean of the given values, weighted with the given weights if weighted
+func weightedMean(values, ws []float32, weighted bool) float32 {
+	sum, weightSum := float32(0), float32(0)
+	for j, v := range values {
+		if weighted {
+			sum, weightSum = sum+v*ws[j], weightSum+ws[j]
+		} else {
+			sum, weightSum = sum+v, weightSum+1
+		}
+	}
+	return sum / weightSum
+}
+
+// Sorts values in ascending order, keeping their weights paired
+type valuesAndWeights struct {
+	values, weights []float32
+}
+
+func (s valuesAndWeights) Len() int           { return len(s.values) }
+func (s valuesAndWeights) Less(i, j int) bool { return s.values[i] < s.values[j] }
+func (s valuesAndWeights) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.weights[i], s.weights[j] = s.weights[j], s.weights[i]
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestESDCriticalValues(t *testing.T) {
+	// reference values from Rosner (1983), table 1 for n=25 at alpha 0.05
+	want := []float64{2.82, 2.80, 2.78}
+	for i, c := range esdCriticalValues(25, 3, 0.05) {
+		if math.Abs(c-want[i]) > 0.01 {
+			t.Errorf("critical value %d: got %.3f; want %.2f", i+1, c, want[i])
+		}
+	}
+}
+
+func TestStackESD(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	nan := float32(math.NaN())
+	lights := make([][]float32, 120)
+	for i := range lights {
+		lights[i] = []float32{100 + float32(rng.NormFloat64()), 50 + float32(rng.NormFloat64()), nan}
+	}
+	lights[3][0], lights[17][0], lights[40][0] = 1000, 900, 20 // satellite trails and a dropout
+	res := make([]float32, 3)
+	maps := NewStackMaps(3, true, true, true, false)
+	clipLow, clipHigh := StackESD(lights, -1, 0.3, 0.05, res, maps)
+	if maps.Low[0] != 1 || maps.High[0] != 2 {
+		t.Errorf("pixel 0: clipped low %g high %g; want 1 and 2", maps.Low[0], maps.High[0])
+	}
+	if clipLow+clipHigh > 5 {
+		t.Errorf("clipped low %d high %d; want at most two false positives", clipLow, clipHigh)
+	}
+	if math.Abs(float64(res[0]-100)) > 0.3 || math.Abs(float64(res[1]-50)) > 0.3 {
+		t.Errorf("got %v; want 100 and 50", res)
+	}
+	if res[2] != -1 || maps.Coverage[2] != 0 {
+		t.Errorf("pixel without data: got %g coverage %g", res[2], maps.Coverage[2])
+	}
+
+	// weights shift the mean of the retained values only
+	weights := make([]float32, len(lights))
+	for i := range weights {
+		weights[i] = 1
+	}
+	weights[3], weights[0] = 100, 0
+	resW := make([]float32, 3)
+	StackESDWeighted(lights, weights, -1, 0.3, 0.05, resW, nil)
+	want := float32(0)
+	for i := range lights {
+		if i != 3 && i != 17 && i != 40 {
+			want += lights[i][0] * weights[i]
+		}
+	}
+	want /= float32(len(lights) - 4)
+	if math.Abs(float64(resW[0]-want)) > 1e-3 {
+		t.Errorf("weighted: got %g; want %g", resW[0], want)
+	}
+}
+
+func TestStackPercentile(t *testing.T) {
+	lights := [][]float32{{100, 10}, {104, 10}, {60, 10}, {130, 12}}
+	res := make([]float32, 2)
+	maps := NewStackMaps(2, true, true, true, false)
+	clipLow, clipHigh := StackPercentile(lights, 0, 0.2, 0.1, res, maps)
+	if clipLow != 1 || clipHigh != 2 {
+		t.Errorf("clipped low %d high %d; want 1 and 2", clipLow, clipHigh)
+	}
+	if res[0] != 102 || res[1] != 10 {
+		t.Errorf("got %v; want 102 and 10", res)
+	}
+
+	StackPercentileWeighted(lights, []float32{3, 1, 1, 1}, 0, 0.2, 0.1, res, nil)
+	if res[0] != 101 {
+		t.Errorf("weighted: got %g; want 101", res[0])
+	}
+}
+
+func TestStackMinMax(t *testing.T) {
+	nan := float32(math.NaN())
+	lights := [][]float32{{1, 1}, {5, nan}, {2, nan}, {9, 3}, {4, nan}}
+	res := make([]float32, 2)
+	maps := NewStackMaps(2, true, true, true, false)
+	clipLow, clipHigh := StackMinMax(lights, 0, 1, 2, res, maps)
+	if res[0] != 3 || res[1] != 3 {
+		t.Errorf("got %v; want 3 and 3", res)
+	}
+	// with only two values, both high drops are given up to keep one value
+	if clipLow != 2 || clipHigh != 2 || maps.Low[1] != 1 || maps.High[1] != 0 {
+		t.Errorf("clipped low %d high %d, second pixel %g %g; want 2 2, 1 0", clipLow, clipHigh, maps.Low[1], maps.High[1])
+	}
+
+	StackMinMaxWeighted(lights, []float32{1, 1, 1, 1, 3}, 0, 1, 1, res, nil)
+	if res[0] != 3.8 || res[1] != 3 {
+		t.Errorf("weighted: got %v; want 3.8 and 3", res)
+	}
+}
+
+func TestFindSigmasAndStack(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	fs := make([]*fits.Image, 10)
+	for i := range fs {
+		data := make([]float32, 2000)
+		for j := range data {
+			data[j] = 100 + 10*float32(rng.NormFloat64())
+		}
+		fs[i] = fits.NewImageFromNaxisn([]int32{2000, 1}, data)
+	}
+	c := ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD)
+	for _, mode := range []StackMode{StSigma, StPercentile} {
+		op := NewOpStack(mode, StWeightNone, -1, -1, 1, 2, -1, -1, 0, 0, 0, 0, "", "", "", "", true)
+		_, _, clipLow, clipHigh, _, _ := op.FindSigmasAndStack(fs, mode, nil, c)
+		percLow, percHigh := float32(clipLow)*100/20000, float32(clipHigh)*100/20000
+		if math.Abs(float64(percLow-1)) > 0.1 || math.Abs(float64(percHigh-2)) > 0.1 {
+			t.Errorf("mode %d: clipped %.2f%% low and %.2f%% high; want 1%% and 2%%", mode, percLow, percHigh)
+		}
+	}
+}
+
+func TestAutoSelectStackingMode(t *testing.T) {
+	for l, want := range map[int]StackMode{1: StMean, 4: StMean, 10: StSigma, 20: StWinsorSigma, 50: StLinearFit, 150: StESD} {
+		if got := autoSelectStackingMode(l); got != want {
+			t.Errorf("%d frames: got mode %d; want %d", l, got, want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+)
+
+// A frame spilled to a temporary file as raw little-endian float32 values in row-major order,
+// so a band of rows can be read back with a single contiguous read
+type spillFile struct {
+	name  string
+	width int32 // pixels per row
+	rows  int32 // number of rows, across all axes beyond the first
+}
+
+// Writes the data of the given frame to a spill file with the given name
+func writeSpill(name string, f *fits.Image) (s *spillFile, err error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(file, 1<<20)
+	width := int(f.Naxisn[0])
+	buf := make([]byte, 4*width)
+	for lower := 0; lower < len(f.Data); lower += width {
+		for i, v := range f.Data[lower : lower+width] {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+		}
+		if _, err = w.Write(buf); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	return &spillFile{name: name, width: f.Naxisn[0], rows: int32(len(f.Data)) / f.Naxisn[0]}, nil
+}
+
+// Reads the given band of rows from the spill file into dst, which must hold rows*width values
+func (s *spillFile) readRows(y0, rows int32, dst []float32) error {
+	file, err := os.Open(s.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf := make([]byte, 4*len(dst))
+	if _, err = file.ReadAt(buf, 4*int64(y0)*int64(s.width)); err != nil {
+		return err
+	}
+	for i := range dst {
+		dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return nil
+}
+
+// Splits the per-batch sequence into the steps before the stack operator, the stack operator itself,
+// and the steps after it. Out-of-core stacking supports only the plain stack operator
+func (op *OpStackBatches) splitPerBatch() (pre *ops.OpSequence, st *OpStack, post *ops.OpSequence, err error) {
+	for i, step := range op.PerBatch.Steps {
+		if s, ok := step.(*OpStack); ok {
+			return ops.NewOpSequence(op.PerBatch.Steps[:i]...), s, ops.NewOpSequence(op.PerBatch.Steps[i+1:]...), nil
+		}
+	}
+	return nil, nil, nil, errors.New("out-of-core stacking needs a stack operator in the per-batch sequence")
+}
+
+// Out-of-core stacking with exact global rejection. Preprocesses and aligns each frame once, in chunks of
+// the given batch size, and spills it to a temporary file. Then stacks band by band of rows over all frames
+func (op *OpStackBatches) applySpill(ins []ops.Promise, batchSize int64, c *ops.Context) (fOut *fits.Image, err error) {
+	pre, st, post, err := op.splitPerBatch()
+	if err != nil {
+		return nil, err
+	}
+
+	// create the temporary directory
+	dir, err := os.MkdirTemp(op.SpillDir, "nightlight-spill-")
+	if err != nil {
+		return nil, err
+	}
+	if op.KeepSpill {
+		fmt.Fprintf(c.Log, "Keeping spill files in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	fmt.Fprintf(c.Log, "Spilling %d frames to %s...\n", len(ins), dir)
+
+	// preprocess the frames in chunks and spill them, keeping only their metadata in memory
+	target := &spillTarget{dir: dir, maxBytes: op.SpillMaxMB * 1024 * 1024}
+	for from := int64(0); from < int64(len(ins)); from += batchSize {
+		to := from + batchSize
+		if to > int64(len(ins)) {
+			to = int64(len(ins))
+		}
+		fmt.Fprintf(c.Log, "\nPreprocessing frames %d to %d of %d...\n", from+1, to, len(ins))
+		proms, err := pre.MakePromises(ins[from:to], c)
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range proms {
+			proms[i] = target.spillPromise(p)
+		}
+		if _, err = ops.MaterializeAll(proms, c.MaxThreads, true); err != nil {
+			return nil, err
+		}
+		debug.FreeOSMemory()
+	}
+	frames, spills := target.frames, target.spills
+	if len(frames) == 0 {
+		return nil, errors.New("no frames left to stack")
+	}
+	fmt.Fprintf(c.Log, "Spilled %d frames with %d MiB in total\n", len(frames), target.written/1024/1024)
+
+	// stack band by band, then apply the remaining steps to the result
+	stack, err := st.applyBands(frames, spills, c)
+	if err != nil {
+		return nil, err
+	}
+	c.DarkFrame, c.FlatFrame = nil, nil
+	debug.FreeOSMemory()
+	outs, err := post.MakePromises([]ops.Promise{func() (*fits.Image, error) { return stack, nil }}, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(outs) != 1 {
+		return nil, errors.New("stacking returned more than one promise")
+	}
+	return outs[0]()
+}
+
+// The destination of spilled frames, with the metadata and spill files of the frames written so far
+type spillTarget struct {
+	dir      string
+	maxBytes int64 // maximum disk space for spill files in bytes, 0=unlimited
+	written  int64 // bytes written to spill files so far
+	frames   []*fits.Image
+	spills   []*spillFile
+	lock     sync.Mutex
+}
+
+// Wraps the given promise to spill the materialized frame to the target directory, and record its metadata
+// and spill file. The frame data is released, but statistics needed for weighting are computed first.
+// Frames filtered out by preprocessing are skipped. Fails if the frame would exceed the disk space limit
+func (t *spillTarget) spillPromise(p ops.Promise) ops.Promise {
+	return func() (*fits.Image, error) {
+		f, err := p()
+		if err != nil || f == nil {
+			return nil, err
+		}
+		size := 4 * int64(len(f.Data))
+		t.lock.Lock()
+		if t.maxBytes > 0 && t.written+size > t.maxBytes {
+			t.lock.Unlock()
+			return nil, fmt.Errorf("%d: spilling needs more than the limit of %d MiB of disk space", f.ID, t.maxBytes/1024/1024)
+		}
+		t.written += size // reserved before writing, so concurrent frames cannot overshoot the limit
+		t.lock.Unlock()
+
+		s, err := writeSpill(filepath.Join(t.dir, fmt.Sprintf("frame%05d.raw", f.ID)), f)
+		if err != nil {
+			return nil, err
+		}
+		if f.Stats != nil {
+			f.Stats.Location()
+			f.Stats.Noise()
+			f.Stats.FreeData()
+		}
+		f.Data, f.MedianDiffStats = nil, nil
+
+		t.lock.Lock()
+		t.frames, t.spills = append(t.frames, f), append(t.spills, s)
+		t.lock.Unlock()
+		return f, nil
+	}
+}
+
+// Stacks the given spilled frames band by band of rows, with weights and rejection bounds determined once
+// for all bands. Negative bounds are goal-seeked on the central band. The frames provide the metadata only
+func (op *OpStack) applyBands(frames []*fits.Image, spills []*spillFile, c *ops.Context) (result *fits.Image, err error) {
+	mode, weights, err := op.prepare(frames, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// size the bands to fit the frames, the result and the maps into memory
+	width, rows := spills[0].width, spills[0].rows
+	for _, s := range spills {
+		if s.width != width || s.rows != rows {
+			return nil, errors.New("spilled frames differ in size")
+		}
+	}
+	bandRows := int32(int64(c.StackMemoryMB) * 1024 * 1024 / 4 / (int64(len(frames)) + 6) / int64(width))
+	if bandRows < 1 {
+		bandRows = 1
+	}
+	if bandRows > rows {
+		bandRows = rows
+	}
+	numBands := (rows + bandRows - 1) / bandRows
+	band := make([]*fits.Image, len(frames))
+	for i := range band {
+		band[i] = fits.NewImageFromNaxisn([]int32{width, bandRows}, nil)
+	}
+	readBand := func(y0, n int32) ([]*fits.Image, error) {
+		for i, s := range spills {
+			band[i].Data = band[i].Data[:n*width]
+			if err := s.readRows(y0, n, band[i].Data); err != nil {
+				return nil, err
+			}
+		}
+		return band, nil
+	}
+
+	low, high := op.bounds(mode)
+	if low < 0 || high < 0 {
+		y0 := (numBands / 2) * bandRows
+		n := bandRows
+		if y0+n > rows {
+			n = rows - y0
+		}
+		fmt.Fprintf(c.Log, "Goal-seeking bounds on band %d of %d:\n", numBands/2+1, numBands)
+		b, err := readBand(y0, n)
+		if err != nil {
+			return nil, err
+		}
+		_, _, _, _, low, high = op.FindSigmasAndStack(b, mode, weights, c)
+	}
+
+	fmt.Fprintf(c.Log, "Stacking %d frames in %d bands of %d rows with stacking mode %d and %s:\n",
+		len(frames), numBands, bandRows, mode, op.describe(mode, low, high))
+	data := make([]float32, int(width)*int(rows))
+	maps := op.newMaps(len(data))
+	numClippedLow, numClippedHigh := int32(0), int32(0)
+	for y0 := int32(0); y0 < rows; y0 += bandRows {
+		n := bandRows
+		if y0+n > rows {
+			n = rows - y0
+		}
+		b, err := readBand(y0, n)
+		if err != nil {
+			return nil, err
+		}
+		bandData, bandMaps, clipLow, clipHigh := op.stack(b, mode, weights, low, high, c)
+		lower := int(y0) * int(width)
+		copy(data[lower:], bandData)
+		maps.copyFrom(lower, bandMaps)
+		numClippedLow, numClippedHigh = numClippedLow+clipLow, numClippedHigh+clipHigh
+	}
+	band = nil
+
+	return op.assemble(frames, mode, data, maps, numClippedLow, numClippedHigh, c)
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/ops"
+	"github.com/mlnoga/nightlight/internal/stats"
+)
+
+func TestStackSpill(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	fs := make([]*fits.Image, 20)
+	for i := range fs {
+		fs[i] = fits.NewImageFromNaxisn([]int32{256, 256}, nil)
+		fs[i].ID = i
+		for j := range fs[i].Data {
+			fs[i].Data[j] = 100 + float32(rng.NormFloat64())
+		}
+	}
+	for _, i := range []int{2, 5, 11} { // a satellite trail crossing several frames
+		for x := 0; x < 256; x++ {
+			fs[i].Data[130*256+x] = 1000
+		}
+	}
+
+	// reference stack with all frames in memory
+	opStack := NewOpStack(StSigma, StWeightNone, 2, 2, 0, 0, 0, 0, 0, 0, 0, 0, "", "", "", "", true)
+	copies := make([]*fits.Image, len(fs))
+	for i, f := range fs {
+		copies[i] = fits.NewImageFromNaxisn(f.Naxisn, append([]float32(nil), f.Data...))
+	}
+	want, err := opStack.Apply(copies, ops.NewContext(io.Discard, 1024, stats.LSEMedianMAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keep := range []bool{false, true} {
+		ins := make([]ops.Promise, len(fs))
+		for i := range fs {
+			f := fits.NewImageFromNaxisn(fs[i].Naxisn, append([]float32(nil), fs[i].Data...))
+			f.ID = i
+			ins[i] = func() (*fits.Image, error) { return f, nil }
+		}
+		dir := t.TempDir()
+		c := ops.NewContext(io.Discard, 2, stats.LSEMedianMAD) // fits only a few frames, forcing a spill
+		op := NewOpStackBatches(ops.NewOpSequence(opStack), dir, keep, 0, "", false)
+		got, err := op.Apply(ins, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want.Data {
+			if math.Abs(float64(got.Data[i]-want.Data[i])) > 1e-4 {
+				t.Fatalf("keep %v: pixel %d is %g; want %g", keep, i, got.Data[i], want.Data[i])
+			}
+		}
+		if got.Data[130*256+7] > 101 || got.Coverage[0] != 1 {
+			t.Errorf("keep %v: got trail %g coverage %g; want trail rejected and full coverage", keep, got.Data[130*256+7], got.Coverage[0])
+		}
+
+		entries, _ := os.ReadDir(dir)
+		if (keep && len(entries) != 1) || (!keep && len(entries) != 0) {
+			t.Errorf("keep %v: found %d entries in spill directory", keep, len(entries))
+		}
+	}
+
+	// 20 frames of 256 KiB each need 5 MiB of disk space
+	for _, maxMB := range []int64{1, 5} {
+		ins := make([]ops.Promise, len(fs))
+		for i := range fs {
+			f := fits.NewImageFromNaxisn(fs[i].Naxisn, append([]float32(nil), fs[i].Data...))
+			f.ID = i
+			ins[i] = func() (*fits.Image, error) { return f, nil }
+		}
+		dir := t.TempDir()
+		op := NewOpStackBatches(ops.NewOpSequence(opStack), dir, false, maxMB, "", false)
+		_, err := op.Apply(ins, ops.NewContext(io.Discard, 2, stats.LSEMedianMAD))
+		if (maxMB == 1) != (err != nil) {
+			t.Errorf("limit %d MiB: got error %v", maxMB, err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("limit %d MiB: found %d entries in spill directory", maxMB, len(entries))
+		}
+	}
+
+	op := NewOpStackBatches(ops.NewOpSequence(), t.TempDir(), false, 1, "", false)
+	if _, err := op.Apply([]ops.Promise{func() (*fits.Image, error) { return fs[0], nil }}, ops.NewContext(io.Discard, 2, stats.LSEMedianMAD)); err != nil {
+		t.Errorf("single frame in memory: unexpected error %v", err)
+	}
+}
@@ -131,6 +131,7 @@ func postJob(c *gin.Context) {
 			fmt.Fprintf(logWriter, "Error materializing promises: %s\n", err.Error())
 			return
 		}
+		oc.FinishStats()
 		logWriter.(http.Flusher).Flush()
 	}
 	debug.FreeOSMemory()
@@ -0,0 +1,255 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package solve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+)
+
+// A star from a reference catalog, with J2000/ICRS coordinates in degrees, magnitude and optional color index
+type CatalogStar struct {
+	RA    float64
+	Dec   float64
+	Mag   float32
+	BV    float32 // B-V color index, valid if HasBV
+	HasBV bool
+}
+
+// A reference star catalog, sorted by declination for fast cone searches
+type Catalog struct {
+	Stars []CatalogStar
+}
+
+// Magic number at the start of the binary catalog format. It is followed by the little endian uint32 number
+// of stars, and for each star the little endian float64 right ascension, float64 declination, float32 magnitude
+// and float32 B-V color index, NaN if unknown. The first version of the format lacks the color index
+var (
+	catalogMagic   = []byte("NLCAT002")
+	catalogMagicV1 = []byte("NLCAT001")
+)
+
+// Column names accepted for CSV catalogs, in lower case. Magnitudes fall back to any column containing "mag".
+// Color indices are optional, from a B-V or Gaia BP-RP column or else from separate B and V magnitude columns
+var (
+	raColumns   = []string{"ra", "ra_deg", "raj2000", "_raj2000", "ra_icrs", "radeg"}
+	decColumns  = []string{"dec", "de", "dec_deg", "dej2000", "_dej2000", "de_icrs", "dec_icrs", "dedeg"}
+	magColumns  = []string{"mag", "vmag", "gmag", "phot_g_mean_mag", "vtmag", "btmag", "v", "g"}
+	bvColumns   = []string{"b-v", "b_v", "bv", "b-v_mag", "bvmag"}
+	bpRpColumns = []string{"bp_rp", "bp-rp", "bprp", "bp-rp_mag"}
+	bColumns    = []string{"bmag", "b_mag", "b"}
+	vColumns    = []string{"vmag", "v_mag", "v"}
+)
+
+// Creates a catalog from the given stars, which are sorted in place
+func NewCatalog(stars []CatalogStar) *Catalog {
+	sort.Slice(stars, func(i, j int) bool { return stars[i].Dec < stars[j].Dec })
+	return &Catalog{Stars: stars}
+}
+
+// Loads a catalog from the given file, in the binary format or as CSV with a header line
+func LoadCatalog(fileName string) (*Catalog, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var stars []CatalogStar
+	if magic, err := r.Peek(len(catalogMagic)); err == nil && (bytes.Equal(magic, catalogMagic) || bytes.Equal(magic, catalogMagicV1)) {
+		stars, err = ReadCatalogBinary(r)
+	} else {
+		stars, err = ReadCatalogCSV(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog %s: %s", fileName, err.Error())
+	}
+	return NewCatalog(stars), nil
+}
+
+// Reads catalog stars from CSV with a header line naming the right ascension, declination and magnitude columns,
+// and optionally color index columns. Coordinates must be in decimal degrees
+func ReadCatalogCSV(r io.Reader) (stars []CatalogStar, err error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	raCol, decCol, magCol := findColumn(header, raColumns, ""), findColumn(header, decColumns, ""), findColumn(header, magColumns, "mag")
+	if raCol < 0 || decCol < 0 || magCol < 0 {
+		return nil, fmt.Errorf("header line %v lacks right ascension, declination or magnitude column", header)
+	}
+	bvCol, bpRpCol := findColumn(header, bvColumns, ""), findColumn(header, bpRpColumns, "")
+	bCol, vCol := findColumn(header, bColumns, ""), findColumn(header, vColumns, "")
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		ra, errRA := strconv.ParseFloat(strings.TrimSpace(record[raCol]), 64)
+		dec, errDec := strconv.ParseFloat(strings.TrimSpace(record[decCol]), 64)
+		mag, errMag := strconv.ParseFloat(strings.TrimSpace(record[magCol]), 32)
+		if errRA != nil || errDec != nil {
+			return nil, fmt.Errorf("line %d: invalid coordinates", line)
+		}
+		if errMag != nil {
+			continue // skip stars without magnitude, common in catalog extracts
+		}
+		s := CatalogStar{RA: ra, Dec: dec, Mag: float32(mag)}
+		s.BV, s.HasBV = parseColor(record, bvCol, bpRpCol, bCol, vCol)
+		stars = append(stars, s)
+	}
+	return stars, nil
+}
+
+// Parses the B-V color index from the given record, using the first available of the B-V column,
+// the BP-RP column and the difference of the B and V columns. Returns false if none is available
+func parseColor(record []string, bvCol, bpRpCol, bCol, vCol int) (bv float32, ok bool) {
+	parse := func(col int) (float32, bool) {
+		if col < 0 {
+			return 0, false
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[col]), 32)
+		return float32(v), err == nil
+	}
+	if bv, ok := parse(bvCol); ok {
+		return bv, true
+	}
+	if bprp, ok := parse(bpRpCol); ok {
+		return fits.BPRPToBV(bprp), true
+	}
+	b, okB := parse(bCol)
+	v, okV := parse(vCol)
+	if okB && okV && bCol != vCol {
+		return b - v, true
+	}
+	return 0, false
+}
+
+// Returns the index of the first column whose lower case name is in the given list, or else contains
+// the given fallback substring if not empty. Returns -1 if not found
+func findColumn(header, names []string, fallback string) int {
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		for _, n := range names {
+			if h == n {
+				return i
+			}
+		}
+	}
+	if fallback != "" {
+		for i, h := range header {
+			if strings.Contains(strings.ToLower(h), fallback) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Reads catalog stars in the binary format
+func ReadCatalogBinary(r io.Reader) (stars []CatalogStar, err error) {
+	magic := make([]byte, len(catalogMagic))
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	recordSize := 24
+	if bytes.Equal(magic, catalogMagicV1) {
+		recordSize = 20
+	} else if !bytes.Equal(magic, catalogMagic) {
+		return nil, errors.New("not a binary star catalog")
+	}
+	var count uint32
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordSize)
+	stars = make([]CatalogStar, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if _, err = io.ReadFull(r, record); err != nil {
+			return nil, fmt.Errorf("star %d of %d: %s", i, count, err.Error())
+		}
+		s := CatalogStar{
+			RA:  math.Float64frombits(binary.LittleEndian.Uint64(record[0:])),
+			Dec: math.Float64frombits(binary.LittleEndian.Uint64(record[8:])),
+			Mag: math.Float32frombits(binary.LittleEndian.Uint32(record[16:])),
+		}
+		if recordSize > 20 {
+			s.BV = math.Float32frombits(binary.LittleEndian.Uint32(record[20:]))
+			s.HasBV = !math.IsNaN(float64(s.BV))
+			if !s.HasBV {
+				s.BV = 0
+			}
+		}
+		stars = append(stars, s)
+	}
+	return stars, nil
+}
+
+// Writes catalog stars in the binary format, e.g. to convert a CSV extract for faster loading
+func WriteCatalogBinary(w io.Writer, stars []CatalogStar) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(catalogMagic)
+	binary.Write(bw, binary.LittleEndian, uint32(len(stars)))
+	record := make([]byte, 24)
+	for _, s := range stars {
+		bv := float32(math.NaN())
+		if s.HasBV {
+			bv = s.BV
+		}
+		binary.LittleEndian.PutUint64(record[0:], math.Float64bits(s.RA))
+		binary.LittleEndian.PutUint64(record[8:], math.Float64bits(s.Dec))
+		binary.LittleEndian.PutUint32(record[16:], math.Float32bits(s.Mag))
+		binary.LittleEndian.PutUint32(record[20:], math.Float32bits(bv))
+		bw.Write(record)
+	}
+	return bw.Flush()
+}
+
+// Returns all stars within the given radius around the given center, sorted by brightness.
+// All angles in degrees
+func (c *Catalog) Cone(ra, dec, radius float64) []CatalogStar {
+	lower := sort.Search(len(c.Stars), func(i int) bool { return c.Stars[i].Dec >= dec-radius })
+	res := []CatalogStar{}
+	for _, s := range c.Stars[lower:] {
+		if s.Dec > dec+radius {
+			break
+		}
+		if fits.AngularDistance(ra, dec, s.RA, s.Dec) <= radius {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Mag < res[j].Mag })
+	return res
+}
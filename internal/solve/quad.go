@@ -0,0 +1,154 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package solve
+
+import (
+	"math"
+)
+
+// Maximum distance between the hash codes of matching quads
+const codeTolerance = 0.012
+
+// A quad of four stars with a geometric hash code, which is invariant to translation, rotation and scale.
+// A and B are the most distant pair of stars. The code holds the positions of C and D in the frame where
+// A is at (0,0) and B at (1,1). Symmetries are broken by requiring xC+xD<=1 and xC<=xD
+type quad struct {
+	ids  [4]int32   // indices of stars A, B, C and D
+	code [4]float64 // xC, yC, xD, yD
+	diam float64    // distance between A and B
+}
+
+// Computes the quad for the given four star positions and their indices. Returns false for degenerate quads
+func newQuad(ids [4]int32, ps [4][2]float64) (q quad, ok bool) {
+	// find the most distant pair
+	ia, ib, maxDist := 0, 1, -1.0
+	for i := 0; i < 4; i++ {
+		for j := i + 1; j < 4; j++ {
+			if d := math.Hypot(ps[i][0]-ps[j][0], ps[i][1]-ps[j][1]); d > maxDist {
+				ia, ib, maxDist = i, j, d
+			}
+		}
+	}
+	if maxDist <= 0 {
+		return q, false
+	}
+	var others [2]int
+	k := 0
+	for i := 0; i < 4; i++ {
+		if i != ia && i != ib {
+			others[k] = i
+			k++
+		}
+	}
+	ic, id := others[0], others[1]
+
+	// map A to (0,0) and B to (1,1) with a similarity transformation, via complex arithmetic
+	ab := complex(ps[ib][0]-ps[ia][0], ps[ib][1]-ps[ia][1])
+	toFrame := func(i int) (x, y float64) {
+		z := complex(ps[i][0]-ps[ia][0], ps[i][1]-ps[ia][1]) * complex(1, 1) / ab
+		return real(z), imag(z)
+	}
+	xc, yc := toFrame(ic)
+	xd, yd := toFrame(id)
+
+	if xc+xd > 1 { // swap A and B, which maps the frame by (x,y) -> (1-x,1-y)
+		ia, ib = ib, ia
+		xc, yc, xd, yd = 1-xc, 1-yc, 1-xd, 1-yd
+	}
+	if xc > xd {
+		ic, id = id, ic
+		xc, yc, xd, yd = xd, yd, xc, yc
+	}
+	return quad{
+		ids:  [4]int32{ids[ia], ids[ib], ids[ic], ids[id]},
+		code: [4]float64{xc, yc, xd, yd},
+		diam: maxDist,
+	}, true
+}
+
+// Creates all quads from the given star positions with the given indices, skipping those with
+// a diameter below the given minimum
+func quadsFrom(ids []int32, ps [][2]float64, minDiam float64) []quad {
+	res := []quad{}
+	n := len(ps)
+	for a := 0; a < n; a++ {
+		for b := a + 1; b < n; b++ {
+			for c := b + 1; c < n; c++ {
+				for d := c + 1; d < n; d++ {
+					q, ok := newQuad([4]int32{ids[a], ids[b], ids[c], ids[d]}, [4][2]float64{ps[a], ps[b], ps[c], ps[d]})
+					if ok && q.diam >= minDiam {
+						res = append(res, q)
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// A hash index of quads by their codes, binned with the code tolerance
+type quadIndex struct {
+	quads []quad
+	cells []int32 // cell of each quad
+	bins  map[[4]int16][]int32
+}
+
+func newQuadIndex() *quadIndex {
+	return &quadIndex{bins: make(map[[4]int16][]int32)}
+}
+
+func binKey(code [4]float64) (key [4]int16) {
+	for i, c := range code {
+		key[i] = int16(math.Floor(c / codeTolerance))
+	}
+	return key
+}
+
+// Adds the quad from the given cell to the index
+func (qi *quadIndex) add(q quad, cell int32) {
+	key := binKey(q.code)
+	qi.bins[key] = append(qi.bins[key], int32(len(qi.quads)))
+	qi.quads = append(qi.quads, q)
+	qi.cells = append(qi.cells, cell)
+}
+
+// Calls the given function for all quads whose code is within the tolerance of the given code,
+// until it returns false. Returns false if stopped early
+func (qi *quadIndex) lookup(code [4]float64, f func(i int32) bool) bool {
+	key := binKey(code)
+	var k [4]int16
+	for d0 := int16(-1); d0 <= 1; d0++ {
+		k[0] = key[0] + d0
+		for d1 := int16(-1); d1 <= 1; d1++ {
+			k[1] = key[1] + d1
+			for d2 := int16(-1); d2 <= 1; d2++ {
+				k[2] = key[2] + d2
+				for d3 := int16(-1); d3 <= 1; d3++ {
+					k[3] = key[3] + d3
+					for _, i := range qi.bins[k] {
+						c := qi.quads[i].code
+						d := (c[0]-code[0])*(c[0]-code[0]) + (c[1]-code[1])*(c[1]-code[1]) +
+							(c[2]-code[2])*(c[2]-code[2]) + (c[3]-code[3])*(c[3]-code[3])
+						if d <= codeTolerance*codeTolerance && !f(i) {
+							return false
+						}
+					}
+				}
+			}
+		}
+	}
+	return true
+}
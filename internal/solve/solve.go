@@ -0,0 +1,469 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package solve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Default pixel scale range for blind solving, in arc seconds per pixel
+const (
+	DefaultScaleLow  = 0.2
+	DefaultScaleHigh = 60
+)
+
+const (
+	quadStars    = 10 // number of brightest stars per sky or image cell from which quads are formed
+	verifyStars  = 50 // number of brightest image and catalog stars compared when verifying a hypothesis
+	refineStars  = 200
+	minMatches   = 8    // minimum number of matched stars to accept a solution
+	minMatchFrac = 0.25 // minimum fraction of the verification stars matched to accept a solution
+)
+
+// Optional hints narrowing down the search
+type Hint struct {
+	RA, Dec   float64 // approximate center of the field in degrees
+	Radius    float64 // search radius around the center in degrees, 0=search the whole catalog
+	ScaleLow  float64 // lower bound of the pixel scale in arc seconds per pixel, 0=default
+	ScaleHigh float64 // upper bound of the pixel scale in arc seconds per pixel, 0=default
+}
+
+// A plate solution
+type Solution struct {
+	WCS     fits.WCS
+	Matches int     // number of image stars matched to catalog stars
+	RMS     float64 // root mean square distance of the matches in pixels
+}
+
+// A sky cell with the brightest catalog stars around its center
+type skyCell struct {
+	ra, dec float64
+	stars   []CatalogStar
+}
+
+// Plate solves the given star detections of an image with the given dimensions against the catalog.
+// Stars from the image and the catalog are grouped into quads, which are matched by hash codes
+// invariant to translation, rotation, scale and parity. Each match is a hypothesis for the projection,
+// which is verified against the other stars in the field and refined with least squares.
+// Proceeds from wide to narrow fields over the scale range, and returns the first verified solution
+func Solve(cat *Catalog, stars []star.Star, width, height int32, hint Hint, log io.Writer) (*Solution, error) {
+	if len(stars) < minMatches {
+		return nil, fmt.Errorf("%d stars are too few for plate solving, need %d", len(stars), minMatches)
+	}
+	stars = append([]star.Star(nil), stars...)
+	sort.Slice(stars, func(i, j int) bool { return stars[i].Mass > stars[j].Mass })
+
+	scaleLow, scaleHigh := hint.ScaleLow, hint.ScaleHigh
+	if scaleLow <= 0 {
+		scaleLow = DefaultScaleLow
+	}
+	if scaleHigh <= 0 {
+		scaleHigh = DefaultScaleHigh
+	}
+	if scaleLow > scaleHigh {
+		return nil, fmt.Errorf("invalid scale range %g to %g", scaleLow, scaleHigh)
+	}
+
+	// proceed in steps covering a factor of two in field size, in degrees along the shorter image side
+	minSide := float64(width)
+	if height < width {
+		minSide = float64(height)
+	}
+	for fieldHigh := scaleHigh * minSide / 3600; fieldHigh > scaleLow*minSide/3600*0.999; fieldHigh /= 2 {
+		fieldLow := math.Max(fieldHigh/2, scaleLow*minSide/3600)
+		sol, err := solveStep(cat, stars, width, height, hint, fieldLow, fieldHigh, log)
+		if err != nil || sol != nil {
+			return sol, err
+		}
+	}
+	return nil, errors.New("no plate solution found")
+}
+
+// Searches for a solution with a field size in the given range, in degrees along the shorter image side
+func solveStep(cat *Catalog, stars []star.Star, width, height int32, hint Hint, fieldLow, fieldHigh float64,
+	log io.Writer) (*Solution, error) {
+	minSide := float64(width)
+	if height < width {
+		minSide = float64(height)
+	}
+	scaleLow, scaleHigh := fieldLow/minSide, fieldHigh/minSide // in degrees per pixel
+
+	// index quads of the brightest catalog stars within a radius of the sky cell centers. The cell spacing
+	// ensures that any field in the range fully contains at least one such disk
+	radius, spacing := fieldLow/4, 0.3*fieldLow
+	cells := skyCells(cat, hint, radius, spacing, fieldHigh)
+	index := newQuadIndex()
+	for ci, cell := range cells {
+		ids, ps := make([]int32, len(cell.stars)), make([][2]float64, len(cell.stars))
+		for i, s := range cell.stars {
+			xi, eta, _ := fits.Gnomonic(cell.ra, cell.dec, s.RA, s.Dec)
+			ids[i], ps[i] = int32(i), [2]float64{xi, eta}
+		}
+		for _, q := range quadsFrom(ids, ps, radius/3) {
+			index.add(q, int32(ci))
+		}
+	}
+
+	// create quads from the brightest image stars within the corresponding disks in pixels,
+	// for mirrored and unmirrored parity
+	imgQuads := imageQuads(stars, width, height, radius/scaleHigh, radius/scaleLow)
+	fmt.Fprintf(log, "Solving for %.3g to %.3g\"/px with %d sky cells, %d catalog quads and %d image quads\n",
+		scaleLow*3600, scaleHigh*3600, len(cells), len(index.quads), len(imgQuads))
+	if len(index.quads) == 0 || len(imgQuads) == 0 {
+		return nil, nil
+	}
+
+	var solution *Solution
+	hypotheses := 0
+	for _, iq := range imgQuads {
+		for _, mirrored := range []bool{false, true} {
+			code := iq.code
+			if mirrored {
+				var ps [4][2]float64
+				for i, id := range iq.ids {
+					ps[i] = [2]float64{float64(stars[id].X), -float64(stars[id].Y)}
+				}
+				mq, _ := newQuad(iq.ids, ps)
+				iq, code = mq, mq.code
+			}
+			index.lookup(code, func(qi int32) bool {
+				hypotheses++
+				cq, cell := index.quads[qi], cells[index.cells[qi]]
+				w, ok := hypothesis(stars, iq, cell, cq)
+				if !ok {
+					return true
+				}
+				if s := w.PixelScale() / 3600; s < scaleLow || s > scaleHigh {
+					return true
+				}
+				solution = verify(cat, stars, width, height, w)
+				return solution == nil
+			})
+			if solution != nil {
+				fmt.Fprintf(log, "Verified solution after %d hypotheses\n", hypotheses)
+				return solution, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns the sky cells on a grid with the given spacing which hold at least four catalog stars, and which
+// are in the search radius of the hint if given. Cells hold the brightest catalog stars within the given radius
+func skyCells(cat *Catalog, hint Hint, radius, spacing, fieldHigh float64) []skyCell {
+	// grid of declination bands, each split into cells of at most the spacing in right ascension
+	bands := int(math.Ceil(180 / spacing))
+	bandHeight := 180 / float64(bands)
+	cellsInBand := func(band int) int {
+		lower, upper := -90+float64(band)*bandHeight, -90+float64(band+1)*bandHeight
+		maxCos := math.Cos(math.Min(math.Abs(lower), math.Abs(upper)) * math.Pi / 180)
+		if lower < 0 && upper > 0 {
+			maxCos = 1
+		}
+		return int(math.Max(1, math.Ceil(360*maxCos/spacing)))
+	}
+
+	// visit only occupied cells
+	occupied := map[[2]int]bool{}
+	for _, s := range cat.Stars {
+		band := int(math.Min(float64(bands-1), math.Floor((s.Dec+90)/bandHeight)))
+		n := cellsInBand(band)
+		ra := math.Mod(s.RA, 360)
+		if ra < 0 {
+			ra += 360
+		}
+		occupied[[2]int{band, int(math.Min(float64(n-1), math.Floor(ra/360*float64(n))))}] = true
+	}
+	keys := make([][2]int, 0, len(occupied))
+	for k := range occupied {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+
+	cells := []skyCell{}
+	for _, k := range keys {
+		n := cellsInBand(k[0])
+		dec := -90 + (float64(k[0])+0.5)*bandHeight
+		ra := (float64(k[1]) + 0.5) * 360 / float64(n)
+		if hint.Radius > 0 && fits.AngularDistance(ra, dec, hint.RA, hint.Dec) > hint.Radius+fieldHigh {
+			continue
+		}
+		stars := cat.Cone(ra, dec, radius)
+		if len(stars) < 4 {
+			continue
+		}
+		if len(stars) > quadStars {
+			stars = stars[:quadStars]
+		}
+		cells = append(cells, skyCell{ra, dec, stars})
+	}
+	return cells
+}
+
+// Creates quads from the brightest image stars within disks of the given radius range in pixels
+// around a grid of centers. Quads are deduplicated and ordered by the brightness of their faintest star
+func imageQuads(stars []star.Star, width, height int32, radiusLow, radiusHigh float64) []quad {
+	seen := map[[4]int32]bool{}
+	res := []quad{}
+	for r := radiusLow; r <= radiusHigh*1.0001; r *= math.Sqrt2 {
+		step := r / 2
+		for cy := step / 2; cy < float64(height); cy += step {
+			for cx := step / 2; cx < float64(width); cx += step {
+				ids, ps := []int32{}, [][2]float64{}
+				for i, s := range stars { // sorted by brightness
+					if math.Hypot(float64(s.X)-cx, float64(s.Y)-cy) <= r {
+						ids, ps = append(ids, int32(i)), append(ps, [2]float64{float64(s.X), float64(s.Y)})
+						if len(ids) == quadStars {
+							break
+						}
+					}
+				}
+				for _, q := range quadsFrom(ids, ps, r/3) {
+					key := q.ids
+					sort.Slice(key[:], func(i, j int) bool { return key[i] < key[j] })
+					if !seen[key] {
+						seen[key] = true
+						res = append(res, q)
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return maxID(res[i].ids) < maxID(res[j].ids) })
+	return res
+}
+
+func maxID(ids [4]int32) int32 {
+	m := ids[0]
+	for _, id := range ids[1:] {
+		if id > m {
+			m = id
+		}
+	}
+	return m
+}
+
+// Creates a WCS hypothesis mapping the image quad onto the catalog quad in the tangent plane of the sky cell
+func hypothesis(stars []star.Star, iq quad, cell skyCell, cq quad) (w *fits.WCS, ok bool) {
+	xs, ys, xis, etas := make([]float64, 4), make([]float64, 4), make([]float64, 4), make([]float64, 4)
+	for i := range iq.ids {
+		s, c := stars[iq.ids[i]], cell.stars[cq.ids[i]]
+		xs[i], ys[i] = float64(s.X), float64(s.Y)
+		xis[i], etas[i], _ = fits.Gnomonic(cell.ra, cell.dec, c.RA, c.Dec)
+	}
+	return fitWCS(cell.ra, cell.dec, xs, ys, xis, etas)
+}
+
+// Fits a WCS with the given tangent point to pixel positions and their standard coordinates on the
+// tangent plane, with least squares. Returns false if the fit is degenerate
+func fitWCS(ra, dec float64, xs, ys, xis, etas []float64) (w *fits.WCS, ok bool) {
+	a, b, c, ok1 := fitPlane(xs, ys, xis)
+	d, e, f, ok2 := fitPlane(xs, ys, etas)
+	det := a*e - b*d
+	if !ok1 || !ok2 || det == 0 {
+		return nil, false
+	}
+	// the reference pixel is where the standard coordinates vanish
+	x0, y0 := (-c*e+b*f)/det, (-a*f+c*d)/det
+	return &fits.WCS{
+		CRVAL: [2]float64{ra, dec},
+		CRPIX: [2]float64{x0 + 1, y0 + 1},
+		CD:    [2][2]float64{{a, b}, {d, e}},
+	}, true
+}
+
+// Fits u=a*x+b*y+c with least squares. Returns false if the points are collinear
+func fitPlane(xs, ys, us []float64) (a, b, c float64, ok bool) {
+	n := float64(len(xs))
+	mx, my, mu := 0.0, 0.0, 0.0
+	for i := range xs {
+		mx, my, mu = mx+xs[i], my+ys[i], mu+us[i]
+	}
+	mx, my, mu = mx/n, my/n, mu/n
+	sxx, sxy, syy, sxu, syu := 0.0, 0.0, 0.0, 0.0, 0.0
+	for i := range xs {
+		dx, dy, du := xs[i]-mx, ys[i]-my, us[i]-mu
+		sxx, sxy, syy, sxu, syu = sxx+dx*dx, sxy+dx*dy, syy+dy*dy, sxu+dx*du, syu+dy*du
+	}
+	det := sxx*syy - sxy*sxy
+	if det <= 1e-12*(sxx*syy) || det == 0 {
+		return 0, 0, 0, false
+	}
+	a = (sxu*syy - syu*sxy) / det
+	b = (syu*sxx - sxu*sxy) / det
+	return a, b, mu - a*mx - b*my, true
+}
+
+// Projects the catalog stars in the field of the given WCS into pixel coordinates, keeping the n brightest
+// within the image bounds
+func fieldStars(cat *Catalog, width, height int32, w *fits.WCS, n int) (ps []star.Point2D) {
+	ra, dec := w.PixelToWorld(float64(width)/2, float64(height)/2)
+	radius := math.Hypot(float64(width), float64(height)) / 2 * w.PixelScale() / 3600 * 1.05
+	for _, s := range cat.Cone(ra, dec, radius) {
+		x, y, ok := w.WorldToPixel(s.RA, s.Dec)
+		if !ok || x < 0 || y < 0 || x >= float64(width) || y >= float64(height) {
+			continue
+		}
+		ps = append(ps, star.Point2D{X: float32(x), Y: float32(y)})
+		if len(ps) == n {
+			break
+		}
+	}
+	return ps
+}
+
+// Counts the first n image stars which have a projected catalog star within the given distance in pixels
+func countMatches(stars []star.Star, n int, catPoints []star.Point2D, tol float32) int {
+	if len(catPoints) == 0 {
+		return 0
+	}
+	var kdt star.KDTree2 = append([]star.Point2D(nil), catPoints...)
+	kdt.Make()
+	matches := 0
+	for _, s := range stars[:n] {
+		if _, dsq := kdt.NearestNeighbor(star.Point2D{X: s.X, Y: s.Y}); dsq <= tol*tol {
+			matches++
+		}
+	}
+	return matches
+}
+
+// Verifies the hypothesis against the brightest stars in the field, and refines it if plausible.
+// Returns nil if verification fails
+func verify(cat *Catalog, stars []star.Star, width, height int32, w *fits.WCS) *Solution {
+	n := verifyStars
+	if n > len(stars) {
+		n = len(stars)
+	}
+	catPoints := fieldStars(cat, width, height, w, n)
+	minSide := float32(width)
+	if height < width {
+		minSide = float32(height)
+	}
+
+	// loose tolerance for hypotheses extrapolated from a single quad
+	if countMatches(stars, n, catPoints, 2+0.01*minSide) < minMatches/2 {
+		return nil
+	}
+	sol := refine(cat, stars, width, height, *w, 2+0.01*minSide)
+	if sol == nil {
+		return nil
+	}
+
+	catPoints = fieldStars(cat, width, height, &sol.WCS, n)
+	expected := n
+	if len(catPoints) < expected {
+		expected = len(catPoints)
+	}
+	if sol.RMS > 1+0.002*float64(minSide) {
+		return nil
+	}
+	tol := float32(math.Max(2, 3*sol.RMS))
+	if matches := countMatches(stars, n, catPoints, tol); matches < minMatches || float64(matches) < minMatchFrac*float64(expected) {
+		return nil
+	}
+	return sol
+}
+
+// Refines the WCS by iteratively matching image stars to projected catalog stars and refitting with
+// least squares, moving the reference pixel to the image center. Returns nil if too few stars match
+func refine(cat *Catalog, stars []star.Star, width, height int32, w fits.WCS, tol float32) *Solution {
+	n := refineStars
+	if n > len(stars) {
+		n = len(stars)
+	}
+	cx, cy := float64(width-1)/2, float64(height-1)/2
+	var sol *Solution
+	for round := 0; round < 4; round++ {
+		ra0, dec0 := w.PixelToWorld(cx, cy)
+
+		// match image stars to the nearest projected catalog stars
+		ra, dec := w.PixelToWorld(float64(width)/2, float64(height)/2)
+		radius := math.Hypot(float64(width), float64(height)) / 2 * w.PixelScale() / 3600 * 1.05
+		var catPoints []star.Point2D
+		var catStars []CatalogStar
+		for _, s := range cat.Cone(ra, dec, radius) {
+			x, y, ok := w.WorldToPixel(s.RA, s.Dec)
+			if !ok || x < 0 || y < 0 || x >= float64(width) || y >= float64(height) {
+				continue
+			}
+			catPoints, catStars = append(catPoints, star.Point2D{X: float32(x), Y: float32(y)}), append(catStars, s)
+			if len(catPoints) == 2*n {
+				break
+			}
+		}
+		if len(catPoints) < minMatches {
+			return nil
+		}
+		byPoint := make(map[star.Point2D]int, len(catPoints))
+		for i, p := range catPoints {
+			byPoint[p] = i
+		}
+		var kdt star.KDTree2 = append([]star.Point2D(nil), catPoints...)
+		kdt.Make()
+
+		xs, ys, xis, etas := []float64{}, []float64{}, []float64{}, []float64{}
+		used := map[int]bool{}
+		for _, s := range stars[:n] {
+			p, dsq := kdt.NearestNeighbor(star.Point2D{X: s.X, Y: s.Y})
+			if dsq > tol*tol {
+				continue
+			}
+			i := byPoint[p]
+			if used[i] {
+				continue
+			}
+			used[i] = true
+			xi, eta, _ := fits.Gnomonic(ra0, dec0, catStars[i].RA, catStars[i].Dec)
+			xs, ys, xis, etas = append(xs, float64(s.X)), append(ys, float64(s.Y)), append(xis, xi), append(etas, eta)
+		}
+		if len(xs) < minMatches {
+			return nil
+		}
+
+		// fit on the tangent plane at the image center, then move the tangent point to the fitted center
+		fit, ok := fitWCS(ra0, dec0, xs, ys, xis, etas)
+		if !ok {
+			return nil
+		}
+		xi0 := fit.CD[0][0]*(cx+1-fit.CRPIX[0]) + fit.CD[0][1]*(cy+1-fit.CRPIX[1])
+		eta0 := fit.CD[1][0]*(cx+1-fit.CRPIX[0]) + fit.CD[1][1]*(cy+1-fit.CRPIX[1])
+		w.CRVAL[0], w.CRVAL[1] = fits.InverseGnomonic(ra0, dec0, xi0, eta0)
+		w.CRPIX = [2]float64{cx + 1, cy + 1}
+		w.CD = fit.CD
+
+		// residuals under the fitted model
+		sumSq := 0.0
+		for i := range xs {
+			dxi := fit.CD[0][0]*(xs[i]+1-fit.CRPIX[0]) + fit.CD[0][1]*(ys[i]+1-fit.CRPIX[1]) - xis[i]
+			deta := fit.CD[1][0]*(xs[i]+1-fit.CRPIX[0]) + fit.CD[1][1]*(ys[i]+1-fit.CRPIX[1]) - etas[i]
+			sumSq += dxi*dxi + deta*deta
+		}
+		rms := math.Sqrt(sumSq/float64(len(xs))) / (w.PixelScale() / 3600)
+		sol = &Solution{WCS: w, Matches: len(xs), RMS: rms}
+		tol = float32(math.Min(float64(tol), math.Max(2, 3*rms))) // tighten, but never widen on poor fits
+	}
+	return sol
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package solve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/mlnoga/nightlight/internal/fits"
+	"github.com/mlnoga/nightlight/internal/star"
+)
+
+// Creates a random catalog of stars in a square region around the given center
+func syntheticCatalog(rng *rand.Rand, ra, dec, size float64, n int) *Catalog {
+	stars := make([]CatalogStar, n)
+	for i := range stars {
+		stars[i] = CatalogStar{
+			RA:  ra + (rng.Float64()-0.5)*size/math.Cos(dec*math.Pi/180),
+			Dec: dec + (rng.Float64()-0.5)*size,
+			Mag: float32(6 + 8*math.Pow(rng.Float64(), 0.3)), // more faint stars than bright ones
+		}
+	}
+	return NewCatalog(stars)
+}
+
+// Projects the catalog into an image with the given WCS, with position noise, dropouts and spurious detections
+func syntheticStars(rng *rand.Rand, cat *Catalog, w *fits.WCS, width, height int32) []star.Star {
+	stars := []star.Star{}
+	for _, s := range cat.Stars {
+		x, y, ok := w.WorldToPixel(s.RA, s.Dec)
+		if !ok || x < 0 || y < 0 || x >= float64(width) || y >= float64(height) || rng.Float64() < 0.1 {
+			continue
+		}
+		mass := float32(math.Pow(10, -0.4*float64(s.Mag-6))) * (0.8 + 0.4*rng.Float32())
+		stars = append(stars, star.Star{X: float32(x + 0.3*rng.NormFloat64()), Y: float32(y + 0.3*rng.NormFloat64()), Mass: mass})
+	}
+	for i := len(stars) / 10; i > 0; i-- {
+		stars = append(stars, star.Star{X: rng.Float32() * float32(width), Y: rng.Float32() * float32(height), Mass: rng.Float32() * 1e-3})
+	}
+	return stars
+}
+
+func testWCS(ra, dec, scale, rotation float64, mirrored bool, width, height int32) *fits.WCS {
+	s := scale / 3600
+	sin, cos := math.Sincos(rotation * math.Pi / 180)
+	flip := 1.0
+	if mirrored {
+		flip = -1
+	}
+	return &fits.WCS{
+		CRVAL: [2]float64{ra, dec},
+		CRPIX: [2]float64{float64(width+1) / 2, float64(height+1) / 2},
+		CD:    [2][2]float64{{-s * cos * flip, s * sin}, {s * sin * flip, s * cos}},
+	}
+}
+
+func checkSolution(t *testing.T, sol *Solution, want *fits.WCS, width, height int32) {
+	t.Helper()
+	for _, p := range [][2]float64{{0, 0}, {float64(width - 1), 0}, {float64(width) / 2, float64(height) / 2}, {0, float64(height - 1)}} {
+		ra, dec := sol.WCS.PixelToWorld(p[0], p[1])
+		wantRA, wantDec := want.PixelToWorld(p[0], p[1])
+		if d := fits.AngularDistance(ra, dec, wantRA, wantDec) * 3600; d > 0.5*want.PixelScale() {
+			t.Errorf("pixel %v maps to %.5f %.5f, want %.5f %.5f, off by %.2f\"", p, ra, dec, wantRA, wantDec, d)
+		}
+	}
+	if sol.WCS.Mirrored() != want.Mirrored() {
+		t.Errorf("solution mirrored=%v, want %v", sol.WCS.Mirrored(), want.Mirrored())
+	}
+}
+
+func TestSolveWithHint(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	cat := syntheticCatalog(rng, 150, 30, 5, 6000)
+	width, height := int32(1200), int32(800)
+	want := testWCS(150.3, 29.8, 3, 30, false, width, height)
+	stars := syntheticStars(rng, cat, want, width, height)
+
+	sol, err := Solve(cat, stars, width, height, Hint{RA: 150, Dec: 30, Radius: 2, ScaleLow: 2.5, ScaleHigh: 3.5}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSolution(t, sol, want, width, height)
+	if sol.RMS > 1 {
+		t.Errorf("rms %.2f px too large", sol.RMS)
+	}
+}
+
+func TestSolveBlindMirrored(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	cat := syntheticCatalog(rng, 80, -45, 5, 6000)
+	width, height := int32(1000), int32(1000)
+	want := testWCS(79.2, -44.5, 2.2, -110, true, width, height)
+	stars := syntheticStars(rng, cat, want, width, height)
+
+	sol, err := Solve(cat, stars, width, height, Hint{}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSolution(t, sol, want, width, height)
+}
+
+func TestSolveFailsOnRandomStars(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	cat := syntheticCatalog(rng, 200, 10, 4, 4000)
+	width, height := int32(800), int32(600)
+	stars := make([]star.Star, 100)
+	for i := range stars {
+		stars[i] = star.Star{X: rng.Float32() * float32(width), Y: rng.Float32() * float32(height), Mass: rng.Float32()}
+	}
+	if sol, err := Solve(cat, stars, width, height, Hint{RA: 200, Dec: 10, Radius: 1, ScaleLow: 2, ScaleHigh: 4}, io.Discard); err == nil {
+		t.Errorf("unexpected solution %v", sol.WCS)
+	}
+}
+
+func TestCatalogFormats(t *testing.T) {
+	csvData := "source_id, ra, dec, phot_g_mean_mag, bp_rp\n1, 10.5, -20.25, 7.5, 0.82\n2, 11, -21, , 1\n3, 359.9, 89.5, 4.25, \n"
+	stars, err := ReadCatalogCSV(strings.NewReader(csvData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CatalogStar{{RA: 10.5, Dec: -20.25, Mag: 7.5, BV: 0.65, HasBV: true}, {RA: 359.9, Dec: 89.5, Mag: 4.25}}
+	if len(stars) != len(want) || stars[0] != want[0] || stars[1] != want[1] {
+		t.Fatalf("got %v want %v", stars, want)
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteCatalogBinary(&buf, stars); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadCatalogBinary(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(want) || read[0] != want[0] || read[1] != want[1] {
+		t.Errorf("binary round trip got %v want %v", read, want)
+	}
+
+	// the first version of the binary format has no color index
+	v1 := append([]byte("NLCAT001"), 1, 0, 0, 0)
+	record := make([]byte, 20)
+	binary.LittleEndian.PutUint64(record[0:], math.Float64bits(want[1].RA))
+	binary.LittleEndian.PutUint64(record[8:], math.Float64bits(want[1].Dec))
+	binary.LittleEndian.PutUint32(record[16:], math.Float32bits(want[1].Mag))
+	if read, err := ReadCatalogBinary(bytes.NewReader(append(v1, record...))); err != nil || len(read) != 1 || read[0] != want[1] {
+		t.Errorf("binary version 1 got %v, %v want %v", read, err, want[1])
+	}
+
+	// B-V takes precedence over separate B and V magnitudes
+	stars, err = ReadCatalogCSV(strings.NewReader("RAJ2000,DEJ2000,Bmag,Vmag,B-V\n1,2,8.5,8,\n3,4,9.5,9,0.4\n"))
+	if err != nil || len(stars) != 2 || !stars[0].HasBV || stars[0].BV != 0.5 || stars[0].Mag != 8 || stars[1].BV != 0.4 {
+		t.Errorf("B-V from magnitudes got %v, %v", stars, err)
+	}
+
+	cat := NewCatalog(read)
+	if cone := cat.Cone(0.1, 89.6, 0.5); len(cone) != 1 || cone[0] != want[1] {
+		t.Errorf("cone across RA wraparound got %v", cone)
+	}
+}
@@ -32,10 +32,12 @@ type Aligner struct {
 	RefTriangles []Triangle   // Reference triangles built from the above, using the k constant
 	RefTri3DT    KDTree3P     // Pointerless 3-dimensional tree for fast lookup of reference triangles
 	K            int32        // Consider top k brightest stars for building triangles
+	MinMatch     float32      // Minimum fraction of stars which must match reference stars to accept a candidate alignment
 }
 
 // A triangle representing the distances between three stars, which are translation and rotation invariant.
-// Also stores their indices into the Stars[] array for later processing steps.
+// Also stores their indices into the Stars[] array for later processing steps, and their orientation.
+// Distances are also invariant under reflection, but the orientation flips.
 type Triangle struct {
 	DistAB	float32
 	DistAC  float32
@@ -43,6 +45,7 @@ type Triangle struct {
 	A       int32
 	B       int32
 	C       int32   
+	Clockwise bool  // True if A, B, C are in clockwise order in image coordinates
 }
 
 // A candidate match between a triangle and a reference triangle, with distance between them
@@ -50,6 +53,7 @@ type Match struct {
 	Dist        float32
 	TriIndex    int32
 	RefTriIndex int32
+	Mirrored    bool    // True if the triangle orientations differ, i.e. the match implies a mirrored frame
 } 
 
 const minDistanceForAlignmentStars float32 = 1.0/20.0
@@ -67,7 +71,7 @@ func NewAligner(naxisn []int32, refStars []Star, k int32) *Aligner {
 	for i,s:=range tris { trisKDT3[i]=Point3DPayload{Point3D{s.DistAB, s.DistAC, s.DistBC}, interface{}(int32(i)) } }
 	trisKDT3.Make()
 
-	return &Aligner{naxisn, refStars, kdt2, tris, trisKDT3, k}
+	return &Aligner{naxisn, refStars, kdt2, tris, trisKDT3, k, 1.0/3.0}
 }
 
 // Calculates image alignments based on their respective star positions
@@ -120,7 +124,8 @@ func generateTriangles(stars []Star, indices []int, scaleFactor float32) []Trian
 				dBC:=Dist2D(Point2D{starB.X*scaleFactor, starB.Y*scaleFactor}, Point2D{starC.X*scaleFactor, starC.Y*scaleFactor})
 
 				if(dAB<dAC && dAC<dBC) {
-					tri:=Triangle{dAB, dAC, dBC, int32(a), int32(b), int32(c) }	
+					cross:=(starB.X-starA.X)*(starC.Y-starA.Y) - (starB.Y-starA.Y)*(starC.X-starA.X)
+					tri:=Triangle{dAB, dAC, dBC, int32(a), int32(b), int32(c), cross<0 }	
 					tris=append(tris, tri)
 				}
 			}
@@ -137,7 +142,8 @@ func (a *Aligner) closestTriangleMatches(triangles []Triangle) (matches []Match)
 	for i, tri := range triangles {
 		pt   :=Point3D{tri   .DistAB, tri   .DistAC, tri   .DistBC}
 		closest, distSquared:=kdt.NearestNeighbor(pt)
-		matches[i]=Match{distSquared, int32(i), closest.Payload.(int32) }
+		refTriIndex:=closest.Payload.(int32)
+		matches[i]=Match{distSquared, int32(i), refTriIndex, tri.Clockwise!=a.RefTriangles[refTriIndex].Clockwise }
 	}
 
 	// FIXME: wasteful, should use extract to find the k-th smallest element
@@ -148,10 +154,18 @@ func (a *Aligner) closestTriangleMatches(triangles []Triangle) (matches []Match)
 	k:=a.K
 	if k>int32(len(matches)) { k=int32(len(matches)) }
 	shortlist:=make([]Match, k)
-	for i, _:=range(shortlist) {
-		m:=matches[i]
-		shortlist[i]=Match{m.Dist, m.TriIndex, m.RefTriIndex}
+	copy(shortlist, matches)
+
+	// Detect the parity of the frame by majority vote of the shortlist, and try matches with that parity first.
+	// Spurious matches have random parity, whereas true matches agree
+	numMirrored:=0
+	for _,m:=range shortlist {
+		if m.Mirrored { numMirrored++ }
 	}
+	mirrored:=2*numMirrored>len(shortlist)
+	sort.SliceStable(shortlist, func(i, j int) bool {
+		return shortlist[i].Mirrored==mirrored && shortlist[j].Mirrored!=mirrored
+	} )
 	return shortlist
 }
 
@@ -163,6 +177,7 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 
 	distSquaredLimit:=float32(8.0*8.0)         // Distance limit to consider a star a match
 	earlyAbortForResidualError:=float32(0.01)  // Stop further search if a global match closer than this is found
+	weights:=snrWeights(stars)                 // Weight stars by PSF signal to noise ratio, if available
 
 	for _, match:=range(matches) {
 		// Build initial transformation based on the triples of stars in the match
@@ -174,8 +189,13 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 		p1p:=Point2D{refStars[refTri.A].X, refStars[refTri.A].Y}
 		p2p:=Point2D{refStars[refTri.B].X, refStars[refTri.B].Y}
 		p3p:=Point2D{refStars[refTri.C].X, refStars[refTri.C].Y}
+		// The exact affine fit to three noisy points can shear nearly collinear triangles into the wrong parity.
+		// Fall back to a similarity transform with the parity implied by the triangle orientations
 		trans, err:=NewTransform2D(p1, p2, p3, p1p, p2p, p3p)
-		if err!=nil { continue }
+		if err!=nil || trans.Mirrored()!=match.Mirrored {
+			trans, err=NewSimilarity2D([]Point2D{p1, p2, p3}, []Point2D{p1p, p2p, p3p}, match.Mirrored)
+			if err!=nil { continue }
+		}
 
 		// Print some stats about the transformation candidate found
 		//if id==0 {
@@ -207,7 +227,7 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 		//if id==0 {
 		//	LogPrintf("Match %d numStarsMatched %d totalStarsMatched %d\n", i, numMatches, len(stars))
 		//}
-		if numMatches<len(stars)/3 { // abort if fewer than a third of the stars matched
+		if numMatches<int(float32(len(stars))*a.MinMatch) { // abort if too few stars matched, by default a third
 			continue;
 		}
 
@@ -219,6 +239,7 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 
 				starsMatched    :=int32(0)      
 				distSquaredSum  :=float32(0)
+				weightSum       :=float32(0)
 				for id,star:=range stars {
 					p:=Point2D{star.X, star.Y}
 					proj:=tr.Apply(p)
@@ -226,11 +247,13 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 					refPoint:=refPoints[id]
 					if !math.IsNaN(float64(refPoint.X)) {
 						distSquared:=Dist2DSquared(proj, refPoint)
-						distSquaredSum+=distSquared
+						distSquaredSum+=weights[id]*distSquared
+						weightSum+=weights[id]
 						starsMatched++
 					}
 		        }
-		        return math.Sqrt(float64(distSquaredSum))/float64(starsMatched)
+		        // normalize weights to a mean of one, so the residual is comparable to the unweighted case
+		        return math.Sqrt(float64(distSquaredSum)*float64(starsMatched)/float64(weightSum))/float64(starsMatched)
 			},			
 		}
 		result, err := optimize.Minimize(problem, x0, nil, &optimize.NelderMead{})
@@ -241,6 +264,7 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 
 		x:=result.X
 		trans=Transform2D{float32(x[0]), float32(x[1]), float32(x[2]), float32(x[3]), float32(x[4]), float32(x[5])}
+		if trans.Mirrored()!=match.Mirrored { continue } // optimizer collapsed the transformation
 		residualError:=float32(result.F)
 		// Update best solution found, if applicable
 		if residualError<bestResidualError {
@@ -257,6 +281,29 @@ func (a *Aligner) findBestMatch(matches []Match, triangles []Triangle, stars []S
 }
 
 
+// Calculates alignment weights for the given stars from the signal to noise ratio of their PSF fits,
+// normalized to a mean of one and clamped to [0.1, 10]. Stars without PSF fit get weight one
+func snrWeights(stars []Star) []float32 {
+	weights:=make([]float32, len(stars))
+	snrSum, snrCount:=float32(0), 0
+	for _,s:=range stars {
+		if s.SNR>0 {
+			snrSum+=s.SNR
+			snrCount++
+		}
+	}
+	for i,s:=range stars {
+		w:=float32(1)
+		if s.SNR>0 {
+			w=s.SNR*float32(snrCount)/snrSum
+			if w<0.1 { w=0.1 }
+			if w>10  { w=10  }
+		}
+		weights[i]=w
+	}
+	return weights
+}
+
 func (a *Aligner) calcDist(stars []Star, tr Transform2D) (starsMatched int32, dist float32) {
 	distSquaredLimit:=float32(8.0*8.0)  // Distance limit to consider this a match. FIXME: arbitrary!!
 	starsMatched=int32(0)
@@ -0,0 +1,77 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestNewSimilarity2D(t *testing.T) {
+	for _, want := range []Transform2D{{0.8, -0.6, 10, 0.6, 0.8, -5}, {0.8, 0.6, 10, 0.6, -0.8, -5}} {
+		ps := []Point2D{{0, 0}, {100, 20}, {30, 80}}
+		pps := want.ApplySlice(ps)
+		got, err := NewSimilarity2D(ps, pps, want.Mirrored())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range ps {
+			if d := Dist2D(got.Apply(p), pps[i]); d > 1e-3 {
+				t.Errorf("%v: got %v, distance %g at %v", want, got, d, p)
+			}
+		}
+		if got.Mirrored() != want.Mirrored() {
+			t.Errorf("%v: got parity %s", want, got.Parity())
+		}
+	}
+}
+
+func TestAlignMirroredFrame(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	refStars := []Star{}
+	for i := 0; i < 120; i++ {
+		refStars = append(refStars, Star{X: rng.Float32() * 1000, Y: rng.Float32() * 800, Mass: rng.Float32()})
+	}
+	sort.Slice(refStars, func(i, j int) bool { return refStars[i].Mass > refStars[j].Mass })
+	aligner := NewAligner([]int32{1000, 800}, refStars, 20)
+
+	// a rotated frame, and a frame mirrored horizontally as through a star diagonal
+	for _, want := range []Transform2D{{0.995, -0.0998, 30, 0.0998, 0.995, -20}, {-0.995, 0.0998, 1000, 0.0998, 0.995, -20}} {
+		inv, err := want.Invert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stars := make([]Star, len(refStars))
+		for i, s := range refStars {
+			p := inv.Apply(Point2D{s.X, s.Y})
+			stars[i] = Star{X: p.X + 0.2*float32(rng.NormFloat64()), Y: p.Y + 0.2*float32(rng.NormFloat64()), Mass: s.Mass}
+		}
+
+		got, residual := aligner.Align([]int32{1000, 800}, stars, 1)
+		if residual > 0.1 {
+			t.Errorf("%v: residual %g too large", want, residual)
+		}
+		if got.Mirrored() != want.Mirrored() {
+			t.Errorf("%v: got parity %s", want, got.Parity())
+		}
+		for _, p := range []Point2D{{0, 0}, {999, 799}} {
+			if d := Dist2D(got.Apply(p), want.Apply(p)); d > 0.5 {
+				t.Errorf("%v: got %v, off by %g at %v", want, got, d, p)
+			}
+		}
+	}
+}
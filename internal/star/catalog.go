@@ -0,0 +1,108 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A star catalog entry for export, with optional coordinates in the reference frame
+type catalogEntry struct {
+	Index        int32    `json:"index"`
+	Value        float32  `json:"value"`
+	X            float32  `json:"x"`
+	Y            float32  `json:"y"`
+	Mass         float32  `json:"mass"`
+	HFR          float32  `json:"hfr"`
+	FWHMX        float32  `json:"fwhmX"`
+	FWHMY        float32  `json:"fwhmY"`
+	Angle        float32  `json:"angle"`
+	Eccentricity float32  `json:"eccentricity"`
+	Amplitude    float32  `json:"amplitude"`
+	Background   float32  `json:"background"`
+	SNR          float32  `json:"snr"`
+	RefX         *float32 `json:"refX,omitempty"`
+	RefY         *float32 `json:"refY,omitempty"`
+}
+
+// Writes the given stars as CSV with a header line. If trans is not nil, appends
+// the star coordinates transformed into the reference frame as extra columns
+func WriteStarsCSV(w io.Writer, stars []Star, trans Transformation) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "Index,Value,X,Y,Mass,HFR,FWHMX,FWHMY,Angle,Eccentricity,Amplitude,Background,SNR")
+	if trans != nil {
+		fmt.Fprint(bw, ",RefX,RefY")
+	}
+	fmt.Fprintln(bw)
+	for _, s := range stars {
+		fmt.Fprintf(bw, "%d,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g,%g", s.Index, s.Value, s.X, s.Y, s.Mass, s.HFR,
+			s.FWHMX, s.FWHMY, s.Angle, s.Eccentricity, s.Amplitude, s.Background, s.SNR)
+		if trans != nil {
+			ref := trans.Apply(Point2D{s.X, s.Y})
+			fmt.Fprintf(bw, ",%g,%g", ref.X, ref.Y)
+		}
+		fmt.Fprintln(bw)
+	}
+	return bw.Flush()
+}
+
+// Writes the given stars as a JSON array of objects. If trans is not nil, adds
+// the star coordinates transformed into the reference frame as refX and refY
+func WriteStarsJSON(w io.Writer, stars []Star, trans Transformation) error {
+	entries := make([]catalogEntry, len(stars))
+	for i, s := range stars {
+		e := catalogEntry{s.Index, s.Value, s.X, s.Y, s.Mass, s.HFR,
+			s.FWHMX, s.FWHMY, s.Angle, s.Eccentricity, s.Amplitude, s.Background, s.SNR, nil, nil}
+		if trans != nil {
+			ref := trans.Apply(Point2D{s.X, s.Y})
+			e.RefX, e.RefY = &ref.X, &ref.Y
+		}
+		entries[i] = e
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// Writes the given stars as SAO DS9 region file in image coordinates, for overlaying on the original frame.
+// Stars with PSF fits are drawn as ellipses at their half maximum, all others as circles of twice their HFR.
+// Measured fields and reference frame coordinates (if trans is not nil) are written as a comment line before each region
+func WriteStarsDS9(w io.Writer, stars []Star, trans Transformation) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Region file format: DS9 version 4.1")
+	fmt.Fprintln(bw, "global color=green dashlist=8 3 width=1 font=\"helvetica 10 normal roman\" select=1 highlite=1 dash=0 fixed=0 edit=1 move=1 delete=1 include=1 source=1")
+	fmt.Fprintln(bw, "image")
+	for _, s := range stars {
+		fmt.Fprintf(bw, "# index=%d value=%g mass=%g hfr=%g fwhmX=%g fwhmY=%g angle=%g eccentricity=%g amplitude=%g background=%g snr=%g",
+			s.Index, s.Value, s.Mass, s.HFR, s.FWHMX, s.FWHMY, s.Angle, s.Eccentricity, s.Amplitude, s.Background, s.SNR)
+		if trans != nil {
+			ref := trans.Apply(Point2D{s.X, s.Y})
+			fmt.Fprintf(bw, " refX=%g refY=%g", ref.X, ref.Y)
+		}
+		fmt.Fprintln(bw)
+
+		// DS9 image coordinates are 1-based
+		if s.FWHMX > 0 && s.FWHMY > 0 {
+			fmt.Fprintf(bw, "ellipse(%.3f,%.3f,%.3f,%.3f,%.2f)\n", s.X+1, s.Y+1, s.FWHMX/2, s.FWHMY/2, s.Angle) // semi-axes
+		} else {
+			fmt.Fprintf(bw, "circle(%.3f,%.3f,%.3f)\n", s.X+1, s.Y+1, 2*s.HFR)
+		}
+	}
+	return bw.Flush()
+}
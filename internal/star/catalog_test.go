@@ -0,0 +1,67 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteStarsCatalogs(t *testing.T) {
+	stars := []Star{
+		{Index: 5, Value: 100, X: 5, Y: 0, Mass: 1000, HFR: 2},
+		{Index: 12, Value: 200, X: 2, Y: 1, Mass: 2000, HFR: 1.5, FWHMX: 4, FWHMY: 3, Angle: 30, Eccentricity: 0.66, SNR: 50},
+	}
+	trans := Transform2D{1, 0, 10, 0, 1, 20}
+
+	buf := bytes.Buffer{}
+	if err := WriteStarsCSV(&buf, stars, &trans); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("len(lines)=%d; want %d", len(lines), 3)
+	}
+	if !strings.HasSuffix(lines[0], ",RefX,RefY") || !strings.HasSuffix(lines[2], ",12,21") {
+		t.Errorf("lines=%v; want reference coordinates", lines)
+	}
+
+	buf.Reset()
+	if err := WriteStarsJSON(&buf, stars, nil); err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1]["fwhmX"] != 4.0 {
+		t.Errorf("entries=%v; want two entries with fwhmX=4", entries)
+	}
+	if _, ok := entries[0]["refX"]; ok {
+		t.Errorf("entries[0]=%v; want no refX without transformation", entries[0])
+	}
+
+	buf.Reset()
+	if err := WriteStarsDS9(&buf, stars, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "circle(6.000,1.000,4.000)") || !strings.Contains(out, "ellipse(3.000,2.000,2.000,1.500,30.00)") {
+		t.Errorf("ds9=%s; want circle and ellipse regions", out)
+	}
+}
@@ -137,6 +137,47 @@ func NewTransform2D(p1, p2, p3, p1p, p2p, p3p Point2D) (Transform2D, error) {
 }
 
 
+// Fit a 2D similarity transformation (rotation, uniform scale and translation) from the given points 
+// in the first coordinate system onto the corresponding reference points in the second with least squares.
+// If mirrored, the transformation includes a reflection, e.g. for frames taken through a star diagonal.
+func NewSimilarity2D(ps, pps []Point2D, mirrored bool) (Transform2D, error) {
+	// center both point sets
+	var c, cp Point2D
+	for i:=range ps { c, cp=Add2D(c, ps[i]), Add2D(cp, pps[i]) }
+	n:=float32(len(ps))
+	c, cp=Point2D{c.X/n, c.Y/n}, Point2D{cp.X/n, cp.Y/n}
+
+	// solve for x'=a*x-b*y, y'=b*x+a*y on centered coordinates, reflecting y first if mirrored
+	flip:=float32(1)
+	if mirrored { flip=-1 }
+	var num, numRot, denom float32
+	for i:=range ps {
+		d, dp:=Sub2D(ps[i], c), Sub2D(pps[i], cp)
+		d.Y*=flip
+		num   +=d.X*dp.X + d.Y*dp.Y
+		numRot+=d.X*dp.Y - d.Y*dp.X
+		denom +=d.X*d.X + d.Y*d.Y
+	}
+	if denom<1e-8 { return Transform2D{}, errors.New("degenerate points") }
+	a, b:=num/denom, numRot/denom
+	t:=Transform2D{a, -b*flip, 0, b, a*flip, 0}
+	t.C=cp.X - t.A*c.X - t.B*c.Y
+	t.F=cp.Y - t.D*c.X - t.E*c.Y
+	return t, nil
+}
+
+// Returns true if the given 2D transformation mirrors the image, i.e. has a negative determinant
+func (t *Transform2D) Mirrored() bool {
+	return t.A*t.E-t.B*t.D < 0
+}
+
+// Returns the parity of the given 2D transformation as a human-readable string
+func (t *Transform2D) Parity() string {
+	if t.Mirrored() { return "mirrored" }
+	return "normal"
+}
+
+
 // Apply given 2D transformation to the given coordinates
 func (t *Transform2D) Apply(p Point2D) (pP Point2D) {
 	xP:=t.A*p.X + t.B*p.Y + t.C
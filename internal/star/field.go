@@ -0,0 +1,184 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mlnoga/nightlight/internal/median"
+)
+
+// Number of fixed point iterations for inverting a displacement field
+const fieldInverseIterations = 4
+
+// A smooth displacement field sampled on a regular grid, e.g. from local alignment. Maps points
+// by adding the displacement, bilinearly interpolated between the grid points and held constant
+// beyond the outermost ones
+type DisplacementField struct {
+	X0, Y0       float32   // position of the first grid point
+	StepX, StepY float32   // spacing of the grid points
+	Cols, Rows   int       // number of grid points
+	DX, DY       []float32 // displacements at the grid points, in row-major order
+	inverted     bool      // if true, applies the inverse mapping
+}
+
+// Creates a displacement field of zeros with the given grid
+func NewDisplacementField(x0, y0, stepX, stepY float32, cols, rows int) *DisplacementField {
+	return &DisplacementField{X0: x0, Y0: y0, StepX: stepX, StepY: stepY, Cols: cols, Rows: rows,
+		DX: make([]float32, cols*rows), DY: make([]float32, cols*rows)}
+}
+
+// Returns the interpolated displacement at the given point
+func (d *DisplacementField) At(p Point2D) (dx, dy float32) {
+	gx, gy := (p.X-d.X0)/d.StepX, (p.Y-d.Y0)/d.StepY
+	x0, fx := gridCell(gx, d.Cols)
+	y0, fy := gridCell(gy, d.Rows)
+	x1, y1 := x0+1, y0+1
+	if x1 >= d.Cols {
+		x1 = x0
+	}
+	if y1 >= d.Rows {
+		y1 = y0
+	}
+	i00, i01, i10, i11 := y0*d.Cols+x0, y0*d.Cols+x1, y1*d.Cols+x0, y1*d.Cols+x1
+	dx = (1-fy)*((1-fx)*d.DX[i00]+fx*d.DX[i01]) + fy*((1-fx)*d.DX[i10]+fx*d.DX[i11])
+	dy = (1-fy)*((1-fx)*d.DY[i00]+fx*d.DY[i01]) + fy*((1-fx)*d.DY[i10]+fx*d.DY[i11])
+	return dx, dy
+}
+
+// Returns the index of the grid cell containing the given grid coordinate, and the fraction within it,
+// clamped to the grid
+func gridCell(g float32, n int) (i int, frac float32) {
+	if g <= 0 || n == 1 {
+		return 0, 0
+	}
+	if g >= float32(n-1) {
+		return n - 1, 0
+	}
+	i = int(g)
+	return i, g - float32(i)
+}
+
+// Applies the displacement field to the given point. The inverse is found by fixed point iteration,
+// which converges for fields which vary slowly compared to the grid spacing
+func (d *DisplacementField) Apply(p Point2D) Point2D {
+	if !d.inverted {
+		dx, dy := d.At(p)
+		return Point2D{p.X + dx, p.Y + dy}
+	}
+	q := p
+	for i := 0; i < fieldInverseIterations; i++ {
+		dx, dy := d.At(q)
+		q = Point2D{p.X - dx, p.Y - dy}
+	}
+	return q
+}
+
+// Returns the inverse displacement field. Implements the Transformation interface
+func (d *DisplacementField) Inverse() (Transformation, error) {
+	inv := *d
+	inv.inverted = !d.inverted
+	return &inv, nil
+}
+
+// Returns the maximum and root mean square length of the displacements at the grid points
+func (d *DisplacementField) Stats() (max, rms float32) {
+	sum := 0.0
+	for i := range d.DX {
+		l := d.DX[i]*d.DX[i] + d.DY[i]*d.DY[i]
+		sum += float64(l)
+		if l > max {
+			max = l
+		}
+	}
+	return float32(math.Sqrt(float64(max))), float32(math.Sqrt(sum / float64(len(d.DX))))
+}
+
+// Replaces grid points which are not valid with the average of their valid neighbors, growing outwards
+// until all are filled. Then replaces outliers which deviate from the median of their neighbors by more
+// than the given tolerance with that median. Returns false if no point is valid
+func (d *DisplacementField) FillAndSmooth(valid []bool, tolerance float32) bool {
+	valid = append([]bool(nil), valid...)
+	for {
+		filled, missing := []int{}, 0
+		for y := 0; y < d.Rows; y++ {
+			for x := 0; x < d.Cols; x++ {
+				if valid[y*d.Cols+x] {
+					continue
+				}
+				missing++
+				sx, sy, n := float32(0), float32(0), 0
+				d.neighbors(x, y, func(j int) {
+					if valid[j] {
+						sx, sy, n = sx+d.DX[j], sy+d.DY[j], n+1
+					}
+				})
+				if n > 0 {
+					i := y*d.Cols + x
+					d.DX[i], d.DY[i] = sx/float32(n), sy/float32(n)
+					filled = append(filled, i)
+				}
+			}
+		}
+		if missing == 0 {
+			break
+		}
+		if len(filled) == 0 {
+			return false
+		}
+		for _, i := range filled {
+			valid[i] = true
+		}
+	}
+
+	dx, dy := append([]float32(nil), d.DX...), append([]float32(nil), d.DY...)
+	for y := 0; y < d.Rows; y++ {
+		for x := 0; x < d.Cols; x++ {
+			i, xs, ys := y*d.Cols+x, []float32{}, []float32{}
+			d.neighbors(x, y, func(j int) {
+				if j != i {
+					xs, ys = append(xs, d.DX[j]), append(ys, d.DY[j])
+				}
+			})
+			if len(xs) == 0 {
+				continue
+			}
+			mx, my := median.MedianFloat32(xs), median.MedianFloat32(ys)
+			if ex, ey := d.DX[i]-mx, d.DY[i]-my; ex*ex+ey*ey > tolerance*tolerance {
+				dx[i], dy[i] = mx, my
+			}
+		}
+	}
+	d.DX, d.DY = dx, dy
+	return true
+}
+
+// Calls the given function with the indices of the grid point and its up to eight neighbors
+func (d *DisplacementField) neighbors(x, y int, f func(j int)) {
+	for ny := y - 1; ny <= y+1; ny++ {
+		for nx := x - 1; nx <= x+1; nx++ {
+			if nx >= 0 && ny >= 0 && nx < d.Cols && ny < d.Rows {
+				f(ny*d.Cols + nx)
+			}
+		}
+	}
+}
+
+func (d DisplacementField) String() string {
+	max, rms := d.Stats()
+	return fmt.Sprintf("D%dx%d[max %.3g rms %.3g]", d.Cols, d.Rows, max, rms)
+}
@@ -18,7 +18,6 @@ package star
 
 import (
 	"io"
-	"fmt"
 	"math"
 	"github.com/valyala/fastrand"
 	"github.com/mlnoga/nightlight/internal/stats"
@@ -34,6 +33,20 @@ type Star struct {
 	Y     float32       // Precise star y position via center of mass
 	Mass  float32       // Star mass. Summed pixel values above location estimate, within given radius
 	HFR	  float32       // Half-Flux Radius of the star, in pixels
+
+	// PSF fit results. All zero if no PSF fit was performed, or the fit failed
+	FWHMX        float32 // Full width at half maximum along the major axis of the PSF, in pixels
+	FWHMY        float32 // Full width at half maximum along the minor axis of the PSF, in pixels
+	Angle        float32 // Rotation of the major axis counterclockwise from the x axis, in degrees [0,180)
+	Eccentricity float32 // Eccentricity of the PSF ellipse, 0=round
+	Amplitude    float32 // Peak value of the PSF above background
+	Background   float32 // Local background level under the PSF
+	SNR          float32 // Background-limited signal to noise ratio of the PSF flux
+}
+
+// Returns the geometric mean of the PSF FWHM along both axes, or zero if no PSF fit is available
+func (s *Star) FWHM() float32 {
+	return float32(math.Sqrt(float64(s.FWHMX)*float64(s.FWHMY)))
 }
 
 // Adapter method 1 to make Star work with KD-Tree  
@@ -49,10 +62,7 @@ func (s *Star) Dimension(i int) float64 {
 
 // Prints given array of stars as CSV 
 func PrintStars(w io.Writer, stars []Star) {
-	fmt.Fprintln(w,"Index,Value,X,Y,Mass,HFR")
-	for _,s :=range stars {
-		fmt.Fprintf(w,"%d,%g,%g,%g,%g,%g\n", s.Index, s.Value, s.X, s.Y, s.Mass, s.HFR)
-	}
+	WriteStarsCSV(w, stars, nil)
 }
 
 // Find stars in the given image with data type int16
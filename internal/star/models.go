@@ -0,0 +1,421 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// An invertible 2D coordinate transformation, e.g. from a frame into the reference frame
+type Transformation interface {
+	Apply(p Point2D) Point2D
+	Inverse() (Transformation, error)
+}
+
+// Returns the inverse affine transformation. Implements the Transformation interface
+func (t *Transform2D) Inverse() (Transformation, error) {
+	inv, err := t.Invert()
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Returns the transformation which applies first, then second. Compositions of
+// affine transformations are affine again, all others are chained
+func Compose(first, second Transformation) Transformation {
+	a, aOk := first.(*Transform2D)
+	b, bOk := second.(*Transform2D)
+	if aOk && bOk {
+		return &Transform2D{
+			A: b.A*a.A + b.B*a.D, B: b.A*a.B + b.B*a.E, C: b.A*a.C + b.B*a.F + b.C,
+			D: b.D*a.A + b.E*a.D, E: b.D*a.B + b.E*a.E, F: b.D*a.C + b.E*a.F + b.F,
+		}
+	}
+	return &chain{first, second}
+}
+
+// A chain of two transformations, applied in order
+type chain struct {
+	first, second Transformation
+}
+
+func (c *chain) Apply(p Point2D) Point2D {
+	return c.second.Apply(c.first.Apply(p))
+}
+
+func (c *chain) Inverse() (Transformation, error) {
+	firstInv, err := c.first.Inverse()
+	if err != nil {
+		return nil, err
+	}
+	secondInv, err := c.second.Inverse()
+	if err != nil {
+		return nil, err
+	}
+	return &chain{secondInv, firstInv}, nil
+}
+
+func (c chain) String() string {
+	return fmt.Sprintf("%v then %v", c.first, c.second)
+}
+
+// Registration model for mapping frames onto the reference frame
+type RegistrationModel int
+
+const (
+	RMAffine      RegistrationModel = iota // Affine transformation: translation, rotation, scale and shear
+	RMHomography                           // Projective transformation, e.g. for wide fields
+	RMPolynomial2                          // Second order polynomial, for mild field distortions
+	RMPolynomial3                          // Third order polynomial, for stronger field distortions
+)
+
+// Returns the minimum number of matched star pairs for fitting the given registration model
+func (m RegistrationModel) MinPairs() int {
+	switch m {
+	case RMHomography:
+		return 8
+	case RMPolynomial2:
+		return 12
+	case RMPolynomial3:
+		return 20
+	default:
+		return 3
+	}
+}
+
+// A 2D projective transformation, given by a 3x3 matrix in row-major order
+type Homography struct {
+	H [9]float64
+}
+
+// Applies the homography to the given point
+func (h *Homography) Apply(p Point2D) Point2D {
+	x, y := float64(p.X), float64(p.Y)
+	w := h.H[6]*x + h.H[7]*y + h.H[8]
+	return Point2D{
+		X: float32((h.H[0]*x + h.H[1]*y + h.H[2]) / w),
+		Y: float32((h.H[3]*x + h.H[4]*y + h.H[5]) / w),
+	}
+}
+
+// Returns the inverse homography. Implements the Transformation interface
+func (h *Homography) Inverse() (Transformation, error) {
+	m := mat.NewDense(3, 3, h.H[:])
+	var inv mat.Dense
+	if err := inv.Inverse(m); err != nil {
+		return nil, fmt.Errorf("homography has no inverse: %s", err.Error())
+	}
+	res := &Homography{}
+	copy(res.H[:], inv.RawMatrix().Data)
+	return res, nil
+}
+
+func (h Homography) String() string {
+	return fmt.Sprintf("H[%.6g %.6g %.6g; %.6g %.6g %.6g; %.6g %.6g %.6g]",
+		h.H[0], h.H[1], h.H[2], h.H[3], h.H[4], h.H[5], h.H[6], h.H[7], h.H[8])
+}
+
+// Fits a homography mapping from src to dst points with the normalized direct linear transformation
+func FitHomography(src, dst []Point2D) (*Homography, error) {
+	if len(src) != len(dst) || len(src) < 4 {
+		return nil, errors.New("homography requires at least four point pairs")
+	}
+	ns, _ := normalizePoints(src)
+	nd, ndInv := normalizePoints(dst)
+
+	a := mat.NewDense(2*len(src), 9, nil)
+	for i := range src {
+		x, y := ns.apply(src[i])
+		u, v := nd.apply(dst[i])
+		a.SetRow(2*i, []float64{-x, -y, -1, 0, 0, 0, u * x, u * y, u})
+		a.SetRow(2*i+1, []float64{0, 0, 0, -x, -y, -1, v * x, v * y, v})
+	}
+	var svd mat.SVD
+	if !svd.Factorize(a, mat.SVDFullV) {
+		return nil, errors.New("homography SVD did not converge")
+	}
+	var vt mat.Dense
+	svd.VTo(&vt)
+	hn := mat.NewDense(3, 3, nil)
+	for i := 0; i < 9; i++ {
+		hn.Set(i/3, i%3, vt.At(i, 8))
+	}
+
+	// denormalize: H = inv(Nd) * Hn * Ns
+	var tmp, h mat.Dense
+	tmp.Mul(hn, ns.matrix())
+	h.Mul(ndInv, &tmp)
+	if h.At(2, 2) == 0 {
+		return nil, errors.New("degenerate homography")
+	}
+	res := &Homography{}
+	scale := 1 / h.At(2, 2)
+	for i := 0; i < 9; i++ {
+		res.H[i] = h.At(i/3, i%3) * scale
+	}
+	return res, nil
+}
+
+// A 2D polynomial transformation of given order, similar to the SIP distortion convention.
+// Coordinates are normalized for numerical stability before evaluating the polynomial.
+// Carries a separately fitted inverse polynomial, as polynomials have no closed-form inverse. Supports orders up to three
+type Polynomial2D struct {
+	Order   int
+	CX      []float64          // coefficients for x, ordered by total degree, then decreasing power of x
+	CY      []float64          // coefficients for y, same ordering
+	in      pointNormalization // normalization of input coordinates
+	out     pointNormalization // normalization of output coordinates
+	inverse *Polynomial2D
+}
+
+// Applies the polynomial transformation to the given point
+func (t *Polynomial2D) Apply(p Point2D) Point2D {
+	x, y := t.in.apply(p)
+	var buffer [10]float64
+	terms := polynomialTerms(x, y, t.Order, buffer[:])
+	u, v := 0.0, 0.0
+	for i, term := range terms {
+		u += t.CX[i] * term
+		v += t.CY[i] * term
+	}
+	return t.out.invert(u, v)
+}
+
+// Returns the fitted inverse polynomial. Implements the Transformation interface
+func (t *Polynomial2D) Inverse() (Transformation, error) {
+	if t.inverse == nil {
+		return nil, errors.New("polynomial transformation has no fitted inverse")
+	}
+	return t.inverse, nil
+}
+
+func (t Polynomial2D) String() string {
+	return fmt.Sprintf("P%d[x%.6g y%.6g]", t.Order, t.CX, t.CY)
+}
+
+// Fits polynomial transformations of the given order from src to dst points and back with least squares
+func FitPolynomial2D(src, dst []Point2D, order int) (*Polynomial2D, error) {
+	fwd, err := fitPolynomialOneWay(src, dst, order)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := fitPolynomialOneWay(dst, src, order)
+	if err != nil {
+		return nil, err
+	}
+	fwd.inverse, inv.inverse = inv, fwd
+	return fwd, nil
+}
+
+func fitPolynomialOneWay(src, dst []Point2D, order int) (*Polynomial2D, error) {
+	numTerms := (order + 1) * (order + 2) / 2
+	if len(src) != len(dst) || len(src) < numTerms {
+		return nil, fmt.Errorf("polynomial of order %d requires at least %d point pairs", order, numTerms)
+	}
+	in, _ := normalizePoints(src)
+	out, _ := normalizePoints(dst)
+
+	a := mat.NewDense(len(src), numTerms, nil)
+	bx := mat.NewVecDense(len(src), nil)
+	by := mat.NewVecDense(len(src), nil)
+	terms := make([]float64, numTerms)
+	for i := range src {
+		x, y := in.apply(src[i])
+		a.SetRow(i, polynomialTerms(x, y, order, terms))
+		u, v := out.apply(dst[i])
+		bx.SetVec(i, u)
+		by.SetVec(i, v)
+	}
+	var qr mat.QR
+	qr.Factorize(a)
+	var cx, cy mat.VecDense
+	if err := qr.SolveVecTo(&cx, false, bx); err != nil {
+		return nil, err
+	}
+	if err := qr.SolveVecTo(&cy, false, by); err != nil {
+		return nil, err
+	}
+	return &Polynomial2D{
+		Order: order,
+		CX:    append([]float64(nil), cx.RawVector().Data...),
+		CY:    append([]float64(nil), cy.RawVector().Data...),
+		in:    in,
+		out:   out,
+	}, nil
+}
+
+// Calculates the terms x^i*y^j for all i+j<=order, ordered by total degree, then decreasing power of x.
+// Reuses the given buffer if not nil
+func polynomialTerms(x, y float64, order int, buffer []float64) []float64 {
+	numTerms := (order + 1) * (order + 2) / 2
+	if buffer == nil || len(buffer) < numTerms {
+		buffer = make([]float64, numTerms)
+	}
+	var px, py [4]float64
+	px[0], py[0] = 1, 1
+	for i := 1; i <= order && i < len(px); i++ {
+		px[i], py[i] = px[i-1]*x, py[i-1]*y
+	}
+	k := 0
+	for degree := 0; degree <= order; degree++ {
+		for i := degree; i >= 0; i-- {
+			buffer[k] = px[i] * py[degree-i]
+			k++
+		}
+	}
+	return buffer[:numTerms]
+}
+
+// Similarity normalization of a point set to centroid zero and mean distance sqrt(2)
+type pointNormalization struct {
+	CX, CY, Scale float64
+}
+
+func normalizePoints(ps []Point2D) (n pointNormalization, inv *mat.Dense) {
+	for _, p := range ps {
+		n.CX += float64(p.X)
+		n.CY += float64(p.Y)
+	}
+	n.CX /= float64(len(ps))
+	n.CY /= float64(len(ps))
+	meanDist := 0.0
+	for _, p := range ps {
+		dx, dy := float64(p.X)-n.CX, float64(p.Y)-n.CY
+		meanDist += math.Sqrt(dx*dx + dy*dy)
+	}
+	meanDist /= float64(len(ps))
+	n.Scale = 1
+	if meanDist > 0 {
+		n.Scale = math.Sqrt2 / meanDist
+	}
+	inv = mat.NewDense(3, 3, []float64{1 / n.Scale, 0, n.CX, 0, 1 / n.Scale, n.CY, 0, 0, 1})
+	return n, inv
+}
+
+func (n pointNormalization) apply(p Point2D) (x, y float64) {
+	return (float64(p.X) - n.CX) * n.Scale, (float64(p.Y) - n.CY) * n.Scale
+}
+
+func (n pointNormalization) invert(x, y float64) Point2D {
+	return Point2D{X: float32(x/n.Scale + n.CX), Y: float32(y/n.Scale + n.CY)}
+}
+
+func (n pointNormalization) matrix() *mat.Dense {
+	return mat.NewDense(3, 3, []float64{n.Scale, 0, -n.CX * n.Scale, 0, n.Scale, -n.CY * n.Scale, 0, 0, 1})
+}
+
+// Fits the given registration model from src to dst points with least squares
+func FitModel(src, dst []Point2D, model RegistrationModel) (Transformation, error) {
+	switch model {
+	case RMHomography:
+		return FitHomography(src, dst)
+	case RMPolynomial2:
+		return FitPolynomial2D(src, dst, 2)
+	case RMPolynomial3:
+		return FitPolynomial2D(src, dst, 3)
+	case RMAffine:
+		return FitAffine(src, dst)
+	}
+	return nil, fmt.Errorf("invalid registration model %d", model)
+}
+
+// Fits an affine transformation from src to dst points with least squares
+func FitAffine(src, dst []Point2D) (*Transform2D, error) {
+	p, err := fitPolynomialOneWay(src, dst, 1)
+	if err != nil {
+		return nil, err
+	}
+	// expand normalized linear polynomial u=c0+c1*x+c2*y into pixel coordinates
+	si, so := p.in.Scale, p.out.Scale
+	a, b := p.CX[1]*si/so, p.CX[2]*si/so
+	d, e := p.CY[1]*si/so, p.CY[2]*si/so
+	c := p.CX[0]/so + p.out.CX - a*p.in.CX - b*p.in.CY
+	f := p.CY[0]/so + p.out.CY - d*p.in.CX - e*p.in.CY
+	return &Transform2D{float32(a), float32(b), float32(c), float32(d), float32(e), float32(f)}, nil
+}
+
+// Refines the given affine alignment of stars onto the reference stars with the given registration model.
+// Matches stars to their nearest reference stars under the current transformation, fits the model to the
+// matched pairs with least squares, and repeats with the refined model. Returns the transformation
+// from the frame into the reference frame, and its residual
+func (a *Aligner) Refine(stars []Star, affine Transform2D, model RegistrationModel) (trans Transformation, residual float32, err error) {
+	distSquaredLimit := float32(8.0 * 8.0) // Distance limit to consider a star a match, as in findBestMatch
+	trans = &affine
+	for round := 0; round < 3; round++ {
+		src, dst := []Point2D{}, []Point2D{}
+		for _, s := range stars {
+			p := Point2D{s.X, s.Y}
+			refPoint, distSquared := a.Stars2DT.NearestNeighbor(trans.Apply(p))
+			if distSquared < distSquaredLimit {
+				src, dst = append(src, p), append(dst, refPoint)
+			}
+		}
+		if len(src) < model.MinPairs() {
+			return nil, 0, fmt.Errorf("%d matched stars are too few for registration model %d, need %d", len(src), model, model.MinPairs())
+		}
+		trans, err = FitModel(src, dst, model)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// residual in the same metric as findBestMatch
+		distSquaredSum := float32(0)
+		for i, p := range src {
+			distSquaredSum += Dist2DSquared(trans.Apply(p), dst[i])
+		}
+		residual = float32(math.Sqrt(float64(distSquaredSum))) / float32(len(src))
+	}
+
+	// the inverse of non-affine models is fitted or extrapolated, and projection depends on it everywhere
+	if model != RMAffine {
+		if e := inverseError(trans, a.Naxisn, 8); !(e <= maxInverseError) {
+			return nil, 0, fmt.Errorf("inverse of registration model %d deviates by %.3g pixels within the frame", model, e)
+		}
+	}
+	return trans, residual, nil
+}
+
+// Maximum deviation from the identity in pixels for applying a transformation after its inverse
+const maxInverseError = 0.25
+
+// Returns the maximum distance in pixels between points and their images under the inverse, then the forward
+// transformation, on a grid with the given number of cells per axis over a frame of the given size, including
+// its corners. Returns infinity if there is no inverse, or if it is undefined at a point
+func inverseError(t Transformation, naxisn []int32, cells int) float32 {
+	inv, err := t.Inverse()
+	if err != nil {
+		return float32(math.Inf(1))
+	}
+	width, height := float32(naxisn[0]-1), float32(naxisn[1]-1)
+	maxErr := float32(0)
+	for gy := 0; gy <= cells; gy++ {
+		for gx := 0; gx <= cells; gx++ {
+			p := Point2D{width * float32(gx) / float32(cells), height * float32(gy) / float32(cells)}
+			d := Dist2D(t.Apply(inv.Apply(p)), p)
+			if math.IsNaN(float64(d)) {
+				return float32(math.Inf(1))
+			} else if d > maxErr {
+				maxErr = d
+			}
+		}
+	}
+	return maxErr
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Generates random points on a 1000x800 image and their images under the given mapping
+func randomPairs(n int, mapping func(p Point2D) Point2D) (src, dst []Point2D) {
+	rng := rand.New(rand.NewSource(7))
+	for i := 0; i < n; i++ {
+		p := Point2D{rng.Float32() * 1000, rng.Float32() * 800}
+		src, dst = append(src, p), append(dst, mapping(p))
+	}
+	return src, dst
+}
+
+func checkModel(t *testing.T, name string, trans Transformation, src, dst []Point2D, tolerance float32) {
+	inv, err := trans.Inverse()
+	if err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	for i, p := range src {
+		if d := Dist2D(trans.Apply(p), dst[i]); d > tolerance {
+			t.Errorf("%s: forward distance %g at %v; want <=%g", name, d, p, tolerance)
+			return
+		}
+		if d := Dist2D(inv.Apply(dst[i]), p); d > tolerance {
+			t.Errorf("%s: inverse distance %g at %v; want <=%g", name, d, dst[i], tolerance)
+			return
+		}
+	}
+}
+
+func TestFitAffine(t *testing.T) {
+	want := Transform2D{0.99, -0.05, 12.5, 0.05, 0.99, -7.25}
+	src, dst := randomPairs(20, func(p Point2D) Point2D { return want.Apply(p) })
+	trans, err := FitAffine(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModel(t, "affine", trans, src, dst, 0.01)
+}
+
+func TestFitHomography(t *testing.T) {
+	want := Homography{[9]float64{1.01, 0.02, 5, -0.03, 0.98, -3, 1e-5, -2e-5, 1}}
+	src, dst := randomPairs(30, func(p Point2D) Point2D { return want.Apply(p) })
+	trans, err := FitHomography(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModel(t, "homography", trans, src, dst, 0.01)
+}
+
+func TestFitPolynomial2D(t *testing.T) {
+	// affine plus mild radial distortion around the image center
+	mapping := func(p Point2D) Point2D {
+		dx, dy := p.X-500, p.Y-400
+		r2 := (dx*dx + dy*dy) * 2e-8
+		return Point2D{500 + dx*(1+r2) + 3, 400 + dy*(1+r2) - 2}
+	}
+	src, dst := randomPairs(100, mapping)
+	trans, err := FitPolynomial2D(src, dst, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModel(t, "polynomial3", trans, src, dst, 0.05) // the inverse of the distortion is only approximately cubic
+
+	if _, err := FitPolynomial2D(src[:5], dst[:5], 2); err == nil {
+		t.Errorf("err=nil; want error for too few point pairs")
+	}
+}
+
+func TestDisplacementField(t *testing.T) {
+	// a smooth field on a 6x5 grid over 1000x800 pixels, with one invalid point and one outlier
+	field := NewDisplacementField(100, 100, 160, 150, 6, 5)
+	valid := make([]bool, 30)
+	for i := range field.DX {
+		x, y := field.X0+float32(i%6)*field.StepX, field.Y0+float32(i/6)*field.StepY
+		field.DX[i], field.DY[i], valid[i] = 2*x/1000, -y/800, true
+	}
+	field.DX[8], valid[8] = 0, false
+	field.DX[20] = 5
+	if !field.FillAndSmooth(valid, 0.5) {
+		t.Fatal("no valid points")
+	}
+	for _, i := range []int{8, 20} { // both at x=420
+		if math.Abs(float64(field.DX[i]-0.84)) > 0.01 {
+			t.Errorf("got displacement %g at filled or outlier point %d; want 0.84", field.DX[i], i)
+		}
+	}
+	if dx, _ := field.At(Point2D{100, 100}); math.Abs(float64(dx-0.2)) > 1e-5 {
+		t.Errorf("got corner displacement %g; want 0.2", dx)
+	}
+
+	src, dst := randomPairs(50, func(p Point2D) Point2D { return field.Apply(p) })
+	checkModel(t, "displacement field", field, src, dst, 0.01)
+
+	if field.FillAndSmooth(make([]bool, 30), 1) {
+		t.Errorf("expected failure without valid points")
+	}
+}
+
+func TestInverseError(t *testing.T) {
+	// radial distortion of the given strength around the image center
+	distortion := func(k float32) func(p Point2D) Point2D {
+		return func(p Point2D) Point2D {
+			dx, dy := p.X-500, p.Y-400
+			r2 := (dx*dx + dy*dy) * k
+			return Point2D{500 + dx*(1+r2), 400 + dy*(1+r2)}
+		}
+	}
+	src, dst := randomPairs(100, distortion(3e-8))
+	trans, err := FitPolynomial2D(src, dst, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := inverseError(trans, []int32{1000, 800}, 8); e > maxInverseError {
+		t.Errorf("inverse error %g of full-frame fit; want <=%g", e, maxInverseError)
+	}
+
+	// fitted only from stars near the center, the inverse extrapolates badly towards the corners
+	mapping := distortion(2e-7)
+	for i := range src {
+		src[i].X, src[i].Y = 400+src[i].X/5, 320+src[i].Y/5
+		dst[i] = mapping(src[i])
+	}
+	if trans, err = FitPolynomial2D(src, dst, 3); err != nil {
+		t.Fatal(err)
+	}
+	if e := inverseError(trans, []int32{1000, 800}, 8); e <= maxInverseError {
+		t.Errorf("inverse error %g of central fit; want >%g", e, maxInverseError)
+	}
+	if e := inverseError(&Transform2D{1, 0, 5, 0, 1, -3}, []int32{1000, 800}, 8); e > 1e-3 {
+		t.Errorf("inverse error %g of affine transformation; want 0", e)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"math"
+	"sort"
+)
+
+// Point spread function model for star fitting
+type PSFModel int
+
+const (
+	PSFNone     PSFModel = iota // No PSF fitting
+	PSFGaussian                 // Elliptical 2D Gaussian
+	PSFMoffat                   // Elliptical 2D Moffat with free beta
+)
+
+// Parameter indices for PSF fitting. The Moffat model has an additional beta parameter
+const (
+	psfBackground = iota
+	psfAmplitude
+	psfX
+	psfY
+	psfWidthA
+	psfWidthB
+	psfAngle
+	psfBeta
+)
+
+const (
+	psfMaxIterations = 50
+	psfTolerance     = 1e-6
+)
+
+// Fits the given PSF model to all stars, and enriches them with FWHM, angle, eccentricity, amplitude, background
+// and SNR. Stars where the fit does not converge to plausible values keep zero PSF fields.
+// Location is the image background estimate and noise the standard deviation of the background noise.
+// Returns the number of stars fitted, and the median FWHM and eccentricity across them
+func FitPSFs(stars []Star, data []float32, width int32, location, noise float32, radius int32, model PSFModel) (numFitted int, medianFWHM, medianEcc float32) {
+	if model == PSFNone {
+		return 0, 0, 0
+	}
+	fwhms := make([]float32, 0, len(stars))
+	eccs := make([]float32, 0, len(stars))
+	for i := range stars {
+		if FitPSF(&stars[i], data, width, location, noise, radius, model) {
+			fwhms = append(fwhms, stars[i].FWHM())
+			eccs = append(eccs, stars[i].Eccentricity)
+		}
+	}
+	if len(fwhms) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(fwhms, func(i, j int) bool { return fwhms[i] < fwhms[j] })
+	sort.Slice(eccs, func(i, j int) bool { return eccs[i] < eccs[j] })
+	return len(fwhms), fwhms[len(fwhms)/2], eccs[len(eccs)/2]
+}
+
+// Fits the given PSF model to a single star with Levenberg-Marquardt least squares, starting from
+// its centroid position and HFR. The fitting window is three HFRs wide, limited by the given radius.
+// Updates the star and returns true on success. Leaves the star unchanged on failure
+func FitPSF(s *Star, data []float32, width int32, location, noise float32, radius int32, model PSFModel) bool {
+	height := int32(len(data)) / width
+	hfr := s.HFR
+	if hfr <= 0 {
+		hfr = 1
+	}
+	half := int32(math.Ceil(float64(3 * hfr)))
+	if half < 3 {
+		half = 3
+	}
+	if half > radius {
+		half = radius
+	}
+	cx, cy := int32(s.X+0.5), int32(s.Y+0.5)
+	x0, x1, y0, y1 := cx-half, cx+half, cy-half, cy+half
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 >= width {
+		x1 = width - 1
+	}
+	if y1 >= height {
+		y1 = height - 1
+	}
+
+	// gather samples from the window
+	xs, ys, vs := []float64{}, []float64{}, []float64{}
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			v := data[y*width+x]
+			if math.IsNaN(float64(v)) {
+				continue
+			}
+			xs, ys, vs = append(xs, float64(x)), append(ys, float64(y)), append(vs, float64(v))
+		}
+	}
+
+	// initial guess from the centroid detection. HFR of a Gaussian is about 1.1774 sigma
+	sigma := float64(hfr) / 1.1774
+	p := []float64{float64(location), float64(s.Value - location), float64(s.X), float64(s.Y), sigma, sigma, 0}
+	if model == PSFMoffat {
+		beta := 3.0
+		alpha := 2.3548 * sigma / (2 * math.Sqrt(math.Pow(2, 1/beta)-1)) // match the FWHM of the Gaussian guess
+		p[psfWidthA], p[psfWidthB] = alpha, alpha
+		p = append(p, beta)
+	}
+	if len(vs) <= len(p) || p[psfAmplitude] <= 0 {
+		return false
+	}
+
+	p, ok := levenbergMarquardt(p, xs, ys, vs, model)
+	if !ok {
+		return false
+	}
+
+	// plausibility checks
+	wa, wb := math.Abs(p[psfWidthA]), math.Abs(p[psfWidthB])
+	dx, dy := p[psfX]-float64(s.X), p[psfY]-float64(s.Y)
+	if p[psfAmplitude] <= 0 || wa < 0.1 || wb < 0.1 || wa > float64(radius) || wb > float64(radius) ||
+		dx*dx+dy*dy > float64(hfr*hfr) || (model == PSFMoffat && (p[psfBeta] <= 1 || p[psfBeta] > 20)) {
+		return false
+	}
+
+	// normalize so that width A is the major axis, and the angle is in [0,180) degrees
+	angle := p[psfAngle]
+	if wa < wb {
+		wa, wb = wb, wa
+		angle += math.Pi / 2
+	}
+	angle = math.Mod(angle, math.Pi)
+	if angle < 0 {
+		angle += math.Pi
+	}
+
+	// convert widths to FWHM and determine the total integrated flux of the profile
+	var fwhmA, fwhmB, flux float64
+	if model == PSFMoffat {
+		beta := p[psfBeta]
+		factor := 2 * math.Sqrt(math.Pow(2, 1/beta)-1)
+		fwhmA, fwhmB = factor*wa, factor*wb
+		flux = math.Pi * p[psfAmplitude] * wa * wb / (beta - 1)
+	} else {
+		fwhmA, fwhmB = 2.3548*wa, 2.3548*wb
+		flux = 2 * math.Pi * p[psfAmplitude] * wa * wb
+	}
+
+	s.X, s.Y = float32(p[psfX]), float32(p[psfY])
+	s.FWHMX, s.FWHMY = float32(fwhmA), float32(fwhmB)
+	s.Angle = float32(angle * 180 / math.Pi)
+	s.Eccentricity = float32(math.Sqrt(1 - (wb*wb)/(wa*wa)))
+	s.Amplitude = float32(p[psfAmplitude])
+	s.Background = float32(p[psfBackground])
+	s.SNR = 0
+	if noise > 0 {
+		// background-limited signal to noise ratio
+		s.SNR = float32(flux / (float64(noise) * math.Sqrt(math.Pi*fwhmA*fwhmB)))
+	}
+	return true
+}
+
+// Evaluates the PSF model with parameters p at position (x,y). If grad is not nil,
+// also stores the partial derivatives with regard to all parameters
+func psfEval(p []float64, x, y float64, model PSFModel, grad []float64) float64 {
+	dx, dy := x-p[psfX], y-p[psfY]
+	sin, cos := math.Sincos(p[psfAngle])
+	u := dx*cos + dy*sin
+	v := -dx*sin + dy*cos
+	wa, wb := p[psfWidthA], p[psfWidthB]
+	wa2, wb2 := wa*wa, wb*wb
+	q := u*u/wa2 + v*v/wb2
+
+	var g, dgdq float64
+	if model == PSFMoffat {
+		beta := p[psfBeta]
+		base := 1 + q
+		g = math.Pow(base, -beta)
+		dgdq = -beta * g / base
+		if grad != nil {
+			grad[psfBeta] = -p[psfAmplitude] * math.Log(base) * g
+		}
+	} else {
+		g = math.Exp(-0.5 * q)
+		dgdq = -0.5 * g
+	}
+	if grad != nil {
+		dqdu, dqdv := 2*u/wa2, 2*v/wb2
+		ag := p[psfAmplitude] * dgdq
+		grad[psfBackground] = 1
+		grad[psfAmplitude] = g
+		grad[psfX] = ag * (-dqdu*cos + dqdv*sin)
+		grad[psfY] = ag * (-dqdu*sin - dqdv*cos)
+		grad[psfWidthA] = ag * (-2 * u * u / (wa2 * wa))
+		grad[psfWidthB] = ag * (-2 * v * v / (wb2 * wb))
+		grad[psfAngle] = ag * 2 * u * v * (1/wa2 - 1/wb2)
+	}
+	return p[psfBackground] + p[psfAmplitude]*g
+}
+
+// Sum of squared residuals of the PSF model with parameters p over the given samples
+func psfChiSquared(p, xs, ys, vs []float64, model PSFModel) float64 {
+	chi2 := 0.0
+	for i := range vs {
+		r := vs[i] - psfEval(p, xs[i], ys[i], model, nil)
+		chi2 += r * r
+	}
+	return chi2
+}
+
+// Minimizes the squared residuals of the PSF model over the given samples with the Levenberg-Marquardt
+// algorithm, starting from parameters p. Returns the optimized parameters, and false if no convergence
+func levenbergMarquardt(p, xs, ys, vs []float64, model PSFModel) ([]float64, bool) {
+	n := len(p)
+	jtj := make([]float64, n*n)
+	jtr := make([]float64, n)
+	grad := make([]float64, n)
+	a := make([]float64, n*n)
+	delta := make([]float64, n)
+	trial := make([]float64, n)
+
+	lambda := 1e-3
+	chi2 := psfChiSquared(p, xs, ys, vs, model)
+	for iter := 0; iter < psfMaxIterations; iter++ {
+		// accumulate normal equations
+		for i := range jtj {
+			jtj[i] = 0
+		}
+		for i := range jtr {
+			jtr[i] = 0
+		}
+		for k := range vs {
+			r := vs[k] - psfEval(p, xs[k], ys[k], model, grad)
+			for i := 0; i < n; i++ {
+				jtr[i] += grad[i] * r
+				for j := 0; j <= i; j++ {
+					jtj[i*n+j] += grad[i] * grad[j]
+				}
+			}
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < i; j++ {
+				jtj[j*n+i] = jtj[i*n+j]
+			}
+		}
+
+		// increase damping until a step reduces the residual
+		improved := false
+		for attempt := 0; attempt < 10; attempt++ {
+			copy(a, jtj)
+			for i := 0; i < n; i++ {
+				a[i*n+i] += lambda * (jtj[i*n+i] + 1e-12)
+			}
+			copy(delta, jtr)
+			if !solveLinearSystem(a, delta, n) {
+				lambda *= 10
+				continue
+			}
+			for i := range p {
+				trial[i] = p[i] + delta[i]
+			}
+			trialChi2 := psfChiSquared(trial, xs, ys, vs, model)
+			if !math.IsNaN(trialChi2) && trialChi2 < chi2 {
+				converged := (chi2 - trialChi2) <= psfTolerance*chi2
+				copy(p, trial)
+				chi2 = trialChi2
+				lambda *= 0.1
+				improved = true
+				if converged {
+					return p, true
+				}
+				break
+			}
+			lambda *= 10
+		}
+		if !improved {
+			return p, true // no further improvement possible, at a minimum
+		}
+	}
+	return p, false
+}
+
+// Solves the linear system a*x=b of size n in place with Gaussian elimination and partial pivoting.
+// On success, b contains the solution. Returns false if the matrix is singular
+func solveLinearSystem(a, b []float64, n int) bool {
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row*n+col]) > math.Abs(a[pivot*n+col]) {
+				pivot = row
+			}
+		}
+		if a[pivot*n+col] == 0 || math.IsNaN(a[pivot*n+col]) {
+			return false
+		}
+		if pivot != col {
+			for k := 0; k < n; k++ {
+				a[col*n+k], a[pivot*n+k] = a[pivot*n+k], a[col*n+k]
+			}
+			b[col], b[pivot] = b[pivot], b[col]
+		}
+		for row := col + 1; row < n; row++ {
+			factor := a[row*n+col] / a[col*n+col]
+			for k := col; k < n; k++ {
+				a[row*n+k] -= factor * a[col*n+k]
+			}
+			b[row] -= factor * b[col]
+		}
+	}
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row*n+k] * b[k]
+		}
+		b[row] = sum / a[row*n+row]
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package star
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Renders a synthetic star with the given PSF model and parameters, plus Gaussian noise
+func renderPSF(width, height int32, p []float64, model PSFModel, noise float64) []float32 {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]float32, width*height)
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			data[y*width+x] = float32(psfEval(p, float64(x), float64(y), model, nil) + noise*rng.NormFloat64())
+		}
+	}
+	return data
+}
+
+func checkClose(t *testing.T, name string, got, want, tolerance float32) {
+	if math.Abs(float64(got-want)) > float64(tolerance) {
+		t.Errorf("%s=%g; want %g +/- %g", name, got, want, tolerance)
+	}
+}
+
+func TestFitPSFGaussian(t *testing.T) {
+	width, height := int32(41), int32(41)
+	// background, amplitude, x, y, sigma major, sigma minor, angle 30 degrees
+	p := []float64{100, 1000, 20.3, 19.6, 2.5, 1.5, math.Pi / 6}
+	data := renderPSF(width, height, p, PSFGaussian, 2)
+
+	s := Star{Index: 20*width + 20, Value: data[20*width+20], X: 20, Y: 20, HFR: 2.4}
+	if !FitPSF(&s, data, width, 100, 2, 16, PSFGaussian) {
+		t.Fatalf("fit failed")
+	}
+	checkClose(t, "X", s.X, 20.3, 0.02)
+	checkClose(t, "Y", s.Y, 19.6, 0.02)
+	checkClose(t, "FWHMX", s.FWHMX, 2.3548*2.5, 0.05)
+	checkClose(t, "FWHMY", s.FWHMY, 2.3548*1.5, 0.05)
+	checkClose(t, "Angle", s.Angle, 30, 1)
+	checkClose(t, "Eccentricity", s.Eccentricity, float32(math.Sqrt(1-1.5*1.5/(2.5*2.5))), 0.01)
+	checkClose(t, "Amplitude", s.Amplitude, 1000, 10)
+	checkClose(t, "Background", s.Background, 100, 0.5)
+	if s.SNR <= 100 {
+		t.Errorf("SNR=%g; want >%g", s.SNR, 100.0)
+	}
+}
+
+func TestFitPSFMoffat(t *testing.T) {
+	width, height := int32(41), int32(41)
+	// background, amplitude, x, y, alpha major, alpha minor, angle 120 degrees, beta
+	p := []float64{50, 500, 19.8, 20.4, 3, 2.5, 2 * math.Pi / 3, 2.5}
+	data := renderPSF(width, height, p, PSFMoffat, 1)
+
+	s := Star{Index: 20*width + 20, Value: data[20*width+20], X: 20, Y: 20, HFR: 2.5}
+	if !FitPSF(&s, data, width, 50, 1, 16, PSFMoffat) {
+		t.Fatalf("fit failed")
+	}
+	factor := float32(2 * math.Sqrt(math.Pow(2, 1/2.5)-1))
+	checkClose(t, "X", s.X, 19.8, 0.02)
+	checkClose(t, "Y", s.Y, 20.4, 0.02)
+	checkClose(t, "FWHMX", s.FWHMX, factor*3, 0.1)
+	checkClose(t, "FWHMY", s.FWHMY, factor*2.5, 0.1)
+	checkClose(t, "Angle", s.Angle, 120, 2)
+	checkClose(t, "Amplitude", s.Amplitude, 500, 10)
+	checkClose(t, "Background", s.Background, 50, 1)
+}
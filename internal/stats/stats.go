@@ -75,6 +75,36 @@ func NewStatsForChannel(hcl []float32, w int32, ch, numCh int) *Stats {
 	return &Stats{data: hcl[ch*chLen : (ch+1)*chLen], width: w}
 }
 
+// Cached statistics without the underlying data, e.g. for persisting the histogram reference
+type Cached struct {
+	Width        int32   `json:"width"`
+	Min          float32 `json:"min"`
+	Max          float32 `json:"max"`
+	Mean         float32 `json:"mean"`
+	StdDev       float32 `json:"stdDev"`
+	Location     float32 `json:"location"`
+	Scale        float32 `json:"scale"`
+	Noise        float32 `json:"noise"`
+	HaveMMM      bool    `json:"haveMMM"`
+	HaveStdDev   bool    `json:"haveStdDev"`
+	HaveLocScale bool    `json:"haveLocScale"`
+	HaveNoise    bool    `json:"haveNoise"`
+}
+
+// Creates stats from previously cached values. Values not cached are calculated from d on demand, if given
+func NewStatsFromCached(d []float32, c Cached) *Stats {
+	return &Stats{data: d, width: c.Width,
+		min: c.Min, max: c.Max, mean: c.Mean, stdDev: c.StdDev, location: c.Location, scale: c.Scale, noise: c.Noise,
+		haveMMM: c.HaveMMM, haveStdDev: c.HaveStdDev, haveLocScale: c.HaveLocScale, haveNoise: c.HaveNoise}
+}
+
+// Returns the currently cached values, without calculating missing ones
+func (s *Stats) Cached() Cached {
+	return Cached{Width: s.width,
+		Min: s.min, Max: s.max, Mean: s.mean, StdDev: s.stdDev, Location: s.location, Scale: s.scale, Noise: s.noise,
+		HaveMMM: s.haveMMM, HaveStdDev: s.haveStdDev, HaveLocScale: s.haveLocScale, HaveNoise: s.haveNoise}
+}
+
 func (s *Stats) FreeData() {
 	s.data = nil
 }
@@ -503,8 +503,12 @@ Blockly.defineBlocksWithJsonArray([
           [ "mean (no sigmas)", "1"],
           [ "sigma-clipped mean", "2"],
           [ "winsorized mean", "3"],
-          [ "linear regression fit", "4"],
-          [ "automatic mode selection", "5"],
+          [ "MAD sigma-clipped mean", "4"],
+          [ "linear regression fit", "5"],
+          [ "automatic mode selection", "6"],
+          [ "generalized ESD rejection", "7"],
+          [ "percentile clipping", "8"],
+          [ "min/max rejection", "9"],
         ]
       }
     ],
@@ -536,7 +540,10 @@ Blockly.defineBlocksWithJsonArray([
           [ "equally", "0"],
           [ "by exposure time", "1"],
           [ "by inverse noise (lower noise has higher weight)", "2"],
-          [ "by inverse HFR (lower HFR has higher weight)", "3"]
+          [ "by inverse HFR (lower HFR has higher weight)", "3"],
+          [ "by inverse variance", "4"],
+          [ "by signal to noise ratio", "5"],
+          [ "by PSF signal (star flux, FWHM and noise)", "6"]
         ]
       }
     ],